@@ -0,0 +1,460 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// rutaClaveAdjuntos es la clave AES-256 con la que se cifran los adjuntos.
+// Se genera en el primer arranque; sin ella los adjuntos son ilegibles, así
+// que debe incluirse en las copias de seguridad (por separado de la base de
+// datos).
+const rutaClaveAdjuntos = "data/adjuntos.key"
+
+// Límites de los adjuntos.
+const (
+	tamanyoMaxAdjunto   = 20 << 20  // tamaño máximo de un fichero
+	tamanyoMaxFragmento = 512 << 10 // tamaño máximo de cada fragmento subido o descargado
+)
+
+// Estados de un adjunto.
+const (
+	estadoAdjuntoSubiendo = "subiendo"
+	estadoAdjuntoCompleto = "completo"
+)
+
+// Acción del historial de revisiones al adjuntar un fichero.
+const revisionAdjunto = "adjunto"
+
+// Una subida sin fragmentos nuevos durante plazoSubidaAdjunto se da por
+// abandonada y se borra con su contenido. Se comprueba cada intervaloAdjuntos.
+const (
+	plazoSubidaAdjunto = 24 * time.Hour
+	intervaloAdjuntos  = time.Hour
+)
+
+// Acción con la que se audita el borrado de una subida abandonada.
+const accionAdjuntoCaducado = "adjuntoCaducado"
+
+// tiposAdjuntoPermitidos son los tipos de contenido aceptados, detectados a
+// partir de los primeros bytes del fichero y no de su nombre.
+var tiposAdjuntoPermitidos = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+}
+
+// Adjunto describe un fichero adjunto a un expediente. Los metadatos de los
+// adjuntos completos se guardan también en el expediente para listarlos con
+// él; el contenido se guarda cifrado por fragmentos en 'AdjuntosDatos'.
+type Adjunto struct {
+	ID         int    `json:"id"`
+	Expediente int    `json:"expediente"`
+	Nombre     string `json:"nombre"`
+	Tipo       string `json:"tipo,omitempty"` //tipo de contenido detectado
+	Tamanyo    int64  `json:"tamanyo"`
+	Sha256     string `json:"sha256"`
+	Fragmentos int    `json:"fragmentos"`
+	Recibido   int64  `json:"recibido,omitempty"`  //bytes recibidos durante la subida
+	Actividad  string `json:"actividad,omitempty"` //último fragmento recibido durante la subida
+	Estado     string `json:"estado,omitempty"`
+	Subido_por string `json:"subido_por"`
+	Fecha      string `json:"fecha"`
+}
+
+// cargarClaveAdjuntos lee la clave de cifrado de los adjuntos, creándola si
+// no existe, y devuelve el cifrador AES-GCM correspondiente.
+func cargarClaveAdjuntos(ruta string) (cipher.AEAD, error) {
+	clave, err := os.ReadFile(ruta)
+	if errors.Is(err, os.ErrNotExist) {
+		clave = make([]byte, 32)
+		if _, err := rand.Read(clave); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(ruta), 0700); err != nil {
+			return nil, err
+		}
+		// O_EXCL: si otro proceso la ha creado a la vez no la sobrescribimos
+		fichero, err := os.OpenFile(ruta, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fichero.Write(clave); err != nil {
+			fichero.Close()
+			return nil, err
+		}
+		if err := fichero.Close(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(clave) != 32 {
+		return nil, fmt.Errorf("%s: la clave debe tener 32 bytes", ruta)
+	}
+	bloque, err := aes.NewCipher(clave)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bloque)
+}
+
+// claveFragmento construye la clave de un fragmento de un adjunto.
+func claveFragmento(adjunto, fragmento int) []byte {
+	return []byte(fmt.Sprintf("%010d|%06d", adjunto, fragmento))
+}
+
+// cifrarFragmento cifra un fragmento. La clave del fragmento se autentica
+// con él para que no pueda cambiarse de sitio sin que se detecte.
+func (s *server) cifrarFragmento(clave, datos []byte) ([]byte, error) {
+	nonce := make([]byte, s.cifrado.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.cifrado.Seal(nonce, nonce, datos, clave), nil
+}
+
+// descifrarFragmento descifra un fragmento guardado con cifrarFragmento.
+func (s *server) descifrarFragmento(clave, cifrado []byte) ([]byte, error) {
+	if len(cifrado) < s.cifrado.NonceSize() {
+		return nil, errors.New("fragmento cifrado incorrecto")
+	}
+	nonce, datos := cifrado[:s.cifrado.NonceSize()], cifrado[s.cifrado.NonceSize():]
+	return s.cifrado.Open(nil, nonce, datos, clave)
+}
+
+// obtenerAdjunto lee los metadatos de un adjunto junto con su versión.
+func (s *server) obtenerAdjunto(id int) (Adjunto, uint64, error) {
+	var adjunto Adjunto
+	adjuntoJson, version, err := s.db.GetWithVersion("Adjuntos", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return adjunto, 0, err
+	}
+	err = json.Unmarshal(adjuntoJson, &adjunto)
+	return adjunto, version, err
+}
+
+// comprobarAdjuntos valida las credenciales de una petición sobre adjuntos
+// y que el cifrado esté disponible. Devuelve nil si puede continuarse.
+func (s *server) comprobarAdjuntos(req api.Request) *api.Response {
+	if !s.isTokenValid(req.Token, req.Username) {
+		return &api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if s.cifrado == nil {
+		return &api.Response{Success: -1, Message: "Los adjuntos no están disponibles: falta la clave de cifrado del servidor"}
+	}
+	return nil
+}
+
+// iniciarAdjunto registra la subida de un fichero al expediente req.ID con
+// el nombre, el tamaño y el SHA-256 que declara el cliente. Responde con el
+// identificador del adjunto al que enviar los fragmentos.
+func (s *server) iniciarAdjunto(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.NombreFichero == "" || req.Sha256 == "" {
+		return api.Response{Success: -1, Message: "Faltan datos del adjunto (expediente, nombre y SHA-256)"}
+	}
+	if res := s.comprobarAdjuntos(req); res != nil {
+		return *res
+	}
+	if req.Tamanyo <= 0 || req.Tamanyo > tamanyoMaxAdjunto {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El tamaño del fichero debe estar entre 1 byte y %d MB", tamanyoMaxAdjunto>>20)}
+	}
+	if suma, err := hex.DecodeString(req.Sha256); err != nil || len(suma) != sha256.Size {
+		return api.Response{Success: -1, Message: "El SHA-256 indicado no es válido"}
+	}
+	if _, res := s.expedienteAccesible(req.Username, req.ID); res != nil {
+		return *res
+	}
+
+	id, err := s.siguienteSecuencia("Adjuntos")
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador del adjunto"}
+	}
+	adjunto := Adjunto{
+		ID:         id,
+		Expediente: req.ID,
+		Nombre:     filepath.Base(req.NombreFichero),
+		Tamanyo:    req.Tamanyo,
+		Sha256:     strings.ToLower(req.Sha256),
+		Estado:     estadoAdjuntoSubiendo,
+		Subido_por: req.Username,
+		Fecha:      time.Now().Format(time.RFC3339),
+	}
+	adjunto.Actividad = adjunto.Fecha
+	adjuntoJson, err := json.Marshal(adjunto)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el adjunto a json"}
+	}
+	if err := s.db.Put("Adjuntos", []byte(strconv.Itoa(id)), adjuntoJson); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el adjunto"}
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Adjunto %d creado; envíe el contenido en fragmentos de hasta %d KB", id, tamanyoMaxFragmento>>10), Adjunto: id}
+}
+
+// subirFragmento guarda cifrado el siguiente fragmento de un adjunto en
+// subida. Los fragmentos deben enviarse en orden, empezando por el 0; si se
+// reenvía el último recibido (por ejemplo, tras un error de red) se
+// sustituye.
+func (s *server) subirFragmento(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Adjunto == 0 || len(req.Contenido) == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos del fragmento"}
+	}
+	if res := s.comprobarAdjuntos(req); res != nil {
+		return *res
+	}
+	if len(req.Contenido) > tamanyoMaxFragmento {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El fragmento supera el máximo de %d KB", tamanyoMaxFragmento>>10)}
+	}
+	adjunto, version, err := s.obtenerAdjunto(req.Adjunto)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el adjunto %d", req.Adjunto)}
+	}
+	if adjunto.Estado != estadoAdjuntoSubiendo || adjunto.Subido_por != req.Username {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El adjunto %d no admite más fragmentos", req.Adjunto)}
+	}
+	if _, res := s.expedienteAccesible(req.Username, adjunto.Expediente); res != nil {
+		return *res
+	}
+
+	recibido := adjunto.Recibido
+	switch {
+	case req.Fragmento == adjunto.Fragmentos: // el siguiente
+	case req.Fragmento == adjunto.Fragmentos-1 && req.Fragmento >= 0: // reenvío del último
+		anterior, err := s.db.Get("AdjuntosDatos", claveFragmento(adjunto.ID, req.Fragmento))
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al leer el fragmento anterior"}
+		}
+		recibido -= int64(len(anterior) - s.cifrado.NonceSize() - s.cifrado.Overhead())
+		adjunto.Fragmentos--
+	default:
+		return api.Response{Success: -1, Message: fmt.Sprintf("Se esperaba el fragmento %d", adjunto.Fragmentos)}
+	}
+	if recibido+int64(len(req.Contenido)) > adjunto.Tamanyo {
+		return api.Response{Success: -1, Message: "El contenido supera el tamaño declarado del fichero"}
+	}
+	// El tipo se detecta con el comienzo del fichero, antes de aceptar nada más
+	if req.Fragmento == 0 {
+		tipo := strings.Split(http.DetectContentType(req.Contenido), ";")[0]
+		if !tiposAdjuntoPermitidos[tipo] {
+			return api.Response{Success: -1, Message: fmt.Sprintf("Tipo de fichero no permitido (%s); sólo se admiten PDF e imágenes", tipo)}
+		}
+		adjunto.Tipo = tipo
+	}
+
+	clave := claveFragmento(adjunto.ID, req.Fragmento)
+	cifrado, err := s.cifrarFragmento(clave, req.Contenido)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al cifrar el fragmento"}
+	}
+	adjunto.Fragmentos++
+	adjunto.Recibido = recibido + int64(len(req.Contenido))
+	adjunto.Actividad = time.Now().Format(time.RFC3339)
+	adjuntoJson, err := json.Marshal(adjunto)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el adjunto a json"}
+	}
+	err = s.db.Batch([]store.Op{
+		{Namespace: "Adjuntos", Key: []byte(strconv.Itoa(adjunto.ID)), Value: adjuntoJson, CheckVersion: true, Version: version},
+		{Namespace: "AdjuntosDatos", Key: clave, Value: cifrado},
+	})
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Message: "El adjunto se está subiendo desde otra sesión"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el fragmento"}
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Recibidos %d de %d bytes", adjunto.Recibido, adjunto.Tamanyo)}
+}
+
+// completarAdjunto comprueba que el contenido recibido coincide con el
+// tamaño y el SHA-256 declarados y, si es así, añade el adjunto al
+// expediente.
+func (s *server) completarAdjunto(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Adjunto == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos del adjunto"}
+	}
+	if res := s.comprobarAdjuntos(req); res != nil {
+		return *res
+	}
+	adjunto, version, err := s.obtenerAdjunto(req.Adjunto)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el adjunto %d", req.Adjunto)}
+	}
+	if adjunto.Estado != estadoAdjuntoSubiendo || adjunto.Subido_por != req.Username {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El adjunto %d no está pendiente de completar", req.Adjunto)}
+	}
+	if adjunto.Recibido != adjunto.Tamanyo {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Faltan datos: recibidos %d de %d bytes", adjunto.Recibido, adjunto.Tamanyo)}
+	}
+
+	suma := sha256.New()
+	for i := 0; i < adjunto.Fragmentos; i++ {
+		datos, err := s.leerFragmento(adjunto.ID, i)
+		if err != nil {
+			return api.Response{Success: -1, Message: fmt.Sprintf("Error al leer el fragmento %d", i)}
+		}
+		suma.Write(datos)
+	}
+	if hex.EncodeToString(suma.Sum(nil)) != adjunto.Sha256 {
+		if err := s.borrarAdjunto(adjunto, version); err != nil {
+			s.log.Printf("Error al borrar el adjunto %d: %v", adjunto.ID, err)
+		}
+		return api.Response{Success: -1, Message: "El SHA-256 del contenido recibido no coincide con el declarado; vuelva a subir el fichero"}
+	}
+
+	// Primero se añade al expediente: si falla, el adjunto sigue pendiente y
+	// puede volver a completarse
+	peticion := req
+	peticion.ID, peticion.ExpectedVersion = adjunto.Expediente, 0
+	adjunto.Recibido, adjunto.Actividad = 0, ""
+	res := s.modificarExpediente(peticion, revisionAdjunto, func(expediente *Expediente) error {
+		listado := adjunto
+		listado.Estado = ""
+		expediente.Adjuntos = append(expediente.Adjuntos, listado)
+		return nil
+	})
+	if res.Success != 1 {
+		return res
+	}
+	adjunto.Estado = estadoAdjuntoCompleto
+	adjuntoJson, err := json.Marshal(adjunto)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el adjunto a json"}
+	}
+	if err := s.db.CompareAndSwap("Adjuntos", []byte(strconv.Itoa(adjunto.ID)), version, adjuntoJson); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el adjunto"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionCompletarAdjunto,
+		fmt.Sprintf("adjunto %d (%s, %s, %d bytes, sha256 %s) en el expediente %d", adjunto.ID, adjunto.Nombre, adjunto.Tipo, adjunto.Tamanyo, adjunto.Sha256, adjunto.Expediente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Fichero %s adjuntado al expediente %d", adjunto.Nombre, adjunto.Expediente), Adjunto: adjunto.ID}
+}
+
+// leerFragmento lee y descifra un fragmento de un adjunto.
+func (s *server) leerFragmento(adjunto, fragmento int) ([]byte, error) {
+	clave := claveFragmento(adjunto, fragmento)
+	cifrado, err := s.db.Get("AdjuntosDatos", clave)
+	if err != nil {
+		return nil, err
+	}
+	return s.descifrarFragmento(clave, cifrado)
+}
+
+// borrarAdjunto elimina los metadatos y el contenido de un adjunto que no
+// llegó a completarse, si sigue en la versión leída; si entretanto ha
+// recibido otro fragmento devuelve store.ErrVersionConflict.
+func (s *server) borrarAdjunto(adjunto Adjunto, version uint64) error {
+	ops := []store.Op{{Namespace: "Adjuntos", Key: []byte(strconv.Itoa(adjunto.ID)), Delete: true, CheckVersion: true, Version: version}}
+	for i := 0; i < adjunto.Fragmentos; i++ {
+		ops = append(ops, store.Op{Namespace: "AdjuntosDatos", Key: claveFragmento(adjunto.ID, i), Delete: true})
+	}
+	return s.db.Batch(ops)
+}
+
+// borrarSubidasAbandonadas borra los adjuntos en subida que llevan más de
+// plazoSubidaAdjunto sin recibir fragmentos, junto con lo ya recibido.
+func (s *server) borrarSubidasAbandonadas() {
+	claves, err := s.db.ListKeys("Adjuntos")
+	if err != nil && !noEncontrado(err) {
+		s.log.Printf("Error listando los adjuntos: %v", err)
+		return
+	}
+	limite := time.Now().Add(-plazoSubidaAdjunto)
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		adjunto, version, err := s.obtenerAdjunto(id)
+		if err != nil || adjunto.Estado != estadoAdjuntoSubiendo {
+			continue
+		}
+		// Las subidas anteriores a este campo cuentan desde que se iniciaron
+		actividad := adjunto.Actividad
+		if actividad == "" {
+			actividad = adjunto.Fecha
+		}
+		if ultima, err := time.Parse(time.RFC3339, actividad); err == nil && ultima.After(limite) {
+			continue
+		}
+		if err := s.borrarAdjunto(adjunto, version); errors.Is(err, store.ErrVersionConflict) {
+			continue // ha recibido un fragmento mientras tanto
+		} else if err != nil {
+			s.log.Printf("Error al borrar el adjunto abandonado %d: %v", id, err)
+			continue
+		}
+		s.registrarAuditoria("sistema", accionAdjuntoCaducado,
+			fmt.Sprintf("adjunto %d (%s) del expediente %d abandonado por %s con %d de %d bytes", id, adjunto.Nombre, adjunto.Expediente, adjunto.Subido_por, adjunto.Recibido, adjunto.Tamanyo))
+	}
+}
+
+// subidasProgramadas borra periódicamente las subidas abandonadas.
+func (s *server) subidasProgramadas() {
+	s.borrarSubidasAbandonadas()
+	for range time.Tick(intervaloAdjuntos) {
+		s.borrarSubidasAbandonadas()
+	}
+}
+
+// descargarAdjunto devuelve descifrado el fragmento req.Fragmento de un
+// adjunto completo, junto con sus metadatos (en Registros) para que el
+// cliente sepa cuántos fragmentos pedir y pueda comprobar el SHA-256.
+func (s *server) descargarAdjunto(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Adjunto == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos del adjunto"}
+	}
+	if res := s.comprobarAdjuntos(req); res != nil {
+		return *res
+	}
+	adjunto, _, err := s.obtenerAdjunto(req.Adjunto)
+	if err != nil || adjunto.Estado != estadoAdjuntoCompleto {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el adjunto %d", req.Adjunto)}
+	}
+	if _, res := s.expedienteAccesible(req.Username, adjunto.Expediente); res != nil {
+		return *res
+	}
+	if req.Fragmento < 0 || req.Fragmento >= adjunto.Fragmentos {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El adjunto %d tiene %d fragmentos", adjunto.ID, adjunto.Fragmentos)}
+	}
+
+	datos, err := s.leerFragmento(adjunto.ID, req.Fragmento)
+	if err != nil {
+		s.log.Printf("Adjunto %d: fragmento %d ilegible: %v", adjunto.ID, req.Fragmento, err)
+		return api.Response{Success: -1, Message: "Error al leer el adjunto"}
+	}
+	adjuntoJson, err := json.Marshal(adjunto)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el adjunto a json"}
+	}
+	if req.Fragmento == 0 {
+		s.registrarAuditoria(req.Username, api.ActionDescargarAdjunto,
+			fmt.Sprintf("descarga del adjunto %d (%s) del expediente %d", adjunto.ID, adjunto.Nombre, adjunto.Expediente))
+	}
+
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("Fragmento %d de %d", req.Fragmento+1, adjunto.Fragmentos),
+		Contenido: datos,
+		Registros: [][]byte{adjuntoJson},
+		Adjunto:   adjunto.ID,
+	}
+}
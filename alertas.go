@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Alerta es una alergia, enfermedad crónica u otro aviso clínico del
+// paciente. Las alertas resueltas se conservan para saber quién y por qué
+// las dio por cerradas.
+type Alerta struct {
+	ID                int    `json:"id"` //posición en la lista del paciente, empezando en 1
+	Tipo              string `json:"tipo"`
+	Descripcion       string `json:"descripcion"`
+	Gravedad          string `json:"gravedad"`
+	Fecha             string `json:"fecha"`
+	Registrada_por    string `json:"registrada_por"`
+	Resuelta          bool   `json:"resuelta,omitempty"`
+	Resuelta_por      string `json:"resuelta_por,omitempty"`
+	Fecha_resolucion  string `json:"fecha_resolucion,omitempty"`
+	Motivo_resolucion string `json:"motivo_resolucion,omitempty"`
+}
+
+// ordenGravedad permite mostrar primero las alertas más graves.
+var ordenGravedad = map[string]int{api.GravedadAlta: 0, api.GravedadMedia: 1, api.GravedadBaja: 2}
+
+// modificarPaciente aplica 'cambiar' sobre el paciente y lo guarda con una
+// escritura condicional, reintentando si otro lo ha modificado a la vez.
+func (s *server) modificarPaciente(id string, cambiar func(*Paciente) error) (Paciente, error) {
+	var paciente Paciente
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		pacienteJson, version, err := s.db.GetWithVersion("Pacientes", []byte(id))
+		if err != nil {
+			return paciente, err
+		}
+		paciente = Paciente{}
+		if err := json.Unmarshal(pacienteJson, &paciente); err != nil {
+			return paciente, err
+		}
+		if err := cambiar(&paciente); err != nil {
+			return paciente, err
+		}
+		if pacienteJson, err = json.Marshal(paciente); err != nil {
+			return paciente, err
+		}
+		err = s.db.CompareAndSwap("Pacientes", []byte(id), version, pacienteJson)
+		if !errors.Is(err, store.ErrVersionConflict) {
+			return paciente, err
+		}
+	}
+	return paciente, store.ErrVersionConflict
+}
+
+// codificarAlertasActivas devuelve en json las alertas sin resolver, de la
+// más grave a la menos grave.
+func codificarAlertasActivas(paciente Paciente) ([][]byte, error) {
+	var activas []Alerta
+	for _, alerta := range paciente.Alertas {
+		if !alerta.Resuelta {
+			activas = append(activas, alerta)
+		}
+	}
+	sort.SliceStable(activas, func(i, j int) bool {
+		return ordenGravedad[activas[i].Gravedad] < ordenGravedad[activas[j].Gravedad]
+	})
+
+	var alertas [][]byte
+	for _, alerta := range activas {
+		alertaJson, err := json.Marshal(alerta)
+		if err != nil {
+			return nil, err
+		}
+		alertas = append(alertas, alertaJson)
+	}
+	return alertas, nil
+}
+
+// alertasActivas devuelve las alertas sin resolver del paciente.
+func (s *server) alertasActivas(id string) ([][]byte, error) {
+	paciente, err := s.obtenerPaciente(id)
+	if err != nil {
+		return nil, err
+	}
+	return codificarAlertasActivas(paciente)
+}
+
+// anyadirAlerta registra una alergia, enfermedad crónica o aviso en el
+// paciente. Responde con las alertas activas actualizadas.
+func (s *server) anyadirAlerta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.TipoAlerta == "" || strings.TrimSpace(req.Descripcion) == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la alerta (tipo y descripción)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if req.TipoAlerta != api.AlertaAlergia && req.TipoAlerta != api.AlertaCronica && req.TipoAlerta != api.AlertaAviso {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Tipo de alerta no válido: %s", req.TipoAlerta)}
+	}
+	gravedad := req.Gravedad
+	if gravedad == "" {
+		gravedad = api.GravedadMedia
+	}
+	if _, ok := ordenGravedad[gravedad]; !ok {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Gravedad no válida: %s", gravedad)}
+	}
+	id, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, id); res != nil {
+		return *res
+	}
+
+	alerta := Alerta{
+		Tipo:           req.TipoAlerta,
+		Descripcion:    strings.TrimSpace(req.Descripcion),
+		Gravedad:       gravedad,
+		Fecha:          time.Now().Format(time.RFC3339),
+		Registrada_por: req.Username,
+	}
+	paciente, err := s.modificarPaciente(id, func(paciente *Paciente) error {
+		alerta.ID = len(paciente.Alertas) + 1
+		paciente.Alertas = append(paciente.Alertas, alerta)
+		return nil
+	})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la alerta del paciente"}
+	}
+	alertas, err := codificarAlertasActivas(paciente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir las alertas a json"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionAnyadirAlerta,
+		fmt.Sprintf("alerta %d (%s, %s) en el paciente %s: %s", alerta.ID, alerta.Tipo, alerta.Gravedad, id, alerta.Descripcion))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Alerta %d añadida", alerta.ID), Paciente: id, Alertas: alertas}
+}
+
+// resolverAlerta da por cerrada una alerta del paciente (por ejemplo, una
+// alergia descartada), indicando el motivo. Responde con las alertas
+// activas actualizadas.
+func (s *server) resolverAlerta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Alerta == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos para resolver la alerta (alerta y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	id, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, id); res != nil {
+		return *res
+	}
+
+	var descripcion string
+	var rechazo error // motivo por el que no puede resolverse, para el usuario
+	paciente, err := s.modificarPaciente(id, func(paciente *Paciente) error {
+		if req.Alerta < 1 || req.Alerta > len(paciente.Alertas) {
+			rechazo = fmt.Errorf("No existe la alerta %d del paciente %s", req.Alerta, id)
+			return rechazo
+		}
+		alerta := &paciente.Alertas[req.Alerta-1]
+		if alerta.Resuelta {
+			rechazo = fmt.Errorf("La alerta %d ya fue resuelta por %s", req.Alerta, alerta.Resuelta_por)
+			return rechazo
+		}
+		alerta.Resuelta = true
+		alerta.Resuelta_por = req.Username
+		alerta.Fecha_resolucion = time.Now().Format(time.RFC3339)
+		alerta.Motivo_resolucion = req.Motivo
+		descripcion = alerta.Descripcion
+		return nil
+	})
+	if rechazo != nil {
+		return api.Response{Success: -1, Message: rechazo.Error()}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la alerta del paciente"}
+	}
+	alertas, err := codificarAlertasActivas(paciente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir las alertas a json"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionResolverAlerta,
+		fmt.Sprintf("alerta %d del paciente %s (%s) resuelta: %s", req.Alerta, id, descripcion, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Alerta %d resuelta", req.Alerta), Paciente: id, Alertas: alertas}
+}
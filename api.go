@@ -3,15 +3,141 @@
 package api
 
 const (
-	ActionRegister            = "register"
-	ActionLogin               = "login"
-	ActionFetchData           = "fetchData"
-	ActionUpdateData          = "updateData"
-	ActionLogout              = "logout"
-	ActionDarAlta             = "darAlta"
-	ActionObtenerExpedientes  = "obtenerExpedientes"
-	ActionModificarExpediente = "modificarExpediente"
-	ActionCrearExpediente     = "crearExpediente"
+	ActionRegister                = "register"
+	ActionLogin                   = "login"
+	ActionFetchData               = "fetchData"
+	ActionUpdateData              = "updateData"
+	ActionLogout                  = "logout"
+	ActionDarAlta                 = "darAlta"
+	ActionObtenerExpedientes      = "obtenerExpedientes"
+	ActionModificarExpediente     = "modificarExpediente"
+	ActionCrearExpediente         = "crearExpediente"
+	ActionDarBaja                 = "darBaja"
+	ActionReingresar              = "reingresar"
+	ActionSolicitarFusion         = "solicitarFusion"
+	ActionListarSolicitudesFusion = "listarSolicitudesFusion"
+	ActionMergePacientes          = "mergePacientes"
+	ActionDeshacerFusion          = "deshacerFusion"
+	ActionAnyadirIdentificador    = "anyadirIdentificador"
+	ActionBuscarPacientes         = "buscarPacientes"
+	ActionReconstruirIndices      = "reconstruirIndices"
+	ActionHistorialExpediente     = "historialExpediente"
+	ActionExpedienteEnFecha       = "expedienteEnFecha"
+	ActionCorregirObservacion     = "corregirObservacion"
+	ActionAnularObservacion       = "anularObservacion"
+	ActionBuscarCIE10             = "buscarCIE10"
+	ActionPrescribir              = "prescribir"
+	ActionModificarReceta         = "modificarReceta"
+	ActionSuspenderReceta         = "suspenderReceta"
+	ActionListarRecetas           = "listarRecetas"
+	ActionAnyadirAlerta           = "anyadirAlerta"
+	ActionResolverAlerta          = "resolverAlerta"
+	ActionRegistrarMedicion       = "registrarMedicion"
+	ActionConsultarMediciones     = "consultarMediciones"
+	ActionIniciarAdjunto          = "iniciarAdjunto"
+	ActionSubirFragmento          = "subirFragmento"
+	ActionCompletarAdjunto        = "completarAdjunto"
+	ActionDescargarAdjunto        = "descargarAdjunto"
+	ActionPublicarHuecos          = "publicarHuecos"
+	ActionListarHuecos            = "listarHuecos"
+	ActionAgendaDia               = "agendaDia"
+	ActionReservarCita            = "reservarCita"
+	ActionCancelarCita            = "cancelarCita"
+	ActionReprogramarCita         = "reprogramarCita"
+	ActionSolicitarInterconsulta  = "solicitarInterconsulta"
+	ActionBandejaInterconsultas   = "bandejaInterconsultas"
+	ActionAceptarInterconsulta    = "aceptarInterconsulta"
+	ActionRechazarInterconsulta   = "rechazarInterconsulta"
+	ActionCompletarInterconsulta  = "completarInterconsulta"
+	ActionSolicitarTraslado       = "solicitarTraslado"
+	ActionListarTraslados         = "listarTraslados"
+	ActionAceptarTraslado         = "aceptarTraslado"
+	ActionRechazarTraslado        = "rechazarTraslado"
+	ActionListCatalogs            = "listCatalogs"
+	ActionCrearHospital           = "crearHospital"
+	ActionRenombrarHospital       = "renombrarHospital"
+	ActionBorrarHospital          = "borrarHospital"
+	ActionCrearEspecialidad       = "crearEspecialidad"
+	ActionRenombrarEspecialidad   = "renombrarEspecialidad"
+	ActionBorrarEspecialidad      = "borrarEspecialidad"
+	ActionListarUsuarios          = "listarUsuarios"
+	ActionDeshabilitarUsuario     = "deshabilitarUsuario"
+	ActionHabilitarUsuario        = "habilitarUsuario"
+	ActionCambiarDestinoUsuario   = "cambiarDestinoUsuario"
+	ActionBorrarUsuario           = "borrarUsuario"
+	ActionGenerarCodigoReset      = "generarCodigoReset"
+	ActionResetPassword           = "resetPassword"
+	ActionCambiarRolUsuario       = "cambiarRolUsuario"
+	ActionDelegarResidente        = "delegarResidente"
+	ActionRevocarDelegacion       = "revocarDelegacion"
+	ActionListarDelegaciones      = "listarDelegaciones"
+	ActionPendientesRefrendo      = "pendientesRefrendo"
+	ActionRefrendarObservacion    = "refrendarObservacion"
+)
+
+// Tipos de identificador de paciente.
+const (
+	IdentificadorInterno   = "id" // identificador interno asignado por el servidor
+	IdentificadorDNI       = "dni"
+	IdentificadorNIE       = "nie"
+	IdentificadorPasaporte = "pasaporte"
+	IdentificadorNHC       = "nhc" // número de historia clínica
+	IdentificadorSIP       = "sip" // tarjeta sanitaria SIP de la Comunitat Valenciana
+)
+
+// Roles de usuario.
+const (
+	RolMedico    = "medico"
+	RolAdmin     = "admin"
+	RolResidente = "residente" //médico interno residente; lo que escribe lo refrenda su supervisor
+)
+
+// Estados posibles de un paciente dentro de su historial.
+const (
+	EstadoIngresado  = "ingresado"
+	EstadoBaja       = "baja"
+	EstadoFallecido  = "fallecido"
+	EstadoTrasladado = "trasladado"
+)
+
+// Tipos de alerta clínica de un paciente.
+const (
+	AlertaAlergia = "alergia"
+	AlertaCronica = "cronica" // enfermedad crónica
+	AlertaAviso   = "aviso"   // cualquier otra advertencia (riesgo de caídas, aislamiento...)
+)
+
+// Gravedad de una alerta clínica, de mayor a menor.
+const (
+	GravedadAlta  = "alta"
+	GravedadMedia = "media"
+	GravedadBaja  = "baja"
+)
+
+// Prioridad de una interconsulta, de mayor a menor.
+const (
+	PrioridadUrgente    = "urgente"
+	PrioridadPreferente = "preferente"
+	PrioridadNormal     = "normal"
+)
+
+// Tipos de evento que el servidor envía por /events. No hay evento de
+// consentimiento revocado porque el servidor no registra los consentimientos
+// de los pacientes.
+const (
+	EventoNuevoExpediente       = "nuevoExpediente"
+	EventoNuevaObservacion      = "nuevaObservacion"
+	EventoInterconsultaRecibida = "interconsultaRecibida"
+)
+
+// Tipos de medición de un paciente: constantes vitales y resultados de
+// laboratorio.
+const (
+	MedicionTension            = "tension" // tensión arterial sistólica y diastólica
+	MedicionFrecuenciaCardiaca = "frecuencia_cardiaca"
+	MedicionTemperatura        = "temperatura"
+	MedicionGlucosa            = "glucosa"
+	MedicionAnalitica          = "analitica" // cualquier otro analito de laboratorio
 )
 
 // Request y Response como antes
@@ -28,16 +154,90 @@ type Request struct { //omitempty es para que no aparezca en el json del request
 	Nombre       string `json:"nombre,omitempty"`
 	Fecha        string `json:"Fecha;omitempty"`
 	//Medico        string `json:"medico;omitempty"`
-	DNI         string `json:"dni;omitempty"`
-	Diagnostico string `json:"diagnostico;omitempty"`
-	ID          int    `json:"id;omitempty"`
+	DNI               string   `json:"dni;omitempty"`
+	Diagnostico       string   `json:"diagnostico;omitempty"`
+	ID                int      `json:"id;omitempty"`
+	Estado            string   `json:"estado,omitempty"` //estado final al dar de baja (baja, fallecido, trasladado)
+	Motivo            string   `json:"motivo,omitempty"`
+	Forzar            bool     `json:"forzar,omitempty"`             //registrar aunque existan posibles duplicados
+	Duplicado         string   `json:"duplicado,omitempty"`          //DNI o identificador interno del paciente duplicado
+	Paciente          string   `json:"paciente,omitempty"`           //identificador interno del paciente
+	TipoIdentificador string   `json:"tipo_identificador,omitempty"` //tipo de 'Identificador' (dni, nie, pasaporte, nhc, sip)
+	Identificador     string   `json:"identificador,omitempty"`
+	Pagina            int      `json:"pagina,omitempty"`          //página de resultados solicitada (empezando en 1)
+	Limite            int      `json:"limite,omitempty"`          //número máximo de resultados por página
+	Cursor            string   `json:"cursor,omitempty"`          //posición desde la que continuar un listado paginado
+	Descendente       bool     `json:"descendente,omitempty"`     //listar del más reciente al más antiguo
+	ExpectedVersion   int      `json:"expectedVersion,omitempty"` //versión del registro sobre la que se hizo la modificación
+	Observacion       int      `json:"observacion,omitempty"`     //número de la observación dentro del expediente
+	Diagnosticos      []string `json:"diagnosticos,omitempty"`    //códigos CIE-10 de la observación
+	Consulta          string   `json:"consulta,omitempty"`        //texto a buscar en un catálogo
+	Receta            int      `json:"receta,omitempty"`          //identificador de la receta
+	Farmaco           string   `json:"farmaco,omitempty"`
+	Dosis             string   `json:"dosis,omitempty"`
+	Via               string   `json:"via,omitempty"` //vía de administración (oral, intravenosa...)
+	Frecuencia        string   `json:"frecuencia,omitempty"`
+	FechaInicio       string   `json:"fecha_inicio,omitempty"` //AAAA-MM-DD; hoy si se omite
+	FechaFin          string   `json:"fecha_fin,omitempty"`    //AAAA-MM-DD; vacía si el tratamiento es indefinido
+	Alerta            int      `json:"alerta,omitempty"`       //identificador de la alerta del paciente
+	TipoAlerta        string   `json:"tipo_alerta,omitempty"`  //alergia, cronica o aviso
+	Gravedad          string   `json:"gravedad,omitempty"`     //alta, media o baja
+	Descripcion       string   `json:"descripcion,omitempty"`
+	TipoMedicion      string   `json:"tipo_medicion,omitempty"` //tension, frecuencia_cardiaca, temperatura, glucosa o analitica
+	Analito           string   `json:"analito,omitempty"`       //nombre del analito en las mediciones de laboratorio
+	Valor             float64  `json:"valor,omitempty"`
+	Diastolica        float64  `json:"diastolica,omitempty"` //tensión diastólica; 'Valor' es la sistólica
+	Unidad            string   `json:"unidad,omitempty"`
+	Minimo            *float64 `json:"minimo,omitempty"` //rango de referencia del analito
+	Maximo            *float64 `json:"maximo,omitempty"`
+	Adjunto           int      `json:"adjunto,omitempty"` //identificador del fichero adjunto
+	NombreFichero     string   `json:"nombre_fichero,omitempty"`
+	Tamanyo           int64    `json:"tamanyo,omitempty"`   //tamaño total del fichero en bytes
+	Sha256            string   `json:"sha256,omitempty"`    //SHA-256 del fichero completo, en hexadecimal
+	Fragmento         int      `json:"fragmento,omitempty"` //número de fragmento, empezando en 0
+	Contenido         []byte   `json:"contenido,omitempty"`
+	Medico            string   `json:"medico,omitempty"`    //usuario del médico
+	Duracion          int      `json:"duracion,omitempty"`  //duración de cada hueco de agenda, en minutos
+	Cita              int      `json:"cita,omitempty"`      //cita reservada
+	Hueco             int      `json:"hueco,omitempty"`     //hueco libre de agenda que se quiere reservar
+	Prioridad         string   `json:"prioridad,omitempty"` //urgente, preferente o normal
+	Informe           string   `json:"informe,omitempty"`   //informe del especialista al completar una interconsulta
+	Codigo            string   `json:"codigo,omitempty"`    //código de restablecimiento de contraseña
+	Rol               string   `json:"rol,omitempty"`
 }
 
 type Response struct {
-	Success     bool     `json:"success"`
-	Message     string   `json:"message"`
-	Token       string   `json:"token,omitempty"`
-	Data        string   `json:"data,omitempty"`
-	Expedientes [][]byte `json:"expedientes,omitempty"` //lista con el id de los pacientes que tienen algún historial con su médico
-	Hospital    int
+	Success        bool     `json:"success"`
+	Message        string   `json:"message"`
+	Token          string   `json:"token,omitempty"`
+	Data           string   `json:"data,omitempty"`
+	Expedientes    [][]byte `json:"expedientes,omitempty"` //lista con el id de los pacientes que tienen algún historial con su médico
+	Hospital       int
+	Estado         string   `json:"estado,omitempty"`     //estado actual del paciente
+	Duplicados     []string `json:"duplicados,omitempty"` //pacientes con mismo nombre, apellido y fecha de nacimiento
+	Rol            string   `json:"rol,omitempty"`
+	Registros      [][]byte `json:"registros,omitempty"`      //registros json devueltos por las acciones de listado
+	Paciente       string   `json:"paciente,omitempty"`       //identificador interno del paciente
+	Total          int      `json:"total,omitempty"`          //número total de resultados de una búsqueda paginada
+	Cursor         string   `json:"cursor,omitempty"`         //cursor de la página siguiente; vacío si no hay más
+	Conflicto      bool     `json:"conflicto,omitempty"`      //el registro cambió desde que se leyó; se devuelve el actual
+	Avisos         []string `json:"avisos,omitempty"`         //advertencias que no impiden la acción (interacciones...)
+	Alertas        [][]byte `json:"alertas,omitempty"`        //alertas clínicas activas del paciente
+	Adjunto        int      `json:"adjunto,omitempty"`        //identificador del fichero adjunto
+	Contenido      []byte   `json:"contenido,omitempty"`      //fragmento descargado de un adjunto
+	Hospitales     [][]byte `json:"hospitales,omitempty"`     //catálogo de hospitales (id y nombre)
+	Especialidades [][]byte `json:"especialidades,omitempty"` //catálogo de especialidades (id y nombre)
+}
+
+// Evento es una notificación enviada por /events como Server-Sent Events:
+// cada evento llega como "event: <Tipo>" y "data: <Evento en json>".
+type Evento struct {
+	Tipo         string `json:"tipo"`
+	Fecha        string `json:"fecha"`
+	Autor        string `json:"autor"` //usuario que ha provocado el evento
+	Paciente     string `json:"paciente,omitempty"`
+	Expediente   int    `json:"expediente,omitempty"`
+	Especialidad int    `json:"especialidad,omitempty"`
+	Hospital     int    `json:"hospital,omitempty"`
+	Mensaje      string `json:"mensaje"`
 }
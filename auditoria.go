@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EntradaAuditoria registra una operación sensible realizada por un usuario.
+type EntradaAuditoria struct {
+	Fecha   string `json:"fecha"`
+	Usuario string `json:"usuario"`
+	Accion  string `json:"accion"`
+	Detalle string `json:"detalle"`
+}
+
+// registrarAuditoria añade una entrada al namespace 'Auditoria'. La clave
+// empieza por la fecha para que las entradas queden ordenadas en el tiempo.
+func (s *server) registrarAuditoria(usuario, accion, detalle string) {
+	ahora := time.Now()
+	entrada := EntradaAuditoria{
+		Fecha:   ahora.Format(time.RFC3339),
+		Usuario: usuario,
+		Accion:  accion,
+		Detalle: detalle,
+	}
+	entradaJson, err := json.Marshal(entrada)
+	if err != nil {
+		s.log.Printf("Error al convertir la entrada de auditoría a json: %v", err)
+		return
+	}
+	clave := ahora.UTC().Format("20060102T150405.000000000") + "|" + usuario
+	if err := s.db.Put("Auditoria", []byte(clave), entradaJson); err != nil {
+		s.log.Printf("Error al guardar la entrada de auditoría: %v", err)
+	}
+}
@@ -2,8 +2,13 @@ package store
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 
 	"go.etcd.io/bbolt"
 )
@@ -14,7 +19,12 @@ import (
 
 // BboltStore contiene la instancia de la base de datos bbolt.
 type BboltStore struct {
-	db *bbolt.DB
+	db        *bbolt.DB
+	retencion uint64        // cambios que se conservan por namespace
+	mu        sync.Mutex    // protege 'cambio'
+	cambio    chan struct{} // se cierra (y se sustituye) tras cada escritura, para avisar a los Watch
+	cerrado   chan struct{} // se cierra en Close para terminar los Watch
+	cerrar    sync.Once
 }
 
 // NewBboltStore abre la base de datos bbolt en la ruta especificada.
@@ -23,21 +33,189 @@ func NewBboltStore(path string) (*BboltStore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error al abrir base de datos bbolt: %v", err)
 	}
-	return &BboltStore{db: db}, nil
+	return &BboltStore{
+		db:        db,
+		retencion: retencionCambios,
+		cambio:    make(chan struct{}),
+		cerrado:   make(chan struct{}),
+	}, nil
 }
 
 // Put almacena o actualiza (key, value) dentro de un bucket = namespace.
 // No se soportan sub-buckets.
 func (s *BboltStore) Put(namespace string, key, value []byte) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(namespace))
-		if err != nil {
-			return fmt.Errorf("error al crear/abrir bucket '%s': %v", namespace, err)
-		}
-		return b.Put(key, value)
+	return s.escribir(func(tx *bbolt.Tx) error {
+		return s.putTx(tx, namespace, key, value)
 	})
 }
 
+// escribir ejecuta la transacción de escritura y, si se confirma, avisa a
+// los Watch de que puede haber cambios nuevos en el registro.
+func (s *BboltStore) escribir(fn func(tx *bbolt.Tx) error) error {
+	if err := s.db.Update(fn); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	close(s.cambio)
+	s.cambio = make(chan struct{})
+	s.mu.Unlock()
+	return nil
+}
+
+// prefijoVersion es el prefijo de los buckets donde se guarda la versión de
+// cada registro. Los namespaces internos (que empiezan por "__", como los de
+// índices o versiones) no llevan versión.
+const prefijoVersion = "__ver:"
+
+// El registro de cambios que lee Watch se guarda en un bucket por namespace
+// ("__cambios:ns") cuyas claves son la revisión en big endian, así que
+// quedan ordenadas. Cada entrada sólo anota la clave y si se ha borrado:
+// los valores no se copian, para no duplicar fuera de su namespace datos
+// como contraseñas o sesiones. La revisión global es la secuencia del
+// bucket namespaceRevision.
+const (
+	prefijoCambios    = "__cambios:"
+	namespaceRevision = "__revision"
+	// Guarda por namespace la última revisión descartada de su registro.
+	namespaceCompactado = "__compactado"
+	// Cambios que se conservan por namespace; los más antiguos se descartan.
+	retencionCambios = 10000
+)
+
+// versionado indica si los registros del namespace llevan versión y si sus
+// cambios se anotan en el registro de cambios.
+func versionado(namespace string) bool {
+	return !strings.HasPrefix(namespace, "__")
+}
+
+// versionTx devuelve la versión actual de un registro. Los registros
+// escritos antes de que existieran las versiones tienen la versión 1.
+func versionTx(tx *bbolt.Tx, namespace string, key []byte) uint64 {
+	if vb := tx.Bucket([]byte(prefijoVersion + namespace)); vb != nil {
+		if v := vb.Get(key); v != nil {
+			return binary.BigEndian.Uint64(v)
+		}
+	}
+	if b := tx.Bucket([]byte(namespace)); b != nil && b.Get(key) != nil {
+		return 1
+	}
+	return 0
+}
+
+// putTx guarda el registro e incrementa su versión.
+func (s *BboltStore) putTx(tx *bbolt.Tx, namespace string, key, value []byte) error {
+	version := versionTx(tx, namespace, key) + 1
+	b, err := tx.CreateBucketIfNotExists([]byte(namespace))
+	if err != nil {
+		return fmt.Errorf("error al crear/abrir bucket '%s': %v", namespace, err)
+	}
+	if err := b.Put(key, value); err != nil {
+		return err
+	}
+	if !versionado(namespace) {
+		return nil
+	}
+	vb, err := tx.CreateBucketIfNotExists([]byte(prefijoVersion + namespace))
+	if err != nil {
+		return fmt.Errorf("error al crear/abrir bucket '%s': %v", prefijoVersion+namespace, err)
+	}
+	if err := vb.Put(key, binary.BigEndian.AppendUint64(nil, version)); err != nil {
+		return err
+	}
+	return registrarCambio(tx, Change{Namespace: namespace, Key: key}, s.retencion)
+}
+
+// deleteTx borra el registro y su versión. Borrar una clave que no existe
+// no hace nada.
+func (s *BboltStore) deleteTx(tx *bbolt.Tx, b *bbolt.Bucket, namespace string, key []byte) error {
+	if b.Get(key) == nil {
+		return nil
+	}
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	if vb := tx.Bucket([]byte(prefijoVersion + namespace)); vb != nil {
+		if err := vb.Delete(key); err != nil {
+			return err
+		}
+	}
+	if !versionado(namespace) {
+		return nil
+	}
+	return registrarCambio(tx, Change{Namespace: namespace, Key: key, Delete: true}, s.retencion)
+}
+
+// registrarCambio añade el cambio al registro de su namespace con la
+// siguiente revisión, dentro de la misma transacción que lo aplica, y
+// descarta los más antiguos si se supera la retención.
+func registrarCambio(tx *bbolt.Tx, cambio Change, retencion uint64) error {
+	rb, err := tx.CreateBucketIfNotExists([]byte(namespaceRevision))
+	if err != nil {
+		return fmt.Errorf("error al crear/abrir bucket '%s': %v", namespaceRevision, err)
+	}
+	revision, err := rb.NextSequence()
+	if err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(prefijoCambios + cambio.Namespace))
+	if err != nil {
+		return fmt.Errorf("error al crear/abrir bucket '%s': %v", prefijoCambios+cambio.Namespace, err)
+	}
+	cambioJson, err := json.Marshal(cambio)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(binary.BigEndian.AppendUint64(nil, revision), cambioJson); err != nil {
+		return err
+	}
+	// La secuencia del bucket lleva la cuenta de entradas que conserva
+	retenidos, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	if retenidos <= retencion {
+		return nil
+	}
+	return compactarCambios(tx, b, cambio.Namespace, retenidos-retencion)
+}
+
+// compactarCambios descarta las 'n' entradas más antiguas del registro del
+// namespace y anota la última revisión descartada, para que Watch pueda
+// avisar de que ya no se puede continuar desde ella.
+func compactarCambios(tx *bbolt.Tx, b *bbolt.Bucket, namespace string, n uint64) error {
+	var ultima []byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && n > 0; k, _ = c.First() {
+		ultima = append([]byte{}, k...)
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		n--
+		if err := b.SetSequence(b.Sequence() - 1); err != nil {
+			return err
+		}
+	}
+	if ultima == nil {
+		return nil
+	}
+	cb, err := tx.CreateBucketIfNotExists([]byte(namespaceCompactado))
+	if err != nil {
+		return fmt.Errorf("error al crear/abrir bucket '%s': %v", namespaceCompactado, err)
+	}
+	return cb.Put([]byte(namespace), ultima)
+}
+
+// compactadoTx devuelve la última revisión descartada del registro del
+// namespace (0 si no se ha descartado ninguna).
+func compactadoTx(tx *bbolt.Tx, namespace string) uint64 {
+	if cb := tx.Bucket([]byte(namespaceCompactado)); cb != nil {
+		if v := cb.Get([]byte(namespace)); v != nil {
+			return binary.BigEndian.Uint64(v)
+		}
+	}
+	return 0
+}
+
 // Get recupera el valor de (key) en el bucket = namespace.
 func (s *BboltStore) Get(namespace string, key []byte) ([]byte, error) {
 	var val []byte
@@ -57,12 +235,12 @@ func (s *BboltStore) Get(namespace string, key []byte) ([]byte, error) {
 
 // Delete elimina la clave 'key' del bucket = namespace.
 func (s *BboltStore) Delete(namespace string, key []byte) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	return s.escribir(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(namespace))
 		if b == nil {
 			return fmt.Errorf("bucket no encontrado: %s", namespace)
 		}
-		return b.Delete(key)
+		return s.deleteTx(tx, b, namespace, key)
 	})
 }
 
@@ -104,11 +282,303 @@ func (s *BboltStore) KeysByPrefix(namespace string, prefix []byte) ([][]byte, er
 	return matchedKeys, err
 }
 
-// Close cierra la base de datos bbolt.
+// Scan devuelve una página de pares clave/valor en orden ascendente.
+func (s *BboltStore) Scan(namespace string, start, prefix []byte, limit int) ([]KV, []byte, error) {
+	return s.scan(namespace, start, prefix, limit, false)
+}
+
+// ScanReverse devuelve una página de pares clave/valor en orden descendente.
+func (s *BboltStore) ScanReverse(namespace string, start, prefix []byte, limit int) ([]KV, []byte, error) {
+	return s.scan(namespace, start, prefix, limit, true)
+}
+
+func (s *BboltStore) scan(namespace string, start, prefix []byte, limit int, reverse bool) ([]KV, []byte, error) {
+	var pairs []KV
+	var next []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(namespace))
+		if b == nil {
+			return fmt.Errorf("bucket no encontrado: %s", namespace)
+		}
+		c := b.Cursor()
+
+		var k, v []byte
+		step := c.Next
+		if reverse {
+			step = c.Prev
+			k, v = seekReverse(c, start, prefix)
+		} else {
+			if start == nil || bytes.Compare(start, prefix) < 0 {
+				start = prefix
+			}
+			k, v = c.Seek(start)
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = step() {
+			if limit > 0 && len(pairs) == limit {
+				next = append([]byte{}, k...)
+				break
+			}
+			pairs = append(pairs, KV{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+		}
+		return nil
+	})
+	return pairs, next, err
+}
+
+// seekReverse coloca el cursor en la última clave menor o igual que 'start'
+// (o en la última clave con el prefijo, si 'start' es nil).
+func seekReverse(c *bbolt.Cursor, start, prefix []byte) ([]byte, []byte) {
+	if start == nil {
+		// Nos situamos justo antes de la primera clave posterior al prefijo
+		end := prefixEnd(prefix)
+		if end == nil {
+			return c.Last()
+		}
+		if k, _ := c.Seek(end); k == nil {
+			return c.Last()
+		}
+		return c.Prev()
+	}
+	k, v := c.Seek(start)
+	switch {
+	case k == nil:
+		return c.Last()
+	case bytes.Equal(k, start):
+		return k, v
+	}
+	return c.Prev()
+}
+
+// prefixEnd devuelve la menor clave mayor que todas las que empiezan por
+// 'prefix', o nil si no existe (prefijo vacío o formado solo por 0xff).
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// GetWithVersion recupera el valor de (key) junto con su versión.
+func (s *BboltStore) GetWithVersion(namespace string, key []byte) ([]byte, uint64, error) {
+	var val []byte
+	var version uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(namespace))
+		if b == nil {
+			return fmt.Errorf("bucket no encontrado: %s", namespace)
+		}
+		val = b.Get(key)
+		if val == nil {
+			return fmt.Errorf("clave no encontrada: %s", string(key))
+		}
+		val = append([]byte{}, val...)
+		version = versionTx(tx, namespace, key)
+		return nil
+	})
+	return val, version, err
+}
+
+// CompareAndSwap guarda el valor si la versión actual es la esperada.
+func (s *BboltStore) CompareAndSwap(namespace string, key []byte, expected uint64, value []byte) error {
+	return s.Batch([]Op{{Namespace: namespace, Key: key, Value: value, CheckVersion: true, Version: expected}})
+}
+
+// Batch aplica las operaciones dentro de una única transacción de bbolt.
+// Borrar una clave de un bucket inexistente no se considera un error.
+func (s *BboltStore) Batch(ops []Op) error {
+	return s.Update(func(tx Tx) error {
+		for _, op := range ops {
+			if err := tx.Apply(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update ejecuta 'fn' dentro de una transacción de escritura de bbolt.
+func (s *BboltStore) Update(fn func(tx Tx) error) error {
+	return s.escribir(func(tx *bbolt.Tx) error {
+		return fn(bboltTx{tx: tx, s: s})
+	})
+}
+
+// bboltTx implementa Tx sobre una transacción de bbolt.
+type bboltTx struct {
+	tx *bbolt.Tx
+	s  *BboltStore
+}
+
+func (t bboltTx) Get(namespace string, key []byte) []byte {
+	b := t.tx.Bucket([]byte(namespace))
+	if b == nil {
+		return nil
+	}
+	if v := b.Get(key); v != nil {
+		return append([]byte{}, v...)
+	}
+	return nil
+}
+
+func (t bboltTx) ListKeys(namespace string) [][]byte {
+	b := t.tx.Bucket([]byte(namespace))
+	if b == nil {
+		return nil
+	}
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	return keys
+}
+
+func (t bboltTx) Apply(op Op) error {
+	if op.CheckVersion && versionTx(t.tx, op.Namespace, op.Key) != op.Version {
+		return ErrVersionConflict
+	}
+	if op.Delete {
+		b := t.tx.Bucket([]byte(op.Namespace))
+		if b == nil {
+			return nil
+		}
+		return t.s.deleteTx(t.tx, b, op.Namespace, op.Key)
+	}
+	return t.s.putTx(t.tx, op.Namespace, op.Key, op.Value)
+}
+
+// Close termina los Watch abiertos y cierra la base de datos bbolt.
 func (s *BboltStore) Close() error {
+	s.cerrar.Do(func() { close(s.cerrado) })
 	return s.db.Close()
 }
 
+// Cambios que Watch lee del registro en cada transacción y que pueden
+// quedar en el canal sin que nadie los haya recibido.
+const loteCambios = 64
+
+// ErrStoreCerrado indica que el Store ya se ha cerrado.
+var ErrStoreCerrado = errors.New("el store está cerrado")
+
+// Watch vigila el registro de cambios en una goroutine. Si el canal se
+// cierra sin que se haya llamado a la función de cancelar, la lectura del
+// registro ha fallado, se ha cerrado el Store o el vigilante se ha quedado
+// tan atrás que sus cambios se han descartado; al volver a vigilar desde la
+// última revisión recibida, Watch devuelve el error correspondiente.
+func (s *BboltStore) Watch(namespace string, prefix []byte, desde uint64) (<-chan Change, func(), error) {
+	select {
+	case <-s.cerrado:
+		return nil, nil, ErrStoreCerrado
+	default:
+	}
+	var compactado uint64
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		compactado = compactadoTx(tx, namespace)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if desde < compactado {
+		return nil, nil, ErrRevisionCompactada
+	}
+
+	canal := make(chan Change, loteCambios)
+	fin := make(chan struct{})
+	var cancelar sync.Once
+	go func() {
+		defer close(canal)
+		for {
+			// El aviso se toma antes de leer para no perder las escrituras
+			// que se confirmen mientras tanto
+			s.mu.Lock()
+			aviso := s.cambio
+			s.mu.Unlock()
+
+			cambios, leida, err := s.leerCambios(namespace, prefix, desde)
+			if err != nil {
+				return
+			}
+			for _, cambio := range cambios {
+				select {
+				case canal <- cambio:
+				case <-fin:
+					return
+				case <-s.cerrado:
+					return
+				}
+			}
+			desde = leida
+			if len(cambios) == loteCambios {
+				continue // puede haber más sin leer
+			}
+
+			select {
+			case <-aviso:
+			case <-fin:
+				return
+			case <-s.cerrado:
+				return
+			}
+		}
+	}()
+	return canal, func() { cancelar.Do(func() { close(fin) }) }, nil
+}
+
+// leerCambios devuelve como mucho loteCambios cambios del namespace con el
+// prefijo y revisión mayor que 'desde', junto con la última revisión
+// examinada, desde la que continuar. Devuelve ErrRevisionCompactada si
+// alguno de los cambios pedidos ya se ha descartado.
+func (s *BboltStore) leerCambios(namespace string, prefix []byte, desde uint64) ([]Change, uint64, error) {
+	var cambios []Change
+	leida := desde
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if desde < compactadoTx(tx, namespace) {
+			return ErrRevisionCompactada
+		}
+		b := tx.Bucket([]byte(prefijoCambios + namespace))
+		if b == nil {
+			return nil // todavía no hay cambios
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(binary.BigEndian.AppendUint64(nil, desde+1)); k != nil; k, v = c.Next() {
+			leida = binary.BigEndian.Uint64(k)
+			var cambio Change
+			if err := json.Unmarshal(v, &cambio); err != nil {
+				return fmt.Errorf("revisión %d del registro de cambios: %v", leida, err)
+			}
+			if !bytes.HasPrefix(cambio.Key, prefix) {
+				continue
+			}
+			cambio.Namespace = namespace
+			cambio.Revision = leida
+			cambios = append(cambios, cambio)
+			if len(cambios) == loteCambios {
+				break
+			}
+		}
+		return nil
+	})
+	return cambios, leida, err
+}
+
+// Revision devuelve la revisión del último cambio registrado (0 si no hay
+// ninguno).
+func (s *BboltStore) Revision() (uint64, error) {
+	var revision uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(namespaceRevision)); b != nil {
+			revision = b.Sequence()
+		}
+		return nil
+	})
+	return revision, err
+}
+
 // Dump imprime todo el contenido de la base de datos bbolt para propósitos de depuración.
 func (s *BboltStore) Dump() error {
 	err := s.db.View(func(tx *bbolt.Tx) error {
@@ -0,0 +1,376 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// abrirBbolt abre un BboltStore en la ruta dada; cerrarlo queda a cargo
+// del test.
+func abrirBbolt(t *testing.T, ruta string) *BboltStore {
+	t.Helper()
+	s, err := NewBboltStore(ruta)
+	if err != nil {
+		t.Fatalf("NewBboltStore(%q) error = %v", ruta, err)
+	}
+	return s
+}
+
+// nuevoBbolt abre un BboltStore en un directorio temporal que se cierra y
+// se borra al terminar el test.
+func nuevoBbolt(t *testing.T) *BboltStore {
+	t.Helper()
+	s := abrirBbolt(t, filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// recibirCambio espera un cambio del canal; falla si se cierra o tarda.
+func recibirCambio(t *testing.T, canal <-chan Change) Change {
+	t.Helper()
+	select {
+	case cambio, ok := <-canal:
+		if !ok {
+			t.Fatal("el canal se ha cerrado")
+		}
+		return cambio
+	case <-time.After(2 * time.Second):
+		t.Fatal("no ha llegado ningún cambio")
+	}
+	return Change{}
+}
+
+// esperarCierre falla si el canal no se cierra pronto.
+func esperarCierre(t *testing.T, canal <-chan Change) {
+	t.Helper()
+	limite := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-canal:
+			if !ok {
+				return
+			}
+		case <-limite:
+			t.Fatal("el canal no se ha cerrado")
+		}
+	}
+}
+
+func TestWatchFiltraYOrdena(t *testing.T) {
+	s := nuevoBbolt(t)
+	s.Put("P", []byte("a1"), []byte("uno"))
+	s.Put("Q", []byte("a2"), []byte("otro namespace"))
+	s.Put("P", []byte("b1"), []byte("otro prefijo"))
+	s.Put("__interno", []byte("a3"), []byte("sin registro"))
+
+	canal, cancelar, err := s.Watch("P", []byte("a"), 0)
+	if err != nil {
+		t.Fatalf("Watch error = %v", err)
+	}
+	defer cancelar()
+
+	if c := recibirCambio(t, canal); string(c.Key) != "a1" || c.Namespace != "P" || c.Revision != 1 || c.Delete {
+		t.Errorf("primer cambio = %+v, want a1 en P con revisión 1", c)
+	}
+	s.Delete("P", []byte("no-existe"))
+	s.Batch([]Op{
+		{Namespace: "P", Key: []byte("a4"), Value: []byte("cuatro")},
+		{Namespace: "P", Key: []byte("a1"), Delete: true},
+	})
+	c1 := recibirCambio(t, canal)
+	c2 := recibirCambio(t, canal)
+	if string(c1.Key) != "a4" || c1.Delete {
+		t.Errorf("segundo cambio = %+v, want escritura de a4", c1)
+	}
+	if string(c2.Key) != "a1" || !c2.Delete || c2.Revision != c1.Revision+1 {
+		t.Errorf("tercer cambio = %+v, want borrado de a1 con revisión %d", c2, c1.Revision+1)
+	}
+	if rev, _ := s.Revision(); rev != c2.Revision {
+		t.Errorf("Revision() = %d, want %d", rev, c2.Revision)
+	}
+}
+
+func TestWatchNoGuardaValores(t *testing.T) {
+	s := nuevoBbolt(t)
+	s.Put("Usuarios", []byte("ana"), []byte("secreto"))
+
+	volcado, _, err := s.Scan(prefijoCambios+"Usuarios", nil, nil, 0)
+	if err != nil || len(volcado) != 1 {
+		t.Fatalf("registro de Usuarios = %v, %v; want una entrada", volcado, err)
+	}
+	if bytes.Contains(volcado[0].Value, []byte("secreto")) {
+		t.Errorf("el registro de cambios guarda el valor: %s", volcado[0].Value)
+	}
+}
+
+func TestWatchReanudaTrasReinicio(t *testing.T) {
+	ruta := filepath.Join(t.TempDir(), "test.db")
+	s := abrirBbolt(t, ruta)
+	s.Put("P", []byte("k"), []byte("0"))
+	desde, _ := s.Revision()
+	for i := 0; i < 3*loteCambios; i++ {
+		s.Put("P", []byte("k"), []byte{byte(i)})
+	}
+	s.Close()
+
+	s = abrirBbolt(t, ruta)
+	defer s.Close()
+	canal, cancelar, err := s.Watch("P", nil, desde)
+	if err != nil {
+		t.Fatalf("Watch error = %v", err)
+	}
+	defer cancelar()
+	for i := 0; i < 3*loteCambios; i++ {
+		if c := recibirCambio(t, canal); c.Revision != desde+uint64(i)+1 {
+			t.Fatalf("cambio %d con revisión %d, want %d", i, c.Revision, desde+uint64(i)+1)
+		}
+	}
+	s.Put("P", []byte("nuevo"), []byte("x"))
+	if c := recibirCambio(t, canal); string(c.Key) != "nuevo" {
+		t.Errorf("cambio tras reanudar = %+v, want nuevo", c)
+	}
+}
+
+func TestWatchCancelar(t *testing.T) {
+	s := nuevoBbolt(t)
+	canal, cancelar, err := s.Watch("P", nil, 0)
+	if err != nil {
+		t.Fatalf("Watch error = %v", err)
+	}
+	cancelar()
+	cancelar() // cancelar dos veces no debe fallar
+	esperarCierre(t, canal)
+	if err := s.Put("P", []byte("k"), []byte("v")); err != nil {
+		t.Errorf("Put tras cancelar error = %v", err)
+	}
+}
+
+func TestWatchClose(t *testing.T) {
+	s := abrirBbolt(t, filepath.Join(t.TempDir(), "test.db"))
+	canal, cancelar, err := s.Watch("P", nil, 0)
+	if err != nil {
+		t.Fatalf("Watch error = %v", err)
+	}
+	defer cancelar()
+	s.Close()
+	esperarCierre(t, canal)
+	if _, _, err := s.Watch("P", nil, 0); !errors.Is(err, ErrStoreCerrado) {
+		t.Errorf("Watch tras Close error = %v, want ErrStoreCerrado", err)
+	}
+}
+
+func TestWatchCompactado(t *testing.T) {
+	s := nuevoBbolt(t)
+	s.retencion = 5
+	for i := 0; i < 8; i++ {
+		s.Put("P", []byte("k"), []byte{byte(i)})
+	}
+	s.Put("Q", []byte("k"), []byte("otro namespace"))
+
+	if _, _, err := s.Watch("P", nil, 2); !errors.Is(err, ErrRevisionCompactada) {
+		t.Errorf("Watch desde 2 error = %v, want ErrRevisionCompactada", err)
+	}
+	if _, _, err := s.Watch("Q", nil, 0); err != nil {
+		t.Errorf("Watch sobre otro namespace error = %v", err)
+	}
+	canal, cancelar, err := s.Watch("P", nil, 3)
+	if err != nil {
+		t.Fatalf("Watch desde 3 error = %v", err)
+	}
+	defer cancelar()
+	for rev := uint64(4); rev <= 8; rev++ {
+		if c := recibirCambio(t, canal); c.Revision != rev {
+			t.Fatalf("revisión %d, want %d", c.Revision, rev)
+		}
+	}
+}
+
+// clavesDe devuelve las claves de los pares como strings.
+func clavesDe(pares []KV) []string {
+	claves := []string{}
+	for _, par := range pares {
+		claves = append(claves, string(par.Key))
+	}
+	return claves
+}
+
+func TestScanLimitesDePrefijo(t *testing.T) {
+	s := nuevoBbolt(t)
+	for _, clave := range []string{"a", "b", "b\x00", "b1", "b2", "b\xff", "c", "\xff", "\xff\xff"} {
+		s.Put("N", []byte(clave), []byte("v"))
+	}
+
+	tests := []struct {
+		name    string
+		reverse bool
+		start   string
+		prefix  string
+		want    []string
+	}{
+		{"Todo", false, "", "", []string{"a", "b", "b\x00", "b1", "b2", "b\xff", "c", "\xff", "\xff\xff"}},
+		{"Prefijo", false, "", "b", []string{"b", "b\x00", "b1", "b2", "b\xff"}},
+		{"Start antes del prefijo", false, "a", "b", []string{"b", "b\x00", "b1", "b2", "b\xff"}},
+		{"Start dentro del prefijo", false, "b1", "b", []string{"b1", "b2", "b\xff"}},
+		{"Start tras el prefijo", false, "c", "b", []string{}},
+		{"Prefijo 0xff", false, "", "\xff", []string{"\xff", "\xff\xff"}},
+		{"Sin coincidencias", false, "", "z", []string{}},
+		{"Inverso todo", true, "", "", []string{"\xff\xff", "\xff", "c", "b\xff", "b2", "b1", "b\x00", "b", "a"}},
+		{"Inverso prefijo", true, "", "b", []string{"b\xff", "b2", "b1", "b\x00", "b"}},
+		{"Inverso start existente", true, "b1", "b", []string{"b1", "b\x00", "b"}},
+		{"Inverso start inexistente", true, "b15", "b", []string{"b1", "b\x00", "b"}},
+		{"Inverso start tras el último", true, "zz", "", []string{"c", "b\xff", "b2", "b1", "b\x00", "b", "a"}},
+		{"Inverso prefijo 0xff", true, "", "\xff", []string{"\xff\xff", "\xff"}},
+		{"Inverso sin coincidencias", true, "", "bz", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var start []byte
+			if tt.start != "" {
+				start = []byte(tt.start)
+			}
+			scan := s.Scan
+			if tt.reverse {
+				scan = s.ScanReverse
+			}
+			pares, siguiente, err := scan("N", start, []byte(tt.prefix), 0)
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if got := clavesDe(pares); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("claves = %q, want %q", got, tt.want)
+			}
+			if siguiente != nil {
+				t.Errorf("siguiente = %q, want nil", siguiente)
+			}
+		})
+	}
+}
+
+func TestScanPaginado(t *testing.T) {
+	s := nuevoBbolt(t)
+	for _, clave := range []string{"a", "b1", "b2", "b3", "b4", "b5", "c"} {
+		s.Put("N", []byte(clave), []byte("v"))
+	}
+
+	for _, reverse := range []bool{false, true} {
+		scan := s.Scan
+		want := []string{"b1", "b2", "b3", "b4", "b5"}
+		if reverse {
+			scan = s.ScanReverse
+			want = []string{"b5", "b4", "b3", "b2", "b1"}
+		}
+		var got []string
+		var start []byte
+		for paginas := 0; ; paginas++ {
+			if paginas > len(want) {
+				t.Fatalf("reverse=%v: la paginación no termina", reverse)
+			}
+			pares, siguiente, err := scan("N", start, []byte("b"), 2)
+			if err != nil {
+				t.Fatalf("reverse=%v: error = %v", reverse, err)
+			}
+			got = append(got, clavesDe(pares)...)
+			if siguiente == nil {
+				break
+			}
+			start = siguiente
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("reverse=%v: claves = %q, want %q", reverse, got, want)
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s := nuevoBbolt(t)
+	if err := s.CompareAndSwap("N", []byte("k"), 1, []byte("v")); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("crear con versión 1 error = %v, want ErrVersionConflict", err)
+	}
+	if err := s.CompareAndSwap("N", []byte("k"), 0, []byte("v1")); err != nil {
+		t.Fatalf("crear con versión 0 error = %v", err)
+	}
+	if err := s.CompareAndSwap("N", []byte("k"), 0, []byte("otra")); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("crear de nuevo error = %v, want ErrVersionConflict", err)
+	}
+	_, version, err := s.GetWithVersion("N", []byte("k"))
+	if err != nil || version != 1 {
+		t.Fatalf("GetWithVersion = %d, %v; want 1", version, err)
+	}
+	if err := s.CompareAndSwap("N", []byte("k"), 1, []byte("v2")); err != nil {
+		t.Fatalf("actualizar con versión 1 error = %v", err)
+	}
+	if err := s.CompareAndSwap("N", []byte("k"), 1, []byte("perdida")); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("actualizar con versión antigua error = %v, want ErrVersionConflict", err)
+	}
+	if valor, version, _ := s.GetWithVersion("N", []byte("k")); string(valor) != "v2" || version != 2 {
+		t.Errorf("GetWithVersion = %q, %d; want v2, 2", valor, version)
+	}
+
+	// Borrar reinicia la versión
+	s.Delete("N", []byte("k"))
+	if err := s.CompareAndSwap("N", []byte("k"), 0, []byte("v")); err != nil {
+		t.Errorf("crear tras borrar error = %v", err)
+	}
+}
+
+func TestBatchConflictoNoAplicaNada(t *testing.T) {
+	s := nuevoBbolt(t)
+	s.Put("N", []byte("a"), []byte("a1"))
+	s.Put("N", []byte("b"), []byte("b1"))
+
+	err := s.Batch([]Op{
+		{Namespace: "N", Key: []byte("a"), Value: []byte("a2"), CheckVersion: true, Version: 1},
+		{Namespace: "N", Key: []byte("c"), Value: []byte("c1")},
+		{Namespace: "N", Key: []byte("b"), Delete: true, CheckVersion: true, Version: 5},
+	})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Batch error = %v, want ErrVersionConflict", err)
+	}
+	if valor, version, _ := s.GetWithVersion("N", []byte("a")); string(valor) != "a1" || version != 1 {
+		t.Errorf("a = %q versión %d, want a1 versión 1", valor, version)
+	}
+	if _, err := s.Get("N", []byte("b")); err != nil {
+		t.Errorf("b se ha borrado: %v", err)
+	}
+	if _, err := s.Get("N", []byte("c")); err == nil {
+		t.Error("c se ha guardado")
+	}
+	if rev, _ := s.Revision(); rev != 2 {
+		t.Errorf("Revision() = %d, want 2", rev)
+	}
+}
+
+func TestVersionRegistroAnterior(t *testing.T) {
+	s := nuevoBbolt(t)
+	// Registro escrito antes de que existieran las versiones: sin entrada
+	// en el bucket de versiones
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("N"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("k"), []byte("antiguo"))
+	})
+	if err != nil {
+		t.Fatalf("preparando el registro: %v", err)
+	}
+
+	if _, version, err := s.GetWithVersion("N", []byte("k")); err != nil || version != 1 {
+		t.Fatalf("GetWithVersion = %d, %v; want 1", version, err)
+	}
+	if err := s.CompareAndSwap("N", []byte("k"), 0, []byte("x")); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("CAS con versión 0 error = %v, want ErrVersionConflict", err)
+	}
+	if err := s.CompareAndSwap("N", []byte("k"), 1, []byte("nuevo")); err != nil {
+		t.Fatalf("CAS con versión 1 error = %v", err)
+	}
+	if _, version, _ := s.GetWithVersion("N", []byte("k")); version != 2 {
+		t.Errorf("versión tras actualizar = %d, want 2", version)
+	}
+}
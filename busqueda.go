@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Índices secundarios de pacientes. Cada paciente se indexa bajo los
+// términos normalizados de su nombre y de su apellido, de modo que una
+// consulta por prefijo devuelve los pacientes cuyo nombre o apellido contiene
+// una palabra que empieza por el texto buscado.
+const (
+	indicePacientesNombre   = "nombre"
+	indicePacientesApellido = "apellido"
+)
+
+// Índices secundarios de expedientes.
+const (
+	indiceExpedientesEspecialidad = "especialidad"
+)
+
+// Índice de hospitales y especialidades por nombre.
+const indiceCatalogoNombre = "nombre"
+
+// Tamaño de página por defecto y máximo de las búsquedas.
+const (
+	limiteBusqueda    = 20
+	limiteBusquedaMax = 100
+)
+
+// terminosIndice devuelve los términos bajo los que se indexa un nombre: el
+// texto normalizado a partir de cada una de sus palabras. Así "García López"
+// se encuentra buscando "garc" y también "lop".
+func terminosIndice(texto string) []string {
+	palabras := strings.Fields(normalizarTexto(texto))
+	terminos := make([]string, 0, len(palabras))
+	for i := range palabras {
+		terminos = append(terminos, strings.Join(palabras[i:], " "))
+	}
+	return terminos
+}
+
+// extractorJSON construye un extractor de índice que descodifica el
+// registro como T y devuelve los valores calculados por 'valores'.
+func extractorJSON[T any](valores func(T) []string) store.Extractor {
+	return func(key, value []byte) [][]byte {
+		var registro T
+		if err := json.Unmarshal(value, &registro); err != nil {
+			return nil
+		}
+		var resultado [][]byte
+		for _, valor := range valores(registro) {
+			resultado = append(resultado, []byte(valor))
+		}
+		return resultado
+	}
+}
+
+// declararIndices registra los índices secundarios que mantiene el servidor.
+func declararIndices(db *store.IndexedStore) {
+	db.DeclareIndex("Pacientes", indicePacientesNombre, extractorJSON(func(p Paciente) []string {
+		return terminosIndice(p.Nombre)
+	}))
+	db.DeclareIndex("Pacientes", indicePacientesApellido, extractorJSON(func(p Paciente) []string {
+		return terminosIndice(p.Apellido)
+	}))
+	db.DeclareIndex("Expedientes", indiceExpedientesEspecialidad, extractorJSON(func(e Expediente) []string {
+		return []string{strconv.Itoa(e.Especialidad)}
+	}))
+	db.DeclareIndex("Expedientes", indiceExpedientesPaciente, extractorExpedientePaciente)
+	db.DeclareIndex("CIE10", indiceCIE10Descripcion, extractorJSON(func(c CodigoCIE10) []string {
+		return terminosIndice(c.Descripcion)
+	}))
+	db.DeclareIndex("Recetas", indiceRecetasPaciente, extractorJSON(func(r Receta) []string {
+		return []string{r.Paciente}
+	}))
+	db.DeclareIndex("Citas", indiceCitasMedico, extractorCitaMedico)
+	db.DeclareIndex("Citas", indiceCitasPaciente, extractorCitaPaciente)
+	db.DeclareIndex("Interconsultas", indiceInterconsultasDestino, extractorJSON(func(i Interconsulta) []string {
+		return []string{valorIndiceDestino(i.Especialidad, i.Hospital)}
+	}))
+	db.DeclareIndex("Traslados", indiceTrasladosPaciente, extractorJSON(func(t Traslado) []string {
+		return []string{t.Paciente}
+	}))
+	db.DeclareIndex("Traslados", indiceTrasladosDestino, extractorJSON(func(t Traslado) []string {
+		return []string{strconv.Itoa(t.Destino)}
+	}))
+	db.DeclareIndex("Hospitales", indiceCatalogoNombre, extractorJSON(func(h Hospital) []string {
+		return []string{normalizarTexto(h.Nombre)}
+	}))
+	db.DeclareIndex("Especialidades", indiceCatalogoNombre, extractorJSON(func(e Especialidad) []string {
+		return []string{normalizarTexto(e.Nombre)}
+	}))
+	db.DeclareIndex("Usuarios", indiceUsuariosHospital, extractorJSON(func(u Usuario) []string {
+		return []string{strconv.Itoa(u.Hospital)}
+	}))
+	db.DeclareIndex("Usuarios", indiceUsuariosEspecialidad, extractorJSON(func(u Usuario) []string {
+		return []string{strconv.Itoa(u.Especialidad)}
+	}))
+	db.DeclareIndex("Pacientes", indicePacientesHospital, extractorJSON(func(p Paciente) []string {
+		return []string{strconv.Itoa(p.Hospital)}
+	}))
+	db.DeclareIndex("Expedientes", indiceExpedientesRefrendo, extractorJSON(supervisoresPendientes))
+	db.DeclareIndex("Delegaciones", indiceDelegacionesSupervisor, extractorJSON(func(d Delegacion) []string {
+		return []string{d.Supervisor}
+	}))
+	db.DeclareIndex("Delegaciones", indiceDelegacionesResidente, extractorJSON(func(d Delegacion) []string {
+		return []string{d.Residente}
+	}))
+}
+
+// buscarEnIndice devuelve el conjunto de pacientes con algún término que
+// empiece por el prefijo buscado.
+func (s *server) buscarEnIndice(indice, prefijo string) (map[string]bool, error) {
+	claves, err := s.indices.QueryPrefix("Pacientes", indice, []byte(normalizarTexto(prefijo)))
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(claves))
+	for _, clave := range claves {
+		ids[string(clave)] = true
+	}
+	return ids, nil
+}
+
+// buscarPacientes busca pacientes por prefijo de nombre y/o apellido, sin
+// distinguir mayúsculas ni tildes, con filtros opcionales por fecha de
+// nacimiento y hospital. Los resultados se devuelven paginados.
+func (s *server) buscarPacientes(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if normalizarTexto(req.Nombre) == "" && normalizarTexto(req.Apellido) == "" {
+		return api.Response{Success: -1, Message: "Indique al menos el comienzo del nombre o del apellido"}
+	}
+
+	// Intersección de los pacientes encontrados en cada índice
+	var candidatos map[string]bool
+	for _, busqueda := range []struct{ indice, prefijo string }{
+		{indicePacientesNombre, req.Nombre},
+		{indicePacientesApellido, req.Apellido},
+	} {
+		if normalizarTexto(busqueda.prefijo) == "" {
+			continue
+		}
+		ids, err := s.buscarEnIndice(busqueda.indice, busqueda.prefijo)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al consultar los índices de pacientes"}
+		}
+		if candidatos == nil {
+			candidatos = ids
+			continue
+		}
+		for id := range candidatos {
+			if !ids[id] {
+				delete(candidatos, id)
+			}
+		}
+	}
+
+	var pacientes []Paciente
+	for id := range candidatos {
+		paciente, err := s.obtenerPaciente(id)
+		if err != nil {
+			continue
+		}
+		if req.Fecha != "" && paciente.Fecha_nacimiento != req.Fecha {
+			continue
+		}
+		if req.Hospital != 0 && paciente.Hospital != req.Hospital {
+			continue
+		}
+		if permitido, err := s.puedeVerPaciente(req.Username, paciente); err != nil || !permitido {
+			continue
+		}
+		pacientes = append(pacientes, paciente)
+	}
+	sort.Slice(pacientes, func(i, j int) bool {
+		a, b := pacientes[i], pacientes[j]
+		if normalizarTexto(a.Apellido) != normalizarTexto(b.Apellido) {
+			return normalizarTexto(a.Apellido) < normalizarTexto(b.Apellido)
+		}
+		if normalizarTexto(a.Nombre) != normalizarTexto(b.Nombre) {
+			return normalizarTexto(a.Nombre) < normalizarTexto(b.Nombre)
+		}
+		return a.ID < b.ID
+	})
+
+	limite := req.Limite
+	if limite <= 0 {
+		limite = limiteBusqueda
+	}
+	limite = min(limite, limiteBusquedaMax)
+	pagina := max(req.Pagina, 1)
+	inicio := min((pagina-1)*limite, len(pacientes))
+	fin := min(inicio+limite, len(pacientes))
+
+	var resultados [][]byte
+	for _, paciente := range pacientes[inicio:fin] {
+		pacienteJson, err := json.Marshal(paciente)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir el paciente a json"}
+		}
+		resultados = append(resultados, pacienteJson)
+	}
+
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("%d pacientes encontrados", len(pacientes)),
+		Registros: resultados,
+		Total:     len(pacientes),
+	}
+}
+
+// reconstruirIndices vuelve a generar todos los índices secundarios a partir
+// de los registros almacenados. Solo puede usarlo un administrador.
+func (s *server) reconstruirIndices(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return api.Response{Success: -1, Message: "Solo un administrador puede reconstruir los índices"}
+	}
+
+	if err := s.migrarIndices(); err != nil {
+		s.log.Printf("Error reconstruyendo índices: %v", err)
+		return api.Response{Success: -1, Message: "Error al reconstruir los índices"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionReconstruirIndices, "índices secundarios reconstruidos")
+
+	return api.Response{Success: 1, Message: "Índices reconstruidos"}
+}
+
+// migrarIndices construye los índices de todos los namespaces indexados a
+// partir de los registros existentes.
+func (s *server) migrarIndices() error {
+	for _, namespace := range s.indices.Namespaces() {
+		if err := s.indices.Rebuild(namespace); err != nil {
+			return fmt.Errorf("%s: %v", namespace, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Índices para comprobar si un hospital o una especialidad están en uso
+// antes de borrarlos.
+const (
+	indiceUsuariosHospital     = "hospital"
+	indiceUsuariosEspecialidad = "especialidad"
+	indicePacientesHospital    = "hospital"
+)
+
+// EntradaCatalogo es un hospital o una especialidad tal y como se devuelve
+// en los listados.
+type EntradaCatalogo struct {
+	ID     int    `json:"id"`
+	Nombre string `json:"nombre"`
+}
+
+// catalogo describe uno de los catálogos administrables. Los identificadores
+// se toman de un contador propio y no se reutilizan al borrar, así que los
+// usuarios, pacientes y expedientes que los guardan nunca pasan a apuntar a
+// otra entrada.
+type catalogo struct {
+	namespace string
+	singular  string // para los mensajes: "hospital", "especialidad"
+	articulo  string // "el hospital", "la especialidad"
+	// enUso devuelve una descripción de lo que aún referencia la entrada, o
+	// "" si puede borrarse.
+	enUso func(s *server, id int) (string, error)
+}
+
+var (
+	catalogoHospitales = catalogo{
+		namespace: "Hospitales",
+		singular:  "hospital",
+		articulo:  "el hospital",
+		enUso: func(s *server, id int) (string, error) {
+			return s.referencias(id, []referenciaCatalogo{
+				{"Usuarios", indiceUsuariosHospital, "usuarios"},
+				{"Pacientes", indicePacientesHospital, "pacientes"},
+			})
+		},
+	}
+	catalogoEspecialidades = catalogo{
+		namespace: "Especialidades",
+		singular:  "especialidad",
+		articulo:  "la especialidad",
+		enUso: func(s *server, id int) (string, error) {
+			return s.referencias(id, []referenciaCatalogo{
+				{"Usuarios", indiceUsuariosEspecialidad, "usuarios"},
+				{"Expedientes", indiceExpedientesEspecialidad, "expedientes"},
+			})
+		},
+	}
+)
+
+// referenciaCatalogo es un índice cuyos registros apuntan a una entrada de
+// catálogo por su identificador.
+type referenciaCatalogo struct {
+	namespace, indice, descripcion string
+}
+
+// referencias cuenta los registros que apuntan a la entrada 'id' en cada uno
+// de los índices y los describe, p. ej. "3 usuarios, 10 pacientes".
+func (s *server) referencias(id int, referencias []referenciaCatalogo) (string, error) {
+	var usos []string
+	for _, referencia := range referencias {
+		claves, err := s.indices.Query(referencia.namespace, referencia.indice, []byte(strconv.Itoa(id)))
+		if err != nil {
+			return "", err
+		}
+		if len(claves) > 0 {
+			usos = append(usos, fmt.Sprintf("%d %s", len(claves), referencia.descripcion))
+		}
+	}
+	return strings.Join(usos, ", "), nil
+}
+
+// obtenerIdCatalogo devuelve el identificador de la entrada del catálogo
+// con ese nombre, o -1 si no existe.
+func (s *server) obtenerIdCatalogo(namespace, nombre string) int {
+	claves, err := s.indices.Query(namespace, indiceCatalogoNombre, []byte(normalizarTexto(nombre)))
+	if err != nil || len(claves) == 0 {
+		return -1
+	}
+	id, err := strconv.Atoi(string(claves[0]))
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// existeEnCatalogo indica si el catálogo tiene la entrada 'id'.
+func (s *server) existeEnCatalogo(namespace string, id int) bool {
+	_, err := s.db.Get(namespace, []byte(strconv.Itoa(id)))
+	return err == nil
+}
+
+// catalogoVacio indica si el catálogo aún no tiene ninguna entrada.
+func (s *server) catalogoVacio(namespace string) bool {
+	claves, err := s.db.ListKeys(namespace)
+	return noEncontrado(err) || (err == nil && len(claves) == 0)
+}
+
+// entradasCatalogo devuelve las entradas del catálogo ordenadas por nombre.
+func (s *server) entradasCatalogo(namespace string) ([]EntradaCatalogo, error) {
+	claves, err := s.db.ListKeys(namespace)
+	if noEncontrado(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entradas []EntradaCatalogo
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		valor, err := s.db.Get(namespace, clave)
+		if err != nil {
+			return nil, err
+		}
+		entrada := EntradaCatalogo{ID: id}
+		if err := json.Unmarshal(valor, &entrada); err != nil {
+			return nil, err
+		}
+		entrada.ID = id
+		entradas = append(entradas, entrada)
+	}
+	sort.Slice(entradas, func(i, j int) bool {
+		return normalizarTexto(entradas[i].Nombre) < normalizarTexto(entradas[j].Nombre)
+	})
+	return entradas, nil
+}
+
+// codificarCatalogo devuelve en json las entradas del catálogo.
+func (s *server) codificarCatalogo(namespace string) ([][]byte, error) {
+	entradas, err := s.entradasCatalogo(namespace)
+	if err != nil {
+		return nil, err
+	}
+	var registros [][]byte
+	for _, entrada := range entradas {
+		entradaJson, err := json.Marshal(entrada)
+		if err != nil {
+			return nil, err
+		}
+		registros = append(registros, entradaJson)
+	}
+	return registros, nil
+}
+
+// listCatalogs devuelve los hospitales y las especialidades. No requiere
+// sesión: el cliente lo usa para mostrar los nombres al registrarse.
+func (s *server) listCatalogs(req api.Request) api.Response {
+	hospitales, err := s.codificarCatalogo(catalogoHospitales.namespace)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los hospitales"}
+	}
+	especialidades, err := s.codificarCatalogo(catalogoEspecialidades.namespace)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las especialidades"}
+	}
+	return api.Response{
+		Success:        1,
+		Message:        fmt.Sprintf("%d hospitales y %d especialidades", len(hospitales), len(especialidades)),
+		Hospitales:     hospitales,
+		Especialidades: especialidades,
+	}
+}
+
+// comprobarAdminCatalogo valida la sesión y que el usuario sea
+// administrador. Devuelve nil si puede modificar los catálogos.
+func (s *server) comprobarAdminCatalogo(req api.Request) *api.Response {
+	if !s.isTokenValid(req.Token, req.Username) {
+		return &api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return &api.Response{Success: -1, Message: "Solo un administrador puede modificar los catálogos"}
+	}
+	return nil
+}
+
+// guardarEntrada escribe la entrada del catálogo. Si es nueva (version 0)
+// falla si la clave ya existe.
+func (s *server) guardarEntrada(namespace string, id int, nombre string, version uint64) error {
+	valor, err := json.Marshal(EntradaCatalogo{ID: id, Nombre: nombre})
+	if err != nil {
+		return err
+	}
+	return s.db.Batch([]store.Op{{Namespace: namespace, Key: []byte(strconv.Itoa(id)), Value: valor, CheckVersion: true, Version: version}})
+}
+
+// crearEntrada añade al catálogo una entrada con el nombre req.Nombre, que
+// no puede repetirse.
+func (s *server) crearEntrada(cat catalogo, accion string, req api.Request) api.Response {
+	nombre := strings.TrimSpace(req.Nombre)
+	if req.Username == "" || req.Token.Value == "" || nombre == "" {
+		return api.Response{Success: -1, Message: "Indique el nombre"}
+	}
+	if res := s.comprobarAdminCatalogo(req); res != nil {
+		return *res
+	}
+	if otro := s.obtenerIdCatalogo(cat.namespace, nombre); otro != -1 {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Ya existe %s %d con ese nombre", cat.articulo, otro)}
+	}
+
+	// El contador puede ir por detrás si se añadieron entradas a mano:
+	// saltamos las claves ocupadas
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		id, err := s.siguienteSecuencia(cat.namespace)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al generar el identificador"}
+		}
+		err = s.guardarEntrada(cat.namespace, id, nombre, 0)
+		if errors.Is(err, store.ErrVersionConflict) {
+			continue
+		}
+		if err != nil {
+			return api.Response{Success: -1, Message: fmt.Sprintf("Error al guardar %s", cat.articulo)}
+		}
+		s.registrarAuditoria(req.Username, accion, fmt.Sprintf("%s %d: alta (%s)", cat.singular, id, nombre))
+		return api.Response{Success: 1, Message: fmt.Sprintf("Se ha creado %s %d: %s", cat.articulo, id, nombre), Total: id}
+	}
+	return api.Response{Success: -1, Message: "Error al generar el identificador"}
+}
+
+// renombrarEntrada cambia el nombre de la entrada req.ID del catálogo. El
+// identificador no cambia.
+func (s *server) renombrarEntrada(cat catalogo, accion string, req api.Request) api.Response {
+	nombre := strings.TrimSpace(req.Nombre)
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || nombre == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (identificador y nuevo nombre)"}
+	}
+	if res := s.comprobarAdminCatalogo(req); res != nil {
+		return *res
+	}
+	anterior, version, err := s.db.GetWithVersion(cat.namespace, []byte(strconv.Itoa(req.ID)))
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe %s %d", cat.articulo, req.ID)}
+	}
+	if otro := s.obtenerIdCatalogo(cat.namespace, nombre); otro != -1 && otro != req.ID {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Ya existe %s %d con ese nombre", cat.articulo, otro)}
+	}
+	var entrada EntradaCatalogo
+	if err := json.Unmarshal(anterior, &entrada); err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No se puede leer %s %d", cat.articulo, req.ID)}
+	}
+
+	err = s.guardarEntrada(cat.namespace, req.ID, nombre, version)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "El catálogo acaba de ser modificado por otro administrador; vuelva a consultarlo"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Error al guardar %s", cat.articulo)}
+	}
+	s.registrarAuditoria(req.Username, accion, fmt.Sprintf("%s %d: nombre %s -> %s", cat.singular, req.ID, entrada.Nombre, nombre))
+	return api.Response{Success: 1, Message: fmt.Sprintf("Se ha renombrado %s %d a %s", cat.articulo, req.ID, nombre)}
+}
+
+// borrarEntrada elimina la entrada req.ID del catálogo si nada la
+// referencia.
+func (s *server) borrarEntrada(cat catalogo, accion string, req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Falta el identificador a borrar"}
+	}
+	if res := s.comprobarAdminCatalogo(req); res != nil {
+		return *res
+	}
+	anterior, err := s.db.Get(cat.namespace, []byte(strconv.Itoa(req.ID)))
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe %s %d", cat.articulo, req.ID)}
+	}
+	usos, err := cat.enUso(s, req.ID)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Error al comprobar si se usa %s", cat.articulo)}
+	}
+	if usos != "" {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No se puede borrar %s %d porque está en uso (%s)", cat.articulo, req.ID, usos)}
+	}
+	var entrada EntradaCatalogo
+	if err := json.Unmarshal(anterior, &entrada); err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No se puede leer %s %d", cat.articulo, req.ID)}
+	}
+
+	if err := s.db.Delete(cat.namespace, []byte(strconv.Itoa(req.ID))); err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Error al borrar %s", cat.articulo)}
+	}
+	s.registrarAuditoria(req.Username, accion, fmt.Sprintf("%s %d: baja (%s)", cat.singular, req.ID, entrada.Nombre))
+	return api.Response{Success: 1, Message: fmt.Sprintf("Se ha borrado %s %d (%s)", cat.articulo, req.ID, entrada.Nombre)}
+}
+
+// comprobarCatalogosUsuario comprueba que el hospital y la especialidad de
+// un usuario existan. Mientras un catálogo está vacío sólo se admite el
+// primer usuario, al que se nombra administrador para que dé de alta los
+// catálogos.
+func (s *server) comprobarCatalogosUsuario(hospital, especialidad int, primero bool) error {
+	for _, comprobacion := range []struct {
+		cat catalogo
+		id  int
+	}{{catalogoHospitales, hospital}, {catalogoEspecialidades, especialidad}} {
+		if s.existeEnCatalogo(comprobacion.cat.namespace, comprobacion.id) {
+			continue
+		}
+		if primero && s.catalogoVacio(comprobacion.cat.namespace) {
+			continue
+		}
+		return fmt.Errorf("No existe %s %d", comprobacion.cat.articulo, comprobacion.id)
+	}
+	return nil
+}
+
+// migrarIndicesCatalogos construye los índices con los que se comprueba si
+// un hospital o una especialidad están en uso.
+func (s *server) migrarIndicesCatalogos() error {
+	for _, namespace := range []string{"Usuarios", "Pacientes"} {
+		if err := s.indices.Rebuild(namespace); err != nil {
+			return fmt.Errorf("%s: %v", namespace, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+	"prac/pkg/validation"
+)
+
+// rutaCatalogoCIE10 es el catálogo de códigos CIE-10 que se distribuye con
+// el servidor (CSV separado por ';' con las columnas codigo y descripcion).
+const rutaCatalogoCIE10 = "data/cie10.csv"
+
+// Índice del catálogo CIE-10 por los términos de la descripción.
+const indiceCIE10Descripcion = "descripcion"
+
+// Número máximo de códigos devueltos por una búsqueda en el catálogo.
+const limiteBusquedaCIE10 = 20
+
+// CodigoCIE10 es una entrada del catálogo CIE-10. Los diagnósticos
+// codificados de las observaciones guardan también la descripción para que
+// las estadísticas no dependan del catálogo cargado.
+type CodigoCIE10 struct {
+	Codigo      string `json:"codigo"`
+	Descripcion string `json:"descripcion"`
+}
+
+// cargarCatalogoCIE10 lee el catálogo y lo guarda en el namespace 'CIE10'.
+// Se ejecuta en cada arranque, de modo que las actualizaciones del fichero
+// se aplican al reiniciar el servidor.
+func (s *server) cargarCatalogoCIE10(ruta string) error {
+	fichero, err := os.Open(ruta)
+	if err != nil {
+		return err
+	}
+	defer fichero.Close()
+
+	lector := csv.NewReader(fichero)
+	lector.Comma = ';'
+	lector.FieldsPerRecord = 2
+	if _, err := lector.Read(); err != nil { // cabecera
+		return fmt.Errorf("%s: %v", ruta, err)
+	}
+
+	var ops []store.Op
+	for {
+		fila, err := lector.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", ruta, err)
+		}
+		codigo := CodigoCIE10{Codigo: validation.NormalizarCIE10(fila[0]), Descripcion: fila[1]}
+		if err := validation.ValidarCIE10(codigo.Codigo); err != nil {
+			s.log.Printf("Catálogo CIE-10: se ignora la entrada %q: %v", fila[0], err)
+			continue
+		}
+		codigoJson, err := json.Marshal(codigo)
+		if err != nil {
+			return err
+		}
+		if actual, err := s.db.Get("CIE10", []byte(codigo.Codigo)); err == nil && bytes.Equal(actual, codigoJson) {
+			continue // sin cambios desde la última carga
+		}
+		ops = append(ops, store.Op{Namespace: "CIE10", Key: []byte(codigo.Codigo), Value: codigoJson})
+	}
+	if err := s.db.Batch(ops); err != nil {
+		return err
+	}
+	s.log.Printf("Catálogo CIE-10 cargado: %d códigos nuevos o modificados", len(ops))
+	return nil
+}
+
+// diagnosticosCodificados valida los códigos CIE-10 recibidos y devuelve las
+// entradas del catálogo correspondientes. Los errores se devuelven al
+// usuario tal cual.
+func (s *server) diagnosticosCodificados(codigos []string) ([]CodigoCIE10, error) {
+	var diagnosticos []CodigoCIE10
+	for _, codigo := range codigos {
+		codigo = validation.NormalizarCIE10(codigo)
+		if err := validation.ValidarCIE10(codigo); err != nil {
+			return nil, err
+		}
+		entradaJson, err := s.db.Get("CIE10", []byte(codigo))
+		if noEncontrado(err) {
+			return nil, fmt.Errorf("el código %s no está en el catálogo CIE-10", codigo)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error al consultar el catálogo CIE-10")
+		}
+		var entrada CodigoCIE10
+		if err := json.Unmarshal(entradaJson, &entrada); err != nil {
+			return nil, fmt.Errorf("error al consultar el catálogo CIE-10")
+		}
+		diagnosticos = append(diagnosticos, entrada)
+	}
+	return diagnosticos, nil
+}
+
+// buscarCIE10 busca en el catálogo los códigos que empiezan por la consulta
+// y los que tienen alguna palabra de la descripción que empieza por ella,
+// para autocompletar diagnósticos en el cliente.
+func (s *server) buscarCIE10(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Consulta == "" {
+		return api.Response{Success: -1, Message: "Indique el código o el texto a buscar"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	vistos := make(map[string]bool)
+	var claves [][]byte
+
+	// Por código: "j45" encuentra J45, J45.0, J45.9...
+	porCodigo, _, err := s.db.Scan("CIE10", nil, []byte(validation.NormalizarCIE10(req.Consulta)), limiteBusquedaCIE10)
+	if err != nil && !noEncontrado(err) {
+		return api.Response{Success: -1, Message: "Error al consultar el catálogo CIE-10"}
+	}
+	for _, kv := range porCodigo {
+		vistos[string(kv.Key)] = true
+		claves = append(claves, kv.Key)
+	}
+
+	// Por descripción: "asma" encuentra J45.9
+	if termino := normalizarTexto(req.Consulta); termino != "" {
+		porDescripcion, err := s.indices.QueryPrefix("CIE10", indiceCIE10Descripcion, []byte(termino))
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al consultar el catálogo CIE-10"}
+		}
+		for _, clave := range porDescripcion {
+			if !vistos[string(clave)] {
+				vistos[string(clave)] = true
+				claves = append(claves, clave)
+			}
+		}
+	}
+
+	var resultados [][]byte
+	for _, clave := range claves[:min(len(claves), limiteBusquedaCIE10)] {
+		entradaJson, err := s.db.Get("CIE10", clave)
+		if err != nil {
+			continue
+		}
+		resultados = append(resultados, entradaJson)
+	}
+
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("%d códigos encontrados", len(claves)),
+		Registros: resultados,
+		Total:     len(claves),
+	}
+}
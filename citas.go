@@ -0,0 +1,448 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// formatoCita es el formato de las horas de las citas, en hora local. Con
+// anchura fija, el orden alfabético coincide con el cronológico.
+const formatoCita = "2006-01-02 15:04"
+
+// Índices de citas por médico (bajo "medico\x00inicio", para recorrer la
+// agenda de un día en orden) y por paciente.
+const (
+	indiceCitasMedico   = "medico"
+	indiceCitasPaciente = "paciente"
+)
+
+// Límites al publicar huecos.
+const (
+	duracionMinimaHueco = 5   // minutos
+	duracionMaximaHueco = 240 // minutos
+	maxHuecosPublicados = 100 // por petición
+)
+
+// Estados de una cita.
+const (
+	estadoCitaLibre     = "libre"
+	estadoCitaReservada = "reservada"
+)
+
+// Cita es un hueco de la agenda de un médico en un hospital, libre o
+// reservado para un paciente.
+type Cita struct {
+	ID              int    `json:"id"`
+	Medico          string `json:"medico"`
+	Hospital        int    `json:"hospital"`
+	Inicio          string `json:"inicio"` //AAAA-MM-DD HH:MM
+	Fin             string `json:"fin"`
+	Estado          string `json:"estado"`
+	Paciente        string `json:"paciente,omitempty"`
+	Motivo          string `json:"motivo,omitempty"`
+	Reservada_por   string `json:"reservada_por,omitempty"`
+	Fecha_reserva   string `json:"fecha_reserva,omitempty"`
+	Nombre_paciente string `json:"nombre_paciente,omitempty"` //sólo en las respuestas
+}
+
+// extractorCitaMedico indexa cada cita bajo su médico y su hora de inicio.
+func extractorCitaMedico(key, value []byte) [][]byte {
+	var cita Cita
+	if err := json.Unmarshal(value, &cita); err != nil || cita.Medico == "" {
+		return nil
+	}
+	return [][]byte{[]byte(cita.Medico + "\x00" + cita.Inicio)}
+}
+
+// extractorCitaPaciente indexa las citas reservadas bajo su paciente.
+func extractorCitaPaciente(key, value []byte) [][]byte {
+	var cita Cita
+	if err := json.Unmarshal(value, &cita); err != nil || cita.Paciente == "" {
+		return nil
+	}
+	return [][]byte{[]byte(cita.Paciente)}
+}
+
+// seSolapan indica si dos intervalos [inicio, fin) se solapan.
+func seSolapan(inicioA, finA, inicioB, finB string) bool {
+	return inicioA < finB && inicioB < finA
+}
+
+// obtenerCita lee una cita junto con su versión.
+func (s *server) obtenerCita(id int) (Cita, uint64, error) {
+	var cita Cita
+	citaJson, version, err := s.db.GetWithVersion("Citas", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return cita, 0, err
+	}
+	err = json.Unmarshal(citaJson, &cita)
+	return cita, version, err
+}
+
+// citasDeMedico devuelve las citas del médico cuya hora de inicio empieza
+// por 'prefijo' (un día "AAAA-MM-DD", o vacío para todas), en orden.
+func (s *server) citasDeMedico(medico, prefijo string) ([]Cita, error) {
+	claves, err := s.indices.QueryPrefix("Citas", indiceCitasMedico, []byte(medico+"\x00"+prefijo))
+	if err != nil {
+		return nil, err
+	}
+	return s.leerCitas(claves)
+}
+
+// leerCitas lee las citas con las claves indicadas.
+func (s *server) leerCitas(claves [][]byte) ([]Cita, error) {
+	var citas []Cita
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			return nil, fmt.Errorf("clave de cita incorrecta: %q", clave)
+		}
+		cita, _, err := s.obtenerCita(id)
+		if err != nil {
+			return nil, err
+		}
+		citas = append(citas, cita)
+	}
+	return citas, nil
+}
+
+// conflictoPaciente devuelve la cita reservada del paciente, distinta de
+// 'excluir', que se solapa con el hueco indicado.
+func (s *server) conflictoPaciente(paciente string, hueco Cita, excluir int) (*Cita, error) {
+	claves, err := s.indices.Query("Citas", indiceCitasPaciente, []byte(paciente))
+	if err != nil {
+		return nil, err
+	}
+	citas, err := s.leerCitas(claves)
+	if err != nil {
+		return nil, err
+	}
+	for _, cita := range citas {
+		if cita.ID != excluir && cita.Estado == estadoCitaReservada && seSolapan(cita.Inicio, cita.Fin, hueco.Inicio, hueco.Fin) {
+			return &cita, nil
+		}
+	}
+	return nil, nil
+}
+
+// opCita construye la escritura condicional de una cita.
+func opCita(cita Cita, version uint64) (store.Op, error) {
+	citaJson, err := json.Marshal(cita)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Namespace: "Citas", Key: []byte(strconv.Itoa(cita.ID)), Value: citaJson, CheckVersion: true, Version: version}, nil
+}
+
+// respuestaCitas codifica las citas para la respuesta, añadiendo el nombre
+// de los pacientes.
+func (s *server) respuestaCitas(citas []Cita, mensaje string) api.Response {
+	var registros [][]byte
+	for _, cita := range citas {
+		if cita.Paciente != "" {
+			if paciente, err := s.obtenerPaciente(cita.Paciente); err == nil {
+				cita.Nombre_paciente = paciente.Nombre + " " + paciente.Apellido
+			}
+		}
+		citaJson, err := json.Marshal(cita)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la cita a json"}
+		}
+		registros = append(registros, citaJson)
+	}
+	return api.Response{Success: 1, Message: mensaje, Registros: registros}
+}
+
+// publicarHuecos crea huecos libres de 'Duracion' minutos en la agenda del
+// médico que hace la petición, desde FechaInicio hasta FechaFin (ambas
+// "AAAA-MM-DD HH:MM" del mismo día), en su hospital o en el indicado. Se
+// rechazan si se solapan con huecos ya publicados por el médico en
+// cualquier hospital.
+func (s *server) publicarHuecos(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.FechaInicio == "" || req.FechaFin == "" || req.Duracion == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos de los huecos (inicio, fin y duración)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	inicio, errInicio := time.ParseInLocation(formatoCita, req.FechaInicio, time.Local)
+	fin, errFin := time.ParseInLocation(formatoCita, req.FechaFin, time.Local)
+	if errInicio != nil || errFin != nil {
+		return api.Response{Success: -1, Message: "Fechas no válidas (use AAAA-MM-DD HH:MM)"}
+	}
+	switch {
+	case !fin.After(inicio) || inicio.Format(time.DateOnly) != fin.Format(time.DateOnly):
+		return api.Response{Success: -1, Message: "El fin debe ser posterior al inicio y del mismo día"}
+	case inicio.Before(time.Now()):
+		return api.Response{Success: -1, Message: "No se pueden publicar huecos en el pasado"}
+	case req.Duracion < duracionMinimaHueco || req.Duracion > duracionMaximaHueco:
+		return api.Response{Success: -1, Message: fmt.Sprintf("La duración debe estar entre %d y %d minutos", duracionMinimaHueco, duracionMaximaHueco)}
+	}
+	duracion := time.Duration(req.Duracion) * time.Minute
+	if n := int(fin.Sub(inicio) / duracion); n == 0 || n > maxHuecosPublicados {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Se pueden publicar entre 1 y %d huecos cada vez", maxHuecosPublicados)}
+	}
+
+	hospital := req.Hospital
+	if hospital == 0 {
+		usuario, err := s.obtenerUsuario(req.Username)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+		}
+		hospital = usuario.Hospital
+	}
+	if _, err := s.db.Get("Hospitales", []byte(strconv.Itoa(hospital))); err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el hospital %d", hospital)}
+	}
+
+	existentes, err := s.citasDeMedico(req.Username, inicio.Format(time.DateOnly))
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la agenda del médico"}
+	}
+	var ops []store.Op
+	for h := inicio; !h.Add(duracion).After(fin); h = h.Add(duracion) {
+		hueco := Cita{
+			Medico:   req.Username,
+			Hospital: hospital,
+			Inicio:   h.Format(formatoCita),
+			Fin:      h.Add(duracion).Format(formatoCita),
+			Estado:   estadoCitaLibre,
+		}
+		for _, existente := range existentes {
+			if seSolapan(existente.Inicio, existente.Fin, hueco.Inicio, hueco.Fin) {
+				return api.Response{Success: -1, Message: fmt.Sprintf("El hueco %s-%s se solapa con el hueco %d ya publicado (%s-%s)", hueco.Inicio, hueco.Fin[11:], existente.ID, existente.Inicio, existente.Fin[11:])}
+			}
+		}
+		if hueco.ID, err = s.siguienteSecuencia("Citas"); err != nil {
+			return api.Response{Success: -1, Message: "Error al generar el identificador de la cita"}
+		}
+		op, err := opCita(hueco, 0)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la cita a json"}
+		}
+		ops = append(ops, op)
+	}
+	if err := s.db.Batch(ops); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar los huecos"}
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("%d huecos publicados en el hospital %d", len(ops), hospital), Total: len(ops)}
+}
+
+// listarHuecos devuelve los huecos libres de un médico en un día.
+func (s *server) listarHuecos(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" || req.Fecha == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (médico y día)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if _, err := time.Parse(time.DateOnly, req.Fecha); err != nil {
+		return api.Response{Success: -1, Message: "Día no válido (use AAAA-MM-DD)"}
+	}
+
+	citas, err := s.citasDeMedico(req.Medico, req.Fecha)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la agenda del médico"}
+	}
+	ahora := time.Now().Format(formatoCita)
+	var libres []Cita
+	for _, cita := range citas {
+		if cita.Estado == estadoCitaLibre && cita.Inicio > ahora {
+			libres = append(libres, cita)
+		}
+	}
+	return s.respuestaCitas(libres, fmt.Sprintf("%d huecos libres de %s el %s", len(libres), req.Medico, req.Fecha))
+}
+
+// agendaDia devuelve todas las citas, libres y reservadas, del médico que
+// hace la petición en el día indicado (hoy si se omite).
+func (s *server) agendaDia(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	dia := req.Fecha
+	if dia == "" {
+		dia = time.Now().Format(time.DateOnly)
+	}
+	if _, err := time.Parse(time.DateOnly, dia); err != nil {
+		return api.Response{Success: -1, Message: "Día no válido (use AAAA-MM-DD)"}
+	}
+
+	citas, err := s.citasDeMedico(req.Username, dia)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la agenda"}
+	}
+	return s.respuestaCitas(citas, fmt.Sprintf("Agenda de %s del %s", req.Username, dia))
+}
+
+// reservarCita reserva el hueco req.Hueco para el paciente indicado, si
+// sigue libre y el paciente no tiene otra cita a la misma hora.
+func (s *server) reservarCita(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Hueco == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos de la cita"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	paciente, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, paciente); res != nil {
+		return *res
+	}
+	hueco, version, err := s.obtenerCita(req.Hueco)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el hueco %d", req.Hueco)}
+	}
+	if res := s.comprobarHuecoReservable(hueco, paciente, 0); res != nil {
+		return *res
+	}
+
+	hueco.Estado = estadoCitaReservada
+	hueco.Paciente = paciente
+	hueco.Motivo = req.Motivo
+	hueco.Reservada_por = req.Username
+	hueco.Fecha_reserva = time.Now().Format(time.RFC3339)
+	op, err := opCita(hueco, version)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la cita a json"}
+	}
+	if err := s.db.Batch([]store.Op{op}); errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "El hueco acaba de ser reservado por otro usuario"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la cita"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionReservarCita,
+		fmt.Sprintf("cita %d (%s, %s) reservada para el paciente %s", hueco.ID, hueco.Medico, hueco.Inicio, paciente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Cita %d reservada con %s el %s", hueco.ID, hueco.Medico, hueco.Inicio), Paciente: paciente}
+}
+
+// comprobarHuecoReservable comprueba que el hueco esté libre, sea futuro y
+// no se solape con otra cita del paciente (salvo la cita 'excluir', que se
+// está reprogramando). Devuelve nil si puede reservarse.
+func (s *server) comprobarHuecoReservable(hueco Cita, paciente string, excluir int) *api.Response {
+	if hueco.Estado != estadoCitaLibre {
+		return &api.Response{Success: -1, Conflicto: true, Message: fmt.Sprintf("El hueco %d no está libre", hueco.ID)}
+	}
+	if hueco.Inicio <= time.Now().Format(formatoCita) {
+		return &api.Response{Success: -1, Message: fmt.Sprintf("El hueco %d ya ha pasado", hueco.ID)}
+	}
+	otra, err := s.conflictoPaciente(paciente, hueco, excluir)
+	if err != nil {
+		return &api.Response{Success: -1, Message: "Error al obtener las citas del paciente"}
+	}
+	if otra != nil {
+		return &api.Response{Success: -1, Message: fmt.Sprintf("El paciente ya tiene la cita %d con %s a esa hora (%s)", otra.ID, otra.Medico, otra.Inicio)}
+	}
+	return nil
+}
+
+// liberarCita devuelve la cita al estado de hueco libre.
+func liberarCita(cita Cita) Cita {
+	return Cita{ID: cita.ID, Medico: cita.Medico, Hospital: cita.Hospital, Inicio: cita.Inicio, Fin: cita.Fin, Estado: estadoCitaLibre}
+}
+
+// cancelarCita anula la reserva de una cita indicando el motivo. El hueco
+// vuelve a quedar libre.
+func (s *server) cancelarCita(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Cita == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la cancelación (cita y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	cita, version, err := s.obtenerCita(req.Cita)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la cita %d", req.Cita)}
+	}
+	if cita.Estado != estadoCitaReservada {
+		return api.Response{Success: -1, Message: fmt.Sprintf("La cita %d no está reservada", req.Cita)}
+	}
+	if cita.Medico != req.Username {
+		if res := s.accesoPaciente(req.Username, cita.Paciente); res != nil {
+			return *res
+		}
+	}
+
+	op, err := opCita(liberarCita(cita), version)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la cita a json"}
+	}
+	if err := s.db.Batch([]store.Op{op}); errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La cita ha sido modificada por otro usuario; vuelva a consultarla"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la cita"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionCancelarCita,
+		fmt.Sprintf("cita %d (%s, %s) del paciente %s cancelada: %s", cita.ID, cita.Medico, cita.Inicio, cita.Paciente, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Cita %d cancelada", cita.ID)}
+}
+
+// reprogramarCita mueve la reserva de la cita req.Cita al hueco libre
+// req.Hueco, en una sola escritura: o cambian ambos o ninguno.
+func (s *server) reprogramarCita(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Cita == 0 || req.Hueco == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos (cita y nuevo hueco)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if req.Cita == req.Hueco {
+		return api.Response{Success: -1, Message: "El nuevo hueco es el de la cita actual"}
+	}
+	cita, versionCita, err := s.obtenerCita(req.Cita)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la cita %d", req.Cita)}
+	}
+	if cita.Estado != estadoCitaReservada {
+		return api.Response{Success: -1, Message: fmt.Sprintf("La cita %d no está reservada", req.Cita)}
+	}
+	if cita.Medico != req.Username {
+		if res := s.accesoPaciente(req.Username, cita.Paciente); res != nil {
+			return *res
+		}
+	}
+	hueco, versionHueco, err := s.obtenerCita(req.Hueco)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el hueco %d", req.Hueco)}
+	}
+	if res := s.comprobarHuecoReservable(hueco, cita.Paciente, cita.ID); res != nil {
+		return *res
+	}
+
+	hueco.Estado = estadoCitaReservada
+	hueco.Paciente = cita.Paciente
+	hueco.Motivo = cita.Motivo
+	hueco.Reservada_por = req.Username
+	hueco.Fecha_reserva = time.Now().Format(time.RFC3339)
+	opHueco, err := opCita(hueco, versionHueco)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la cita a json"}
+	}
+	opAnterior, err := opCita(liberarCita(cita), versionCita)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la cita a json"}
+	}
+	if err := s.db.Batch([]store.Op{opHueco, opAnterior}); errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La cita o el hueco han sido modificados por otro usuario; vuelva a consultarlos"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la cita"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionReprogramarCita,
+		fmt.Sprintf("cita del paciente %s movida de %d (%s, %s) a %d (%s, %s)", cita.Paciente, cita.ID, cita.Medico, cita.Inicio, hueco.ID, hueco.Medico, hueco.Inicio))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Cita reprogramada: ahora es la %d, con %s el %s", hueco.ID, hueco.Medico, hueco.Inicio)}
+}
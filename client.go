@@ -1,17 +1,25 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"prac/pkg/api"
 	"prac/pkg/ui"
+	"prac/pkg/validation"
 )
 
 // client estructura interna no exportada que controla
@@ -20,15 +28,61 @@ type client struct {
 	log              *log.Logger
 	currentUser      string
 	authToken        api.Token
-	currentSpecialty int //nuevo
-	currentHospital  int //nuevo
-	currentDNI       string
+	currentSpecialty int    //nuevo
+	currentHospital  int    //nuevo
+	currentPaciente  string //identificador interno del paciente seleccionado
+	currentRol       string
+	cancelarEventos  context.CancelFunc //detiene la escucha de /events
+	muNotificaciones sync.Mutex         //protege 'notificaciones', que se rellena en segundo plano
+	notificaciones   []string           //notificaciones recibidas y aún no mostradas
 }
 
 type Observaciones struct {
+	ID                  int    `json:"id"`
 	Fecha_actualizacion string `json:"fecha_actualizacion"`
 	Diagnostico         string `json:"diagnostico"`
 	Medico              string `json:"medico"`
+	Tipo                string `json:"tipo"`
+	Referencia          int    `json:"referencia"`
+	Motivo              string `json:"motivo"`
+	Estado              string `json:"estado"`
+	Sustituida_por      int    `json:"sustituida_por"`
+	Firma               string `json:"firma"`
+	Supervisor          string `json:"supervisor"`
+	Diagnosticos        []struct {
+		Codigo      string `json:"codigo"`
+		Descripcion string `json:"descripcion"`
+	} `json:"diagnosticos"`
+}
+
+// mostrarObservaciones imprime las observaciones de un expediente. Las
+// corregidas o anuladas siguen apareciendo, marcadas y enlazadas con la
+// entrada que las rectifica. Las de los residentes indican si están
+// pendientes de refrendo o quién las refrendó.
+func mostrarObservaciones(observaciones []Observaciones) {
+	for _, obs := range observaciones {
+		switch obs.Tipo {
+		case "correccion":
+			fmt.Printf("  #%d %s - %s: %s\n", obs.ID, obs.Fecha_actualizacion, obs.Medico, obs.Diagnostico)
+			fmt.Printf("      (corrige la #%d; motivo: %s)\n", obs.Referencia, obs.Motivo)
+		case "anulacion":
+			fmt.Printf("  #%d %s - %s: ANULA la #%d; motivo: %s\n", obs.ID, obs.Fecha_actualizacion, obs.Medico, obs.Referencia, obs.Motivo)
+		default:
+			fmt.Printf("  #%d %s - %s: %s\n", obs.ID, obs.Fecha_actualizacion, obs.Medico, obs.Diagnostico)
+		}
+		for _, diagnostico := range obs.Diagnosticos {
+			fmt.Printf("      CIE-10 %s: %s\n", diagnostico.Codigo, diagnostico.Descripcion)
+		}
+		if obs.Estado != "" {
+			fmt.Printf("      [%s por la #%d]\n", strings.ToUpper(obs.Estado), obs.Sustituida_por)
+		}
+		switch obs.Firma {
+		case "pendiente":
+			fmt.Printf("      [PENDIENTE DE REFRENDO por %s]\n", obs.Supervisor)
+		case "refrendada":
+			fmt.Printf("      [refrendada por %s]\n", obs.Supervisor)
+		}
+	}
 }
 
 // Run es la única función exportada de este paquete.
@@ -48,6 +102,7 @@ func Run() {
 func (c *client) runLoop() {
 	for {
 		ui.ClearScreen()
+		c.mostrarNotificaciones()
 
 		// Construimos un título que muestre el usuario logueado, si lo hubiera.
 		var title string
@@ -60,10 +115,11 @@ func (c *client) runLoop() {
 		// Generamos las opciones dinámicamente, según si hay un login activo.
 		var options []string
 		if c.currentUser == "" {
-			// Usuario NO logueado: Registro, Login, Salir
+			// Usuario NO logueado: Registro, Login, Restablecer contraseña, Salir
 			options = []string{
 				"Registrar usuario",
 				"Iniciar sesión",
+				"Restablecer contraseña",
 				"Salir",
 			}
 		} else {
@@ -71,9 +127,20 @@ func (c *client) runLoop() {
 			options = []string{
 				"Dar de alta paciente",
 				"Ver historial del paciente",
-				"Cerrar sesión",
-				"Salir",
+				"Buscar paciente",
+				"Mi agenda",
+				"Interconsultas",
+				"Traslados",
+				"Delegaciones",
 			}
+			if c.currentRol != api.RolResidente {
+				options = append(options, "Refrendos pendientes")
+			}
+			// Las opciones de administración sólo se muestran a los administradores
+			if c.currentRol == api.RolAdmin {
+				options = append(options, "Gestión de usuarios", "Fusiones de pacientes", "Catálogos", "Reconstruir índices")
+			}
+			options = append(options, "Cerrar sesión", "Salir")
 		}
 
 		// Mostramos el menú y obtenemos la elección del usuario.
@@ -88,20 +155,43 @@ func (c *client) runLoop() {
 			case 2:
 				c.loginUser()
 			case 3:
+				c.resetPassword()
+			case 4:
 				// Opción Salir
 				c.log.Println("Saliendo del cliente...")
 				return
 			}
 		} else {
-			// Caso logueado
-			switch choice {
-			case 1:
+			// Caso logueado: las opciones varían según el rol, así que
+			// despachamos por el texto de la opción elegida.
+			switch options[choice-1] {
+			case "Dar de alta paciente":
 				c.darAltaPaciente()
-			case 2:
+			case "Ver historial del paciente":
 				c.verHistorialPaciente()
-			case 3:
+			case "Buscar paciente":
+				c.buscarPaciente()
+			case "Mi agenda":
+				c.miAgenda()
+			case "Interconsultas":
+				c.bandejaInterconsultas()
+			case "Traslados":
+				c.trasladosEntrantes()
+			case "Delegaciones":
+				c.delegaciones()
+			case "Refrendos pendientes":
+				c.refrendosPendientes()
+			case "Fusiones de pacientes":
+				c.gestionarFusiones()
+			case "Gestión de usuarios":
+				c.gestionarUsuarios()
+			case "Catálogos":
+				c.gestionarCatalogos()
+			case "Reconstruir índices":
+				c.reconstruirIndices()
+			case "Cerrar sesión":
 				c.logoutUser()
-			case 4:
+			case "Salir":
 				// Opción Salir
 				c.log.Println("Saliendo del cliente...")
 				return
@@ -121,9 +211,14 @@ func (c *client) registerUser() {
 
 	username := ui.ReadInput("Nombre de usuario")
 	password := ui.ReadInput("Contraseña")
+	if err := validation.ValidarContrasenya(username, password); err != nil {
+		fmt.Println("Contraseña no válida:", err)
+		return
+	}
 	apellido := ui.ReadInput("Apellido")
-	especialidad := ui.ReadInt("ID de especialidad") //ID?
-	hospital := ui.ReadInt("ID de hospital")         //ID???
+	hospitales, especialidades := c.catalogos()
+	especialidad := elegirEntrada("Especialidad", especialidades, "")
+	hospital := elegirEntrada("Hospital", hospitales, "")
 
 	// Enviamos la acción al servidor
 	res := c.sendRequest(api.Request{
@@ -141,6 +236,238 @@ func (c *client) registerUser() {
 
 }
 
+// EntradaCatalogo es un hospital o una especialidad.
+type EntradaCatalogo struct {
+	ID     int    `json:"id"`
+	Nombre string `json:"nombre"`
+}
+
+// catalogos obtiene del servidor los hospitales y las especialidades. Si no
+// se pueden obtener devuelve listas vacías y se pedirán los números.
+func (c *client) catalogos() (hospitales, especialidades []EntradaCatalogo) {
+	res := c.sendRequest(api.Request{Action: api.ActionListCatalogs})
+	if res.Success != 1 {
+		return nil, nil
+	}
+	return decodificarCatalogo(res.Hospitales), decodificarCatalogo(res.Especialidades)
+}
+
+// decodificarCatalogo convierte las entradas json del catálogo.
+func decodificarCatalogo(registros [][]byte) []EntradaCatalogo {
+	var entradas []EntradaCatalogo
+	for _, registro := range registros {
+		var entrada EntradaCatalogo
+		if err := json.Unmarshal(registro, &entrada); err == nil {
+			entradas = append(entradas, entrada)
+		}
+	}
+	return entradas
+}
+
+// nombreEntrada devuelve el nombre de la entrada 'id' del catálogo, o su
+// número si no está.
+func nombreEntrada(entradas []EntradaCatalogo, id int) string {
+	for _, entrada := range entradas {
+		if entrada.ID == id {
+			return entrada.Nombre
+		}
+	}
+	return fmt.Sprintf("nº %d", id)
+}
+
+// elegirEntrada muestra las entradas del catálogo por su nombre y devuelve
+// el identificador de la elegida. Si 'ninguna' no está vacía se ofrece como
+// primera opción y devuelve 0. Con el catálogo vacío se pide el número.
+func elegirEntrada(titulo string, entradas []EntradaCatalogo, ninguna string) int {
+	if len(entradas) == 0 {
+		return ui.ReadInt(titulo + " (número)")
+	}
+	var options []string
+	if ninguna != "" {
+		options = append(options, ninguna)
+	}
+	for _, entrada := range entradas {
+		options = append(options, entrada.Nombre)
+	}
+	choice := ui.PrintMenu(titulo, options)
+	if ninguna != "" {
+		if choice == 1 {
+			return 0
+		}
+		choice--
+	}
+	return entradas[choice-1].ID
+}
+
+// UsuarioListado son los datos de un usuario que recibe un administrador.
+type UsuarioListado struct {
+	Username      string `json:"username"`
+	Apellido      string `json:"apellido"`
+	Especialidad  int    `json:"especialidad"`
+	Hospital      int    `json:"hospital"`
+	Rol           string `json:"rol"`
+	Deshabilitado bool   `json:"deshabilitado"`
+}
+
+// gestionarUsuarios permite a un administrador ver los usuarios,
+// deshabilitarlos o habilitarlos, cambiarlos de hospital o especialidad y
+// borrarlos.
+func (c *client) gestionarUsuarios() {
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Usuarios **")
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionListarUsuarios,
+			Token:    c.authToken,
+			Username: c.currentUser,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		hospitales, especialidades := c.catalogos()
+		var usuarios []UsuarioListado
+		for _, registro := range res.Registros {
+			var usuario UsuarioListado
+			if err := json.Unmarshal(registro, &usuario); err != nil {
+				fmt.Println("Error al leer el usuario:", err)
+				continue
+			}
+			usuarios = append(usuarios, usuario)
+			estado := ""
+			if usuario.Deshabilitado {
+				estado = " [DESHABILITADO]"
+			}
+			fmt.Printf("  %-15s %-15s %-8s %s, %s%s\n", usuario.Username, usuario.Apellido, usuario.Rol,
+				nombreEntrada(hospitales, usuario.Hospital), nombreEntrada(especialidades, usuario.Especialidad), estado)
+		}
+		fmt.Println()
+
+		options := []string{"Deshabilitar", "Habilitar", "Cambiar hospital o especialidad", "Borrar", "Generar código de restablecimiento", "Cambiar rol (médico o residente)", "Volver"}
+		choice := ui.PrintMenu("Opciones", options)
+		if choice == len(options) {
+			return
+		}
+		req := api.Request{Token: c.authToken, Username: c.currentUser}
+		if req.Medico = elegirUsuario(usuarios); req.Medico == "" {
+			continue
+		}
+		switch choice {
+		case 1: // Deshabilitar
+			req.Action = api.ActionDeshabilitarUsuario
+			req.Motivo = ui.ReadInput("Motivo")
+		case 2: // Habilitar
+			req.Action = api.ActionHabilitarUsuario
+		case 3: // Cambiar hospital o especialidad
+			req.Action = api.ActionCambiarDestinoUsuario
+			req.Hospital = elegirEntrada("Nuevo hospital", hospitales, "Sin cambios")
+			req.Especialidad = elegirEntrada("Nueva especialidad", especialidades, "Sin cambios")
+		case 4: // Borrar
+			req.Action = api.ActionBorrarUsuario
+			req.Motivo = ui.ReadInput("Motivo")
+			if !ui.Confirm(fmt.Sprintf("¿Seguro que quieres borrar a %s? Su nombre no podrá reutilizarse", req.Medico)) {
+				continue
+			}
+		case 5: // Generar código de restablecimiento
+			req.Action = api.ActionGenerarCodigoReset
+		case 6: // Cambiar rol
+			req.Action = api.ActionCambiarRolUsuario
+			roles := []string{api.RolMedico, api.RolResidente}
+			choice := ui.PrintMenu("Nuevo rol", []string{"Médico", "Residente", "Cancelar"})
+			if choice == 3 {
+				continue
+			}
+			req.Rol = roles[choice-1]
+		}
+		res = c.sendRequest(req)
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		fmt.Println("Éxito:", res.Success)
+		fmt.Println("Mensaje:", res.Message)
+		if req.Action == api.ActionGenerarCodigoReset && res.Success == 1 {
+			fmt.Println("Código (entréguelo al usuario, no se volverá a mostrar):", res.Data)
+		}
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// elegirUsuario muestra los usuarios y devuelve el nombre del elegido, o ""
+// si se vuelve atrás.
+func elegirUsuario(usuarios []UsuarioListado) string {
+	options := make([]string, len(usuarios)+1)
+	for i, usuario := range usuarios {
+		options[i] = fmt.Sprintf("%s (%s)", usuario.Username, usuario.Apellido)
+	}
+	options[len(usuarios)] = "Volver"
+	choice := ui.PrintMenu("Usuario", options)
+	if choice > len(usuarios) {
+		return ""
+	}
+	return usuarios[choice-1].Username
+}
+
+// gestionarCatalogos permite a un administrador dar de alta, renombrar y
+// borrar hospitales y especialidades.
+func (c *client) gestionarCatalogos() {
+	for {
+		ui.ClearScreen()
+		hospitales, especialidades := c.catalogos()
+		fmt.Println("** Hospitales **")
+		for _, hospital := range hospitales {
+			fmt.Printf("  [%d] %s\n", hospital.ID, hospital.Nombre)
+		}
+		fmt.Println("** Especialidades **")
+		for _, especialidad := range especialidades {
+			fmt.Printf("  [%d] %s\n", especialidad.ID, especialidad.Nombre)
+		}
+		fmt.Println()
+
+		req := api.Request{Token: c.authToken, Username: c.currentUser}
+		options := []string{"Añadir hospital", "Renombrar hospital", "Borrar hospital", "Añadir especialidad", "Renombrar especialidad", "Borrar especialidad", "Volver"}
+		switch ui.PrintMenu("Opciones", options) {
+		case 1: // Añadir hospital
+			req.Action = api.ActionCrearHospital
+			req.Nombre = ui.ReadInput("Nombre del hospital")
+		case 2: // Renombrar hospital
+			req.Action = api.ActionRenombrarHospital
+			req.ID = elegirEntrada("Hospital", hospitales, "")
+			req.Nombre = ui.ReadInput("Nuevo nombre")
+		case 3: // Borrar hospital
+			req.Action = api.ActionBorrarHospital
+			req.ID = elegirEntrada("Hospital", hospitales, "")
+		case 4: // Añadir especialidad
+			req.Action = api.ActionCrearEspecialidad
+			req.Nombre = ui.ReadInput("Nombre de la especialidad")
+		case 5: // Renombrar especialidad
+			req.Action = api.ActionRenombrarEspecialidad
+			req.ID = elegirEntrada("Especialidad", especialidades, "")
+			req.Nombre = ui.ReadInput("Nuevo nombre")
+		case 6: // Borrar especialidad
+			req.Action = api.ActionBorrarEspecialidad
+			req.ID = elegirEntrada("Especialidad", especialidades, "")
+		case 7: // Volver
+			return
+		}
+		if (req.Action == api.ActionBorrarHospital || req.Action == api.ActionBorrarEspecialidad) && !ui.Confirm("¿Seguro que quieres borrarlo?") {
+			continue
+		}
+		res := c.sendRequest(req)
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		fmt.Println("Éxito:", res.Success)
+		fmt.Println("Mensaje:", res.Message)
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
 // loginUser pide credenciales y realiza un login en el servidor.
 func (c *client) loginUser() {
 	ui.ClearScreen()
@@ -162,20 +489,54 @@ func (c *client) loginUser() {
 	if res.Success == 1 {
 		c.currentUser = username
 		c.authToken = res.Token
+		c.currentRol = res.Rol
 		fmt.Println("Sesión iniciada con éxito. Token guardado.")
+		c.iniciarEventos()
+	}
+}
+
+// resetPassword fija una contraseña nueva con el código de restablecimiento
+// que ha generado un administrador.
+func (c *client) resetPassword() {
+	ui.ClearScreen()
+	fmt.Println("** Restablecer contraseña **")
+
+	username := ui.ReadInput("Nombre de usuario")
+	codigo := strings.ToUpper(strings.TrimSpace(ui.ReadInput("Código de restablecimiento")))
+	password := ui.ReadInput("Nueva contraseña")
+	if err := validation.ValidarContrasenya(username, password); err != nil {
+		fmt.Println("Contraseña no válida:", err)
+		return
 	}
+	if ui.ReadInput("Repite la nueva contraseña") != password {
+		fmt.Println("Las contraseñas no coinciden")
+		return
+	}
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionResetPassword,
+		Username: username,
+		Codigo:   codigo,
+		Password: password,
+	})
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
 }
 
 func (c *client) verHistorialPaciente() {
 	ui.ClearScreen()
 	fmt.Println("** Ver historial del paciente **")
 
-	dni := ui.ReadInput("DNI del paciente: ")
+	tipo, identificador := c.leerIdentificador()
+	if tipo == "" {
+		return
+	}
 	res := c.sendRequest(api.Request{
-		Action:   api.ActionObtenerExpedientes,
-		Username: c.currentUser,
-		Token:    c.authToken,
-		DNI:      dni,
+		Action:            api.ActionObtenerExpedientes,
+		Username:          c.currentUser,
+		Token:             c.authToken,
+		TipoIdentificador: tipo,
+		Identificador:     identificador,
 	})
 
 	if res.Success == 0 {
@@ -190,14 +551,36 @@ func (c *client) verHistorialPaciente() {
 		}
 		return
 	}
-	c.currentDNI = dni // Guardamos el DNI actual
+	c.menuPaciente(res, fmt.Sprintf("%s %s", tipo, identificador))
+}
+
+// menuPaciente muestra las opciones sobre el paciente devuelto por
+// obtenerExpedientes hasta que el usuario sale.
+func (c *client) menuPaciente(res api.Response, descripcion string) {
+	c.currentPaciente = res.Paciente // Guardamos el paciente actual
+	estado := res.Estado
+	alertas := res.Alertas
 
 	for {
 		ui.ClearScreen()
-		fmt.Printf("Historial del paciente con DNI %s\n", dni)
+		mostrarAlertas(alertas)
+		fmt.Printf("Historial del paciente %s (%s)\n", c.currentPaciente, descripcion)
+		fmt.Printf("Estado actual: %s\n\n", estado)
+
+		// La opción de baja o reingreso depende del estado actual del paciente
+		opcionEstado := "Dar de baja"
+		if estado != api.EstadoIngresado {
+			opcionEstado = "Reingresar"
+		}
 		options := []string{
 			"Crear expediente",
 			"Elegir expediente",
+			opcionEstado,
+			"Añadir identificador",
+			"Medicación activa",
+			"Alertas clínicas",
+			"Constantes y analíticas",
+			"Solicitar traslado",
 			"Salir",
 		}
 		choice := ui.PrintMenu("Opciones", options)
@@ -206,34 +589,181 @@ func (c *client) verHistorialPaciente() {
 		case 1: // Crear expediente
 			c.crearExpediente()
 		case 2: // Elegir expediente
-			c.elegirExpediente(c.currentDNI)
-		case 3: // Salir
+			c.elegirExpediente(c.currentPaciente)
+		case 3: // Dar de baja o reingresar
+			if estado == api.EstadoIngresado {
+				estado = c.darBajaPaciente(estado)
+			} else {
+				estado = c.reingresarPaciente(estado)
+			}
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 4: // Añadir identificador
+			c.anyadirIdentificador()
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 5: // Medicación activa
+			c.medicacionActiva()
+		case 6: // Alertas clínicas
+			alertas = c.gestionarAlertas(alertas)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 7: // Constantes y analíticas
+			c.menuMediciones()
+		case 8: // Solicitar traslado
+			c.solicitarTraslado()
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 9: // Salir
 			return
 		}
 
 	}
 }
 
-func (c *client) crearExpediente() {
+// Alerta es una alergia, enfermedad crónica u otro aviso del paciente.
+type Alerta struct {
+	ID             int    `json:"id"`
+	Tipo           string `json:"tipo"`
+	Descripcion    string `json:"descripcion"`
+	Gravedad       string `json:"gravedad"`
+	Fecha          string `json:"fecha"`
+	Registrada_por string `json:"registrada_por"`
+}
+
+// decodificarAlertas convierte las alertas recibidas del servidor.
+func decodificarAlertas(alertasJson [][]byte) []Alerta {
+	var alertas []Alerta
+	for _, alertaBytes := range alertasJson {
+		var alerta Alerta
+		if err := json.Unmarshal(alertaBytes, &alerta); err != nil {
+			fmt.Println("Error al procesar alerta:", err)
+			continue
+		}
+		alertas = append(alertas, alerta)
+	}
+	return alertas
+}
+
+// mostrarAlertas imprime un recuadro bien visible con las alertas activas
+// del paciente, para que se vean antes de cualquier menú.
+func mostrarAlertas(alertasJson [][]byte) {
+	alertas := decodificarAlertas(alertasJson)
+	if len(alertas) == 0 {
+		return
+	}
+	linea := strings.Repeat("!", 70)
+	fmt.Println(linea)
+	fmt.Printf("!!  ALERTAS DEL PACIENTE (%d)\n", len(alertas))
+	for _, alerta := range alertas {
+		fmt.Printf("!!  [%s] %s: %s\n", strings.ToUpper(alerta.Gravedad), strings.ToUpper(alerta.Tipo), alerta.Descripcion)
+	}
+	fmt.Println(linea)
+	fmt.Println()
+}
+
+// gestionarAlertas muestra las alertas activas del paciente actual y permite
+// añadir o resolver alertas. Devuelve las alertas activas tras los cambios.
+func (c *client) gestionarAlertas(alertasJson [][]byte) [][]byte {
 	ui.ClearScreen()
-	fmt.Println("** Crear nuevo expediente **")
+	fmt.Println("** Alertas clínicas **")
 
-	observaciones := ui.ReadInput("Observaciones: ")
+	alertas := decodificarAlertas(alertasJson)
+	for _, alerta := range alertas {
+		fmt.Printf("  Alerta %d [%s] %s: %s (%s, %s)\n", alerta.ID, alerta.Gravedad, alerta.Tipo, alerta.Descripcion, alerta.Registrada_por, alerta.Fecha)
+	}
+	if len(alertas) == 0 {
+		fmt.Println("  El paciente no tiene alertas activas")
+	}
+	fmt.Println()
 
-	fmt.Println("DNI:", c.currentDNI)
-	fmt.Println(c.authToken.Value)
-	fmt.Println(c.currentUser)
-	fmt.Println(observaciones)
+	req := api.Request{
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Paciente: c.currentPaciente,
+	}
+	switch ui.PrintMenu("Opciones", []string{"Añadir alerta", "Resolver alerta", "Volver"}) {
+	case 1: // Añadir alerta
+		tipos := []string{api.AlertaAlergia, api.AlertaCronica, api.AlertaAviso}
+		gravedades := []string{api.GravedadAlta, api.GravedadMedia, api.GravedadBaja}
+		req.Action = api.ActionAnyadirAlerta
+		req.TipoAlerta = tipos[ui.PrintMenu("Tipo de alerta", []string{"Alergia", "Enfermedad crónica", "Otro aviso"})-1]
+		req.Gravedad = gravedades[ui.PrintMenu("Gravedad", []string{"Alta", "Media", "Baja"})-1]
+		req.Descripcion = ui.ReadInput("Descripción")
+	case 2: // Resolver alerta
+		req.Action = api.ActionResolverAlerta
+		req.Alerta = ui.ReadInt("Número de la alerta")
+		req.Motivo = ui.ReadInput("Motivo")
+	default:
+		return alertasJson
+	}
 
-	// Enviar solicitud al servidor
-	res := c.sendRequest(api.Request{
-		Action:      api.ActionCrearExpediente,
-		Token:       c.authToken,
-		Username:    c.currentUser,
-		Diagnostico: observaciones,
-		DNI:         c.currentDNI,
-	})
+	res := c.sendRequest(req)
+	if res.Success == 0 {
+		c.logoutUser()
+		return alertasJson
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+	if res.Success != 1 {
+		return alertasJson
+	}
+	return res.Alertas
+}
+
+// tiposMedicion son los tipos de medición en el orden en que se ofrecen.
+var tiposMedicion = []string{api.MedicionTension, api.MedicionFrecuenciaCardiaca, api.MedicionTemperatura, api.MedicionGlucosa, api.MedicionAnalitica}
+
+// elegirTipoMedicion pregunta el tipo de medición y, en las analíticas, el
+// analito.
+func elegirTipoMedicion() (string, string) {
+	choice := ui.PrintMenu("Tipo de medición", []string{"Tensión arterial", "Frecuencia cardiaca", "Temperatura", "Glucosa", "Analítica de laboratorio"})
+	tipo := tiposMedicion[choice-1]
+	if tipo == api.MedicionAnalitica {
+		return tipo, ui.ReadInput("Analito (p. ej. hemoglobina)")
+	}
+	return tipo, ""
+}
+
+// menuMediciones permite registrar constantes vitales y resultados de
+// laboratorio del paciente actual y ver su evolución.
+func (c *client) menuMediciones() {
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Constantes y analíticas **")
+		switch ui.PrintMenu("Opciones", []string{"Registrar medición", "Ver evolución", "Volver"}) {
+		case 1: // Registrar medición
+			c.registrarMedicion()
+		case 2: // Ver evolución
+			c.verEvolucion()
+		case 3: // Volver
+			return
+		}
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// registrarMedicion pide una medición y la envía al servidor.
+func (c *client) registrarMedicion() {
+	req := api.Request{
+		Action:   api.ActionRegistrarMedicion,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Paciente: c.currentPaciente,
+	}
+	req.TipoMedicion, req.Analito = elegirTipoMedicion()
+	switch req.TipoMedicion {
+	case api.MedicionTension:
+		req.Valor = ui.ReadFloat("Sistólica (mmHg)")
+		req.Diastolica = ui.ReadFloat("Diastólica (mmHg)")
+	case api.MedicionAnalitica:
+		req.Valor = ui.ReadFloat("Valor")
+		req.Unidad = ui.ReadInput("Unidad")
+		minimo, maximo := ui.ReadFloat("Mínimo del rango de referencia"), ui.ReadFloat("Máximo del rango de referencia")
+		req.Minimo, req.Maximo = &minimo, &maximo
+	default:
+		req.Valor = ui.ReadFloat("Valor")
+	}
+	req.Fecha = ui.ReadInput("Fecha y hora (AAAA-MM-DD HH:MM, vacío para ahora)")
 
+	res := c.sendRequest(req)
 	if res.Success == 0 {
 		c.logoutUser()
 		return
@@ -241,154 +771,1831 @@ func (c *client) crearExpediente() {
 
 	fmt.Println("Éxito:", res.Success)
 	fmt.Println("Mensaje:", res.Message)
-	ui.Pause("Pulsa [Enter] para continuar...")
+	for _, aviso := range res.Avisos {
+		fmt.Println("AVISO:", aviso)
+	}
 }
 
-func (c *client) elegirExpediente(dni string) {
-	ui.ClearScreen()
-	fmt.Println("** Elegir expediente **")
+// verEvolucion muestra las mediciones de un tipo entre dos fechas, marcando
+// las que están fuera de rango, y su evolución como una línea de texto.
+func (c *client) verEvolucion() {
+	type Medicion struct {
+		Analito        string  `json:"analito"`
+		Valor          float64 `json:"valor"`
+		Diastolica     float64 `json:"diastolica"`
+		Unidad         string  `json:"unidad"`
+		Minimo         float64 `json:"minimo"`
+		Maximo         float64 `json:"maximo"`
+		Fecha          string  `json:"fecha"`
+		Registrada_por string  `json:"registrada_por"`
+		Fuera_de_rango bool    `json:"fuera_de_rango"`
+	}
 
-	// Obtener la lista de expedientes del servidor
-	res := c.sendRequest(api.Request{
-		Action: api.ActionObtenerExpedientes,
-		Token:  c.authToken,
-		DNI:    dni,
-	})
+	req := api.Request{
+		Action:   api.ActionConsultarMediciones,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Paciente: c.currentPaciente,
+	}
+	req.TipoMedicion, req.Analito = elegirTipoMedicion()
+	req.FechaInicio = ui.ReadInput("Desde (AAAA-MM-DD, vacío para el principio)")
+	req.FechaFin = ui.ReadInput("Hasta (AAAA-MM-DD, vacío para hoy)")
 
+	res := c.sendRequest(req)
 	if res.Success == 0 {
 		c.logoutUser()
 		return
 	}
-
-	if res.Success == 1 {
+	if res.Success == -1 {
 		fmt.Println("Mensaje:", res.Message)
 		return
 	}
 
-	// Parsear los expedientes
-	type Expediente struct {
-		Username      string          `json:"username"`
-		Observaciones []Observaciones `json:"observaciones"`
-		FechaCreacion string          `json:"fecha_creacion"`
-		Especialidad  int             `json:"especialidad"`
-	}
-
-	var listaExpedientes []Expediente
-	for _, expBytes := range res.Expedientes {
-		var exp Expediente
-		if err := json.Unmarshal(expBytes, &exp); err != nil {
-			fmt.Println("Error al procesar expediente:", err)
+	var valores []float64
+	var marcas strings.Builder
+	for _, medicionBytes := range res.Registros {
+		var m Medicion
+		if err := json.Unmarshal(medicionBytes, &m); err != nil {
+			fmt.Println("Error al procesar medición:", err)
 			continue
 		}
-		listaExpedientes = append(listaExpedientes, exp)
+		marca := " "
+		if m.Fuera_de_rango {
+			marca = "!"
+		}
+		valor := fmt.Sprintf("%g", m.Valor)
+		if req.TipoMedicion == api.MedicionTension {
+			valor = fmt.Sprintf("%g/%g", m.Valor, m.Diastolica)
+		}
+		fecha := m.Fecha
+		if instante, err := time.Parse(time.RFC3339, m.Fecha); err == nil {
+			fecha = instante.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf(" %s %s  %s %s  (ref. %g-%g; %s)\n", marca, fecha, valor, m.Unidad, m.Minimo, m.Maximo, m.Registrada_por)
+		valores = append(valores, m.Valor)
+		marcas.WriteString(marca)
+	}
+	if len(valores) == 0 {
+		fmt.Println("No hay mediciones en ese periodo")
+		return
 	}
 
-	if len(listaExpedientes) == 0 {
-		fmt.Println("No se encontraron expedientes válidos")
-		ui.Pause("Pulsa [Enter] para continuar...")
+	fmt.Println()
+	fmt.Println("Evolución:", ui.Sparkline(valores))
+	fmt.Println("          ", marcas.String())
+	fmt.Println("(! = fuera del rango de referencia)")
+}
 
-	} else {
-		for {
-			ui.ClearScreen()
-			fmt.Printf("Expedientes de %s:\n", dni)
-			options := make([]string, len(listaExpedientes))
-			for i, exp := range listaExpedientes {
-				options[i] = fmt.Sprintf("Fecha: %s - Observaciones: %s", exp.FechaCreacion, exp.Observaciones)
-			}
-			options = append(options, "Volver")
+// Cita es un hueco de la agenda de un médico, libre o reservado.
+type Cita struct {
+	ID              int    `json:"id"`
+	Medico          string `json:"medico"`
+	Hospital        int    `json:"hospital"`
+	Inicio          string `json:"inicio"`
+	Fin             string `json:"fin"`
+	Estado          string `json:"estado"`
+	Paciente        string `json:"paciente"`
+	Motivo          string `json:"motivo"`
+	Nombre_paciente string `json:"nombre_paciente"`
+}
 
-			choice := ui.PrintMenu("Seleccionar expediente", options)
-			if choice == len(options) {
-				return
-			}
+// decodificarCitas convierte las citas recibidas del servidor.
+func decodificarCitas(citasJson [][]byte) []Cita {
+	var citas []Cita
+	for _, citaBytes := range citasJson {
+		var cita Cita
+		if err := json.Unmarshal(citaBytes, &cita); err != nil {
+			fmt.Println("Error al procesar cita:", err)
+			continue
+		}
+		citas = append(citas, cita)
+	}
+	return citas
+}
 
-			selectedExp := listaExpedientes[choice-1]
-
-			// Submenú para el expediente seleccionado
-			ui.ClearScreen()
-			fmt.Printf("Fecha: %s\n", selectedExp.FechaCreacion)
-			subOptions := []string{"Visualizar", "Editar", "Volver"}
-			subChoice := ui.PrintMenu("Opciones", subOptions)
-
-			switch subChoice {
-			case 1: // Visualizar
-				fmt.Println("Observaciones:", selectedExp.Observaciones)
-				fmt.Println("Creado por:", selectedExp.Username)
-				fmt.Println("Fecha creación:", selectedExp.FechaCreacion)
-				fmt.Println("Especialidad:", selectedExp.Especialidad)
-				ui.Pause("Pulsa [Enter] para continuar...")
-			case 2: // Editar
-				observaciones := ui.ReadInput("Nueva observación: ")
-				c.actualizarExpediente(choice-1, observaciones)
-			case 3: // Volver
-				continue
+// miAgenda muestra la agenda del día del médico y permite publicar huecos
+// y reservar, cancelar o reprogramar citas.
+func (c *client) miAgenda() {
+	dia := time.Now().Format(time.DateOnly)
+	for {
+		ui.ClearScreen()
+		fmt.Printf("** Mi agenda del %s **\n", dia)
+
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionAgendaDia,
+			Token:    c.authToken,
+			Username: c.currentUser,
+			Fecha:    dia,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		citas := decodificarCitas(res.Registros)
+		hospitales, _ := c.catalogos()
+		for _, cita := range citas {
+			if cita.Estado == "reservada" {
+				fmt.Printf("  %s-%s  [%d] %s (%s) %s\n", cita.Inicio[11:], cita.Fin[11:], cita.ID, cita.Nombre_paciente, cita.Paciente, cita.Motivo)
+			} else {
+				fmt.Printf("  %s-%s  [%d] libre (%s)\n", cita.Inicio[11:], cita.Fin[11:], cita.ID, nombreEntrada(hospitales, cita.Hospital))
 			}
 		}
+		if len(citas) == 0 {
+			fmt.Println("  No hay huecos publicados este día")
+		}
+		fmt.Println()
 
+		options := []string{"Cambiar de día", "Publicar huecos", "Reservar cita", "Cancelar cita", "Reprogramar cita", "Volver"}
+		switch ui.PrintMenu("Opciones", options) {
+		case 1: // Cambiar de día
+			dia = ui.ReadInput("Día (AAAA-MM-DD)")
+			continue
+		case 2: // Publicar huecos
+			c.publicarHuecos(dia)
+		case 3: // Reservar cita
+			c.reservarCita(0)
+		case 4: // Cancelar cita
+			c.cancelarCita()
+		case 5: // Reprogramar cita
+			c.reservarCita(ui.ReadInt("Número de la cita a reprogramar"))
+		case 6: // Volver
+			return
+		}
+		ui.Pause("Pulsa [Enter] para continuar...")
 	}
 }
 
-// funcion Actualizar Expediente, se pasa como argumento el numero del expediente, el nombre, observaciones y token
-func (c *client) actualizarExpediente(expID int, observaciones string) {
-	ui.ClearScreen()
-	fmt.Println("** Actualizar expediente **")
-
-	// Obtener la fecha actual
-	fechaActual := time.Now().Format("2006-01-02") // Formato YYYY-MM-DD, ajusta si necesitas otro
-
-	// Enviar la solicitud al servidor
+// publicarHuecos publica huecos libres en la agenda del médico en el día
+// indicado.
+func (c *client) publicarHuecos(dia string) {
+	desde := ui.ReadInput("Hora de inicio (HH:MM)")
+	hasta := ui.ReadInput("Hora de fin (HH:MM)")
 	res := c.sendRequest(api.Request{
-		Action:      api.ActionModificarExpediente,
+		Action:      api.ActionPublicarHuecos,
 		Token:       c.authToken,
-		ID:          expID,
 		Username:    c.currentUser,
-		Diagnostico: observaciones,
-		Fecha:       fechaActual,
+		FechaInicio: dia + " " + desde,
+		FechaFin:    dia + " " + hasta,
+		Duracion:    ui.ReadInt("Duración de cada hueco (minutos)"),
 	})
-
 	if res.Success == 0 {
 		c.logoutUser()
+		return
 	}
 
 	fmt.Println("Éxito:", res.Success)
 	fmt.Println("Mensaje:", res.Message)
 }
 
-func (c *client) darAltaPaciente() {
-	ui.ClearScreen()
-	fmt.Println("** Dar de alta al paciente **")
-
-	nombre := ui.ReadInput("Nombre: ")
-	apellido := ui.ReadInput("Apellido: ")
-	fecha_nacimiento := ui.ReadInput("Fecha de nacimiento (AAAA-dd-mm): ")
-	dni := ui.ReadInput("DNI del paciente: ")
-	sexo := ui.ReadInput("Sexo (H,M,O)")
-
-	// Enviamos la acción al servidor
+// reservarCita busca los huecos libres de un médico en un día y reserva el
+// elegido. Si 'cita' no es 0, mueve esa cita al hueco elegido en lugar de
+// pedir un paciente.
+func (c *client) reservarCita(cita int) {
+	var tipo, identificador string
+	if cita == 0 {
+		if tipo, identificador = c.leerIdentificador(); tipo == "" {
+			return
+		}
+	}
+	medico := ui.ReadInput("Médico (vacío para uno mismo)")
+	if medico == "" {
+		medico = c.currentUser
+	}
 	res := c.sendRequest(api.Request{
-		Action:   api.ActionDarAlta,
+		Action:   api.ActionListarHuecos,
 		Token:    c.authToken,
 		Username: c.currentUser,
-		Nombre:   nombre,
-		Apellido: apellido,
-		Fecha:    fecha_nacimiento,
-		Sexo:     sexo,
-		DNI:      dni,
-		Hospital: c.currentHospital,
+		Medico:   medico,
+		Fecha:    ui.ReadInput("Día (AAAA-MM-DD)"),
 	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+	huecos := decodificarCitas(res.Registros)
+	if res.Success == -1 || len(huecos) == 0 {
+		fmt.Println("Mensaje:", res.Message)
+		return
+	}
+
+	hospitales, _ := c.catalogos()
+	options := make([]string, len(huecos)+1)
+	for i, hueco := range huecos {
+		options[i] = fmt.Sprintf("%s-%s (%s)", hueco.Inicio, hueco.Fin[11:], nombreEntrada(hospitales, hueco.Hospital))
+	}
+	options[len(huecos)] = "Volver"
+	choice := ui.PrintMenu("Seleccionar hueco", options)
+	if choice > len(huecos) {
+		return
+	}
 
+	req := api.Request{
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Hueco:    huecos[choice-1].ID,
+	}
+	if cita == 0 {
+		req.Action = api.ActionReservarCita
+		req.TipoIdentificador, req.Identificador = tipo, identificador
+		req.Motivo = ui.ReadInput("Motivo de la consulta")
+	} else {
+		req.Action = api.ActionReprogramarCita
+		req.Cita = cita
+	}
+	res = c.sendRequest(req)
 	if res.Success == 0 {
 		c.logoutUser()
+		return
 	}
 
-	// Mostramos resultado
 	fmt.Println("Éxito:", res.Success)
 	fmt.Println("Mensaje:", res.Message)
 }
 
-// fetchData pide datos privados al servidor.
-// El servidor devuelve la data asociada al usuario logueado.
-func (c *client) fetchData() {
+// cancelarCita anula la reserva de una cita indicando el motivo.
+func (c *client) cancelarCita() {
+	cita := ui.ReadInt("Número de la cita")
+	motivo := ui.ReadInput("Motivo de la cancelación")
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionCancelarCita,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Cita:     cita,
+		Motivo:   motivo,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// Interconsulta es la derivación de un paciente a otra especialidad tal y
+// como la devuelve el servidor.
+type Interconsulta struct {
+	ID                  int    `json:"id"`
+	Expediente          int    `json:"expediente"`
+	Paciente            string `json:"paciente"`
+	Medico_origen       string `json:"medico_origen"`
+	Especialidad_origen int    `json:"especialidad_origen"`
+	Motivo              string `json:"motivo"`
+	Prioridad           string `json:"prioridad"`
+	Estado              string `json:"estado"`
+	Fecha               string `json:"fecha"`
+	Respondida_por      string `json:"respondida_por"`
+	Expediente_destino  int    `json:"expediente_destino"`
+	Nombre_paciente     string `json:"nombre_paciente"`
+}
+
+// bandejaInterconsultas muestra las interconsultas dirigidas a la
+// especialidad y al hospital del médico y permite aceptarlas, rechazarlas o
+// completarlas.
+func (c *client) bandejaInterconsultas() {
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Interconsultas recibidas **")
+
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionBandejaInterconsultas,
+			Token:    c.authToken,
+			Username: c.currentUser,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		var interconsultas []Interconsulta
+		for _, registro := range res.Registros {
+			var interconsulta Interconsulta
+			if err := json.Unmarshal(registro, &interconsulta); err != nil {
+				fmt.Println("Error al leer la interconsulta:", err)
+				continue
+			}
+			interconsultas = append(interconsultas, interconsulta)
+		}
+		_, especialidades := c.catalogos()
+		for _, ic := range interconsultas {
+			fmt.Printf("  [%d] %-10s %s - %s (%s), de %s (%s, expediente %d)\n",
+				ic.ID, strings.ToUpper(ic.Prioridad), ic.Fecha[:10], ic.Nombre_paciente, ic.Paciente, ic.Medico_origen, nombreEntrada(especialidades, ic.Especialidad_origen), ic.Expediente)
+			fmt.Printf("       %s", ic.Motivo)
+			if ic.Estado == "aceptada" {
+				fmt.Printf(" [aceptada por %s, expediente %d]", ic.Respondida_por, ic.Expediente_destino)
+			}
+			fmt.Println()
+		}
+		if len(interconsultas) == 0 {
+			fmt.Println("  No hay interconsultas pendientes")
+		}
+		fmt.Println()
+
+		req := api.Request{Token: c.authToken, Username: c.currentUser}
+		switch ui.PrintMenu("Opciones", []string{"Aceptar", "Rechazar", "Completar con informe", "Volver"}) {
+		case 1: // Aceptar
+			req.Action = api.ActionAceptarInterconsulta
+			req.ID = ui.ReadInt("Número de la interconsulta")
+		case 2: // Rechazar
+			req.Action = api.ActionRechazarInterconsulta
+			req.ID = ui.ReadInt("Número de la interconsulta")
+			req.Motivo = ui.ReadInput("Motivo del rechazo")
+		case 3: // Completar con informe
+			req.Action = api.ActionCompletarInterconsulta
+			req.ID = ui.ReadInt("Número de la interconsulta")
+			req.Informe = ui.ReadInput("Informe")
+		case 4: // Volver
+			return
+		}
+		res = c.sendRequest(req)
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		fmt.Println("Éxito:", res.Success)
+		fmt.Println("Mensaje:", res.Message)
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// solicitarInterconsulta deriva al paciente del expediente a otra
+// especialidad.
+func (c *client) solicitarInterconsulta(expID int) {
+	hospitales, especialidades := c.catalogos()
+	especialidad := elegirEntrada("Especialidad de destino", especialidades, "")
+	hospital := elegirEntrada("Hospital de destino", hospitales, "Mi hospital")
+	motivo := ui.ReadInput("Motivo de la interconsulta")
+	prioridades := []string{api.PrioridadUrgente, api.PrioridadPreferente, api.PrioridadNormal}
+	prioridad := prioridades[ui.PrintMenu("Prioridad", []string{"Urgente", "Preferente", "Normal"})-1]
+
+	res := c.sendRequest(api.Request{
+		Action:       api.ActionSolicitarInterconsulta,
+		Token:        c.authToken,
+		Username:     c.currentUser,
+		ID:           expID,
+		Especialidad: especialidad,
+		Hospital:     hospital,
+		Motivo:       motivo,
+		Prioridad:    prioridad,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// Traslado es el paso de un paciente a otro hospital tal y como lo
+// devuelve el servidor.
+type Traslado struct {
+	ID              int    `json:"id"`
+	Paciente        string `json:"paciente"`
+	Motivo          string `json:"motivo"`
+	Fecha_efectiva  string `json:"fecha_efectiva"`
+	Estado          string `json:"estado"`
+	Solicitado_por  string `json:"solicitado_por"`
+	Nombre_paciente string `json:"nombre_paciente"`
+	Nombre_origen   string `json:"nombre_origen"`
+}
+
+// solicitarTraslado pide trasladar al paciente actual a otro hospital.
+func (c *client) solicitarTraslado() {
+	hospitales, _ := c.catalogos()
+	hospital := elegirEntrada("Hospital de destino", hospitales, "")
+	fecha := ui.ReadInput("Fecha efectiva (AAAA-MM-DD, vacío para hoy)")
+	motivo := ui.ReadInput("Motivo del traslado")
+	res := c.sendRequest(api.Request{
+		Action:      api.ActionSolicitarTraslado,
+		Token:       c.authToken,
+		Username:    c.currentUser,
+		Paciente:    c.currentPaciente,
+		Hospital:    hospital,
+		FechaInicio: fecha,
+		Motivo:      motivo,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// trasladosEntrantes muestra los traslados de pacientes hacia el hospital
+// del médico y permite aceptarlos o rechazarlos.
+func (c *client) trasladosEntrantes() {
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Traslados hacia mi hospital **")
+
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionListarTraslados,
+			Token:    c.authToken,
+			Username: c.currentUser,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		for _, registro := range res.Registros {
+			var traslado Traslado
+			if err := json.Unmarshal(registro, &traslado); err != nil {
+				fmt.Println("Error al leer el traslado:", err)
+				continue
+			}
+			fmt.Printf("  [%d] %s - %s (%s) desde %s, pedido por %s [%s]\n",
+				traslado.ID, traslado.Fecha_efectiva, traslado.Nombre_paciente, traslado.Paciente, traslado.Nombre_origen, traslado.Solicitado_por, traslado.Estado)
+			fmt.Printf("       %s\n", traslado.Motivo)
+		}
+		if len(res.Registros) == 0 {
+			fmt.Println("  No hay traslados pendientes")
+		}
+		fmt.Println()
+
+		req := api.Request{Token: c.authToken, Username: c.currentUser}
+		switch ui.PrintMenu("Opciones", []string{"Aceptar", "Rechazar", "Volver"}) {
+		case 1: // Aceptar
+			req.Action = api.ActionAceptarTraslado
+			req.ID = ui.ReadInt("Número del traslado")
+		case 2: // Rechazar
+			req.Action = api.ActionRechazarTraslado
+			req.ID = ui.ReadInt("Número del traslado")
+			req.Motivo = ui.ReadInput("Motivo del rechazo")
+		case 3: // Volver
+			return
+		}
+		res = c.sendRequest(req)
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		fmt.Println("Éxito:", res.Success)
+		fmt.Println("Mensaje:", res.Message)
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// Delegacion es el permiso de un residente para escribir en los
+// expedientes de su supervisor, tal como lo devuelve el servidor.
+type Delegacion struct {
+	ID              int    `json:"id"`
+	Supervisor      string `json:"supervisor"`
+	Residente       string `json:"residente"`
+	Especialidad    int    `json:"especialidad"`
+	Paciente        string `json:"paciente"`
+	Desde           string `json:"desde"`
+	Hasta           string `json:"hasta"`
+	Nombre_paciente string `json:"nombre_paciente"`
+}
+
+// delegaciones muestra las delegaciones vigentes concedidas y recibidas, y
+// permite a los médicos delegar en un residente o revocar una delegación.
+func (c *client) delegaciones() {
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Delegaciones **")
+
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionListarDelegaciones,
+			Token:    c.authToken,
+			Username: c.currentUser,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		_, especialidades := c.catalogos()
+		for _, registro := range res.Registros {
+			var delegacion Delegacion
+			if err := json.Unmarshal(registro, &delegacion); err != nil {
+				fmt.Println("Error al leer la delegación:", err)
+				continue
+			}
+			alcance := "todos los pacientes"
+			if delegacion.Paciente != "" {
+				alcance = fmt.Sprintf("%s (%s)", delegacion.Nombre_paciente, delegacion.Paciente)
+			}
+			hasta := "sin fecha de fin"
+			if delegacion.Hasta != "" {
+				hasta = "hasta " + delegacion.Hasta
+			}
+			fmt.Printf("  [%d] %s supervisa a %s en %s: %s, %s\n", delegacion.ID, delegacion.Supervisor, delegacion.Residente,
+				nombreEntrada(especialidades, delegacion.Especialidad), alcance, hasta)
+		}
+		if len(res.Registros) == 0 {
+			fmt.Println("  No hay delegaciones vigentes")
+		}
+		fmt.Println()
+
+		// Los residentes sólo consultan las delegaciones que han recibido
+		if c.currentRol == api.RolResidente {
+			ui.Pause("Pulsa [Enter] para volver...")
+			return
+		}
+		req := api.Request{Token: c.authToken, Username: c.currentUser}
+		switch ui.PrintMenu("Opciones", []string{"Delegar en un residente", "Revocar delegación", "Volver"}) {
+		case 1: // Delegar en un residente
+			req.Action = api.ActionDelegarResidente
+			req.Medico = ui.ReadInput("Usuario del residente")
+			if ui.Confirm("¿Limitar la delegación a un paciente?") {
+				if req.TipoIdentificador, req.Identificador = c.leerIdentificador(); req.TipoIdentificador == "" {
+					continue
+				}
+			}
+			req.FechaFin = ui.ReadInput("Fecha de fin (AAAA-MM-DD, vacía si no caduca)")
+		case 2: // Revocar delegación
+			req.Action = api.ActionRevocarDelegacion
+			req.ID = ui.ReadInt("Número de la delegación")
+		case 3: // Volver
+			return
+		}
+		res = c.sendRequest(req)
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		fmt.Println("Éxito:", res.Success)
+		fmt.Println("Mensaje:", res.Message)
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// ObservacionPendiente es una observación de un residente que el médico
+// tiene pendiente de refrendar.
+type ObservacionPendiente struct {
+	Expediente      int           `json:"expediente"`
+	Paciente        string        `json:"paciente"`
+	Nombre_paciente string        `json:"nombre_paciente"`
+	Observacion     Observaciones `json:"observacion"`
+}
+
+// refrendosPendientes muestra las observaciones de los residentes que el
+// médico supervisa y le permite refrendarlas una a una.
+func (c *client) refrendosPendientes() {
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Refrendos pendientes **")
+
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionPendientesRefrendo,
+			Token:    c.authToken,
+			Username: c.currentUser,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		var pendientes []ObservacionPendiente
+		for _, registro := range res.Registros {
+			var pendiente ObservacionPendiente
+			if err := json.Unmarshal(registro, &pendiente); err != nil {
+				fmt.Println("Error al leer la observación:", err)
+				continue
+			}
+			pendientes = append(pendientes, pendiente)
+		}
+		if len(pendientes) == 0 {
+			fmt.Println("  No hay observaciones pendientes de refrendo")
+			return
+		}
+
+		options := make([]string, len(pendientes)+1)
+		for i, pendiente := range pendientes {
+			options[i] = fmt.Sprintf("Expediente %d, %s - observación #%d de %s", pendiente.Expediente,
+				pendiente.Nombre_paciente, pendiente.Observacion.ID, pendiente.Observacion.Medico)
+		}
+		options[len(pendientes)] = "Volver"
+		choice := ui.PrintMenu("Observación a revisar", options)
+		if choice == len(options) {
+			return
+		}
+		pendiente := pendientes[choice-1]
+		fmt.Printf("\nExpediente %d del paciente %s (%s):\n", pendiente.Expediente, pendiente.Nombre_paciente, pendiente.Paciente)
+		mostrarObservaciones([]Observaciones{pendiente.Observacion})
+		fmt.Println()
+		if !ui.Confirm("¿Refrendar la observación? Si hay que rectificarla, hágalo desde el expediente") {
+			continue
+		}
+		res = c.sendRequest(api.Request{
+			Action:      api.ActionRefrendarObservacion,
+			Token:       c.authToken,
+			Username:    c.currentUser,
+			ID:          pendiente.Expediente,
+			Observacion: pendiente.Observacion.ID,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		fmt.Println("Éxito:", res.Success)
+		fmt.Println("Mensaje:", res.Message)
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// Receta es la prescripción de un fármaco tal y como la devuelve el servidor.
+type Receta struct {
+	ID           int    `json:"id"`
+	Expediente   int    `json:"expediente"`
+	Farmaco      string `json:"farmaco"`
+	Dosis        string `json:"dosis"`
+	Via          string `json:"via"`
+	Frecuencia   string `json:"frecuencia"`
+	Fecha_inicio string `json:"fecha_inicio"`
+	Fecha_fin    string `json:"fecha_fin"`
+	Prescriptor  string `json:"prescriptor"`
+}
+
+// medicacionActiva lista las recetas activas del paciente actual y permite
+// prescribir, modificar o suspender.
+func (c *client) medicacionActiva() {
+	for {
+		ui.ClearScreen()
+		fmt.Printf("** Medicación activa del paciente %s **\n", c.currentPaciente)
+
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionListarRecetas,
+			Token:    c.authToken,
+			Username: c.currentUser,
+			Paciente: c.currentPaciente,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			ui.Pause("Pulsa [Enter] para continuar...")
+			return
+		}
+
+		for _, recetaBytes := range res.Registros {
+			var receta Receta
+			if err := json.Unmarshal(recetaBytes, &receta); err != nil {
+				fmt.Println("Error al procesar receta:", err)
+				continue
+			}
+			fin := receta.Fecha_fin
+			if fin == "" {
+				fin = "indefinido"
+			}
+			fmt.Printf("  Receta %d: %s %s, vía %s, %s (desde %s hasta %s; expediente %d, %s)\n",
+				receta.ID, receta.Farmaco, receta.Dosis, receta.Via, receta.Frecuencia,
+				receta.Fecha_inicio, fin, receta.Expediente, receta.Prescriptor)
+		}
+		if len(res.Registros) == 0 {
+			fmt.Println("  El paciente no tiene medicación activa")
+		}
+		fmt.Println()
+
+		choice := ui.PrintMenu("Opciones", []string{"Prescribir", "Modificar receta", "Suspender receta", "Volver"})
+		switch choice {
+		case 1: // Prescribir
+			c.prescribir()
+		case 2: // Modificar receta
+			c.modificarReceta()
+		case 3: // Suspender receta
+			c.suspenderReceta()
+		case 4: // Volver
+			return
+		}
+		ui.Pause("Pulsa [Enter] para continuar...")
+	}
+}
+
+// enviarReceta envía una prescripción o modificación mostrando los avisos de
+// interacción. Si alguna interacción es grave, pide confirmación y la reenvía
+// forzada.
+func (c *client) enviarReceta(req api.Request) {
+	res := c.sendRequest(req)
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+	for _, aviso := range res.Avisos {
+		fmt.Println("AVISO:", aviso)
+	}
+	if res.Success == -1 && len(res.Avisos) > 0 && !req.Forzar {
+		fmt.Println("Mensaje:", res.Message)
+		if !ui.Confirm("¿Prescribir igualmente?") {
+			return
+		}
+		req.Forzar = true
+		c.enviarReceta(req)
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// prescribir pide los datos de una nueva receta dentro de un expediente del
+// paciente.
+func (c *client) prescribir() {
+	ui.ClearScreen()
+	fmt.Println("** Prescribir **")
+
+	c.enviarReceta(api.Request{
+		Action:      api.ActionPrescribir,
+		Token:       c.authToken,
+		Username:    c.currentUser,
+		ID:          ui.ReadInt("Número de expediente"),
+		Farmaco:     ui.ReadInput("Fármaco"),
+		Dosis:       ui.ReadInput("Dosis"),
+		Via:         ui.ReadInput("Vía de administración"),
+		Frecuencia:  ui.ReadInput("Frecuencia"),
+		FechaInicio: ui.ReadInput("Fecha de inicio (AAAA-MM-DD, vacío para hoy)"),
+		FechaFin:    ui.ReadInput("Fecha de fin (AAAA-MM-DD, vacío si es indefinido)"),
+	})
+}
+
+// modificarReceta cambia la pauta de una receta; los campos que se dejan
+// vacíos no se modifican.
+func (c *client) modificarReceta() {
+	ui.ClearScreen()
+	fmt.Println("** Modificar receta **")
+	fmt.Println("Deje vacíos los campos que no cambian")
+
+	c.enviarReceta(api.Request{
+		Action:      api.ActionModificarReceta,
+		Token:       c.authToken,
+		Username:    c.currentUser,
+		Receta:      ui.ReadInt("Número de receta"),
+		Farmaco:     ui.ReadInput("Fármaco"),
+		Dosis:       ui.ReadInput("Dosis"),
+		Via:         ui.ReadInput("Vía de administración"),
+		Frecuencia:  ui.ReadInput("Frecuencia"),
+		FechaInicio: ui.ReadInput("Fecha de inicio (AAAA-MM-DD)"),
+		FechaFin:    ui.ReadInput("Fecha de fin (AAAA-MM-DD)"),
+	})
+}
+
+// suspenderReceta interrumpe una receta activa indicando el motivo.
+func (c *client) suspenderReceta() {
+	ui.ClearScreen()
+	fmt.Println("** Suspender receta **")
+
+	receta := ui.ReadInt("Número de receta")
+	motivo := ui.ReadInput("Motivo de la suspensión")
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionSuspenderReceta,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Receta:   receta,
+		Motivo:   motivo,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// buscarPaciente busca pacientes por nombre, apellido y, opcionalmente,
+// fecha de nacimiento y hospital, y permite elegir uno de los resultados.
+func (c *client) buscarPaciente() {
+	ui.ClearScreen()
+	fmt.Println("** Buscar paciente **")
+
+	req := api.Request{
+		Action:   api.ActionBuscarPacientes,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Nombre:   ui.ReadInput("Nombre (o su comienzo, en blanco para no filtrar)"),
+		Apellido: ui.ReadInput("Apellido (o su comienzo, en blanco para no filtrar)"),
+		Fecha:    ui.ReadInput("Fecha de nacimiento AAAA-MM-DD (en blanco para no filtrar)"),
+		Hospital: ui.ReadInt("ID de hospital (0 para no filtrar)"),
+		Pagina:   1,
+		Limite:   10,
+	}
+
+	type Paciente struct {
+		ID               string `json:"id"`
+		Nombre           string `json:"nombre"`
+		Apellido         string `json:"apellido"`
+		Fecha_nacimiento string `json:"fecha_nacimiento"`
+		Hospital         int    `json:"hospital"`
+	}
+
+	for {
+		res := c.sendRequest(req)
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		if res.Total == 0 {
+			fmt.Println("No se encontraron pacientes")
+			return
+		}
+
+		var pacientes []Paciente
+		for _, pacBytes := range res.Registros {
+			var pac Paciente
+			if err := json.Unmarshal(pacBytes, &pac); err != nil {
+				fmt.Println("Error al procesar paciente:", err)
+				continue
+			}
+			pacientes = append(pacientes, pac)
+		}
+
+		ui.ClearScreen()
+		fmt.Printf("%s (página %d)\n", res.Message, req.Pagina)
+		hospitales, _ := c.catalogos()
+		options := make([]string, 0, len(pacientes)+3)
+		for _, pac := range pacientes {
+			options = append(options, fmt.Sprintf("%s, %s (%s) - nacido el %s, %s", pac.Apellido, pac.Nombre, pac.ID, pac.Fecha_nacimiento, nombreEntrada(hospitales, pac.Hospital)))
+		}
+		hayAnterior := req.Pagina > 1
+		haySiguiente := req.Pagina*req.Limite < res.Total
+		if hayAnterior {
+			options = append(options, "Página anterior")
+		}
+		if haySiguiente {
+			options = append(options, "Página siguiente")
+		}
+		options = append(options, "Volver")
+
+		choice := ui.PrintMenu("Seleccionar paciente", options)
+		switch {
+		case choice <= len(pacientes):
+			pac := pacientes[choice-1]
+			res := c.sendRequest(api.Request{
+				Action:   api.ActionObtenerExpedientes,
+				Token:    c.authToken,
+				Username: c.currentUser,
+				Paciente: pac.ID,
+			})
+			if res.Success == 0 {
+				c.logoutUser()
+				return
+			}
+			if res.Success == -1 {
+				fmt.Println("Mensaje:", res.Message)
+				return
+			}
+			c.menuPaciente(res, fmt.Sprintf("%s, %s", pac.Apellido, pac.Nombre))
+			return
+		case options[choice-1] == "Página anterior":
+			req.Pagina--
+		case options[choice-1] == "Página siguiente":
+			req.Pagina++
+		default:
+			return
+		}
+	}
+}
+
+// darBajaPaciente pide el motivo de la baja y la envía al servidor.
+// Devuelve el estado del paciente tras la operación.
+func (c *client) darBajaPaciente(estado string) string {
+	ui.ClearScreen()
+	fmt.Println("** Dar de baja al paciente **")
+
+	estados := []string{api.EstadoBaja, api.EstadoFallecido, api.EstadoTrasladado}
+	choice := ui.PrintMenu("Estado final", []string{"Alta médica (baja)", "Fallecido", "Trasladado"})
+	motivo := ui.ReadInput("Motivo")
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionDarBaja,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Paciente: c.currentPaciente,
+		Estado:   estados[choice-1],
+		Motivo:   motivo,
+	})
+
+	if res.Success == 0 {
+		c.logoutUser()
+		return estado
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+	if res.Success == 1 {
+		return res.Estado
+	}
+	return estado
+}
+
+// reingresarPaciente abre un nuevo episodio de ingreso para el paciente actual.
+// Devuelve el estado del paciente tras la operación.
+func (c *client) reingresarPaciente(estado string) string {
+	ui.ClearScreen()
+	fmt.Println("** Reingresar al paciente **")
+
+	if !ui.Confirm("¿Desea reingresar al paciente?") {
+		return estado
+	}
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionReingresar,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Paciente: c.currentPaciente,
+	})
+
+	if res.Success == 0 {
+		c.logoutUser()
+		return estado
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+	if res.Success == 1 {
+		return res.Estado
+	}
+	return estado
+}
+
+func (c *client) crearExpediente() {
+	ui.ClearScreen()
+	fmt.Println("** Crear nuevo expediente **")
+
+	observaciones := ui.ReadInput("Observaciones: ")
+
+	// Diagnósticos codificados (opcionales)
+	var diagnosticos []string
+	for ui.Confirm("¿Añadir un diagnóstico codificado (CIE-10)?") {
+		if codigo := c.elegirCodigoCIE10(); codigo != "" {
+			diagnosticos = append(diagnosticos, codigo)
+		}
+	}
+
+	fmt.Println("Paciente:", c.currentPaciente)
+	fmt.Println(c.authToken.Value)
+	fmt.Println(c.currentUser)
+	fmt.Println(observaciones)
+
+	// Enviar solicitud al servidor
+	res := c.sendRequest(api.Request{
+		Action:       api.ActionCrearExpediente,
+		Token:        c.authToken,
+		Username:     c.currentUser,
+		Diagnostico:  observaciones,
+		Paciente:     c.currentPaciente,
+		Diagnosticos: diagnosticos,
+	})
+
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+	ui.Pause("Pulsa [Enter] para continuar...")
+}
+
+// elegirCodigoCIE10 busca en el catálogo CIE-10 por código o por texto y
+// deja elegir uno de los resultados. Devuelve "" si no se elige ninguno.
+func (c *client) elegirCodigoCIE10() string {
+	for {
+		consulta := ui.ReadInput("Buscar diagnóstico (código o texto)")
+		if consulta == "" {
+			return ""
+		}
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionBuscarCIE10,
+			Token:    c.authToken,
+			Username: c.currentUser,
+			Consulta: consulta,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return ""
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return ""
+		}
+
+		var codigos []string
+		var options []string
+		for _, registro := range res.Registros {
+			var entrada struct {
+				Codigo      string `json:"codigo"`
+				Descripcion string `json:"descripcion"`
+			}
+			if err := json.Unmarshal(registro, &entrada); err != nil {
+				continue
+			}
+			codigos = append(codigos, entrada.Codigo)
+			options = append(options, fmt.Sprintf("%s - %s", entrada.Codigo, entrada.Descripcion))
+		}
+		if len(codigos) == 0 {
+			fmt.Println("No se encontraron códigos para", consulta)
+			continue
+		}
+		if res.Total > len(codigos) {
+			fmt.Printf("Mostrando %d de %d resultados; afine la búsqueda si no aparece el código.\n", len(codigos), res.Total)
+		}
+		options = append(options, "Buscar de nuevo", "Cancelar")
+
+		choice := ui.PrintMenu("Seleccionar diagnóstico", options)
+		switch {
+		case choice <= len(codigos):
+			return codigos[choice-1]
+		case options[choice-1] == "Cancelar":
+			return ""
+		}
+	}
+}
+
+func (c *client) elegirExpediente(paciente string) {
+	// Parsear los expedientes
+	type Expediente struct {
+		ID            int             `json:"id"`
+		Version       uint64          `json:"version"`
+		Medico        string          `json:"medico"`
+		Observaciones []Observaciones `json:"observaciones"`
+		FechaCreacion string          `json:"fecha_creacion"`
+		Especialidad  int             `json:"especialidad"`
+		Adjuntos      []Adjunto       `json:"adjuntos"`
+	}
+
+	// Los expedientes llegan por páginas; guardamos los cursores de las
+	// páginas ya vistas para poder volver atrás.
+	var cursores []string
+	cursor := ""
+	for {
+		ui.ClearScreen()
+		fmt.Println("** Elegir expediente **")
+
+		// Obtener la página de expedientes del servidor, los más recientes primero
+		res := c.sendRequest(api.Request{
+			Action:      api.ActionObtenerExpedientes,
+			Token:       c.authToken,
+			Username:    c.currentUser,
+			Paciente:    paciente,
+			Cursor:      cursor,
+			Limite:      10,
+			Descendente: true,
+		})
+
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			ui.Pause("Pulsa [Enter] para continuar...")
+			return
+		}
+
+		var listaExpedientes []Expediente
+		for _, expBytes := range res.Expedientes {
+			var exp Expediente
+			if err := json.Unmarshal(expBytes, &exp); err != nil {
+				fmt.Println("Error al procesar expediente:", err)
+				continue
+			}
+			listaExpedientes = append(listaExpedientes, exp)
+		}
+
+		if len(listaExpedientes) == 0 {
+			fmt.Println("No se encontraron expedientes válidos")
+			ui.Pause("Pulsa [Enter] para continuar...")
+			return
+		}
+
+		fmt.Printf("Expedientes de %s (%d en total):\n", paciente, res.Total)
+		options := make([]string, len(listaExpedientes))
+		for i, exp := range listaExpedientes {
+			options[i] = fmt.Sprintf("Nº %d - Fecha: %s - %d observaciones", exp.ID, exp.FechaCreacion, len(exp.Observaciones))
+		}
+		if len(cursores) > 0 {
+			options = append(options, "Página anterior")
+		}
+		if res.Cursor != "" {
+			options = append(options, "Página siguiente")
+		}
+		options = append(options, "Volver")
+
+		choice := ui.PrintMenu("Seleccionar expediente", options)
+		switch {
+		case choice > len(listaExpedientes) && options[choice-1] == "Página anterior":
+			cursor = cursores[len(cursores)-1]
+			cursores = cursores[:len(cursores)-1]
+			continue
+		case choice > len(listaExpedientes) && options[choice-1] == "Página siguiente":
+			cursores = append(cursores, cursor)
+			cursor = res.Cursor
+			continue
+		case choice > len(listaExpedientes):
+			return
+		}
+
+		selectedExp := listaExpedientes[choice-1]
+
+		// Submenú para el expediente seleccionado
+		ui.ClearScreen()
+		fmt.Printf("Expediente nº %d - Fecha: %s\n", selectedExp.ID, selectedExp.FechaCreacion)
+		subOptions := []string{"Visualizar", "Editar", "Corregir observación", "Anular observación", "Historial de cambios", "Ver en una fecha", "Adjuntar fichero", "Descargar adjunto", "Solicitar interconsulta", "Volver"}
+		subChoice := ui.PrintMenu("Opciones", subOptions)
+
+		switch subChoice {
+		case 1: // Visualizar
+			fmt.Println("Creado por:", selectedExp.Medico)
+			fmt.Println("Fecha creación:", selectedExp.FechaCreacion)
+			_, especialidades := c.catalogos()
+			fmt.Println("Especialidad:", nombreEntrada(especialidades, selectedExp.Especialidad))
+			fmt.Println("Observaciones:")
+			mostrarObservaciones(selectedExp.Observaciones)
+			if len(selectedExp.Adjuntos) > 0 {
+				fmt.Println("Adjuntos:")
+				mostrarAdjuntos(selectedExp.Adjuntos)
+			}
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 2: // Editar
+			observaciones := ui.ReadInput("Nueva observación: ")
+			c.actualizarExpediente(selectedExp.ID, selectedExp.Version, observaciones)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 3: // Corregir observación
+			c.rectificarObservacion(selectedExp.ID, selectedExp.Version, selectedExp.Observaciones, false)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 4: // Anular observación
+			c.rectificarObservacion(selectedExp.ID, selectedExp.Version, selectedExp.Observaciones, true)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 5: // Historial de cambios
+			c.historialExpediente(selectedExp.ID)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 6: // Ver en una fecha
+			c.expedienteEnFecha(selectedExp.ID)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 7: // Adjuntar fichero
+			c.subirAdjunto(selectedExp.ID)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 8: // Descargar adjunto
+			c.descargarAdjunto(selectedExp.Adjuntos)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 9: // Solicitar interconsulta
+			c.solicitarInterconsulta(selectedExp.ID)
+			ui.Pause("Pulsa [Enter] para continuar...")
+		case 10: // Volver
+			continue
+		}
+	}
+}
+
+// Tamaño de los fragmentos en que se suben los adjuntos. Debe ser menor o
+// igual que el máximo que acepta el servidor.
+const tamanyoFragmento = 256 << 10
+
+// Adjunto describe un fichero adjunto a un expediente.
+type Adjunto struct {
+	ID         int    `json:"id"`
+	Nombre     string `json:"nombre"`
+	Tipo       string `json:"tipo"`
+	Tamanyo    int64  `json:"tamanyo"`
+	Sha256     string `json:"sha256"`
+	Fragmentos int    `json:"fragmentos"`
+	Subido_por string `json:"subido_por"`
+	Fecha      string `json:"fecha"`
+}
+
+// mostrarAdjuntos imprime la lista de adjuntos de un expediente.
+func mostrarAdjuntos(adjuntos []Adjunto) {
+	for _, adjunto := range adjuntos {
+		fmt.Printf("  Adjunto %d: %s (%s, %d KB) - %s, %s\n", adjunto.ID, adjunto.Nombre, adjunto.Tipo, (adjunto.Tamanyo+1023)/1024, adjunto.Subido_por, adjunto.Fecha)
+	}
+}
+
+// subirAdjunto sube un fichero local al expediente en fragmentos. El
+// servidor comprueba al final que el SHA-256 coincide con el del fichero.
+func (c *client) subirAdjunto(expID int) {
+	ui.ClearScreen()
+	fmt.Println("** Adjuntar fichero **")
+
+	ruta := ui.ReadInput("Ruta del fichero (PDF o imagen)")
+	contenido, err := os.ReadFile(ruta)
+	if err != nil {
+		fmt.Println("No se puede leer el fichero:", err)
+		return
+	}
+	suma := sha256.Sum256(contenido)
+
+	res := c.sendRequest(api.Request{
+		Action:        api.ActionIniciarAdjunto,
+		Token:         c.authToken,
+		Username:      c.currentUser,
+		ID:            expID,
+		NombreFichero: filepath.Base(ruta),
+		Tamanyo:       int64(len(contenido)),
+		Sha256:        hex.EncodeToString(suma[:]),
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+	if res.Success == -1 {
+		fmt.Println("Mensaje:", res.Message)
+		return
+	}
+	adjunto := res.Adjunto
+
+	for fragmento, inicio := 0, 0; inicio < len(contenido); fragmento, inicio = fragmento+1, inicio+tamanyoFragmento {
+		fin := min(inicio+tamanyoFragmento, len(contenido))
+		res = c.sendRequest(api.Request{
+			Action:    api.ActionSubirFragmento,
+			Token:     c.authToken,
+			Username:  c.currentUser,
+			Adjunto:   adjunto,
+			Fragmento: fragmento,
+			Contenido: contenido[inicio:fin],
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println()
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		ui.PrintProgressBar(fin, len(contenido), 40)
+	}
+
+	res = c.sendRequest(api.Request{
+		Action:   api.ActionCompletarAdjunto,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		Adjunto:  adjunto,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// descargarAdjunto descarga uno de los adjuntos del expediente, comprueba
+// su SHA-256 y lo guarda en la ruta local indicada.
+func (c *client) descargarAdjunto(adjuntos []Adjunto) {
+	ui.ClearScreen()
+	fmt.Println("** Descargar adjunto **")
+	if len(adjuntos) == 0 {
+		fmt.Println("El expediente no tiene adjuntos")
+		return
+	}
+	options := make([]string, len(adjuntos))
+	for i, adjunto := range adjuntos {
+		options[i] = fmt.Sprintf("%s (%s, %d KB)", adjunto.Nombre, adjunto.Tipo, (adjunto.Tamanyo+1023)/1024)
+	}
+	adjunto := adjuntos[ui.PrintMenu("Seleccionar adjunto", options)-1]
+
+	ruta := ui.ReadInput(fmt.Sprintf("Guardar en (vacío para ./%s)", adjunto.Nombre))
+	if ruta == "" {
+		ruta = adjunto.Nombre
+	}
+	if info, err := os.Stat(ruta); err == nil && info.IsDir() {
+		ruta = filepath.Join(ruta, adjunto.Nombre)
+	}
+	if _, err := os.Stat(ruta); err == nil && !ui.Confirm(fmt.Sprintf("%s ya existe. ¿Sobrescribir?", ruta)) {
+		return
+	}
+
+	var contenido []byte
+	for fragmento := 0; fragmento < adjunto.Fragmentos; fragmento++ {
+		res := c.sendRequest(api.Request{
+			Action:    api.ActionDescargarAdjunto,
+			Token:     c.authToken,
+			Username:  c.currentUser,
+			Adjunto:   adjunto.ID,
+			Fragmento: fragmento,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println()
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+		contenido = append(contenido, res.Contenido...)
+		ui.PrintProgressBar(fragmento+1, adjunto.Fragmentos, 40)
+	}
+
+	suma := sha256.Sum256(contenido)
+	if hex.EncodeToString(suma[:]) != adjunto.Sha256 {
+		fmt.Println("El contenido descargado no coincide con el SHA-256 del adjunto; no se guarda")
+		return
+	}
+	if err := os.WriteFile(ruta, contenido, 0600); err != nil {
+		fmt.Println("Error al guardar el fichero:", err)
+		return
+	}
+	fmt.Printf("Adjunto guardado en %s (SHA-256 verificado)\n", ruta)
+}
+
+// rectificarObservacion pide la observación a corregir (o anular), el
+// motivo y, en las correcciones, el texto correcto.
+func (c *client) rectificarObservacion(expID int, version uint64, observaciones []Observaciones, anular bool) {
+	ui.ClearScreen()
+	accion, titulo := api.ActionCorregirObservacion, "** Corregir observación **"
+	if anular {
+		accion, titulo = api.ActionAnularObservacion, "** Anular observación **"
+	}
+	fmt.Println(titulo)
+	mostrarObservaciones(observaciones)
+
+	numero := ui.ReadInt("Número de la observación")
+	diagnostico := ""
+	if !anular {
+		diagnostico = ui.ReadInput("Texto corregido")
+	}
+	motivo := ui.ReadInput("Motivo")
+
+	res := c.sendRequest(api.Request{
+		Action:          accion,
+		Token:           c.authToken,
+		Username:        c.currentUser,
+		ID:              expID,
+		Observacion:     numero,
+		Diagnostico:     diagnostico,
+		Motivo:          motivo,
+		ExpectedVersion: int(version),
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+	if res.Conflicto {
+		fmt.Println("Vuelva a abrir el expediente para ver los cambios antes de rectificar.")
+	}
+}
+
+// historialExpediente muestra quién modificó el expediente, cuándo y qué
+// cambió en cada revisión.
+func (c *client) historialExpediente(expID int) {
+	ui.ClearScreen()
+	fmt.Printf("** Historial de cambios del expediente %d **\n", expID)
+
+	type Cambio struct {
+		Campo    string          `json:"campo"`
+		Anterior json.RawMessage `json:"anterior"`
+		Nuevo    json.RawMessage `json:"nuevo"`
+	}
+	type Revision struct {
+		Numero  uint64   `json:"numero"`
+		Usuario string   `json:"usuario"`
+		Fecha   string   `json:"fecha"`
+		Accion  string   `json:"accion"`
+		Cambios []Cambio `json:"cambios"`
+	}
+
+	cursor := ""
+	for {
+		res := c.sendRequest(api.Request{
+			Action:   api.ActionHistorialExpediente,
+			Token:    c.authToken,
+			Username: c.currentUser,
+			ID:       expID,
+			Cursor:   cursor,
+		})
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+		if res.Success == -1 {
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+
+		for _, revJson := range res.Registros {
+			var rev Revision
+			if err := json.Unmarshal(revJson, &rev); err != nil {
+				fmt.Println("Error al procesar revisión:", err)
+				continue
+			}
+			fmt.Printf("Revisión %d - %s - %s (%s)\n", rev.Numero, rev.Fecha, rev.Usuario, rev.Accion)
+			for _, cambio := range rev.Cambios {
+				if cambio.Anterior == nil {
+					fmt.Printf("    %s: + %s\n", cambio.Campo, cambio.Nuevo)
+				} else {
+					fmt.Printf("    %s: %s -> %s\n", cambio.Campo, cambio.Anterior, cambio.Nuevo)
+				}
+			}
+		}
+
+		if res.Cursor == "" || !ui.Confirm("¿Ver más revisiones?") {
+			return
+		}
+		cursor = res.Cursor
+	}
+}
+
+// expedienteEnFecha muestra el expediente tal y como estaba en una fecha.
+func (c *client) expedienteEnFecha(expID int) {
+	fecha := ui.ReadInput("Fecha (AAAA-MM-DD)")
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionExpedienteEnFecha,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		ID:       expID,
+		Fecha:    fecha,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+	fmt.Println("Mensaje:", res.Message)
+	if res.Success == -1 || len(res.Expedientes) == 0 {
+		return
+	}
+
+	var exp struct {
+		Medico        string          `json:"medico"`
+		Observaciones []Observaciones `json:"observaciones"`
+		FechaCreacion string          `json:"fecha_creacion"`
+	}
+	if err := json.Unmarshal(res.Expedientes[0], &exp); err != nil {
+		fmt.Println("Error al procesar expediente:", err)
+		return
+	}
+	fmt.Println("Creado por:", exp.Medico, "el", exp.FechaCreacion)
+	mostrarObservaciones(exp.Observaciones)
+}
+
+// actualizarExpediente envía una nueva observación para el expediente,
+// indicando la versión que se ha visto. Si otro médico lo ha modificado
+// entretanto, muestra el expediente actual y ofrece reenviar la observación.
+func (c *client) actualizarExpediente(expID int, version uint64, observaciones string) {
+	ui.ClearScreen()
+	fmt.Println("** Actualizar expediente **")
+
+	for {
+		// Obtener la fecha actual
+		fechaActual := time.Now().Format("2006-01-02") // Formato YYYY-MM-DD, ajusta si necesitas otro
+
+		// Enviar la solicitud al servidor
+		res := c.sendRequest(api.Request{
+			Action:          api.ActionModificarExpediente,
+			Token:           c.authToken,
+			ID:              expID,
+			Username:        c.currentUser,
+			Diagnostico:     observaciones,
+			Fecha:           fechaActual,
+			ExpectedVersion: int(version),
+		})
+
+		if res.Success == 0 {
+			c.logoutUser()
+			return
+		}
+
+		if !res.Conflicto || len(res.Expedientes) == 0 {
+			fmt.Println("Éxito:", res.Success)
+			fmt.Println("Mensaje:", res.Message)
+			return
+		}
+
+		// Conflicto: mostramos el expediente actualizado
+		var actual struct {
+			Observaciones []Observaciones `json:"observaciones"`
+			Version       uint64          `json:"version"`
+		}
+		if err := json.Unmarshal(res.Expedientes[0], &actual); err != nil {
+			fmt.Println("Error al procesar expediente:", err)
+			return
+		}
+		fmt.Println("Mensaje:", res.Message)
+		fmt.Println("Observaciones actuales:")
+		mostrarObservaciones(actual.Observaciones)
+		fmt.Println("Su observación pendiente:", observaciones)
+		if !ui.Confirm("¿Desea añadir su observación al expediente actualizado?") {
+			return
+		}
+		version = actual.Version
+	}
+}
+
+func (c *client) darAltaPaciente() {
+	ui.ClearScreen()
+	fmt.Println("** Dar de alta al paciente **")
+
+	nombre := ui.ReadInput("Nombre: ")
+	apellido := ui.ReadInput("Apellido: ")
+	fecha_nacimiento := ui.ReadInput("Fecha de nacimiento (AAAA-dd-mm): ")
+	dni := c.leerDNI("DNI o NIE del paciente (en blanco si no tiene)")
+	var tipo, identificador string
+	if ui.Confirm("¿Tiene otro identificador (pasaporte, NHC, tarjeta SIP)?") {
+		tipo, identificador = c.leerIdentificador()
+	}
+	sexo := ui.ReadInput("Sexo (H,M,O)")
+
+	// Enviamos la acción al servidor
+	req := api.Request{
+		Action:            api.ActionDarAlta,
+		Token:             c.authToken,
+		Username:          c.currentUser,
+		Nombre:            nombre,
+		Apellido:          apellido,
+		Fecha:             fecha_nacimiento,
+		Sexo:              sexo,
+		DNI:               dni,
+		Hospital:          c.currentHospital,
+		TipoIdentificador: tipo,
+		Identificador:     identificador,
+	}
+	res := c.sendRequest(req)
+
+	// Si hay pacientes que parecen la misma persona, avisamos antes de registrar
+	duplicados := res.Duplicados
+	if res.Success == -1 && len(duplicados) > 0 {
+		fmt.Println(res.Message + ":")
+		for _, d := range duplicados {
+			fmt.Println(" - Paciente", d)
+		}
+		if !ui.Confirm("¿Desea registrar al paciente igualmente?") {
+			return
+		}
+		req.Forzar = true
+		res = c.sendRequest(req)
+	}
+
+	if res.Success == 0 {
+		c.logoutUser()
+	}
+
+	// Mostramos resultado
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+
+	if res.Success == 1 && req.Forzar && ui.Confirm("¿Desea solicitar a un administrador la fusión con un duplicado?") {
+		c.solicitarFusion(res.Paciente, duplicados)
+	}
+}
+
+// leerDNI pide un DNI o NIE hasta que sea válido y lo devuelve normalizado.
+// Devuelve una cadena vacía si el usuario deja el campo en blanco.
+func (c *client) leerDNI(prompt string) string {
+	for {
+		entrada := ui.ReadInput(prompt)
+		if entrada == "" {
+			return ""
+		}
+		dni, err := validation.ValidarDocumento(entrada)
+		if err == nil {
+			return dni
+		}
+		fmt.Printf("DNI/NIE no válido (%s): %v\n", entrada, err)
+	}
+}
+
+// leerIdentificador pide el tipo y el valor de un identificador de paciente
+// hasta que sea válido. Devuelve un tipo vacío si el usuario cancela.
+func (c *client) leerIdentificador() (string, string) {
+	tipos := []string{"", api.IdentificadorPasaporte, api.IdentificadorNHC, api.IdentificadorSIP}
+	choice := ui.PrintMenu("Tipo de identificador", []string{"DNI o NIE", "Pasaporte", "Número de historia clínica (NHC)", "Tarjeta SIP", "Cancelar"})
+	if choice == 5 {
+		return "", ""
+	}
+
+	if choice == 1 {
+		dni := c.leerDNI("DNI o NIE del paciente (en blanco para cancelar)")
+		if dni == "" {
+			return "", ""
+		}
+		if strings.ContainsRune("XYZ", rune(dni[0])) {
+			return api.IdentificadorNIE, dni
+		}
+		return api.IdentificadorDNI, dni
+	}
+
+	tipo := tipos[choice-1]
+	for {
+		entrada := ui.ReadInput("Identificador (en blanco para cancelar)")
+		if entrada == "" {
+			return "", ""
+		}
+		valor := validation.NormalizarIdentificador(tipo, entrada)
+		err := validation.ValidarIdentificador(tipo, valor)
+		if err == nil {
+			return tipo, valor
+		}
+		fmt.Printf("Identificador no válido (%s): %v\n", entrada, err)
+	}
+}
+
+// anyadirIdentificador asocia un nuevo identificador al paciente actual.
+func (c *client) anyadirIdentificador() {
+	ui.ClearScreen()
+	fmt.Println("** Añadir identificador **")
+
+	tipo, identificador := c.leerIdentificador()
+	if tipo == "" {
+		return
+	}
+
+	res := c.sendRequest(api.Request{
+		Action:            api.ActionAnyadirIdentificador,
+		Token:             c.authToken,
+		Username:          c.currentUser,
+		Paciente:          c.currentPaciente,
+		TipoIdentificador: tipo,
+		Identificador:     identificador,
+	})
+
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// solicitarFusion pide al servidor que un administrador revise la fusión
+// del paciente con uno de sus posibles duplicados.
+func (c *client) solicitarFusion(paciente string, duplicados []string) {
+	options := make([]string, len(duplicados))
+	for i, d := range duplicados {
+		options[i] = "Paciente " + d
+	}
+	choice := ui.PrintMenu("Duplicado a fusionar", options)
+
+	res := c.sendRequest(api.Request{
+		Action:    api.ActionSolicitarFusion,
+		Token:     c.authToken,
+		Username:  c.currentUser,
+		Paciente:  paciente,
+		Duplicado: duplicados[choice-1],
+	})
+
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// gestionarFusiones muestra las solicitudes de fusión pendientes y permite
+// al administrador fusionar pacientes o deshacer una fusión reciente.
+func (c *client) gestionarFusiones() {
+	ui.ClearScreen()
+	fmt.Println("** Fusiones de pacientes **")
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionListarSolicitudesFusion,
+		Token:    c.authToken,
+		Username: c.currentUser,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+	if res.Success == -1 {
+		fmt.Println("Mensaje:", res.Message)
+		return
+	}
+
+	type SolicitudFusion struct {
+		ID          int    `json:"id"`
+		DNI         string `json:"dni"`
+		Duplicado   string `json:"duplicado"`
+		Solicitante string `json:"solicitante"`
+		Fecha       string `json:"fecha"`
+	}
+
+	var solicitudes []SolicitudFusion
+	for _, solBytes := range res.Registros {
+		var sol SolicitudFusion
+		if err := json.Unmarshal(solBytes, &sol); err != nil {
+			fmt.Println("Error al procesar solicitud:", err)
+			continue
+		}
+		solicitudes = append(solicitudes, sol)
+	}
+
+	options := make([]string, 0, len(solicitudes)+3)
+	for _, sol := range solicitudes {
+		options = append(options, fmt.Sprintf("Solicitud %d: %s y %s (%s, %s)", sol.ID, sol.DNI, sol.Duplicado, sol.Solicitante, sol.Fecha))
+	}
+	options = append(options, "Fusión manual", "Deshacer fusión", "Volver")
+	choice := ui.PrintMenu("Seleccionar solicitud u opción", options)
+
+	var conservado, duplicado string
+	switch {
+	case choice <= len(solicitudes):
+		sol := solicitudes[choice-1]
+		superviviente := ui.PrintMenu("¿Qué paciente se conserva?", []string{"Paciente " + sol.DNI, "Paciente " + sol.Duplicado})
+		conservado, duplicado = sol.DNI, sol.Duplicado
+		if superviviente == 2 {
+			conservado, duplicado = sol.Duplicado, sol.DNI
+		}
+	case options[choice-1] == "Fusión manual":
+		conservado = ui.ReadInput("DNI o identificador interno del paciente que se conserva")
+		duplicado = ui.ReadInput("DNI o identificador interno del paciente duplicado")
+	case options[choice-1] == "Deshacer fusión":
+		c.deshacerFusion()
+		return
+	default:
+		return
+	}
+
+	if !ui.Confirm(fmt.Sprintf("¿Fusionar el paciente %s en el paciente %s?", duplicado, conservado)) {
+		return
+	}
+	res = c.sendRequest(api.Request{
+		Action:    api.ActionMergePacientes,
+		Token:     c.authToken,
+		Username:  c.currentUser,
+		DNI:       conservado,
+		Duplicado: duplicado,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// deshacerFusion pide el número de fusión y solicita al servidor deshacerla.
+func (c *client) deshacerFusion() {
+	id := ui.ReadInt("Número de fusión")
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionDeshacerFusion,
+		Token:    c.authToken,
+		Username: c.currentUser,
+		ID:       id,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// reconstruirIndices pide al servidor que vuelva a generar los índices de
+// búsqueda a partir de los registros almacenados.
+func (c *client) reconstruirIndices() {
+	ui.ClearScreen()
+	fmt.Println("** Reconstruir índices **")
+
+	if !ui.Confirm("Se regenerarán todos los índices de búsqueda. ¿Continuar?") {
+		return
+	}
+
+	res := c.sendRequest(api.Request{
+		Action:   api.ActionReconstruirIndices,
+		Token:    c.authToken,
+		Username: c.currentUser,
+	})
+	if res.Success == 0 {
+		c.logoutUser()
+		return
+	}
+
+	fmt.Println("Éxito:", res.Success)
+	fmt.Println("Mensaje:", res.Message)
+}
+
+// fetchData pide datos privados al servidor.
+// El servidor devuelve la data asociada al usuario logueado.
+func (c *client) fetchData() {
 	ui.ClearScreen()
 	fmt.Println("** Obtener datos del usuario **")
 
@@ -462,9 +2669,100 @@ func (c *client) logoutUser() {
 
 	// Si fue exitoso, limpiamos la sesión local.
 	if res.Success == 1 {
+		c.detenerEventos()
 		c.currentUser = ""
 		c.authToken = api.Token{}
+		c.currentRol = ""
+	}
+}
+
+// Espera antes de reconectar con /events si se corta la conexión.
+const esperaReconexionEventos = 5 * time.Second
+
+// iniciarEventos arranca en segundo plano la escucha de las notificaciones
+// de la sesión actual.
+func (c *client) iniciarEventos() {
+	c.detenerEventos()
+	ctx, cancelar := context.WithCancel(context.Background())
+	c.cancelarEventos = cancelar
+	go c.escucharEventos(ctx, api.Request{Username: c.currentUser, Token: c.authToken})
+}
+
+// detenerEventos cierra la conexión con /events, si la hay.
+func (c *client) detenerEventos() {
+	if c.cancelarEventos != nil {
+		c.cancelarEventos()
+		c.cancelarEventos = nil
+	}
+}
+
+// escucharEventos mantiene la conexión con /events y guarda las
+// notificaciones recibidas hasta que se cancela el contexto o el servidor
+// rechaza la sesión. Si la conexión se corta, vuelve a conectar.
+func (c *client) escucharEventos(ctx context.Context, credenciales api.Request) {
+	jsonData, _ := json.Marshal(credenciales)
+	for {
+		peticion, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost:8080/events", bytes.NewReader(jsonData))
+		if err != nil {
+			return
+		}
+		peticion.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(peticion)
+		if err == nil {
+			if resp.StatusCode == http.StatusUnauthorized {
+				resp.Body.Close()
+				return
+			}
+			c.leerEventos(resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(esperaReconexionEventos):
+		}
+	}
+}
+
+// leerEventos lee el flujo Server-Sent Events y guarda el mensaje de cada
+// evento. Las líneas de comentario (latidos) se ignoran.
+func (c *client) leerEventos(flujo io.Reader) {
+	lector := bufio.NewScanner(flujo)
+	for lector.Scan() {
+		datos, ok := strings.CutPrefix(lector.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var evento api.Evento
+		if err := json.Unmarshal([]byte(datos), &evento); err != nil {
+			continue
+		}
+		fecha := evento.Fecha
+		if t, err := time.Parse(time.RFC3339, evento.Fecha); err == nil {
+			fecha = t.Format("15:04")
+		}
+		c.muNotificaciones.Lock()
+		c.notificaciones = append(c.notificaciones, fmt.Sprintf("[%s] %s", fecha, evento.Mensaje))
+		c.muNotificaciones.Unlock()
+	}
+}
+
+// mostrarNotificaciones imprime y descarta las notificaciones recibidas
+// desde la última vez.
+func (c *client) mostrarNotificaciones() {
+	c.muNotificaciones.Lock()
+	notificaciones := c.notificaciones
+	c.notificaciones = nil
+	c.muNotificaciones.Unlock()
+	if len(notificaciones) == 0 {
+		return
+	}
+	fmt.Println("** Notificaciones **")
+	for _, notificacion := range notificaciones {
+		fmt.Println("  " + notificacion)
 	}
+	fmt.Println()
 }
 
 // sendRequest envía un POST JSON a la URL del servidor y
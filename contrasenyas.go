@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+	"prac/pkg/validation"
+)
+
+const (
+	// Tiempo durante el que es válido un código de restablecimiento.
+	duracionCodigoReset = 15 * time.Minute
+	// Intentos fallidos tras los que el código deja de valer.
+	maxIntentosCodigoReset = 5
+	longitudCodigoReset    = 10
+	// Sin 0/O ni 1/I para que se pueda dictar sin confusiones; 32 símbolos,
+	// así que cada byte aleatorio módulo 32 no introduce sesgo.
+	alfabetoCodigoReset = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// CodigoReset se guarda en 'CodigosReset' con clave el usuario. Sólo se
+// guarda el hash del código; el código en claro lo ve una única vez el
+// administrador que lo genera.
+type CodigoReset struct {
+	Hash      string `json:"hash"` //SHA-256 del código, en hexadecimal
+	Expira    string `json:"expira"`
+	Intentos  int    `json:"intentos"` //intentos fallidos
+	Generador string `json:"generador"`
+}
+
+// hashCodigoReset devuelve el SHA-256 en hexadecimal del código.
+func hashCodigoReset(codigo string) string {
+	suma := sha256.Sum256([]byte(codigo))
+	return hex.EncodeToString(suma[:])
+}
+
+// nuevoCodigoReset genera un código aleatorio de longitudCodigoReset
+// símbolos de alfabetoCodigoReset.
+func nuevoCodigoReset() (string, error) {
+	aleatorio := make([]byte, longitudCodigoReset)
+	if _, err := rand.Read(aleatorio); err != nil {
+		return "", err
+	}
+	codigo := make([]byte, longitudCodigoReset)
+	for i, b := range aleatorio {
+		codigo[i] = alfabetoCodigoReset[int(b)%len(alfabetoCodigoReset)]
+	}
+	return string(codigo), nil
+}
+
+// generarCodigoReset emite un código de un solo uso con el que el usuario
+// req.Medico puede fijar una contraseña nueva. Sustituye a cualquier código
+// anterior del mismo usuario.
+func (s *server) generarCodigoReset(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" {
+		return api.Response{Success: -1, Message: "Falta el usuario"}
+	}
+	if res := s.usuarioDestino(req); res != nil {
+		return *res
+	}
+
+	codigo, err := nuevoCodigoReset()
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el código"}
+	}
+	expira := time.Now().Add(duracionCodigoReset)
+	codigoJson, err := json.Marshal(CodigoReset{
+		Hash:      hashCodigoReset(codigo),
+		Expira:    expira.Format(time.RFC3339),
+		Generador: req.Username,
+	})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el código a json"}
+	}
+	if err := s.db.Put("CodigosReset", []byte(req.Medico), codigoJson); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el código"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionGenerarCodigoReset, fmt.Sprintf("código de restablecimiento para %s", req.Medico))
+
+	return api.Response{
+		Success: 1,
+		Message: fmt.Sprintf("Código para %s válido hasta las %s; sólo puede usarse una vez", req.Medico, expira.Format("15:04")),
+		Data:    codigo,
+	}
+}
+
+// resetPassword fija la contraseña req.Password al usuario req.Username si
+// req.Codigo es su código de restablecimiento vigente. El código se consume
+// en la misma escritura que cambia la contraseña, y después se cierran las
+// sesiones del usuario.
+func (s *server) resetPassword(req api.Request) api.Response {
+	if req.Username == "" || req.Codigo == "" || req.Password == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (usuario, código y nueva contraseña)"}
+	}
+	if err := validation.ValidarContrasenya(req.Username, req.Password); err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+
+	// Mismo mensaje si no hay código, ha caducado o no coincide, para no
+	// revelar qué usuarios tienen uno pendiente.
+	invalido := api.Response{Success: -1, Message: "Código inválido o caducado"}
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		codigoJson, versionCodigo, err := s.db.GetWithVersion("CodigosReset", []byte(req.Username))
+		if noEncontrado(err) {
+			return invalido
+		} else if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener el código"}
+		}
+		var codigo CodigoReset
+		if err := json.Unmarshal(codigoJson, &codigo); err != nil {
+			return api.Response{Success: -1, Message: "Error al leer el código"}
+		}
+		if expira, err := time.Parse(time.RFC3339, codigo.Expira); err != nil || time.Now().After(expira) {
+			if err := s.db.Delete("CodigosReset", []byte(req.Username)); err != nil && !noEncontrado(err) {
+				s.log.Printf("Error borrando el código caducado de %s: %v", req.Username, err)
+			}
+			return invalido
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashCodigoReset(req.Codigo)), []byte(codigo.Hash)) != 1 {
+			codigo.Intentos++
+			op := store.Op{Namespace: "CodigosReset", Key: []byte(req.Username), CheckVersion: true, Version: versionCodigo}
+			if codigo.Intentos >= maxIntentosCodigoReset {
+				op.Delete = true
+			} else if op.Value, err = json.Marshal(codigo); err != nil {
+				return api.Response{Success: -1, Message: "Error al convertir el código a json"}
+			}
+			if err := s.db.Batch([]store.Op{op}); errors.Is(err, store.ErrVersionConflict) {
+				continue
+			} else if err != nil {
+				s.log.Printf("Error guardando los intentos del código de %s: %v", req.Username, err)
+			}
+			return invalido
+		}
+
+		usuarioJson, versionUsuario, err := s.db.GetWithVersion("Usuarios", []byte(req.Username))
+		if noEncontrado(err) {
+			return invalido
+		} else if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener el usuario"}
+		}
+		var usuario Usuario
+		if err := json.Unmarshal(usuarioJson, &usuario); err != nil {
+			return api.Response{Success: -1, Message: "Error al leer el usuario"}
+		}
+		usuario.Constraseña = req.Password
+		if usuarioJson, err = json.Marshal(usuario); err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir el usuario a json"}
+		}
+		err = s.db.Batch([]store.Op{
+			{Namespace: "CodigosReset", Key: []byte(req.Username), Delete: true, CheckVersion: true, Version: versionCodigo},
+			{Namespace: "Usuarios", Key: []byte(req.Username), Value: usuarioJson, CheckVersion: true, Version: versionUsuario},
+		})
+		if errors.Is(err, store.ErrVersionConflict) {
+			continue
+		} else if err != nil {
+			return api.Response{Success: -1, Message: "Error al guardar la contraseña"}
+		}
+
+		if err := s.cerrarSesiones(req.Username); err != nil {
+			s.log.Printf("Error cerrando la sesión de %s: %v", req.Username, err)
+		}
+		s.registrarAuditoria(req.Username, api.ActionResetPassword, fmt.Sprintf("contraseña restablecida con código de %s", codigo.Generador))
+		return api.Response{Success: 1, Message: "Contraseña restablecida; inicie sesión con la nueva contraseña"}
+	}
+	return api.Response{Success: -1, Message: "El código se está usando desde otra petición; inténtelo de nuevo"}
+}
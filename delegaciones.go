@@ -0,0 +1,403 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Índices de delegaciones por supervisor y por residente.
+const (
+	indiceDelegacionesSupervisor = "supervisor"
+	indiceDelegacionesResidente  = "residente"
+)
+
+// Índice de expedientes por los supervisores que tienen en ellos alguna
+// observación pendiente de refrendo.
+const indiceExpedientesRefrendo = "refrendo"
+
+// Acción de revisión con la que se refrenda una observación.
+const revisionRefrendo = "refrendo"
+
+// Estados de firma de una observación escrita por un residente. Las de los
+// demás médicos no llevan estado de firma.
+const (
+	firmaPendiente  = "pendiente"
+	firmaRefrendada = "refrendada"
+)
+
+// Delegacion permite a un residente escribir en los expedientes de la
+// especialidad de su supervisor, opcionalmente sólo en los de un paciente y
+// hasta una fecha. Lo que escribe queda pendiente de que el supervisor lo
+// refrende.
+type Delegacion struct {
+	ID               int    `json:"id"`
+	Supervisor       string `json:"supervisor"`
+	Residente        string `json:"residente"`
+	Especialidad     int    `json:"especialidad"`
+	Paciente         string `json:"paciente,omitempty"` //vacío: todos los pacientes
+	Desde            string `json:"desde"`
+	Hasta            string `json:"hasta,omitempty"` //AAAA-MM-DD, incluido; vacío: hasta que se revoque
+	Revocada         bool   `json:"revocada,omitempty"`
+	Fecha_revocacion string `json:"fecha_revocacion,omitempty"`
+	Nombre_paciente  string `json:"nombre_paciente,omitempty"` //sólo en las respuestas
+}
+
+// ObservacionPendiente es una observación pendiente de refrendo junto con
+// el expediente en el que está, tal como se envía al supervisor.
+type ObservacionPendiente struct {
+	Expediente      int           `json:"expediente"`
+	Paciente        string        `json:"paciente"`
+	Nombre_paciente string        `json:"nombre_paciente,omitempty"`
+	Observacion     Observaciones `json:"observacion"`
+}
+
+// supervisoresPendientes devuelve los supervisores que tienen alguna
+// observación pendiente de refrendo en el expediente.
+func supervisoresPendientes(expediente Expediente) []string {
+	vistos := make(map[string]bool)
+	var supervisores []string
+	for _, observacion := range expediente.Observaciones {
+		if observacion.Firma == firmaPendiente && !vistos[observacion.Supervisor] {
+			vistos[observacion.Supervisor] = true
+			supervisores = append(supervisores, observacion.Supervisor)
+		}
+	}
+	return supervisores
+}
+
+// delegacionVigente indica si la delegación está en vigor en la fecha 'hoy'
+// (AAAA-MM-DD).
+func delegacionVigente(delegacion Delegacion, hoy string) bool {
+	return !delegacion.Revocada && (delegacion.Hasta == "" || hoy <= delegacion.Hasta)
+}
+
+// esResidente indica si el usuario tiene el rol de residente.
+func (s *server) esResidente(username string) bool {
+	usuario, err := s.obtenerUsuario(username)
+	return err == nil && usuario.Rol == api.RolResidente
+}
+
+// obtenerDelegacion lee una delegación junto con su versión.
+func (s *server) obtenerDelegacion(id int) (Delegacion, uint64, error) {
+	var delegacion Delegacion
+	delegacionJson, version, err := s.db.GetWithVersion("Delegaciones", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return delegacion, 0, err
+	}
+	err = json.Unmarshal(delegacionJson, &delegacion)
+	return delegacion, version, err
+}
+
+// leerDelegaciones devuelve las delegaciones indexadas bajo 'valor' en el
+// índice indicado.
+func (s *server) leerDelegaciones(indice, valor string) ([]Delegacion, error) {
+	claves, err := s.indices.Query("Delegaciones", indice, []byte(valor))
+	if err != nil {
+		return nil, err
+	}
+	var delegaciones []Delegacion
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			return nil, fmt.Errorf("clave de delegación incorrecta: %q", clave)
+		}
+		delegacion, _, err := s.obtenerDelegacion(id)
+		if err != nil {
+			return nil, err
+		}
+		delegaciones = append(delegaciones, delegacion)
+	}
+	return delegaciones, nil
+}
+
+// supervisorDe devuelve el supervisor bajo cuya delegación escribe el
+// usuario en el expediente, o "" si no es residente y firma por sí mismo.
+// Si es residente y no tiene una delegación vigente que cubra el
+// expediente, devuelve un error para el cliente.
+func (s *server) supervisorDe(username string, expediente Expediente) (string, error) {
+	if !s.esResidente(username) {
+		return "", nil
+	}
+	delegaciones, err := s.leerDelegaciones(indiceDelegacionesResidente, username)
+	if err != nil {
+		return "", fmt.Errorf("Error al obtener las delegaciones")
+	}
+	hoy := time.Now().Format(time.DateOnly)
+	for _, delegacion := range delegaciones {
+		if !delegacionVigente(delegacion, hoy) || delegacion.Especialidad != expediente.Especialidad {
+			continue
+		}
+		if delegacion.Paciente != "" && delegacion.Paciente != expediente.Paciente {
+			continue
+		}
+		return delegacion.Supervisor, nil
+	}
+	return "", fmt.Errorf("No tiene una delegación vigente para escribir en el expediente %d", expediente.ID)
+}
+
+// firmarObservacion deja la observación pendiente del refrendo de
+// 'supervisor' si éste no está vacío.
+func firmarObservacion(observacion *Observaciones, supervisor string) {
+	if supervisor != "" {
+		observacion.Firma = firmaPendiente
+		observacion.Supervisor = supervisor
+	}
+}
+
+// delegarResidente concede al residente req.Medico permiso para escribir en
+// los expedientes de la especialidad del supervisor; sólo en los del
+// paciente indicado si lo hay, y hasta req.FechaFin si se indica.
+func (s *server) delegarResidente(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" {
+		return api.Response{Success: -1, Message: "Falta el residente"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	supervisor, err := s.obtenerUsuario(req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+	}
+	if supervisor.Rol == api.RolResidente {
+		return api.Response{Success: -1, Message: "Un residente no puede supervisar a otro"}
+	}
+	residente, err := s.obtenerUsuario(req.Medico)
+	if noEncontrado(err) {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el usuario %s", req.Medico)}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al verificar usuario"}
+	}
+	if residente.Rol != api.RolResidente {
+		return api.Response{Success: -1, Message: fmt.Sprintf("%s no es residente", req.Medico)}
+	}
+
+	hoy := time.Now().Format(time.DateOnly)
+	if req.FechaFin != "" {
+		if _, err := time.Parse(time.DateOnly, req.FechaFin); err != nil {
+			return api.Response{Success: -1, Message: "Fecha de fin incorrecta (AAAA-MM-DD)"}
+		}
+		if req.FechaFin < hoy {
+			return api.Response{Success: -1, Message: "La fecha de fin ya ha pasado"}
+		}
+	}
+	delegacion := Delegacion{
+		Supervisor:   req.Username,
+		Residente:    req.Medico,
+		Especialidad: supervisor.Especialidad,
+		Desde:        hoy,
+		Hasta:        req.FechaFin,
+	}
+	if req.Paciente != "" || req.TipoIdentificador != "" || req.DNI != "" {
+		if delegacion.Paciente, err = s.pacienteDeRequest(req); err != nil {
+			return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+		}
+		paciente, err := s.obtenerPaciente(delegacion.Paciente)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener el paciente"}
+		}
+		if puede, err := s.puedeVerPaciente(req.Username, paciente); err != nil {
+			return api.Response{Success: -1, Message: "Error al comprobar el hospital del paciente"}
+		} else if !puede {
+			return api.Response{Success: -1, Message: "El paciente pertenece a otro hospital"}
+		}
+	}
+
+	if delegacion.ID, err = s.siguienteSecuencia("Delegaciones"); err != nil {
+		return api.Response{Success: -1, Message: "Error al asignar el identificador de la delegación"}
+	}
+	delegacionJson, err := json.Marshal(delegacion)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la delegación a json"}
+	}
+	if err := s.db.Put("Delegaciones", []byte(strconv.Itoa(delegacion.ID)), delegacionJson); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la delegación"}
+	}
+	alcance := "todos los pacientes"
+	if delegacion.Paciente != "" {
+		alcance = "el paciente " + delegacion.Paciente
+	}
+	s.registrarAuditoria(req.Username, api.ActionDelegarResidente,
+		fmt.Sprintf("delegación %d en %s: especialidad %d, %s, hasta %q", delegacion.ID, req.Medico, delegacion.Especialidad, alcance, delegacion.Hasta))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Delegación %d concedida a %s (%s)", delegacion.ID, req.Medico, alcance), Total: delegacion.ID}
+}
+
+// revocarDelegacion retira la delegación req.ID. Sólo puede hacerlo su
+// supervisor. Lo que el residente escribió sigue pendiente de refrendo.
+func (s *server) revocarDelegacion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Falta la delegación"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	delegacion, version, err := s.obtenerDelegacion(req.ID)
+	if noEncontrado(err) {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la delegación %d", req.ID)}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la delegación"}
+	}
+	if delegacion.Supervisor != req.Username {
+		return api.Response{Success: -1, Message: "Sólo el supervisor puede revocar la delegación"}
+	}
+	if delegacion.Revocada {
+		return api.Response{Success: -1, Message: fmt.Sprintf("La delegación %d ya está revocada", req.ID)}
+	}
+
+	delegacion.Revocada = true
+	delegacion.Fecha_revocacion = time.Now().Format(time.RFC3339)
+	delegacionJson, err := json.Marshal(delegacion)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la delegación a json"}
+	}
+	err = s.db.Batch([]store.Op{{
+		Namespace:    "Delegaciones",
+		Key:          []byte(strconv.Itoa(delegacion.ID)),
+		Value:        delegacionJson,
+		CheckVersion: true,
+		Version:      version,
+	}})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la delegación"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionRevocarDelegacion, fmt.Sprintf("delegación %d en %s revocada", delegacion.ID, delegacion.Residente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Delegación %d revocada", req.ID)}
+}
+
+// listarDelegaciones devuelve las delegaciones vigentes que el médico ha
+// concedido y las que ha recibido.
+func (s *server) listarDelegaciones(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	concedidas, err := s.leerDelegaciones(indiceDelegacionesSupervisor, req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las delegaciones"}
+	}
+	recibidas, err := s.leerDelegaciones(indiceDelegacionesResidente, req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las delegaciones"}
+	}
+
+	hoy := time.Now().Format(time.DateOnly)
+	var registros [][]byte
+	for _, delegacion := range append(concedidas, recibidas...) {
+		if !delegacionVigente(delegacion, hoy) {
+			continue
+		}
+		if delegacion.Paciente != "" {
+			if paciente, err := s.obtenerPaciente(delegacion.Paciente); err == nil {
+				delegacion.Nombre_paciente = paciente.Nombre + " " + paciente.Apellido
+			}
+		}
+		delegacionJson, err := json.Marshal(delegacion)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la delegación a json"}
+		}
+		registros = append(registros, delegacionJson)
+	}
+	return api.Response{Success: 1, Message: fmt.Sprintf("%d delegaciones vigentes", len(registros)), Registros: registros}
+}
+
+// pendientesRefrendo devuelve las observaciones que el médico tiene
+// pendientes de refrendar, de la más antigua a la más reciente.
+func (s *server) pendientesRefrendo(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	claves, err := s.indices.Query("Expedientes", indiceExpedientesRefrendo, []byte(req.Username))
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los expedientes"}
+	}
+
+	var pendientes []ObservacionPendiente
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		expediente, err := s.obtenerExpediente(id)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener los expedientes"}
+		}
+		nombre := ""
+		if paciente, err := s.obtenerPaciente(expediente.Paciente); err == nil {
+			nombre = paciente.Nombre + " " + paciente.Apellido
+		}
+		for _, observacion := range expediente.Observaciones {
+			if observacion.Firma != firmaPendiente || observacion.Supervisor != req.Username {
+				continue
+			}
+			pendientes = append(pendientes, ObservacionPendiente{
+				Expediente:      expediente.ID,
+				Paciente:        expediente.Paciente,
+				Nombre_paciente: nombre,
+				Observacion:     observacion,
+			})
+		}
+	}
+	sort.SliceStable(pendientes, func(i, j int) bool {
+		return pendientes[i].Observacion.Fecha_actualizacion < pendientes[j].Observacion.Fecha_actualizacion
+	})
+
+	var registros [][]byte
+	for _, pendiente := range pendientes {
+		pendienteJson, err := json.Marshal(pendiente)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la observación a json"}
+		}
+		registros = append(registros, pendienteJson)
+	}
+	return api.Response{Success: 1, Message: fmt.Sprintf("%d observaciones pendientes de refrendo", len(registros)), Registros: registros, Total: len(registros)}
+}
+
+// refrendarObservacion firma como supervisor la observación req.Observacion
+// del expediente req.ID que escribió un residente. Si tiene algo que
+// corregir, el supervisor la rectifica antes o después con las acciones
+// habituales.
+func (s *server) refrendarObservacion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Observacion == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos del refrendo (expediente y observación)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	var residente string
+	res := s.modificarExpediente(req, revisionRefrendo, func(expediente *Expediente) error {
+		if req.Observacion < 1 || req.Observacion > len(expediente.Observaciones) {
+			return fmt.Errorf("No existe la observación %d en el expediente %d", req.Observacion, expediente.ID)
+		}
+		observacion := &expediente.Observaciones[req.Observacion-1]
+		if observacion.Firma != firmaPendiente {
+			return fmt.Errorf("La observación %d no está pendiente de refrendo", req.Observacion)
+		}
+		if observacion.Supervisor != req.Username {
+			return fmt.Errorf("La observación %d debe refrendarla %s", req.Observacion, observacion.Supervisor)
+		}
+		observacion.Firma = firmaRefrendada
+		observacion.Fecha_refrendo = time.Now().Format(time.RFC3339)
+		residente = observacion.Medico
+		return nil
+	})
+	if res.Success != 1 {
+		return res
+	}
+	s.registrarAuditoria(req.Username, api.ActionRefrendarObservacion,
+		fmt.Sprintf("observación %d del expediente %d, escrita por %s, refrendada", req.Observacion, req.ID, residente))
+	res.Message = fmt.Sprintf("Observación %d refrendada", req.Observacion)
+	return res
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"prac/pkg/api"
+)
+
+const (
+	// Eventos que pueden quedar en cola para una conexión lenta; los que no
+	// caben se descartan para no bloquear a quien los publica.
+	capacidadColaEventos = 32
+	// Cada cuánto se envía un comentario de latido, que además sirve para
+	// cerrar las conexiones cuya sesión ha terminado.
+	intervaloLatido = 25 * time.Second
+)
+
+// busEventos reparte los eventos publicados por los manejadores entre las
+// conexiones abiertas en /events. El valor cero está listo para usarse.
+type busEventos struct {
+	mu           sync.Mutex
+	suscriptores map[chan api.Evento]bool
+}
+
+// suscribir devuelve un canal por el que llegarán los eventos publicados a
+// partir de ahora.
+func (b *busEventos) suscribir() chan api.Evento {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.suscriptores == nil {
+		b.suscriptores = make(map[chan api.Evento]bool)
+	}
+	canal := make(chan api.Evento, capacidadColaEventos)
+	b.suscriptores[canal] = true
+	return canal
+}
+
+// cancelar deja de enviar eventos al canal.
+func (b *busEventos) cancelar(canal chan api.Evento) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.suscriptores, canal)
+}
+
+// publicar envía el evento a todos los suscriptores sin esperar a ninguno.
+// Devuelve cuántos lo han descartado por tener la cola llena.
+func (b *busEventos) publicar(evento api.Evento) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	descartados := 0
+	for canal := range b.suscriptores {
+		select {
+		case canal <- evento:
+		default:
+			descartados++
+		}
+	}
+	return descartados
+}
+
+// publicarEvento completa la fecha del evento y lo publica en el bus.
+func (s *server) publicarEvento(evento api.Evento) {
+	evento.Fecha = time.Now().Format(time.RFC3339)
+	if descartados := s.eventos.publicar(evento); descartados > 0 {
+		s.log.Printf("Evento %s descartado en %d conexiones con la cola llena", evento.Tipo, descartados)
+	}
+}
+
+// atiendeAPaciente indica si el médico es el responsable de alguno de los
+// expedientes del paciente.
+func (s *server) atiendeAPaciente(username, paciente string) (bool, error) {
+	claves, err := s.indices.QueryPrefix("Expedientes", indiceExpedientesPaciente, []byte(paciente+"\x00"))
+	if err != nil {
+		return false, err
+	}
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		expediente, err := s.obtenerExpediente(id)
+		if err != nil {
+			return false, err
+		}
+		if expediente.Medico == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// eventoVisible decide si el evento se envía al usuario: nunca a quien lo
+// provocó; las interconsultas, a la especialidad y el hospital de destino;
+// el resto, a los médicos que atienden al paciente y pueden verlo.
+func (s *server) eventoVisible(username string, evento api.Evento) bool {
+	if evento.Autor == username {
+		return false
+	}
+	usuario, err := s.obtenerUsuario(username)
+	if err != nil {
+		return false
+	}
+	if evento.Tipo == api.EventoInterconsultaRecibida {
+		return usuario.Especialidad == evento.Especialidad && usuario.Hospital == evento.Hospital
+	}
+
+	paciente, err := s.obtenerPaciente(evento.Paciente)
+	if err != nil {
+		return false
+	}
+	if puede, err := s.puedeVerPaciente(username, paciente); err != nil || !puede {
+		return false
+	}
+	atiende, err := s.atiendeAPaciente(username, evento.Paciente)
+	if err != nil {
+		s.log.Printf("Error comprobando los pacientes de %s: %v", username, err)
+		return false
+	}
+	return atiende
+}
+
+// eventsHandler mantiene abierta una conexión Server-Sent Events con los
+// eventos que el usuario puede ver. Como /api, recibe por POST un json con
+// el usuario y el token; la conexión se cierra cuando la sesión deja de ser
+// válida.
+func (s *server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req api.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error en el formato JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" || !s.isTokenValid(req.Token, req.Username) {
+		http.Error(w, "Token inválido o sesión expirada", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "El servidor no admite eventos", http.StatusInternalServerError)
+		return
+	}
+
+	canal := s.eventos.suscribir()
+	defer s.eventos.cancelar(canal)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprint(w, ": conectado\n\n")
+	flusher.Flush()
+
+	latido := time.NewTicker(intervaloLatido)
+	defer latido.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-latido.C:
+			if !s.isTokenValid(req.Token, req.Username) {
+				return
+			}
+			fmt.Fprint(w, ": latido\n\n")
+		case evento := <-canal:
+			if !s.isTokenValid(req.Token, req.Username) {
+				return
+			}
+			if !s.eventoVisible(req.Username, evento) {
+				continue
+			}
+			eventoJson, err := json.Marshal(evento)
+			if err != nil {
+				s.log.Printf("Error al convertir el evento a json: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evento.Tipo, eventoJson)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Índice de expedientes por paciente. Cada expediente se indexa bajo
+// "idPaciente\x00idExpediente" con el identificador del expediente relleno
+// con ceros, de modo que un Scan sobre el índice con el prefijo del paciente
+// recorre sus expedientes por orden de creación.
+const indiceExpedientesPaciente = "paciente"
+
+// Tamaño de página por defecto y máximo al listar expedientes.
+const (
+	limiteExpedientes    = 50
+	limiteExpedientesMax = 200
+)
+
+// valorIndicePaciente construye el valor bajo el que se indexa un expediente.
+func valorIndicePaciente(paciente string, id int) string {
+	return fmt.Sprintf("%s\x00%010d", paciente, id)
+}
+
+// extractorExpedientePaciente indexa cada expediente bajo su paciente.
+func extractorExpedientePaciente(key, value []byte) [][]byte {
+	var expediente Expediente
+	if err := json.Unmarshal(value, &expediente); err != nil || expediente.Paciente == "" {
+		return nil
+	}
+	id, err := strconv.Atoi(string(key))
+	if err != nil {
+		return nil
+	}
+	return [][]byte{[]byte(valorIndicePaciente(expediente.Paciente, id))}
+}
+
+// Reintentos de una escritura condicional antes de rendirse.
+const maxReintentosCAS = 5
+
+// obtenerExpediente lee y descodifica un expediente junto con su versión.
+func (s *server) obtenerExpediente(id int) (Expediente, error) {
+	var expediente Expediente
+	expedienteJson, version, err := s.db.GetWithVersion("Expedientes", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return expediente, err
+	}
+	err = json.Unmarshal(expedienteJson, &expediente)
+	expediente.ID = id // los expedientes antiguos no guardaban su identificador
+	expediente.Version = version
+	for i := range expediente.Observaciones {
+		if expediente.Observaciones[i].ID == 0 {
+			expediente.Observaciones[i].ID = i + 1 // ni el de sus observaciones
+		}
+	}
+	return expediente, err
+}
+
+// expedienteAccesible obtiene el expediente y comprueba que el usuario pueda
+// acceder a él. Si no existe o no tiene acceso devuelve la respuesta para
+// el cliente.
+func (s *server) expedienteAccesible(username string, id int) (Expediente, *api.Response) {
+	expediente, err := s.obtenerExpediente(id)
+	if noEncontrado(err) {
+		return expediente, &api.Response{Success: -1, Message: fmt.Sprintf("No existe el expediente %d", id)}
+	}
+	if err != nil {
+		return expediente, &api.Response{Success: -1, Message: "Error al obtener el expediente"}
+	}
+	if res := s.accesoExpediente(username, expediente); res != nil {
+		return expediente, res
+	}
+	return expediente, nil
+}
+
+// anyadirObservacion añade la observación al final del expediente
+// asignándole el siguiente identificador.
+func anyadirObservacion(expediente *Expediente, observacion Observaciones) {
+	observacion.ID = len(expediente.Observaciones) + 1
+	expediente.Observaciones = append(expediente.Observaciones, observacion)
+}
+
+// modificarExpediente aplica 'cambiar' sobre la versión actual del
+// expediente req.ID y lo guarda con una escritura condicional. Si la
+// petición indica la versión que vio el médico y otro lo ha modificado
+// después, responde con un conflicto y el expediente actual. Sin versión
+// esperada (clientes antiguos) basta con que la lectura y la escritura sean
+// atómicas, así que se reintenta. Los errores de 'cambiar' se devuelven al
+// cliente como mensaje. Sólo pueden modificarlo quienes tienen acceso a él
+// (accesoExpediente).
+func (s *server) modificarExpediente(req api.Request, accion string, cambiar func(*Expediente) error) api.Response {
+	return s.escribirExpediente(req, accion, true, cambiar)
+}
+
+// escribirExpediente es modificarExpediente con la comprobación de acceso
+// opcional, para las escrituras que el servidor hace en nombre de un
+// médico que no tiene por qué ver al paciente (como el informe de una
+// interconsulta respondida desde otro hospital).
+func (s *server) escribirExpediente(req api.Request, accion string, comprobarAcceso bool, cambiar func(*Expediente) error) api.Response {
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		expediente, err := s.obtenerExpediente(req.ID)
+		if noEncontrado(err) {
+			return api.Response{Success: -1, Message: fmt.Sprintf("No existe el expediente %d", req.ID)}
+		}
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir a estructura el expediente"}
+		}
+		if comprobarAcceso {
+			if res := s.accesoExpediente(req.Username, expediente); res != nil {
+				return *res
+			}
+		}
+		if req.ExpectedVersion != 0 && uint64(req.ExpectedVersion) != expediente.Version {
+			return s.conflictoExpediente(expediente)
+		}
+
+		if err := cambiar(&expediente); err != nil {
+			return api.Response{Success: -1, Message: err.Error()}
+		}
+		// El médico que creó el expediente se conserva; el historial de
+		// revisiones guarda quién hizo cada cambio
+		expediente.Ultimo_editor = req.Username
+
+		err = s.guardarExpediente(expediente, req.Username, accion)
+		if errors.Is(err, store.ErrVersionConflict) {
+			if req.ExpectedVersion != 0 {
+				actual, err := s.obtenerExpediente(req.ID)
+				if err != nil {
+					return api.Response{Success: -1, Message: "Error al obtener el expediente"}
+				}
+				return s.conflictoExpediente(actual)
+			}
+			continue
+		}
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al guardar el expediente"}
+		}
+		return api.Response{Success: 1, Message: "Expediente modificado correctamente"}
+	}
+
+	return api.Response{Success: -1, Message: "El expediente está siendo modificado por otros usuarios, inténtelo de nuevo"}
+}
+
+// guardarExpediente almacena el expediente sólo si nadie lo ha modificado
+// desde que se leyó con la versión expediente.Version (0 si es nuevo), y
+// anota en la misma transacción la revisión correspondiente. Si otro lo ha
+// modificado devuelve store.ErrVersionConflict.
+func (s *server) guardarExpediente(expediente Expediente, usuario, accion string) error {
+	ops, err := s.opsGuardarExpediente(expediente, usuario, accion)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(ops)
+}
+
+// opsGuardarExpediente devuelve las escrituras de guardarExpediente para
+// incluirlas en un lote mayor.
+func (s *server) opsGuardarExpediente(expediente Expediente, usuario, accion string) ([]store.Op, error) {
+	clave := []byte(strconv.Itoa(expediente.ID))
+	leida := expediente.Version
+
+	var anterior []byte
+	if leida > 0 {
+		var version uint64
+		var err error
+		anterior, version, err = s.db.GetWithVersion("Expedientes", clave)
+		if err != nil {
+			return nil, err
+		}
+		if version != leida {
+			return nil, store.ErrVersionConflict
+		}
+	}
+
+	expediente.Version = leida + 1
+	expedienteJson, err := json.Marshal(expediente)
+	if err != nil {
+		return nil, err
+	}
+	revision, err := opRevision(expediente.ID, expediente.Version, usuario, accion, anterior, expedienteJson)
+	if err != nil {
+		return nil, err
+	}
+	return []store.Op{
+		{Namespace: "Expedientes", Key: clave, Value: expedienteJson, CheckVersion: true, Version: leida},
+		revision,
+	}, nil
+}
+
+// crearExpediente crea un expediente del paciente en la especialidad
+// indicada con las observaciones iniciales y lo añade a su historial.
+// Devuelve el identificador del expediente.
+func (s *server) crearExpediente(paciente, medico string, especialidad int, observaciones []Observaciones) (int, error) {
+	id, err := s.siguienteSecuencia("Expedientes")
+	if err != nil {
+		return 0, err
+	}
+	expediente := Expediente{
+		ID:             id,
+		Paciente:       paciente,
+		Medico:         medico,
+		Observaciones:  observaciones,
+		Fecha_creacion: time.Now().Format(time.DateOnly),
+		Especialidad:   especialidad,
+	}
+	if err := s.guardarExpediente(expediente, medico, revisionCrear); err != nil {
+		return 0, err
+	}
+
+	// Conservamos el resto del historial (estado y episodios) y sólo añadimos el expediente
+	err = s.modificarHistorial(paciente, func(historial *Historial) error {
+		historial.Expedientes = append(historial.Expedientes, id)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.publicarEvento(api.Evento{
+		Tipo:         api.EventoNuevoExpediente,
+		Autor:        medico,
+		Paciente:     paciente,
+		Expediente:   id,
+		Especialidad: especialidad,
+		Mensaje:      fmt.Sprintf("%s ha abierto el expediente %d del paciente %s", medico, id, paciente),
+	})
+	return id, nil
+}
+
+// conflictoExpediente construye la respuesta a una modificación hecha sobre
+// una versión antigua del expediente, incluyendo el expediente actual para
+// que el cliente pueda mostrarlo y reintentar.
+func (s *server) conflictoExpediente(actual Expediente) api.Response {
+	actualJson, err := json.Marshal(actual)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir expediente a Json"}
+	}
+	return api.Response{
+		Success:     -1,
+		Conflicto:   true,
+		Message:     fmt.Sprintf("El expediente %d ha sido modificado por otro usuario (versión actual %d)", actual.ID, actual.Version),
+		Expedientes: [][]byte{actualJson},
+	}
+}
+
+// opsAsignarExpedientes devuelve las escrituras que cambian el paciente de
+// los expedientes indicados, por ejemplo al fusionar dos pacientes o
+// deshacer la fusión.
+func (s *server) opsAsignarExpedientes(ids []int, paciente, usuario string) ([]store.Op, error) {
+	var ops []store.Op
+	for _, id := range ids {
+		expediente, err := s.obtenerExpediente(id)
+		if err != nil {
+			return nil, fmt.Errorf("expediente %d: %v", id, err)
+		}
+		expediente.Paciente = paciente
+		opsExpediente, err := s.opsGuardarExpediente(expediente, usuario, revisionReasignar)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, opsExpediente...)
+	}
+	return ops, nil
+}
+
+// paginaExpedientes devuelve una página de expedientes del paciente, en
+// orden de creación (o del más reciente al más antiguo si 'descendente'),
+// empezando por el cursor indicado. Devuelve también el cursor de la página
+// siguiente, vacío si no hay más.
+func (s *server) paginaExpedientes(paciente, cursor string, limite int, descendente bool) ([][]byte, string, error) {
+	if limite <= 0 {
+		limite = limiteExpedientes
+	}
+	limite = min(limite, limiteExpedientesMax)
+
+	inicio, err := descodificarCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	scan := s.db.Scan
+	if descendente {
+		scan = s.db.ScanReverse
+	}
+	namespace := store.IndexNamespace("Expedientes", indiceExpedientesPaciente)
+	entradas, siguiente, err := scan(namespace, inicio, []byte(paciente+"\x00"), limite)
+	if noEncontrado(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var expedientes [][]byte
+	for _, entrada := range entradas {
+		i := bytes.LastIndexByte(entrada.Key, 0)
+		id, err := strconv.Atoi(string(entrada.Key[i+1:]))
+		if err != nil {
+			return nil, "", fmt.Errorf("entrada de índice incorrecta: %q", entrada.Key)
+		}
+		// Descodificamos para devolver cada expediente con su versión actual
+		expediente, err := s.obtenerExpediente(id)
+		if err != nil {
+			return nil, "", fmt.Errorf("expediente %d: %v", id, err)
+		}
+		expedienteJson, err := json.Marshal(expediente)
+		if err != nil {
+			return nil, "", err
+		}
+		expedientes = append(expedientes, expedienteJson)
+	}
+
+	return expedientes, codificarCursor(siguiente), nil
+}
+
+// codificarCursor convierte la clave por la que continúa un Scan en el
+// cursor opaco que recibe el cliente (vacío si no hay más páginas).
+func codificarCursor(siguiente []byte) string {
+	if siguiente == nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(siguiente)
+}
+
+// descodificarCursor recupera la clave de inicio de un cursor recibido del
+// cliente (nil si está vacío).
+func descodificarCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	inicio, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("cursor no válido")
+	}
+	return inicio, nil
+}
+
+// migrarExpedientes guarda en cada expediente su identificador y su
+// paciente (para poder indexarlo) y lleva el contador de expedientes al
+// mayor identificador existente.
+func (s *server) migrarExpedientes() error {
+	ultimo := 0
+	claves, err := s.db.ListKeys("Expedientes")
+	if err != nil && !noEncontrado(err) {
+		return err
+	}
+	for _, clave := range claves {
+		if id, err := strconv.Atoi(string(clave)); err == nil {
+			ultimo = max(ultimo, id)
+		}
+	}
+	if err := s.db.Put("Contadores", []byte("Expedientes"), []byte(strconv.Itoa(ultimo))); err != nil {
+		return err
+	}
+
+	pacientes, err := s.db.ListKeys("Historiales")
+	if noEncontrado(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, paciente := range pacientes {
+		historial, err := s.obtenerHistorial(string(paciente))
+		if err != nil {
+			s.log.Printf("Migración de expedientes: historial '%s' ilegible: %v", paciente, err)
+			continue
+		}
+		for _, id := range historial.Expedientes {
+			expediente, err := s.obtenerExpediente(id)
+			if err != nil {
+				s.log.Printf("Migración de expedientes: el historial '%s' referencia el expediente %d, que no existe", paciente, id)
+				continue
+			}
+			expediente.Paciente = string(paciente)
+			if err := s.guardarExpediente(expediente, "migracion", revisionReasignar); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
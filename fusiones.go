@@ -0,0 +1,702 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// SolicitudFusion es la petición de un médico para que un administrador
+// fusione dos pacientes que parecen ser la misma persona.
+type SolicitudFusion struct {
+	ID          int    `json:"id"`
+	DNI         string `json:"dni"`       // identificador interno del paciente
+	Duplicado   string `json:"duplicado"` // identificador interno del posible duplicado
+	Solicitante string `json:"solicitante"`
+	Fecha       string `json:"fecha"`
+	Estado      string `json:"estado"` // pendiente, resuelta
+}
+
+// Fusion guarda lo necesario para deshacer la fusión de dos pacientes
+// durante el periodo de gracia.
+type Fusion struct {
+	ID                      int                 `json:"id"`
+	Superviviente           string              `json:"superviviente"`
+	Absorbido               string              `json:"absorbido"`
+	Administrador           string              `json:"administrador"`
+	Fecha                   string              `json:"fecha"`
+	Deshecha                bool                `json:"deshecha"`
+	Paciente_absorbido      json.RawMessage     `json:"paciente_absorbido"`
+	Historial_absorbido     Historial           `json:"historial_absorbido"`
+	Historial_superviviente Historial           `json:"historial_superviviente"`
+	Solicitudes             []int               `json:"solicitudes,omitempty"` // solicitudes que resolvió; se reabren al deshacerla
+	Alertas_superviviente   int                 `json:"alertas_superviviente"` // las del absorbido van a continuación
+	Registros               map[string][]string `json:"registros,omitempty"`   // claves por espacio de nombres de los registros que pasaron al superviviente
+	Mediciones              []string            `json:"mediciones,omitempty"`  // claves de las mediciones sin el paciente
+}
+
+// registrosPaciente son los espacios de nombres cuyos registros indican en
+// el campo "paciente" a quién pertenecen y que pasan al superviviente al
+// fusionar. Las mediciones llevan además el paciente en la clave y se
+// tratan aparte.
+var registrosPaciente = []struct {
+	namespace string
+	indice    string // índice por paciente; sin él se recorren todos
+}{
+	{"Recetas", indiceRecetasPaciente},
+	{"Citas", indiceCitasPaciente},
+	{"Traslados", indiceTrasladosPaciente},
+	{"Interconsultas", ""},
+}
+
+// plazoDeshacerFusion es el tiempo durante el que se puede deshacer una fusión.
+const plazoDeshacerFusion = 72 * time.Hour
+
+// maxRedirecciones limita la cadena de redirecciones que se sigue al
+// resolver un paciente, para evitar bucles si los datos estuvieran corruptos.
+const maxRedirecciones = 10
+
+// normalizador elimina tildes y diéresis para comparar nombres.
+var normalizador = strings.NewReplacer(
+	"á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u",
+	"à", "a", "è", "e", "ì", "i", "ò", "o", "ù", "u",
+	"ä", "a", "ë", "e", "ï", "i", "ö", "o", "ü", "u",
+	"ñ", "n", "ç", "c",
+)
+
+// normalizarTexto pasa el texto a minúsculas, sin tildes y con los
+// espacios colapsados, para comparaciones tolerantes a errores de escritura.
+func normalizarTexto(texto string) string {
+	return normalizador.Replace(strings.Join(strings.Fields(strings.ToLower(texto)), " "))
+}
+
+// buscarDuplicados devuelve los identificadores internos de los pacientes
+// con el mismo nombre, apellido y fecha de nacimiento.
+func (s *server) buscarDuplicados(nombre, apellido, fechaNacimiento string) ([]string, error) {
+	claves, err := s.db.ListKeys("Pacientes")
+	if noEncontrado(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nombre = normalizarTexto(nombre)
+	apellido = normalizarTexto(apellido)
+	fechaNacimiento = strings.TrimSpace(fechaNacimiento)
+
+	var duplicados []string
+	for _, clave := range claves {
+		pacienteJson, err := s.db.Get("Pacientes", clave)
+		if err != nil {
+			return nil, err
+		}
+		var paciente Paciente
+		if err := json.Unmarshal(pacienteJson, &paciente); err != nil {
+			// Registros antiguos con otro formato: no pueden compararse
+			continue
+		}
+		if normalizarTexto(paciente.Nombre) == nombre &&
+			normalizarTexto(paciente.Apellido) == apellido &&
+			strings.TrimSpace(paciente.Fecha_nacimiento) == fechaNacimiento {
+			duplicados = append(duplicados, string(clave))
+		}
+	}
+	return duplicados, nil
+}
+
+// solicitarFusion registra una solicitud de fusión de dos pacientes
+// para que la revise un administrador.
+func (s *server) solicitarFusion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Duplicado == "" {
+		return api.Response{Success: -1, Message: "Faltan datos para solicitar la fusión"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	paciente, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, paciente); res != nil {
+		return *res
+	}
+	duplicado, err := s.resolverReferencia(req.Duplicado)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el paciente %s", req.Duplicado)}
+	}
+	if paciente == duplicado {
+		return api.Response{Success: -1, Message: "No se puede fusionar un paciente consigo mismo"}
+	}
+	if res := s.accesoPaciente(req.Username, duplicado); res != nil {
+		return *res
+	}
+
+	id, err := s.siguienteSecuencia("SolicitudesFusion")
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador de la solicitud"}
+	}
+
+	solicitud := SolicitudFusion{
+		ID:          id,
+		DNI:         paciente,
+		Duplicado:   duplicado,
+		Solicitante: req.Username,
+		Fecha:       time.Now().Format(time.DateOnly),
+		Estado:      "pendiente",
+	}
+	solicitudJson, err := json.Marshal(solicitud)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la solicitud a json"}
+	}
+	if err := s.db.Put("SolicitudesFusion", []byte(strconv.Itoa(id)), solicitudJson); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la solicitud de fusión"}
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Solicitud de fusión %d enviada a los administradores", id)}
+}
+
+// listarSolicitudesFusion devuelve las solicitudes de fusión pendientes.
+// Sólo disponible para administradores.
+func (s *server) listarSolicitudesFusion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return api.Response{Success: -1, Message: "Acción reservada a administradores"}
+	}
+
+	claves, err := s.db.ListKeys("SolicitudesFusion")
+	if err != nil && !noEncontrado(err) {
+		return api.Response{Success: -1, Message: "Error al obtener las solicitudes de fusión"}
+	}
+
+	var pendientes [][]byte
+	for _, clave := range claves {
+		solicitudJson, err := s.db.Get("SolicitudesFusion", clave)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener las solicitudes de fusión"}
+		}
+		var solicitud SolicitudFusion
+		if err := json.Unmarshal(solicitudJson, &solicitud); err != nil || solicitud.Estado != "pendiente" {
+			continue
+		}
+		pendientes = append(pendientes, solicitudJson)
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("%d solicitudes pendientes", len(pendientes)), Registros: pendientes}
+}
+
+// mergePacientes fusiona el paciente 'Duplicado' en el paciente de la petición:
+// une los expedientes y episodios de ambos historiales, las alertas y los
+// identificadores, pasa al superviviente las recetas, mediciones, citas,
+// traslados e interconsultas del duplicado, lo elimina y deja una redirección
+// desde su identificador interno. Sólo para administradores.
+func (s *server) mergePacientes(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Duplicado == "" {
+		return api.Response{Success: -1, Message: "Faltan datos para fusionar los pacientes"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return api.Response{Success: -1, Message: "Acción reservada a administradores"}
+	}
+
+	superviviente, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente que se conserva"}
+	}
+	absorbido, err := s.resolverReferencia(req.Duplicado)
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el paciente %s", req.Duplicado)}
+	}
+	if superviviente == absorbido {
+		return api.Response{Success: -1, Message: "Ambas referencias corresponden ya al mismo paciente"}
+	}
+
+	// Todo se escribe en un único lote que falla si alguno de los registros
+	// leídos ha cambiado entretanto, para no dejar una fusión a medias
+	pacienteAbsorbido, versionPaciente, err := s.db.GetWithVersion("Pacientes", []byte(absorbido))
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el paciente duplicado"}
+	}
+	var datosAbsorbido Paciente
+	if err := json.Unmarshal(pacienteAbsorbido, &datosAbsorbido); err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el paciente duplicado a struct"}
+	}
+	datosSuperviviente, versionPacienteSuperviviente, err := s.obtenerPacienteVersion(superviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el paciente superviviente"}
+	}
+	historialSuperviviente, versionSuperviviente, err := s.obtenerHistorialVersion(superviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el historial del paciente superviviente"}
+	}
+	historialAbsorbido, versionAbsorbido, err := s.obtenerHistorialVersion(absorbido)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el historial del paciente duplicado"}
+	}
+
+	id, err := s.siguienteSecuencia("Fusiones")
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador de la fusión"}
+	}
+	solicitudes, ops, err := s.opsSolicitudesFusion("resuelta", func(solicitud SolicitudFusion) bool {
+		return solicitud.Estado == "pendiente" &&
+			((solicitud.DNI == superviviente && solicitud.Duplicado == absorbido) || (solicitud.DNI == absorbido && solicitud.Duplicado == superviviente))
+	})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las solicitudes de fusión"}
+	}
+	fusion := Fusion{
+		ID:                      id,
+		Superviviente:           superviviente,
+		Absorbido:               absorbido,
+		Administrador:           req.Username,
+		Fecha:                   time.Now().Format(time.RFC3339),
+		Paciente_absorbido:      pacienteAbsorbido,
+		Historial_absorbido:     historialAbsorbido,
+		Historial_superviviente: historialSuperviviente,
+		Solicitudes:             solicitudes,
+		Alertas_superviviente:   len(datosSuperviviente.Alertas),
+		Registros:               map[string][]string{},
+	}
+	opsRegistros, err := s.opsRegistrosFusion(&fusion)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los registros del paciente duplicado"}
+	}
+	escrituraFusion, err := opFusion(fusion, 0)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la fusión a json"}
+	}
+	escrituraHistorial, err := opHistorial(superviviente, unirHistoriales(historialSuperviviente, historialAbsorbido), versionSuperviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el historial fusionado a json"}
+	}
+	datosSuperviviente.Alertas = numerarAlertas(append(slices.Clip(datosSuperviviente.Alertas), datosAbsorbido.Alertas...))
+	datosSuperviviente.Identificadores = append(datosSuperviviente.Identificadores, datosAbsorbido.Identificadores...)
+	escrituraPaciente, err := opPaciente(datosSuperviviente, versionPacienteSuperviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el paciente fusionado a json"}
+	}
+	opsIdentificadores, err := s.opsReasignarIdentificadores(datosAbsorbido.Identificadores, absorbido, superviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los identificadores del paciente duplicado"}
+	}
+	ops = append(append(ops, opsRegistros...), opsIdentificadores...)
+	ops = append(ops, escrituraFusion, escrituraHistorial, escrituraPaciente,
+		store.Op{Namespace: "Redirecciones", Key: []byte(absorbido), Value: []byte(superviviente)},
+		store.Op{Namespace: "Historiales", Key: []byte(absorbido), Delete: true, CheckVersion: true, Version: versionAbsorbido},
+		store.Op{Namespace: "Pacientes", Key: []byte(absorbido), Delete: true, CheckVersion: true, Version: versionPaciente},
+	)
+	opsExpedientes, err := s.opsAsignarExpedientes(historialAbsorbido.Expedientes, superviviente, req.Username)
+	if err == nil {
+		err = s.db.Batch(append(ops, opsExpedientes...))
+	}
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "Los pacientes se han modificado mientras se fusionaban; vuelva a intentarlo"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la fusión"}
+	}
+
+	s.registrarAuditoria(req.Username, api.ActionMergePacientes,
+		fmt.Sprintf("fusión %d: paciente %s fusionado en %s", id, absorbido, superviviente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Pacientes fusionados (fusión %d). Puede deshacerse durante %v", id, plazoDeshacerFusion)}
+}
+
+// deshacerFusion restaura los dos pacientes de una fusión si no ha pasado
+// el periodo de gracia. Los expedientes, alertas, identificadores y demás
+// registros añadidos al superviviente después de la fusión se conservan en él.
+func (s *server) deshacerFusion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos para deshacer la fusión"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return api.Response{Success: -1, Message: "Acción reservada a administradores"}
+	}
+
+	fusionJson, versionFusion, err := s.db.GetWithVersion("Fusiones", []byte(strconv.Itoa(req.ID)))
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la fusión %d", req.ID)}
+	}
+	var fusion Fusion
+	if err := json.Unmarshal(fusionJson, &fusion); err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la fusión a struct"}
+	}
+	if fusion.Deshecha {
+		return api.Response{Success: -1, Message: "La fusión ya fue deshecha"}
+	}
+	if !esIDInterno(fusion.Superviviente) {
+		return api.Response{Success: -1, Message: "La fusión es anterior a los identificadores internos y no puede deshacerse"}
+	}
+	fechaFusion, err := time.Parse(time.RFC3339, fusion.Fecha)
+	if err != nil || time.Since(fechaFusion) > plazoDeshacerFusion {
+		return api.Response{Success: -1, Message: "Ha expirado el plazo para deshacer la fusión"}
+	}
+	// Una fusión posterior de los mismos pacientes partió del historial que
+	// dejó ésta: separarlos ahora mezclaría los datos al deshacer aquélla
+	if posterior, err := s.fusionPosterior(fusion); err != nil {
+		return api.Response{Success: -1, Message: "Error al comprobar las fusiones posteriores"}
+	} else if posterior != 0 {
+		return api.Response{Success: -1, Message: fmt.Sprintf("La fusión %d es posterior y afecta a los mismos pacientes; debe deshacerse antes", posterior)}
+	}
+
+	// Como al fusionar, todo se escribe en un único lote condicionado a que
+	// nada haya cambiado desde la lectura
+	historialActual, versionSuperviviente, err := s.obtenerHistorialVersion(fusion.Superviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el historial del paciente superviviente"}
+	}
+	datosSuperviviente, versionPacienteSuperviviente, err := s.obtenerPacienteVersion(fusion.Superviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el paciente superviviente"}
+	}
+	var datosAbsorbido Paciente
+	if err := json.Unmarshal(fusion.Paciente_absorbido, &datosAbsorbido); err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el paciente duplicado a struct"}
+	}
+	opsRegistros, err := s.opsDevolverRegistros(fusion)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los registros del paciente duplicado"}
+	}
+	opsIdentificadores, err := s.opsReasignarIdentificadores(datosAbsorbido.Identificadores, fusion.Superviviente, fusion.Absorbido)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los identificadores del paciente duplicado"}
+	}
+	// Las alertas del absorbido vuelven a él con su estado actual, por si se
+	// han resuelto durante la fusión
+	datosSuperviviente.Alertas, datosAbsorbido.Alertas = separarAlertas(datosSuperviviente.Alertas, fusion.Alertas_superviviente, len(datosAbsorbido.Alertas))
+	datosSuperviviente.Identificadores = slices.DeleteFunc(datosSuperviviente.Identificadores, func(identificador Identificador) bool {
+		return slices.Contains(datosAbsorbido.Identificadores, identificador)
+	})
+	escrituraPacienteSuperviviente, err := opPaciente(datosSuperviviente, versionPacienteSuperviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el paciente superviviente a json"}
+	}
+	escrituraPacienteAbsorbido, err := opPaciente(datosAbsorbido, 0)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el paciente duplicado a json"}
+	}
+	_, ops, err := s.opsSolicitudesFusion("pendiente", func(solicitud SolicitudFusion) bool {
+		return solicitud.Estado == "resuelta" && slices.Contains(fusion.Solicitudes, solicitud.ID)
+	})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las solicitudes de fusión"}
+	}
+	fusion.Deshecha = true
+	escrituraFusion, err := opFusion(fusion, versionFusion)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la fusión a json"}
+	}
+	escrituraSuperviviente, err := opHistorial(fusion.Superviviente, separarHistorial(historialActual, fusion.Historial_superviviente, fusion.Historial_absorbido), versionSuperviviente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el historial del paciente superviviente a json"}
+	}
+	escrituraAbsorbido, err := opHistorial(fusion.Absorbido, fusion.Historial_absorbido, 0)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el historial del paciente duplicado a json"}
+	}
+	ops = append(append(ops, opsRegistros...), opsIdentificadores...)
+	ops = append(ops, escrituraFusion, escrituraSuperviviente, escrituraAbsorbido,
+		escrituraPacienteSuperviviente, escrituraPacienteAbsorbido,
+		store.Op{Namespace: "Redirecciones", Key: []byte(fusion.Absorbido), Delete: true},
+	)
+	opsExpedientes, err := s.opsAsignarExpedientes(fusion.Historial_absorbido.Expedientes, fusion.Absorbido, req.Username)
+	if err == nil {
+		err = s.db.Batch(append(ops, opsExpedientes...))
+	}
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "Los pacientes se han modificado mientras se deshacía la fusión; vuelva a intentarlo"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al deshacer la fusión"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionDeshacerFusion,
+		fmt.Sprintf("fusión %d deshecha: paciente %s separado de %s", fusion.ID, fusion.Absorbido, fusion.Superviviente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Fusión %d deshecha correctamente", fusion.ID)}
+}
+
+// opFusion es la escritura de la fusión que falla si su versión ya no es la
+// indicada (0 si es nueva).
+func opFusion(fusion Fusion, version uint64) (store.Op, error) {
+	fusionJson, err := json.Marshal(fusion)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Namespace: "Fusiones", Key: []byte(strconv.Itoa(fusion.ID)), Value: fusionJson, CheckVersion: true, Version: version}, nil
+}
+
+// fusionPosterior devuelve la primera fusión no deshecha posterior a
+// 'fusion' en la que participa alguno de sus dos pacientes, o 0 si no hay.
+func (s *server) fusionPosterior(fusion Fusion) (int, error) {
+	claves, err := s.db.ListKeys("Fusiones")
+	if err != nil {
+		return 0, err
+	}
+	posterior := 0
+	for _, clave := range claves {
+		fusionJson, err := s.db.Get("Fusiones", clave)
+		if err != nil {
+			return 0, err
+		}
+		var otra Fusion
+		if err := json.Unmarshal(fusionJson, &otra); err != nil {
+			return 0, err
+		}
+		if otra.ID <= fusion.ID || otra.Deshecha || (posterior != 0 && otra.ID > posterior) {
+			continue
+		}
+		for _, paciente := range []string{otra.Superviviente, otra.Absorbido} {
+			if paciente == fusion.Superviviente || paciente == fusion.Absorbido {
+				posterior = otra.ID
+			}
+		}
+	}
+	return posterior, nil
+}
+
+// opsSolicitudesFusion devuelve las escrituras que pasan a 'estado' las
+// solicitudes de fusión que cumplen 'filtro', junto con sus identificadores.
+func (s *server) opsSolicitudesFusion(estado string, filtro func(SolicitudFusion) bool) ([]int, []store.Op, error) {
+	claves, err := s.db.ListKeys("SolicitudesFusion")
+	if noEncontrado(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []int
+	var ops []store.Op
+	for _, clave := range claves {
+		solicitudJson, version, err := s.db.GetWithVersion("SolicitudesFusion", clave)
+		if err != nil {
+			return nil, nil, err
+		}
+		var solicitud SolicitudFusion
+		if err := json.Unmarshal(solicitudJson, &solicitud); err != nil || !filtro(solicitud) {
+			continue
+		}
+		solicitud.Estado = estado
+		if solicitudJson, err = json.Marshal(solicitud); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, solicitud.ID)
+		ops = append(ops, store.Op{Namespace: "SolicitudesFusion", Key: clave, Value: solicitudJson, CheckVersion: true, Version: version})
+	}
+	return ids, ops, nil
+}
+
+// opsRegistrosFusion devuelve las escrituras que pasan al superviviente los
+// registros del paciente absorbido y anota en la fusión cuáles son, para
+// poder devolvérselos al deshacerla.
+func (s *server) opsRegistrosFusion(fusion *Fusion) ([]store.Op, error) {
+	var ops []store.Op
+	for _, registros := range registrosPaciente {
+		var claves [][]byte
+		var err error
+		if registros.indice != "" {
+			claves, err = s.indices.Query(registros.namespace, registros.indice, []byte(fusion.Absorbido))
+		} else {
+			claves, err = s.db.ListKeys(registros.namespace)
+		}
+		if err != nil && !noEncontrado(err) {
+			return nil, err
+		}
+		for _, clave := range claves {
+			op, err := s.opReasignarRegistro(registros.namespace, clave, fusion.Absorbido, fusion.Superviviente)
+			if err != nil {
+				return nil, err
+			}
+			if op != nil {
+				ops = append(ops, *op)
+				fusion.Registros[registros.namespace] = append(fusion.Registros[registros.namespace], string(clave))
+			}
+		}
+	}
+
+	prefijo := []byte(fusion.Absorbido + "|")
+	inicio := prefijo
+	for inicio != nil {
+		pagina, siguiente, err := s.db.Scan("Mediciones", inicio, prefijo, limiteMediciones)
+		if err != nil && !noEncontrado(err) {
+			return nil, err
+		}
+		for _, kv := range pagina {
+			fusion.Mediciones = append(fusion.Mediciones, string(kv.Key[len(fusion.Absorbido):]))
+		}
+		inicio = siguiente
+	}
+	opsMediciones, err := s.opsMoverMediciones(fusion.Mediciones, fusion.Absorbido, fusion.Superviviente)
+	return append(ops, opsMediciones...), err
+}
+
+// opsDevolverRegistros devuelve las escrituras que devuelven al paciente
+// absorbido los registros que la fusión pasó al superviviente.
+func (s *server) opsDevolverRegistros(fusion Fusion) ([]store.Op, error) {
+	var ops []store.Op
+	for namespace, claves := range fusion.Registros {
+		for _, clave := range claves {
+			op, err := s.opReasignarRegistro(namespace, []byte(clave), fusion.Superviviente, fusion.Absorbido)
+			if err != nil {
+				return nil, err
+			}
+			if op != nil {
+				ops = append(ops, *op)
+			}
+		}
+	}
+	opsMediciones, err := s.opsMoverMediciones(fusion.Mediciones, fusion.Superviviente, fusion.Absorbido)
+	return append(ops, opsMediciones...), err
+}
+
+// opReasignarRegistro devuelve la escritura que pasa el registro de
+// 'anterior' a 'nuevo', condicionada a que no haya cambiado, o nil si el
+// registro ya no existe o es de otro paciente.
+func (s *server) opReasignarRegistro(namespace string, clave []byte, anterior, nuevo string) (*store.Op, error) {
+	valor, version, err := s.db.GetWithVersion(namespace, clave)
+	if noEncontrado(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	valor, err = cambiarPacienteRegistro(valor, anterior, nuevo)
+	if err != nil || valor == nil {
+		return nil, err
+	}
+	return &store.Op{Namespace: namespace, Key: clave, Value: valor, CheckVersion: true, Version: version}, nil
+}
+
+// opsMoverMediciones devuelve las escrituras que pasan las mediciones de
+// 'anterior' a 'nuevo'. Como el paciente forma parte de la clave, cada
+// medición se copia bajo la clave nueva y se borra la antigua.
+func (s *server) opsMoverMediciones(sufijos []string, anterior, nuevo string) ([]store.Op, error) {
+	var ops []store.Op
+	for _, sufijo := range sufijos {
+		origen := []byte(anterior + sufijo)
+		valor, version, err := s.db.GetWithVersion("Mediciones", origen)
+		if err != nil {
+			return nil, err
+		}
+		if valor, err = cambiarPacienteRegistro(valor, anterior, nuevo); err != nil {
+			return nil, err
+		}
+		ops = append(ops,
+			store.Op{Namespace: "Mediciones", Key: []byte(nuevo + sufijo), Value: valor, CheckVersion: true, Version: 0},
+			store.Op{Namespace: "Mediciones", Key: origen, Delete: true, CheckVersion: true, Version: version})
+	}
+	return ops, nil
+}
+
+// cambiarPacienteRegistro devuelve el registro json con el campo "paciente"
+// cambiado de 'anterior' a 'nuevo', o nil si el registro es de otro paciente.
+// El resto de campos se conservan tal cual.
+func cambiarPacienteRegistro(valor []byte, anterior, nuevo string) ([]byte, error) {
+	var registro map[string]json.RawMessage
+	if err := json.Unmarshal(valor, &registro); err != nil {
+		return nil, err
+	}
+	var paciente string
+	if err := json.Unmarshal(registro["paciente"], &paciente); err != nil || paciente != anterior {
+		return nil, nil
+	}
+	pacienteJson, err := json.Marshal(nuevo)
+	if err != nil {
+		return nil, err
+	}
+	registro["paciente"] = pacienteJson
+	return json.Marshal(registro)
+}
+
+// opsReasignarIdentificadores devuelve las escrituras que hacen que los
+// identificadores que llevan a 'anterior' lleven a 'nuevo', condicionadas
+// a que no hayan cambiado.
+func (s *server) opsReasignarIdentificadores(identificadores []Identificador, anterior, nuevo string) ([]store.Op, error) {
+	var ops []store.Op
+	for _, identificador := range identificadores {
+		clave := claveIdentificador(identificador.Tipo, identificador.Valor)
+		id, version, err := s.db.GetWithVersion("Identificadores", clave)
+		if noEncontrado(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if string(id) == anterior {
+			ops = append(ops, store.Op{Namespace: "Identificadores", Key: clave, Value: []byte(nuevo), CheckVersion: true, Version: version})
+		}
+	}
+	return ops, nil
+}
+
+// numerarAlertas vuelve a numerar las alertas según su posición en la lista.
+func numerarAlertas(alertas []Alerta) []Alerta {
+	for i := range alertas {
+		alertas[i].ID = i + 1
+	}
+	return alertas
+}
+
+// separarAlertas quita de las alertas del superviviente las 'cuantas' que
+// procedían del absorbido, que empiezan tras las 'propias' que tenía al
+// fusionar, y las devuelve aparte. Ambas listas quedan renumeradas.
+func separarAlertas(alertas []Alerta, propias, cuantas int) ([]Alerta, []Alerta) {
+	propias = min(propias, len(alertas))
+	fin := min(propias+cuantas, len(alertas))
+	absorbidas := slices.Clone(alertas[propias:fin])
+	restantes := append(slices.Clone(alertas[:propias]), alertas[fin:]...)
+	return numerarAlertas(restantes), numerarAlertas(absorbidas)
+}
+
+// unirHistoriales combina los expedientes y episodios de ambos historiales
+// manteniendo el estado del superviviente.
+func unirHistoriales(superviviente, absorbido Historial) Historial {
+	unido := superviviente
+	unido.Expedientes = append(append([]int{}, superviviente.Expedientes...), absorbido.Expedientes...)
+	sort.Ints(unido.Expedientes)
+	unido.Episodios = append(append([]Episodio{}, superviviente.Episodios...), absorbido.Episodios...)
+	sort.SliceStable(unido.Episodios, func(i, j int) bool {
+		return unido.Episodios[i].Fecha_ingreso < unido.Episodios[j].Fecha_ingreso
+	})
+	if absorbido.Fecha_creacion != "" && absorbido.Fecha_creacion < unido.Fecha_creacion {
+		unido.Fecha_creacion = absorbido.Fecha_creacion
+	}
+	return unido
+}
+
+// separarHistorial quita del historial fusionado los expedientes y episodios
+// que procedían del paciente absorbido y recupera la fecha de creación original.
+func separarHistorial(fusionado, original, absorbido Historial) Historial {
+	separado := fusionado
+	separado.Fecha_creacion = original.Fecha_creacion
+	separado.Expedientes = nil
+	for _, id := range fusionado.Expedientes {
+		if !slices.Contains(absorbido.Expedientes, id) {
+			separado.Expedientes = append(separado.Expedientes, id)
+		}
+	}
+	separado.Episodios = nil
+	for _, episodio := range fusionado.Episodios {
+		if !slices.Contains(absorbido.Episodios, episodio) {
+			separado.Episodios = append(separado.Episodios, episodio)
+		}
+	}
+	return separado
+}
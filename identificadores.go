@@ -0,0 +1,366 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+	"prac/pkg/validation"
+)
+
+// Identificador es uno de los documentos o números con los que se puede
+// buscar a un paciente. Cada par (tipo, valor) pertenece a un único paciente
+// y se guarda en el namespace 'Identificadores' con la clave "tipo:valor".
+type Identificador struct {
+	Tipo  string `json:"tipo"`
+	Valor string `json:"valor"`
+}
+
+// errPacienteNoEncontrado se devuelve cuando ningún paciente tiene el identificador buscado.
+var errPacienteNoEncontrado = errors.New("paciente no encontrado")
+
+// formatoIDInterno es el formato de los identificadores internos de paciente.
+const formatoIDInterno = "P%08d"
+
+// nuevoIDPaciente genera el siguiente identificador interno de paciente.
+func (s *server) nuevoIDPaciente() (string, error) {
+	n, err := s.siguienteSecuencia("Pacientes")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(formatoIDInterno, n), nil
+}
+
+// esIDInterno indica si la referencia tiene el formato de un identificador interno.
+func esIDInterno(referencia string) bool {
+	if len(referencia) != 9 || referencia[0] != 'P' {
+		return false
+	}
+	_, err := strconv.Atoi(referencia[1:])
+	return err == nil
+}
+
+// tipoDocumento distingue un NIE (empieza por X, Y o Z) de un DNI.
+func tipoDocumento(documento string) string {
+	if documento != "" && strings.ContainsRune("XYZ", rune(documento[0])) {
+		return api.IdentificadorNIE
+	}
+	return api.IdentificadorDNI
+}
+
+// claveIdentificador construye la clave del namespace 'Identificadores'.
+func claveIdentificador(tipo, valor string) []byte {
+	return []byte(tipo + ":" + valor)
+}
+
+// resolverPaciente sigue las redirecciones que dejan las fusiones y devuelve
+// el identificador del paciente superviviente (o el mismo si no fue fusionado).
+func (s *server) resolverPaciente(id string) string {
+	for i := 0; i < maxRedirecciones; i++ {
+		destino, err := s.db.Get("Redirecciones", []byte(id))
+		if err != nil {
+			return id
+		}
+		id = string(destino)
+	}
+	return id
+}
+
+// resolverIdentificador busca el paciente con el identificador indicado
+// y devuelve su identificador interno, siguiendo las fusiones.
+func (s *server) resolverIdentificador(tipo, valor string) (string, error) {
+	if valor == "" {
+		return "", errors.New("falta el identificador del paciente")
+	}
+	if tipo == api.IdentificadorInterno {
+		id := s.resolverPaciente(valor)
+		if _, err := s.db.Get("Pacientes", []byte(id)); err != nil {
+			return "", errPacienteNoEncontrado
+		}
+		return id, nil
+	}
+
+	id, err := s.db.Get("Identificadores", claveIdentificador(tipo, valor))
+	if noEncontrado(err) {
+		return "", errPacienteNoEncontrado
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.resolverPaciente(string(id)), nil
+}
+
+// resolverReferencia resuelve una referencia escrita por un usuario, que
+// puede ser un identificador interno o un DNI/NIE.
+func (s *server) resolverReferencia(referencia string) (string, error) {
+	if esIDInterno(referencia) {
+		return s.resolverIdentificador(api.IdentificadorInterno, referencia)
+	}
+	return s.resolverIdentificador(tipoDocumento(referencia), referencia)
+}
+
+// pacienteDeRequest obtiene el identificador interno del paciente al que se
+// refiere la petición: por 'Paciente', por 'TipoIdentificador' e
+// 'Identificador', o por 'DNI', en ese orden de preferencia.
+func (s *server) pacienteDeRequest(req api.Request) (string, error) {
+	switch {
+	case req.Paciente != "":
+		return s.resolverIdentificador(api.IdentificadorInterno, req.Paciente)
+	case req.TipoIdentificador != "":
+		return s.resolverIdentificador(req.TipoIdentificador, req.Identificador)
+	default:
+		return s.resolverReferencia(req.DNI)
+	}
+}
+
+// comprobarIdentificadorLibre valida el identificador y comprueba que no
+// pertenezca ya a otro paciente.
+func (s *server) comprobarIdentificadorLibre(identificador Identificador) error {
+	if err := validation.ValidarIdentificador(identificador.Tipo, identificador.Valor); err != nil {
+		return fmt.Errorf("%s no válido: %v", identificador.Tipo, err)
+	}
+	id, err := s.db.Get("Identificadores", claveIdentificador(identificador.Tipo, identificador.Valor))
+	if err == nil {
+		return fmt.Errorf("ya existe un paciente (%s) con %s %s", s.resolverPaciente(string(id)), identificador.Tipo, identificador.Valor)
+	}
+	if !noEncontrado(err) {
+		return err
+	}
+	return nil
+}
+
+// obtenerPaciente recupera y decodifica el paciente con el identificador interno indicado.
+func (s *server) obtenerPaciente(id string) (Paciente, error) {
+	var paciente Paciente
+	pacienteJson, err := s.db.Get("Pacientes", []byte(id))
+	if err != nil {
+		return paciente, err
+	}
+	err = json.Unmarshal(pacienteJson, &paciente)
+	return paciente, err
+}
+
+// obtenerPacienteVersion devuelve el paciente junto con la versión leída,
+// para escribirlo después en un lote condicionado a que no haya cambiado.
+func (s *server) obtenerPacienteVersion(id string) (Paciente, uint64, error) {
+	var paciente Paciente
+	pacienteJson, version, err := s.db.GetWithVersion("Pacientes", []byte(id))
+	if err != nil {
+		return paciente, 0, err
+	}
+	err = json.Unmarshal(pacienteJson, &paciente)
+	return paciente, version, err
+}
+
+// opPaciente es la escritura del paciente que falla si su versión ya no es
+// la indicada (0 si no debe existir).
+func opPaciente(paciente Paciente, version uint64) (store.Op, error) {
+	pacienteJson, err := json.Marshal(paciente)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Namespace: "Pacientes", Key: []byte(paciente.ID), Value: pacienteJson, CheckVersion: true, Version: version}, nil
+}
+
+// guardarPaciente codifica y almacena el paciente bajo su identificador
+// interno. Los índices de búsqueda se actualizan en la misma escritura.
+func (s *server) guardarPaciente(paciente Paciente) error {
+	pacienteJson, err := json.Marshal(paciente)
+	if err != nil {
+		return err
+	}
+	return s.db.Put("Pacientes", []byte(paciente.ID), pacienteJson)
+}
+
+// opIdentificador registra el identificador del paciente sólo si no
+// pertenece ya a nadie: si otro lo ha registrado, el lote entero falla con
+// store.ErrVersionConflict.
+func opIdentificador(identificador Identificador, id string) store.Op {
+	return store.Op{Namespace: "Identificadores", Key: claveIdentificador(identificador.Tipo, identificador.Valor), Value: []byte(id), CheckVersion: true, Version: 0}
+}
+
+// crearPaciente escribe en un único lote el paciente nuevo, su historial y
+// sus identificadores. Si alguno de los identificadores ya pertenece a otro
+// paciente devuelve store.ErrVersionConflict sin escribir nada.
+func (s *server) crearPaciente(paciente Paciente, historial Historial) error {
+	escrituraPaciente, err := opPaciente(paciente, 0)
+	if err != nil {
+		return err
+	}
+	escrituraHistorial, err := opHistorial(paciente.ID, historial, 0)
+	if err != nil {
+		return err
+	}
+	ops := []store.Op{escrituraPaciente, escrituraHistorial}
+	for _, identificador := range paciente.Identificadores {
+		ops = append(ops, opIdentificador(identificador, paciente.ID))
+	}
+	return s.db.Batch(ops)
+}
+
+// anyadirIdentificador asocia un nuevo identificador (por ejemplo, el NIE
+// de un paciente extranjero) a un paciente existente.
+func (s *server) anyadirIdentificador(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.TipoIdentificador == "" || req.Identificador == "" {
+		return api.Response{Success: -1, Message: "Faltan datos del identificador"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if req.Paciente == "" {
+		return api.Response{Success: -1, Message: "Falta el paciente al que añadir el identificador"}
+	}
+
+	id, err := s.resolverIdentificador(api.IdentificadorInterno, req.Paciente)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, id); res != nil {
+		return *res
+	}
+
+	identificador := Identificador{Tipo: req.TipoIdentificador, Valor: req.Identificador}
+	if err := s.comprobarIdentificadorLibre(identificador); err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+	// El identificador se reserva con una escritura condicional para que dos
+	// pacientes no puedan quedárselo a la vez
+	err = s.db.Batch([]store.Op{opIdentificador(identificador, id)})
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Ya existe un paciente con %s %s", identificador.Tipo, identificador.Valor)}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el identificador"}
+	}
+	if _, err := s.modificarPaciente(id, func(paciente *Paciente) error {
+		paciente.Identificadores = append(paciente.Identificadores, identificador)
+		return nil
+	}); err != nil {
+		// Sin el paciente actualizado el identificador no debe quedar reservado
+		if err := s.db.Delete("Identificadores", claveIdentificador(identificador.Tipo, identificador.Valor)); err != nil {
+			s.log.Printf("Error liberando el identificador %s %s: %v", identificador.Tipo, identificador.Valor, err)
+		}
+		return api.Response{Success: -1, Message: "Error al guardar el paciente"}
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Identificador %s añadido al paciente %s", identificador.Tipo, id), Paciente: id}
+}
+
+// migrarIdentificadores pasa de usar el DNI como clave de pacientes e
+// historiales a usar un identificador interno, registrando el DNI (o NIE)
+// en 'Identificadores'. Las redirecciones y solicitudes de fusión, que
+// contenían DNIs, se traducen a identificadores internos.
+func (s *server) migrarIdentificadores() error {
+	claves, err := s.db.ListKeys("Pacientes")
+	if err != nil && !noEncontrado(err) {
+		return err
+	}
+
+	nuevos := map[string]string{} // DNI -> identificador interno
+	for _, clave := range claves {
+		dni := string(clave)
+		if esIDInterno(dni) {
+			continue
+		}
+		paciente, err := s.obtenerPaciente(dni)
+		if err != nil {
+			s.log.Printf("Migración de identificadores: el paciente '%s' tiene un formato desconocido y no se migra", dni)
+			continue
+		}
+
+		id, err := s.nuevoIDPaciente()
+		if err != nil {
+			return err
+		}
+		identificador := Identificador{Tipo: tipoDocumento(dni), Valor: dni}
+		nhc, err := s.nhcLibre(id)
+		if err != nil {
+			return err
+		}
+		paciente.ID = id
+		paciente.Historial = id
+		paciente.Identificadores = []Identificador{identificador, nhc}
+
+		// Cada paciente se migra en un único lote para que una interrupción no
+		// lo deje a medias
+		escrituraPaciente, err := opPaciente(paciente, 0)
+		if err != nil {
+			return err
+		}
+		ops := []store.Op{escrituraPaciente, {Namespace: "Pacientes", Key: clave, Delete: true}}
+		if historial, err := s.db.Get("Historiales", clave); err == nil {
+			ops = append(ops,
+				store.Op{Namespace: "Historiales", Key: []byte(id), Value: historial},
+				store.Op{Namespace: "Historiales", Key: clave, Delete: true})
+		}
+		for _, i := range paciente.Identificadores {
+			ops = append(ops, opIdentificador(i, id))
+		}
+		if err := s.db.Batch(ops); err != nil {
+			return err
+		}
+		nuevos[dni] = id
+	}
+
+	// Las redirecciones antiguas iban de DNI absorbido a DNI superviviente. El
+	// paciente absorbido ya no existe, así que su DNI pasa a ser directamente
+	// un identificador del superviviente.
+	redirecciones, err := s.db.ListKeys("Redirecciones")
+	if err != nil && !noEncontrado(err) {
+		return err
+	}
+	for _, clave := range redirecciones {
+		if esIDInterno(string(clave)) {
+			continue
+		}
+		destino, err := s.db.Get("Redirecciones", clave)
+		if err != nil {
+			return err
+		}
+		if id, ok := nuevos[string(destino)]; ok {
+			dni := string(clave)
+			if err := s.db.Put("Identificadores", claveIdentificador(tipoDocumento(dni), dni), []byte(id)); err != nil {
+				return err
+			}
+		}
+		if err := s.db.Delete("Redirecciones", clave); err != nil {
+			return err
+		}
+	}
+
+	return actualizarRegistros(s, "SolicitudesFusion", func(solicitud *SolicitudFusion) {
+		if id, ok := nuevos[solicitud.DNI]; ok {
+			solicitud.DNI = id
+		}
+		if id, ok := nuevos[solicitud.Duplicado]; ok {
+			solicitud.Duplicado = id
+		}
+	})
+}
+
+// numeroHistoria devuelve el NHC que se asigna por defecto a un paciente:
+// la parte numérica de su identificador interno.
+func numeroHistoria(id string) string {
+	n, _ := strconv.Atoi(id[1:])
+	return strconv.Itoa(n)
+}
+
+// nhcLibre devuelve el NHC que se asigna al paciente: numeroHistoria(id) o,
+// si ese número ya se registró a mano para otro paciente, el siguiente que
+// esté libre.
+func (s *server) nhcLibre(id string) (Identificador, error) {
+	n, _ := strconv.Atoi(numeroHistoria(id))
+	for ; ; n++ {
+		nhc := Identificador{Tipo: api.IdentificadorNHC, Valor: strconv.Itoa(n)}
+		_, err := s.db.Get("Identificadores", claveIdentificador(nhc.Tipo, nhc.Valor))
+		if noEncontrado(err) {
+			return nhc, nil
+		}
+		if err != nil {
+			return nhc, err
+		}
+	}
+}
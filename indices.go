@@ -0,0 +1,237 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// prefijoIndice es el prefijo de los namespaces donde se guardan los índices.
+const prefijoIndice = "__idx:"
+
+// Extractor devuelve los valores bajo los que se indexa un registro de un
+// namespace. Un registro puede aparecer bajo varios valores o bajo ninguno.
+type Extractor func(key, value []byte) [][]byte
+
+// IndexedStore envuelve un Store y mantiene índices secundarios sobre sus
+// namespaces. Cada índice vive en su propio namespace ("__idx:ns:nombre")
+// con entradas "valor\x00clave" y valor vacío, de modo que las consultas se
+// resuelven con KeysByPrefix. Las entradas de índice se escriben en la misma
+// transacción que el registro, así que nunca quedan desincronizadas.
+type IndexedStore struct {
+	Store
+	mu      sync.Mutex
+	indices map[string]map[string]Extractor // namespace -> nombre del índice -> extractor
+}
+
+// NewIndexedStore crea la capa de índices sobre el Store dado.
+func NewIndexedStore(s Store) *IndexedStore {
+	return &IndexedStore{Store: s, indices: make(map[string]map[string]Extractor)}
+}
+
+// IndexNamespace devuelve el namespace donde se guarda un índice.
+func IndexNamespace(namespace, index string) string {
+	return prefijoIndice + namespace + ":" + index
+}
+
+// DeclareIndex registra un índice sobre un namespace. Debe llamarse antes de
+// empezar a escribir; los registros ya existentes se indexan con Rebuild.
+func (s *IndexedStore) DeclareIndex(namespace, index string, extract Extractor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indices[namespace] == nil {
+		s.indices[namespace] = make(map[string]Extractor)
+	}
+	s.indices[namespace][index] = extract
+}
+
+// Namespaces devuelve los namespaces que tienen algún índice declarado.
+func (s *IndexedStore) Namespaces() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var namespaces []string
+	for namespace := range s.indices {
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces
+}
+
+// entradaIndice construye la clave de una entrada de índice.
+func entradaIndice(valor, key []byte) []byte {
+	entrada := make([]byte, 0, len(valor)+1+len(key))
+	entrada = append(entrada, valor...)
+	entrada = append(entrada, 0)
+	return append(entrada, key...)
+}
+
+// opsIndices devuelve las operaciones que llevan los índices de un registro
+// de su valor 'anterior' (nil si no existía) al 'nuevo' (nil si se borra).
+func opsIndices(indices map[string]Extractor, namespace string, key, anterior, nuevo []byte) []Op {
+	var ops []Op
+	for index, extract := range indices {
+		indexNs := IndexNamespace(namespace, index)
+		nuevas := make(map[string]bool)
+		if nuevo != nil {
+			for _, valor := range extract(key, nuevo) {
+				nuevas[string(entradaIndice(valor, key))] = true
+			}
+		}
+		if anterior != nil {
+			for _, valor := range extract(key, anterior) {
+				entrada := entradaIndice(valor, key)
+				if nuevas[string(entrada)] {
+					delete(nuevas, string(entrada)) // sin cambios
+					continue
+				}
+				ops = append(ops, Op{Namespace: indexNs, Key: entrada, Delete: true})
+			}
+		}
+		for entrada := range nuevas {
+			ops = append(ops, Op{Namespace: indexNs, Key: []byte(entrada), Value: []byte{}})
+		}
+	}
+	return ops
+}
+
+// Put guarda el registro y actualiza sus índices en la misma transacción.
+func (s *IndexedStore) Put(namespace string, key, value []byte) error {
+	return s.Batch([]Op{{Namespace: namespace, Key: key, Value: value}})
+}
+
+// CompareAndSwap guarda el registro si su versión es la esperada y
+// actualiza sus índices en la misma transacción.
+func (s *IndexedStore) CompareAndSwap(namespace string, key []byte, expected uint64, value []byte) error {
+	return s.Batch([]Op{{Namespace: namespace, Key: key, Value: value, CheckVersion: true, Version: expected}})
+}
+
+// Delete borra el registro y sus entradas de índice en la misma transacción.
+func (s *IndexedStore) Delete(namespace string, key []byte) error {
+	if _, ok := s.indicesDe(namespace); !ok {
+		return s.Store.Delete(namespace, key)
+	}
+	return s.Batch([]Op{{Namespace: namespace, Key: key, Delete: true}})
+}
+
+// Batch aplica las operaciones y las actualizaciones de índice que
+// correspondan en una única transacción.
+func (s *IndexedStore) Batch(ops []Op) error {
+	return s.Update(func(tx Tx) error {
+		for _, op := range ops {
+			if err := tx.Apply(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update ejecuta 'fn' en una transacción del Store cuyas escrituras
+// actualizan también los índices. El valor anterior de cada registro se lee
+// dentro de la misma transacción, así que ninguna escritura concurrente
+// puede dejar los índices desincronizados.
+func (s *IndexedStore) Update(fn func(tx Tx) error) error {
+	return s.Store.Update(func(tx Tx) error {
+		return fn(indexedTx{Tx: tx, s: s})
+	})
+}
+
+// indexedTx añade a cada operación de la transacción las de sus índices.
+type indexedTx struct {
+	Tx
+	s *IndexedStore
+}
+
+func (t indexedTx) Apply(op Op) error {
+	indices, ok := t.s.indicesDe(op.Namespace)
+	if !ok {
+		return t.Tx.Apply(op)
+	}
+	anterior := t.Tx.Get(op.Namespace, op.Key)
+	if err := t.Tx.Apply(op); err != nil {
+		return err
+	}
+	var nuevo []byte
+	if !op.Delete {
+		nuevo = op.Value
+	}
+	for _, opIndice := range opsIndices(indices, op.Namespace, op.Key, anterior, nuevo) {
+		if err := t.Tx.Apply(opIndice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indicesDe indica si el namespace tiene índices declarados.
+func (s *IndexedStore) indicesDe(namespace string) (map[string]Extractor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indices, ok := s.indices[namespace]
+	return indices, ok
+}
+
+// Query devuelve las claves de los registros indexados exactamente bajo el
+// valor dado.
+func (s *IndexedStore) Query(namespace, index string, value []byte) ([][]byte, error) {
+	return s.consultar(namespace, index, append(append([]byte{}, value...), 0))
+}
+
+// QueryPrefix devuelve las claves de los registros indexados bajo algún
+// valor que empiece por el prefijo dado, sin repeticiones y en el orden del
+// índice.
+func (s *IndexedStore) QueryPrefix(namespace, index string, prefix []byte) ([][]byte, error) {
+	return s.consultar(namespace, index, prefix)
+}
+
+func (s *IndexedStore) consultar(namespace, index string, prefix []byte) ([][]byte, error) {
+	if _, ok := s.indicesDe(namespace); !ok {
+		return nil, fmt.Errorf("no hay índices declarados sobre '%s'", namespace)
+	}
+	entradas, err := s.Store.KeysByPrefix(IndexNamespace(namespace, index), prefix)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "bucket no encontrado") {
+			return nil, nil // índice todavía vacío
+		}
+		return nil, err
+	}
+	vistas := make(map[string]bool)
+	var keys [][]byte
+	for _, entrada := range entradas {
+		i := bytes.LastIndexByte(entrada, 0)
+		if i < 0 || vistas[string(entrada[i+1:])] {
+			continue
+		}
+		vistas[string(entrada[i+1:])] = true
+		keys = append(keys, entrada[i+1:])
+	}
+	return keys, nil
+}
+
+// Rebuild borra y vuelve a construir todos los índices de un namespace a
+// partir de los registros almacenados, en una única transacción.
+func (s *IndexedStore) Rebuild(namespace string) error {
+	indices, ok := s.indicesDe(namespace)
+	if !ok {
+		return fmt.Errorf("no hay índices declarados sobre '%s'", namespace)
+	}
+
+	return s.Store.Update(func(tx Tx) error {
+		var ops []Op
+		for index := range indices {
+			indexNs := IndexNamespace(namespace, index)
+			for _, entrada := range tx.ListKeys(indexNs) {
+				ops = append(ops, Op{Namespace: indexNs, Key: entrada, Delete: true})
+			}
+		}
+		for _, key := range tx.ListKeys(namespace) {
+			ops = append(ops, opsIndices(indices, namespace, key, nil, tx.Get(namespace, key))...)
+		}
+		for _, op := range ops {
+			if err := tx.Apply(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
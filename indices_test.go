@@ -0,0 +1,125 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// nuevoIndexado crea un IndexedStore con un índice "valor" que indexa cada
+// registro de "P" bajo cada byte de su valor.
+func nuevoIndexado(t *testing.T) (*IndexedStore, *BboltStore) {
+	t.Helper()
+	b := nuevoBbolt(t)
+	s := NewIndexedStore(b)
+	s.DeclareIndex("P", "valor", func(key, value []byte) [][]byte {
+		var valores [][]byte
+		for i := range value {
+			valores = append(valores, value[i:i+1])
+		}
+		return valores
+	})
+	return s, b
+}
+
+// consultar devuelve las claves indexadas bajo el valor como strings.
+func consultar(t *testing.T, s *IndexedStore, valor string) []string {
+	t.Helper()
+	claves, err := s.Query("P", "valor", []byte(valor))
+	if err != nil {
+		t.Fatalf("Query(%q) error = %v", valor, err)
+	}
+	resultado := []string{}
+	for _, clave := range claves {
+		resultado = append(resultado, string(clave))
+	}
+	return resultado
+}
+
+func TestIndicesActualizarYBorrar(t *testing.T) {
+	s, _ := nuevoIndexado(t)
+	s.Put("P", []byte("k1"), []byte("ab"))
+	s.Put("P", []byte("k2"), []byte("b"))
+	s.Put("P", []byte("k1"), []byte("bc"))
+
+	tests := []struct {
+		valor string
+		want  []string
+	}{
+		{"a", []string{}},
+		{"b", []string{"k1", "k2"}},
+		{"c", []string{"k1"}},
+	}
+	for _, tt := range tests {
+		if got := consultar(t, s, tt.valor); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tras actualizar, Query(%q) = %v, want %v", tt.valor, got, tt.want)
+		}
+	}
+
+	if err := s.Delete("P", []byte("k1")); err != nil {
+		t.Fatalf("Delete error = %v", err)
+	}
+	if got := consultar(t, s, "b"); !reflect.DeepEqual(got, []string{"k2"}) {
+		t.Errorf("tras borrar, Query(b) = %v, want [k2]", got)
+	}
+	if got := consultar(t, s, "c"); len(got) != 0 {
+		t.Errorf("tras borrar, Query(c) = %v, want []", got)
+	}
+}
+
+func TestIndicesMismoRegistroEnUnLote(t *testing.T) {
+	s, _ := nuevoIndexado(t)
+	err := s.Batch([]Op{
+		{Namespace: "P", Key: []byte("k"), Value: []byte("a")},
+		{Namespace: "P", Key: []byte("k"), Value: []byte("b")},
+	})
+	if err != nil {
+		t.Fatalf("Batch error = %v", err)
+	}
+	if got := consultar(t, s, "a"); len(got) != 0 {
+		t.Errorf("Query(a) = %v, want []", got)
+	}
+	if got := consultar(t, s, "b"); !reflect.DeepEqual(got, []string{"k"}) {
+		t.Errorf("Query(b) = %v, want [k]", got)
+	}
+}
+
+func TestIndicesBatchAtomico(t *testing.T) {
+	s, _ := nuevoIndexado(t)
+	s.Put("P", []byte("k1"), []byte("a"))
+	_, version, _ := s.GetWithVersion("P", []byte("k1"))
+
+	err := s.Batch([]Op{
+		{Namespace: "P", Key: []byte("k2"), Value: []byte("a")},
+		{Namespace: "P", Key: []byte("k1"), Value: []byte("b"), CheckVersion: true, Version: version + 1},
+	})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Batch error = %v, want ErrVersionConflict", err)
+	}
+	if _, err := s.Get("P", []byte("k2")); err == nil {
+		t.Error("el lote fallido ha guardado k2")
+	}
+	if got := consultar(t, s, "a"); !reflect.DeepEqual(got, []string{"k1"}) {
+		t.Errorf("Query(a) = %v, want [k1]", got)
+	}
+	if got := consultar(t, s, "b"); len(got) != 0 {
+		t.Errorf("Query(b) = %v, want []", got)
+	}
+}
+
+func TestIndicesRebuild(t *testing.T) {
+	s, b := nuevoIndexado(t)
+	// Escrituras sin pasar por la capa de índices
+	b.Put("P", []byte("k1"), []byte("a"))
+	b.Put(IndexNamespace("P", "valor"), entradaIndice([]byte("z"), []byte("viejo")), []byte{})
+
+	if err := s.Rebuild("P"); err != nil {
+		t.Fatalf("Rebuild error = %v", err)
+	}
+	if got := consultar(t, s, "a"); !reflect.DeepEqual(got, []string{"k1"}) {
+		t.Errorf("Query(a) = %v, want [k1]", got)
+	}
+	if got := consultar(t, s, "z"); len(got) != 0 {
+		t.Errorf("Query(z) = %v, want []", got)
+	}
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Índice de interconsultas por destino, bajo "especialidad|hospital", para
+// formar la bandeja de los médicos de esa especialidad.
+const indiceInterconsultasDestino = "destino"
+
+// Acción de revisión con la que se anota el informe de una interconsulta en
+// el expediente de origen.
+const revisionInterconsulta = "interconsulta"
+
+// Estados de una interconsulta.
+const (
+	estadoInterconsultaPendiente  = "pendiente"
+	estadoInterconsultaAceptada   = "aceptada"
+	estadoInterconsultaRechazada  = "rechazada"
+	estadoInterconsultaCompletada = "completada"
+)
+
+// ordenPrioridad permite mostrar primero las interconsultas más urgentes.
+var ordenPrioridad = map[string]int{api.PrioridadUrgente: 0, api.PrioridadPreferente: 1, api.PrioridadNormal: 2}
+
+// Interconsulta es la derivación de un paciente desde un expediente a otra
+// especialidad. Al aceptarla se crea un expediente en la especialidad de
+// destino, y el informe final se anota en el expediente de origen.
+type Interconsulta struct {
+	ID                  int    `json:"id"`
+	Expediente          int    `json:"expediente"` //expediente de origen
+	Paciente            string `json:"paciente"`
+	Medico_origen       string `json:"medico_origen"`
+	Especialidad_origen int    `json:"especialidad_origen"`
+	Especialidad        int    `json:"especialidad"` //especialidad de destino
+	Hospital            int    `json:"hospital"`     //hospital de destino
+	Motivo              string `json:"motivo"`
+	Prioridad           string `json:"prioridad"`
+	Estado              string `json:"estado"`
+	Fecha               string `json:"fecha"`
+	Respondida_por      string `json:"respondida_por,omitempty"`
+	Fecha_respuesta     string `json:"fecha_respuesta,omitempty"`
+	Motivo_rechazo      string `json:"motivo_rechazo,omitempty"`
+	Expediente_destino  int    `json:"expediente_destino,omitempty"`
+	Informe             string `json:"informe,omitempty"`
+	Fecha_informe       string `json:"fecha_informe,omitempty"`
+	Nombre_paciente     string `json:"nombre_paciente,omitempty"` //sólo en las respuestas
+}
+
+// valorIndiceDestino construye el valor bajo el que se indexa una
+// interconsulta según su destino.
+func valorIndiceDestino(especialidad, hospital int) string {
+	return fmt.Sprintf("%d|%d", especialidad, hospital)
+}
+
+// obtenerInterconsulta lee una interconsulta junto con su versión.
+func (s *server) obtenerInterconsulta(id int) (Interconsulta, uint64, error) {
+	var interconsulta Interconsulta
+	interconsultaJson, version, err := s.db.GetWithVersion("Interconsultas", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return interconsulta, 0, err
+	}
+	err = json.Unmarshal(interconsultaJson, &interconsulta)
+	return interconsulta, version, err
+}
+
+// guardarInterconsulta almacena la interconsulta sólo si no ha cambiado
+// desde que se leyó con 'version' (0 si es nueva).
+func (s *server) guardarInterconsulta(interconsulta Interconsulta, version uint64) error {
+	interconsultaJson, err := json.Marshal(interconsulta)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch([]store.Op{{
+		Namespace:    "Interconsultas",
+		Key:          []byte(strconv.Itoa(interconsulta.ID)),
+		Value:        interconsultaJson,
+		CheckVersion: true,
+		Version:      version,
+	}})
+}
+
+// esDestinoInterconsulta indica si el médico pertenece a la especialidad y
+// al hospital a los que va dirigida la interconsulta.
+func (s *server) esDestinoInterconsulta(username string, interconsulta Interconsulta) bool {
+	usuario, err := s.obtenerUsuario(username)
+	if err != nil {
+		return false
+	}
+	return usuario.Especialidad == interconsulta.Especialidad && usuario.Hospital == interconsulta.Hospital
+}
+
+// interconsultaDeRequest lee la interconsulta req.ID y comprueba que esté en
+// el estado esperado. Si no, devuelve la respuesta de error para el cliente.
+func (s *server) interconsultaDeRequest(req api.Request, estado string) (Interconsulta, uint64, *api.Response) {
+	interconsulta, version, err := s.obtenerInterconsulta(req.ID)
+	if noEncontrado(err) {
+		return interconsulta, 0, &api.Response{Success: -1, Message: fmt.Sprintf("No existe la interconsulta %d", req.ID)}
+	}
+	if err != nil {
+		return interconsulta, 0, &api.Response{Success: -1, Message: "Error al obtener la interconsulta"}
+	}
+	if interconsulta.Estado != estado {
+		return interconsulta, 0, &api.Response{Success: -1, Message: fmt.Sprintf("La interconsulta %d está %s", req.ID, interconsulta.Estado)}
+	}
+	return interconsulta, version, nil
+}
+
+// solicitarInterconsulta deriva al paciente del expediente req.ID a la
+// especialidad req.Especialidad del hospital req.Hospital (el del médico
+// si se omite), con el motivo y la prioridad indicados.
+func (s *server) solicitarInterconsulta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Especialidad == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la interconsulta (expediente, especialidad y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	prioridad := req.Prioridad
+	if prioridad == "" {
+		prioridad = api.PrioridadNormal
+	}
+	if _, ok := ordenPrioridad[prioridad]; !ok {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Prioridad no válida: %s", prioridad)}
+	}
+	expediente, res := s.expedienteAccesible(req.Username, req.ID)
+	if res != nil {
+		return *res
+	}
+	if expediente.Paciente == "" {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El expediente %d no está asociado a ningún paciente", req.ID)}
+	}
+
+	hospital := req.Hospital
+	if hospital == 0 {
+		usuario, err := s.obtenerUsuario(req.Username)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+		}
+		hospital = usuario.Hospital
+	}
+	if _, err := s.db.Get("Hospitales", []byte(strconv.Itoa(hospital))); err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el hospital %d", hospital)}
+	}
+	if req.Especialidad == expediente.Especialidad {
+		return api.Response{Success: -1, Message: "El expediente ya es de esa especialidad"}
+	}
+
+	interconsulta := Interconsulta{
+		Expediente:          expediente.ID,
+		Paciente:            expediente.Paciente,
+		Medico_origen:       req.Username,
+		Especialidad_origen: expediente.Especialidad,
+		Especialidad:        req.Especialidad,
+		Hospital:            hospital,
+		Motivo:              req.Motivo,
+		Prioridad:           prioridad,
+		Estado:              estadoInterconsultaPendiente,
+		Fecha:               time.Now().Format(time.RFC3339),
+	}
+	var err error
+	if interconsulta.ID, err = s.siguienteSecuencia("Interconsultas"); err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador de la interconsulta"}
+	}
+	if err := s.guardarInterconsulta(interconsulta, 0); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la interconsulta"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionSolicitarInterconsulta,
+		fmt.Sprintf("interconsulta %d (%s) del expediente %d del paciente %s a la especialidad %d del hospital %d: %s",
+			interconsulta.ID, prioridad, expediente.ID, expediente.Paciente, req.Especialidad, hospital, req.Motivo))
+	s.publicarEvento(api.Evento{
+		Tipo:         api.EventoInterconsultaRecibida,
+		Autor:        req.Username,
+		Paciente:     expediente.Paciente,
+		Expediente:   expediente.ID,
+		Especialidad: req.Especialidad,
+		Hospital:     hospital,
+		Mensaje:      fmt.Sprintf("Interconsulta %d (%s) de %s: %s", interconsulta.ID, prioridad, req.Username, req.Motivo),
+	})
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Interconsulta %d solicitada", interconsulta.ID), Paciente: expediente.Paciente}
+}
+
+// bandejaInterconsultas devuelve las interconsultas dirigidas a la
+// especialidad y al hospital del médico, de la más urgente a la menos y,
+// dentro de cada prioridad, de la más antigua a la más reciente. Sin
+// req.Estado se devuelven las pendientes y las aceptadas.
+func (s *server) bandejaInterconsultas(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	usuario, err := s.obtenerUsuario(req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+	}
+
+	claves, err := s.indices.Query("Interconsultas", indiceInterconsultasDestino, []byte(valorIndiceDestino(usuario.Especialidad, usuario.Hospital)))
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las interconsultas"}
+	}
+	var bandeja []Interconsulta
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		interconsulta, _, err := s.obtenerInterconsulta(id)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener las interconsultas"}
+		}
+		if req.Estado == "" && interconsulta.Estado != estadoInterconsultaPendiente && interconsulta.Estado != estadoInterconsultaAceptada {
+			continue
+		}
+		if req.Estado != "" && interconsulta.Estado != req.Estado {
+			continue
+		}
+		bandeja = append(bandeja, interconsulta)
+	}
+	sort.SliceStable(bandeja, func(i, j int) bool {
+		if ordenPrioridad[bandeja[i].Prioridad] != ordenPrioridad[bandeja[j].Prioridad] {
+			return ordenPrioridad[bandeja[i].Prioridad] < ordenPrioridad[bandeja[j].Prioridad]
+		}
+		return bandeja[i].Fecha < bandeja[j].Fecha
+	})
+
+	var registros [][]byte
+	for _, interconsulta := range bandeja {
+		if paciente, err := s.obtenerPaciente(interconsulta.Paciente); err == nil {
+			interconsulta.Nombre_paciente = paciente.Nombre + " " + paciente.Apellido
+		}
+		interconsultaJson, err := json.Marshal(interconsulta)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la interconsulta a json"}
+		}
+		registros = append(registros, interconsultaJson)
+	}
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("%d interconsultas para la especialidad %d del hospital %d", len(registros), usuario.Especialidad, usuario.Hospital),
+		Registros: registros,
+	}
+}
+
+// aceptarInterconsulta acepta la interconsulta pendiente req.ID y crea al
+// paciente un expediente en la especialidad de destino, a cargo del médico
+// que la acepta.
+func (s *server) aceptarInterconsulta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Falta la interconsulta a aceptar"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	interconsulta, version, res := s.interconsultaDeRequest(req, estadoInterconsultaPendiente)
+	if res != nil {
+		return *res
+	}
+	if !s.esDestinoInterconsulta(req.Username, interconsulta) {
+		return api.Response{Success: -1, Message: "La interconsulta no va dirigida a su especialidad y hospital"}
+	}
+
+	// Primero reservamos la interconsulta, para que dos médicos no la acepten
+	// a la vez y se creen dos expedientes
+	interconsulta.Estado = estadoInterconsultaAceptada
+	interconsulta.Respondida_por = req.Username
+	interconsulta.Fecha_respuesta = time.Now().Format(time.RFC3339)
+	err := s.guardarInterconsulta(interconsulta, version)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La interconsulta acaba de ser atendida por otro médico"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la interconsulta"}
+	}
+	_, version, err = s.obtenerInterconsulta(interconsulta.ID)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la interconsulta"}
+	}
+
+	observaciones := []Observaciones{{
+		ID:                  1,
+		Fecha_actualizacion: time.Now().Format(time.DateOnly),
+		Diagnostico: fmt.Sprintf("Interconsulta %d solicitada por %s desde el expediente %d (%s): %s",
+			interconsulta.ID, interconsulta.Medico_origen, interconsulta.Expediente, interconsulta.Prioridad, interconsulta.Motivo),
+		Medico: req.Username,
+	}}
+	expediente, err := s.crearExpediente(interconsulta.Paciente, req.Username, interconsulta.Especialidad, observaciones)
+	if err != nil {
+		s.log.Printf("Error creando el expediente de la interconsulta %d: %v", interconsulta.ID, err)
+		// Devolvemos la interconsulta a la bandeja para que pueda aceptarse de nuevo
+		pendiente := interconsulta
+		pendiente.Estado, pendiente.Respondida_por, pendiente.Fecha_respuesta = estadoInterconsultaPendiente, "", ""
+		if err := s.guardarInterconsulta(pendiente, version); err != nil {
+			s.log.Printf("Error devolviendo a pendiente la interconsulta %d: %v", interconsulta.ID, err)
+		}
+		return api.Response{Success: -1, Message: "Error al crear el expediente de la interconsulta"}
+	}
+	interconsulta.Expediente_destino = expediente
+	if err := s.guardarInterconsulta(interconsulta, version); err != nil {
+		s.log.Printf("Error anotando el expediente %d en la interconsulta %d: %v", expediente, interconsulta.ID, err)
+	}
+	s.registrarAuditoria(req.Username, api.ActionAceptarInterconsulta,
+		fmt.Sprintf("interconsulta %d del paciente %s aceptada; expediente %d creado", interconsulta.ID, interconsulta.Paciente, expediente))
+
+	return api.Response{
+		Success:  1,
+		Message:  fmt.Sprintf("Interconsulta %d aceptada; creado el expediente %d", interconsulta.ID, expediente),
+		Paciente: interconsulta.Paciente,
+		Total:    expediente,
+	}
+}
+
+// rechazarInterconsulta rechaza la interconsulta pendiente req.ID
+// indicando el motivo.
+func (s *server) rechazarInterconsulta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos del rechazo (interconsulta y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	interconsulta, version, res := s.interconsultaDeRequest(req, estadoInterconsultaPendiente)
+	if res != nil {
+		return *res
+	}
+	if !s.esDestinoInterconsulta(req.Username, interconsulta) {
+		return api.Response{Success: -1, Message: "La interconsulta no va dirigida a su especialidad y hospital"}
+	}
+
+	interconsulta.Estado = estadoInterconsultaRechazada
+	interconsulta.Respondida_por = req.Username
+	interconsulta.Fecha_respuesta = time.Now().Format(time.RFC3339)
+	interconsulta.Motivo_rechazo = req.Motivo
+	err := s.guardarInterconsulta(interconsulta, version)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La interconsulta acaba de ser atendida por otro médico"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la interconsulta"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionRechazarInterconsulta,
+		fmt.Sprintf("interconsulta %d del paciente %s rechazada: %s", interconsulta.ID, interconsulta.Paciente, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Interconsulta %d rechazada", interconsulta.ID)}
+}
+
+// completarInterconsulta cierra la interconsulta aceptada req.ID con el
+// informe del especialista, que se anota como observación en el
+// expediente de origen. Sólo puede completarla el médico que la aceptó.
+func (s *server) completarInterconsulta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Informe == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (interconsulta e informe)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	interconsulta, version, res := s.interconsultaDeRequest(req, estadoInterconsultaAceptada)
+	if res != nil {
+		return *res
+	}
+	if interconsulta.Respondida_por != req.Username {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Sólo %s, que aceptó la interconsulta, puede completarla", interconsulta.Respondida_por)}
+	}
+
+	interconsulta.Estado = estadoInterconsultaCompletada
+	interconsulta.Informe = req.Informe
+	interconsulta.Fecha_informe = time.Now().Format(time.RFC3339)
+	err := s.guardarInterconsulta(interconsulta, version)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La interconsulta ha sido modificada por otro usuario; vuelva a consultarla"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la interconsulta"}
+	}
+
+	// Quien responde puede ser de otro hospital: la interconsulta le da
+	// acceso a anotar el informe aunque no pueda ver al paciente
+	peticion := api.Request{Username: req.Username, ID: interconsulta.Expediente}
+	anotado := s.escribirExpediente(peticion, revisionInterconsulta, false, func(expediente *Expediente) error {
+		anyadirObservacion(expediente, Observaciones{
+			Fecha_actualizacion: time.Now().Format(time.DateOnly),
+			Diagnostico:         fmt.Sprintf("Informe de la interconsulta %d (expediente %d): %s", interconsulta.ID, interconsulta.Expediente_destino, req.Informe),
+			Medico:              req.Username,
+		})
+		return nil
+	})
+	if anotado.Success != 1 {
+		s.log.Printf("Error anotando el informe de la interconsulta %d en el expediente %d: %s", interconsulta.ID, interconsulta.Expediente, anotado.Message)
+		return api.Response{Success: -1, Message: "Interconsulta completada, pero no se pudo anotar el informe en el expediente de origen: " + anotado.Message}
+	}
+	s.registrarAuditoria(req.Username, api.ActionCompletarInterconsulta,
+		fmt.Sprintf("interconsulta %d del paciente %s completada; informe anotado en el expediente %d", interconsulta.ID, interconsulta.Paciente, interconsulta.Expediente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Interconsulta %d completada", interconsulta.ID)}
+}
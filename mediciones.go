@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"prac/pkg/api"
+)
+
+// Número máximo de mediciones devueltas por una consulta.
+const limiteMediciones = 1000
+
+// Medicion es una constante vital o un resultado de laboratorio de un
+// paciente. Se guarda con el rango de referencia aplicado para que el
+// marcado como fuera de rango no cambie si cambian los rangos.
+type Medicion struct {
+	Paciente          string  `json:"paciente"`
+	Tipo              string  `json:"tipo"`
+	Analito           string  `json:"analito,omitempty"` //sólo en las analíticas
+	Valor             float64 `json:"valor"`
+	Diastolica        float64 `json:"diastolica,omitempty"` //sólo en la tensión arterial
+	Unidad            string  `json:"unidad"`
+	Minimo            float64 `json:"minimo"`
+	Maximo            float64 `json:"maximo"`
+	Minimo_diastolica float64 `json:"minimo_diastolica,omitempty"`
+	Maximo_diastolica float64 `json:"maximo_diastolica,omitempty"`
+	Fecha             string  `json:"fecha"` //RFC3339 en UTC
+	Registrada_por    string  `json:"registrada_por"`
+	Fuera_de_rango    bool    `json:"fuera_de_rango,omitempty"`
+}
+
+// rangoVital es la unidad y el rango de referencia de una constante vital
+// en adultos.
+type rangoVital struct {
+	unidad                   string
+	minimo, maximo           float64
+	minimoDiast, maximoDiast float64
+}
+
+var rangosVitales = map[string]rangoVital{
+	api.MedicionTension:            {unidad: "mmHg", minimo: 90, maximo: 140, minimoDiast: 60, maximoDiast: 90},
+	api.MedicionFrecuenciaCardiaca: {unidad: "lpm", minimo: 60, maximo: 100},
+	api.MedicionTemperatura:        {unidad: "ºC", minimo: 35.5, maximo: 37.5},
+	api.MedicionGlucosa:            {unidad: "mg/dL", minimo: 70, maximo: 110},
+}
+
+// serieMedicion identifica la serie temporal de la medición: el tipo, o el
+// analito en las analíticas.
+func serieMedicion(tipo, analito string) string {
+	if tipo == api.MedicionAnalitica {
+		return tipo + ":" + normalizarTexto(analito)
+	}
+	return tipo
+}
+
+// prefijoMediciones devuelve el prefijo de las claves de una serie. Las
+// mediciones se guardan bajo "paciente|serie|fecha|secuencia", de modo que
+// las de una serie quedan contiguas y ordenadas por fecha.
+func prefijoMediciones(paciente, serie string) string {
+	return paciente + "|" + serie + "|"
+}
+
+// fueraDeRango indica si la medición está fuera de su rango de referencia.
+func fueraDeRango(medicion Medicion) bool {
+	if medicion.Valor < medicion.Minimo || medicion.Valor > medicion.Maximo {
+		return true
+	}
+	return medicion.Tipo == api.MedicionTension &&
+		(medicion.Diastolica < medicion.Minimo_diastolica || medicion.Diastolica > medicion.Maximo_diastolica)
+}
+
+// nuevaMedicion construye la medición pedida aplicando el rango de
+// referencia que corresponda y comprueba que los valores tengan sentido.
+func nuevaMedicion(req api.Request) (Medicion, error) {
+	medicion := Medicion{Tipo: req.TipoMedicion, Valor: req.Valor}
+	if req.Valor <= 0 {
+		return medicion, fmt.Errorf("El valor de la medición debe ser positivo")
+	}
+
+	if req.TipoMedicion == api.MedicionAnalitica {
+		if strings.TrimSpace(req.Analito) == "" || strings.TrimSpace(req.Unidad) == "" || req.Minimo == nil || req.Maximo == nil {
+			return medicion, fmt.Errorf("Las analíticas requieren analito, unidad y rango de referencia")
+		}
+		if *req.Minimo > *req.Maximo {
+			return medicion, fmt.Errorf("El rango de referencia no es válido")
+		}
+		medicion.Analito = strings.TrimSpace(req.Analito)
+		medicion.Unidad = strings.TrimSpace(req.Unidad)
+		medicion.Minimo, medicion.Maximo = *req.Minimo, *req.Maximo
+		return medicion, nil
+	}
+
+	rango, ok := rangosVitales[req.TipoMedicion]
+	if !ok {
+		return medicion, fmt.Errorf("Tipo de medición no válido: %s", req.TipoMedicion)
+	}
+	if req.TipoMedicion == api.MedicionTension {
+		if req.Diastolica <= 0 || req.Diastolica >= req.Valor {
+			return medicion, fmt.Errorf("La tensión diastólica debe ser positiva y menor que la sistólica")
+		}
+		medicion.Diastolica = req.Diastolica
+		medicion.Minimo_diastolica, medicion.Maximo_diastolica = rango.minimoDiast, rango.maximoDiast
+	}
+	medicion.Unidad = rango.unidad
+	medicion.Minimo, medicion.Maximo = rango.minimo, rango.maximo
+	return medicion, nil
+}
+
+// fechaMedicion interpreta la fecha en que se tomó la medición (RFC3339 o
+// "AAAA-MM-DD HH:MM" en hora local); si se omite, es el momento actual.
+func fechaMedicion(fecha string) (time.Time, error) {
+	if fecha == "" {
+		return time.Now(), nil
+	}
+	if instante, err := time.Parse(time.RFC3339, fecha); err == nil {
+		return instante, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", fecha, time.Local)
+}
+
+// registrarMedicion guarda una constante vital o un resultado de
+// laboratorio del paciente, marcándolo si está fuera de rango.
+func (s *server) registrarMedicion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.TipoMedicion == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la medición"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	paciente, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, paciente); res != nil {
+		return *res
+	}
+
+	medicion, err := nuevaMedicion(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+	instante, err := fechaMedicion(req.Fecha)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Fecha no válida (use AAAA-MM-DD HH:MM)"}
+	}
+	if instante.After(time.Now().Add(time.Minute)) {
+		return api.Response{Success: -1, Message: "La fecha de la medición es posterior a la actual"}
+	}
+	medicion.Paciente = paciente
+	medicion.Fecha = instante.UTC().Format(time.RFC3339)
+	medicion.Registrada_por = req.Username
+	medicion.Fuera_de_rango = fueraDeRango(medicion)
+
+	secuencia, err := s.siguienteSecuencia("Mediciones")
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador de la medición"}
+	}
+	clave := fmt.Sprintf("%s%s|%010d", prefijoMediciones(paciente, serieMedicion(medicion.Tipo, medicion.Analito)), medicion.Fecha, secuencia)
+	medicionJson, err := json.Marshal(medicion)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir la medición a json"}
+	}
+	if err := s.db.Put("Mediciones", []byte(clave), medicionJson); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la medición"}
+	}
+
+	if medicion.Fuera_de_rango {
+		return api.Response{
+			Success: 1,
+			Message: "Medición registrada",
+			Avisos:  []string{fmt.Sprintf("Valor fuera del rango de referencia (%g-%g %s)", medicion.Minimo, medicion.Maximo, medicion.Unidad)},
+		}
+	}
+	return api.Response{Success: 1, Message: "Medición registrada"}
+}
+
+// consultarMediciones devuelve, en orden cronológico, las mediciones de un
+// tipo (o analito) del paciente entre dos fechas, ambas incluidas. Sin
+// fechas se devuelven todas.
+func (s *server) consultarMediciones(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.TipoMedicion == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la consulta"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if req.TipoMedicion == api.MedicionAnalitica && strings.TrimSpace(req.Analito) == "" {
+		return api.Response{Success: -1, Message: "Indique el analito a consultar"}
+	}
+	paciente, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, paciente); res != nil {
+		return *res
+	}
+
+	// Las fechas de las claves están en UTC con anchura fija, así que el
+	// rango de fechas es un rango de claves
+	var desde, hasta string
+	if req.FechaInicio != "" {
+		dia, err := time.ParseInLocation(time.DateOnly, req.FechaInicio, time.Local)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Fecha de inicio no válida (use AAAA-MM-DD)"}
+		}
+		desde = dia.UTC().Format(time.RFC3339)
+	}
+	if req.FechaFin != "" {
+		instante, err := parsearInstante(req.FechaFin)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Fecha de fin no válida (use AAAA-MM-DD)"}
+		}
+		hasta = instante.UTC().Format(time.RFC3339)
+	}
+
+	prefijo := prefijoMediciones(paciente, serieMedicion(req.TipoMedicion, req.Analito))
+	inicio := []byte(prefijo + desde)
+	var mediciones [][]byte
+	for len(mediciones) < limiteMediciones {
+		pagina, siguiente, err := s.db.Scan("Mediciones", inicio, []byte(prefijo), limiteMediciones-len(mediciones))
+		if err != nil && !noEncontrado(err) {
+			return api.Response{Success: -1, Message: "Error al obtener las mediciones"}
+		}
+		for _, kv := range pagina {
+			if hasta != "" && string(kv.Key[len(prefijo):len(prefijo)+len(hasta)]) > hasta {
+				siguiente = nil
+				break
+			}
+			mediciones = append(mediciones, kv.Value)
+		}
+		if siguiente == nil {
+			break
+		}
+		inicio = siguiente
+	}
+
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("%d mediciones", len(mediciones)),
+		Registros: mediciones,
+		Paciente:  paciente,
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"prac/pkg/validation"
+)
+
+// migracion adapta los datos existentes a un cambio de formato. Cada
+// migración se aplica una sola vez y queda anotada en 'Migraciones'.
+type migracion struct {
+	nombre  string
+	aplicar func(s *server) error
+}
+
+// migraciones se aplican en orden al arrancar el servidor.
+var migraciones = []migracion{
+	{"administradores", (*server).migrarAdministradores},
+	{"normalizar_dni", (*server).migrarDNIs},
+	{"identificadores_pacientes", (*server).migrarIdentificadores},
+	{"indices", (*server).migrarIndices},
+	{"revisiones_expedientes", (*server).migrarRevisiones},
+	{"expedientes_paciente", (*server).migrarExpedientes},
+	{"indices_catalogos", (*server).migrarIndicesCatalogos},
+}
+
+// migrar aplica las migraciones pendientes.
+func (s *server) migrar() error {
+	for _, m := range migraciones {
+		if _, err := s.db.Get("Migraciones", []byte(m.nombre)); err == nil {
+			continue
+		} else if !noEncontrado(err) {
+			return err
+		}
+
+		s.log.Printf("Aplicando migración %s", m.nombre)
+		if err := m.aplicar(s); err != nil {
+			return fmt.Errorf("migración %s: %v", m.nombre, err)
+		}
+		if err := s.db.Put("Migraciones", []byte(m.nombre), []byte(time.Now().Format(time.RFC3339))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrarDNIs normaliza los DNIs usados como clave de pacientes, historiales
+// y redirecciones, así como los que aparecen dentro de otros registros.
+func (s *server) migrarDNIs() error {
+	for _, namespace := range []string{"Pacientes", "Historiales", "Redirecciones"} {
+		if err := s.normalizarClavesDNI(namespace); err != nil {
+			return err
+		}
+	}
+
+	// Campos que contienen DNIs
+	if err := actualizarRegistros(s, "Pacientes", func(paciente *Paciente) {
+		paciente.Historial = validation.NormalizarDNI(paciente.Historial)
+	}); err != nil {
+		return err
+	}
+	if err := actualizarRegistros(s, "SolicitudesFusion", func(solicitud *SolicitudFusion) {
+		solicitud.DNI = validation.NormalizarDNI(solicitud.DNI)
+		solicitud.Duplicado = validation.NormalizarDNI(solicitud.Duplicado)
+	}); err != nil {
+		return err
+	}
+	if err := actualizarRegistros(s, "Fusiones", func(fusion *Fusion) {
+		fusion.Superviviente = validation.NormalizarDNI(fusion.Superviviente)
+		fusion.Absorbido = validation.NormalizarDNI(fusion.Absorbido)
+	}); err != nil {
+		return err
+	}
+
+	claves, err := s.db.ListKeys("Redirecciones")
+	if noEncontrado(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, clave := range claves {
+		destino, err := s.db.Get("Redirecciones", clave)
+		if err != nil {
+			return err
+		}
+		if normalizado := validation.NormalizarDNI(string(destino)); normalizado != string(destino) {
+			if err := s.db.Put("Redirecciones", clave, []byte(normalizado)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalizarClavesDNI renombra las claves del namespace a su DNI normalizado.
+// Si ya existe un registro con la clave normalizada no se sobrescribe: se
+// deja el original y se avisa en el log para que se resuelva con una fusión.
+func (s *server) normalizarClavesDNI(namespace string) error {
+	claves, err := s.db.ListKeys(namespace)
+	if noEncontrado(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, clave := range claves {
+		normalizado := validation.NormalizarDNI(string(clave))
+		if normalizado == string(clave) {
+			continue
+		}
+		if _, err := s.db.Get(namespace, []byte(normalizado)); err == nil {
+			s.log.Printf("Migración de DNIs: '%s' y '%s' coinciden en %s, se conserva la clave original", clave, normalizado, namespace)
+			continue
+		}
+
+		valor, err := s.db.Get(namespace, clave)
+		if err != nil {
+			return err
+		}
+		if err := s.db.Put(namespace, []byte(normalizado), valor); err != nil {
+			return err
+		}
+		if err := s.db.Delete(namespace, clave); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// actualizarRegistros aplica 'cambiar' a todos los registros del namespace
+// que se puedan decodificar como T y guarda los que hayan cambiado.
+// Los registros con otro formato se dejan como están.
+func actualizarRegistros[T any](s *server, namespace string, cambiar func(*T)) error {
+	claves, err := s.db.ListKeys(namespace)
+	if noEncontrado(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, clave := range claves {
+		valor, err := s.db.Get(namespace, clave)
+		if err != nil {
+			return err
+		}
+		var registro T
+		if err := json.Unmarshal(valor, &registro); err != nil {
+			continue
+		}
+		cambiar(&registro)
+		nuevoValor, err := json.Marshal(registro)
+		if err != nil {
+			return err
+		}
+		if string(nuevoValor) != string(valor) {
+			if err := s.db.Put(namespace, clave, nuevoValor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
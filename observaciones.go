@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"prac/pkg/api"
+)
+
+// Tipos de entrada de un expediente que rectifican otra anterior.
+const (
+	observacionCorreccion = "correccion"
+	observacionAnulacion  = "anulacion"
+)
+
+// Estados de una observación rectificada. Las observaciones nunca se
+// borran: la original sigue visible, marcada y enlazada con la entrada que
+// la sustituye.
+const (
+	estadoObservacionCorregida = "corregida"
+	estadoObservacionAnulada   = "anulada"
+)
+
+// Acciones del historial de revisiones de un expediente.
+const (
+	revisionCorreccion = "correccion"
+	revisionAnulacion  = "anulacion"
+)
+
+// rectificarObservacion añade al expediente la entrada que corrige o anula
+// la observación 'id' y marca ésta con el estado indicado.
+func rectificarObservacion(expediente *Expediente, id int, entrada Observaciones, estado string) error {
+	if id < 1 || id > len(expediente.Observaciones) {
+		return fmt.Errorf("No existe la observación %d en el expediente %d", id, expediente.ID)
+	}
+	original := expediente.Observaciones[id-1]
+	if original.Estado != "" {
+		return fmt.Errorf("La observación %d ya fue %s por la entrada %d; rectifique esa entrada", id, original.Estado, original.Sustituida_por)
+	}
+	if original.Tipo == observacionAnulacion {
+		return fmt.Errorf("La observación %d es una anulación y no puede rectificarse", id)
+	}
+
+	entrada.Referencia = id
+	anyadirObservacion(expediente, entrada)
+	expediente.Observaciones[id-1].Estado = estado
+	expediente.Observaciones[id-1].Sustituida_por = len(expediente.Observaciones)
+	return nil
+}
+
+// corregirObservacion añade una corrección de una observación existente con
+// el nuevo texto, el motivo y el autor. La original se conserva marcada como
+// corregida.
+func (s *server) corregirObservacion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Observacion == 0 || req.Diagnostico == "" || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la corrección (expediente, observación, texto y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	diagnosticos, err := s.diagnosticosCodificados(req.Diagnosticos)
+	if err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+
+	correccion := Observaciones{
+		Fecha_actualizacion: time.Now().Format(time.DateOnly),
+		Diagnostico:         req.Diagnostico,
+		Medico:              req.Username,
+		Tipo:                observacionCorreccion,
+		Motivo:              req.Motivo,
+		Diagnosticos:        diagnosticos,
+	}
+	res := s.modificarExpediente(req, revisionCorreccion, func(expediente *Expediente) error {
+		supervisor, err := s.supervisorDe(req.Username, *expediente)
+		if err != nil {
+			return err
+		}
+		firmarObservacion(&correccion, supervisor)
+		return rectificarObservacion(expediente, req.Observacion, correccion, estadoObservacionCorregida)
+	})
+	if res.Success == 1 {
+		res.Message = fmt.Sprintf("Observación %d corregida", req.Observacion)
+	}
+	return res
+}
+
+// anularObservacion deja sin efecto una observación registrada por error,
+// indicando el motivo. La original se conserva marcada como anulada.
+func (s *server) anularObservacion(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Observacion == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la anulación (expediente, observación y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	anulacion := Observaciones{
+		Fecha_actualizacion: time.Now().Format(time.DateOnly),
+		Medico:              req.Username,
+		Tipo:                observacionAnulacion,
+		Motivo:              req.Motivo,
+	}
+	res := s.modificarExpediente(req, revisionAnulacion, func(expediente *Expediente) error {
+		supervisor, err := s.supervisorDe(req.Username, *expediente)
+		if err != nil {
+			return err
+		}
+		firmarObservacion(&anulacion, supervisor)
+		return rectificarObservacion(expediente, req.Observacion, anulacion, estadoObservacionAnulada)
+	})
+	if res.Success == 1 {
+		res.Message = fmt.Sprintf("Observación %d anulada", req.Observacion)
+	}
+	return res
+}
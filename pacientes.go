@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// errRechazo interrumpe una modificación condicional que no puede hacerse;
+// la respuesta para el usuario la prepara quien la pide.
+var errRechazo = errors.New("modificación rechazada")
+
+// obtenerHistorial recupera y decodifica el historial de un paciente.
+func (s *server) obtenerHistorial(id string) (Historial, error) {
+	var historial Historial
+	historialJson, err := s.db.Get("Historiales", []byte(id))
+	if err != nil {
+		return historial, err
+	}
+	err = json.Unmarshal(historialJson, &historial)
+	return historial, err
+}
+
+// obtenerHistorialVersion recupera el historial junto con su versión, para
+// guardarlo después con una escritura condicional.
+func (s *server) obtenerHistorialVersion(id string) (Historial, uint64, error) {
+	var historial Historial
+	historialJson, version, err := s.db.GetWithVersion("Historiales", []byte(id))
+	if err != nil {
+		return historial, 0, err
+	}
+	err = json.Unmarshal(historialJson, &historial)
+	return historial, version, err
+}
+
+// opHistorial es la escritura del historial que falla si su versión ya no
+// es la indicada (0 si no debe existir).
+func opHistorial(id string, historial Historial, version uint64) (store.Op, error) {
+	historialJson, err := json.Marshal(historial)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Namespace: "Historiales", Key: []byte(id), Value: historialJson, CheckVersion: true, Version: version}, nil
+}
+
+// guardarHistorial codifica y almacena el historial bajo el identificador
+// interno del paciente.
+func (s *server) guardarHistorial(id string, historial Historial) error {
+	historialJson, err := json.Marshal(historial)
+	if err != nil {
+		return err
+	}
+	return s.db.Put("Historiales", []byte(id), historialJson)
+}
+
+// modificarHistorial aplica 'cambiar' sobre la versión actual del historial
+// del paciente y lo guarda con una escritura condicional, reintentando si
+// otro lo ha modificado entretanto. Si tras maxReintentosCAS intentos sigue
+// habiendo conflicto devuelve store.ErrVersionConflict.
+func (s *server) modificarHistorial(id string, cambiar func(*Historial) error) error {
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		historialJson, version, err := s.db.GetWithVersion("Historiales", []byte(id))
+		if err != nil {
+			return err
+		}
+		var historial Historial
+		if err := json.Unmarshal(historialJson, &historial); err != nil {
+			return err
+		}
+		if err := cambiar(&historial); err != nil {
+			return err
+		}
+		if historialJson, err = json.Marshal(historial); err != nil {
+			return err
+		}
+		err = s.db.CompareAndSwap("Historiales", []byte(id), version, historialJson)
+		if errors.Is(err, store.ErrVersionConflict) {
+			continue
+		}
+		return err
+	}
+	return store.ErrVersionConflict
+}
+
+// estadoActual devuelve el estado del paciente. Los historiales creados antes
+// de existir el campo no lo tienen y se consideran ingresados.
+func estadoActual(historial Historial) string {
+	if historial.Estado == "" {
+		return api.EstadoIngresado
+	}
+	return historial.Estado
+}
+
+// darBaja cierra el episodio abierto del paciente con el estado final indicado
+// (baja, fallecido o trasladado).
+func (s *server) darBaja(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Estado == "" {
+		return api.Response{Success: -1, Message: "Faltan datos para dar de baja al paciente"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	if req.Estado != api.EstadoBaja && req.Estado != api.EstadoFallecido && req.Estado != api.EstadoTrasladado {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Estado de baja no válido: %s", req.Estado)}
+	}
+
+	id, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, id); res != nil {
+		return *res
+	}
+	fechaStr := time.Now().Format(time.DateOnly)
+
+	// Se modifica con una escritura condicional para no perder los
+	// expedientes que se añadan al historial a la vez
+	var rechazo api.Response // respuesta si no puede darse de baja
+	err = s.modificarHistorial(id, func(historial *Historial) error {
+		if estadoActual(*historial) != api.EstadoIngresado {
+			rechazo = api.Response{Success: -1, Message: fmt.Sprintf("El paciente no está ingresado (estado: %s)", estadoActual(*historial))}
+			return errRechazo
+		}
+		// Los historiales antiguos no tienen episodios: el primero empieza con la creación del historial
+		if len(historial.Episodios) == 0 {
+			historial.Episodios = append(historial.Episodios, Episodio{Fecha_ingreso: historial.Fecha_creacion})
+		}
+		ultimo := &historial.Episodios[len(historial.Episodios)-1]
+		ultimo.Fecha_baja = fechaStr
+		ultimo.Medico_baja = req.Username
+		ultimo.Estado_final = req.Estado
+		ultimo.Motivo = req.Motivo
+		historial.Estado = req.Estado
+		return nil
+	})
+	if errors.Is(err, errRechazo) {
+		return rechazo
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el historial del paciente"}
+	}
+
+	return api.Response{Success: 1, Message: "Paciente dado de baja correctamente", Estado: req.Estado}
+}
+
+// reingresar abre un nuevo episodio para un paciente dado de baja o trasladado.
+func (s *server) reingresar(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan datos para reingresar al paciente"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+
+	id, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, id); res != nil {
+		return *res
+	}
+	var rechazo api.Response // respuesta si no puede reingresar
+	err = s.modificarHistorial(id, func(historial *Historial) error {
+		switch estadoActual(*historial) {
+		case api.EstadoIngresado:
+			rechazo = api.Response{Success: -1, Message: "El paciente ya está ingresado"}
+			return errRechazo
+		case api.EstadoFallecido:
+			rechazo = api.Response{Success: -1, Message: "No se puede reingresar a un paciente fallecido"}
+			return errRechazo
+		}
+		historial.Episodios = append(historial.Episodios, Episodio{
+			Fecha_ingreso:  time.Now().Format(time.DateOnly),
+			Medico_ingreso: req.Username,
+		})
+		historial.Estado = api.EstadoIngresado
+		return nil
+	})
+	if errors.Is(err, errRechazo) {
+		return rechazo
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el historial del paciente"}
+	}
+
+	return api.Response{Success: 1, Message: "Paciente reingresado correctamente", Estado: api.EstadoIngresado}
+}
@@ -12,6 +12,7 @@ estudiantes: Samuel López Brufal
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"time"
@@ -27,6 +28,17 @@ func main() {
 	// los mensajes en la consola.
 	log := log.New(os.Stdout, "[main] ", log.LstdFlags)
 
+	// Los administradores se nombran con el servidor parado
+	admin := flag.String("admin", "", "nombra administrador a un usuario ya registrado y termina")
+	flag.Parse()
+	if *admin != "" {
+		if err := server.PromoverAdministrador(*admin); err != nil {
+			log.Fatalf("Error nombrando administrador: %v\n", err)
+		}
+		log.Printf("Usuario %s nombrado administrador\n", *admin)
+		return
+	}
+
 	// Inicia servidor en goroutine.
 	log.Println("Iniciando servidor...")
 	go func() {
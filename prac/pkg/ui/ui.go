@@ -118,3 +118,27 @@ func PrintProgressBar(progress, total int, width int) {
 		fmt.Println()
 	}
 }
+
+// Sparkline dibuja una serie de valores como una línea de caracteres ASCII
+// cuya altura es proporcional a cada valor, entre el mínimo y el máximo de
+// la serie.
+func Sparkline(values []float64) string {
+	const levels = "_.-~=+*#"
+	if len(values) == 0 {
+		return ""
+	}
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo = min(lo, v)
+		hi = max(hi, v)
+	}
+	var sb strings.Builder
+	for _, v := range values {
+		level := len(levels) / 2 // serie constante: todos a media altura
+		if hi > lo {
+			level = int((v-lo)/(hi-lo)*float64(len(levels)-1) + 0.5)
+		}
+		sb.WriteByte(levels[level])
+	}
+	return sb.String()
+}
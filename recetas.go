@@ -0,0 +1,382 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// rutaInteracciones es el fichero de reglas de interacciones entre fármacos
+// (CSV separado por ';' con farmaco_a, farmaco_b, gravedad y descripcion).
+const rutaInteracciones = "data/interacciones.csv"
+
+// Índice de recetas por paciente.
+const indiceRecetasPaciente = "paciente"
+
+// Estados de una receta. Una receta activa cuya fecha de fin ya ha pasado
+// se considera finalizada.
+const (
+	estadoRecetaActiva     = "activa"
+	estadoRecetaSuspendida = "suspendida"
+	estadoRecetaFinalizada = "finalizada"
+)
+
+// gravedadGrave es la gravedad de interacción que exige confirmar la receta.
+const gravedadGrave = "grave"
+
+// Receta es la prescripción de un fármaco dentro de un expediente.
+type Receta struct {
+	ID                 int    `json:"id"`
+	Expediente         int    `json:"expediente"`
+	Paciente           string `json:"paciente"`
+	Farmaco            string `json:"farmaco"`
+	Dosis              string `json:"dosis"`
+	Via                string `json:"via"`
+	Frecuencia         string `json:"frecuencia"`
+	Fecha_inicio       string `json:"fecha_inicio"`
+	Fecha_fin          string `json:"fecha_fin,omitempty"` //vacía si el tratamiento es indefinido
+	Prescriptor        string `json:"prescriptor"`
+	Estado             string `json:"estado"`
+	Modificada_por     string `json:"modificada_por,omitempty"`
+	Fecha_modificacion string `json:"fecha_modificacion,omitempty"`
+	Suspendida_por     string `json:"suspendida_por,omitempty"`
+	Fecha_suspension   string `json:"fecha_suspension,omitempty"`
+	Motivo_suspension  string `json:"motivo_suspension,omitempty"`
+}
+
+// Interaccion es una regla del fichero de interacciones entre dos principios
+// activos.
+type Interaccion struct {
+	FarmacoA    string
+	FarmacoB    string
+	Gravedad    string
+	Descripcion string
+}
+
+// cargarInteracciones lee las reglas de interacciones. Los nombres se
+// normalizan para compararlos sin tildes ni mayúsculas.
+func cargarInteracciones(ruta string) ([]Interaccion, error) {
+	fichero, err := os.Open(ruta)
+	if err != nil {
+		return nil, err
+	}
+	defer fichero.Close()
+
+	lector := csv.NewReader(fichero)
+	lector.Comma = ';'
+	lector.FieldsPerRecord = 4
+	if _, err := lector.Read(); err != nil { // cabecera
+		return nil, fmt.Errorf("%s: %v", ruta, err)
+	}
+
+	var interacciones []Interaccion
+	for {
+		fila, err := lector.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ruta, err)
+		}
+		interacciones = append(interacciones, Interaccion{
+			FarmacoA:    normalizarTexto(fila[0]),
+			FarmacoB:    normalizarTexto(fila[1]),
+			Gravedad:    normalizarTexto(fila[2]),
+			Descripcion: fila[3],
+		})
+	}
+	return interacciones, nil
+}
+
+// mencionaFarmaco indica si el nombre prescrito ("Warfarina 5 mg") contiene
+// el principio activo de una regla ("warfarina") como palabras completas.
+func mencionaFarmaco(farmaco, principio string) bool {
+	return strings.Contains(" "+normalizarTexto(farmaco)+" ", " "+principio+" ")
+}
+
+// comprobarInteracciones devuelve los avisos de interacción del fármaco con
+// las recetas activas, e indica si alguno es grave.
+func (s *server) comprobarInteracciones(farmaco string, activas []Receta) ([]string, bool) {
+	var avisos []string
+	grave := false
+	for _, receta := range activas {
+		for _, regla := range s.interacciones {
+			if (mencionaFarmaco(farmaco, regla.FarmacoA) && mencionaFarmaco(receta.Farmaco, regla.FarmacoB)) ||
+				(mencionaFarmaco(farmaco, regla.FarmacoB) && mencionaFarmaco(receta.Farmaco, regla.FarmacoA)) {
+				avisos = append(avisos, fmt.Sprintf("Interacción %s con %s (receta %d): %s", regla.Gravedad, receta.Farmaco, receta.ID, regla.Descripcion))
+				grave = grave || regla.Gravedad == gravedadGrave
+			}
+		}
+	}
+	return avisos, grave
+}
+
+// estadoReceta devuelve el estado efectivo de la receta en la fecha 'hoy'.
+func estadoReceta(receta Receta, hoy string) string {
+	if receta.Estado == estadoRecetaActiva && receta.Fecha_fin != "" && receta.Fecha_fin < hoy {
+		return estadoRecetaFinalizada
+	}
+	return receta.Estado
+}
+
+// recetasActivas devuelve las recetas activas del paciente, excepto la
+// indicada en 'excluir' (la que se está modificando).
+func (s *server) recetasActivas(paciente string, excluir int) ([]Receta, error) {
+	claves, err := s.indices.Query("Recetas", indiceRecetasPaciente, []byte(paciente))
+	if err != nil {
+		return nil, err
+	}
+	hoy := time.Now().Format(time.DateOnly)
+	var activas []Receta
+	for _, clave := range claves {
+		receta, _, err := s.obtenerReceta(string(clave))
+		if err != nil {
+			return nil, err
+		}
+		if receta.ID != excluir && estadoReceta(receta, hoy) == estadoRecetaActiva {
+			activas = append(activas, receta)
+		}
+	}
+	return activas, nil
+}
+
+// obtenerReceta lee una receta junto con su versión.
+func (s *server) obtenerReceta(id string) (Receta, uint64, error) {
+	var receta Receta
+	recetaJson, version, err := s.db.GetWithVersion("Recetas", []byte(id))
+	if err != nil {
+		return receta, 0, err
+	}
+	err = json.Unmarshal(recetaJson, &receta)
+	return receta, version, err
+}
+
+// guardarReceta almacena la receta si su versión sigue siendo 'version'.
+func (s *server) guardarReceta(receta Receta, version uint64) error {
+	recetaJson, err := json.Marshal(receta)
+	if err != nil {
+		return err
+	}
+	return s.db.CompareAndSwap("Recetas", []byte(strconv.Itoa(receta.ID)), version, recetaJson)
+}
+
+// validarPauta comprueba los datos de la prescripción.
+func validarPauta(receta Receta) error {
+	if strings.TrimSpace(receta.Farmaco) == "" || strings.TrimSpace(receta.Dosis) == "" ||
+		strings.TrimSpace(receta.Via) == "" || strings.TrimSpace(receta.Frecuencia) == "" {
+		return errors.New("Faltan datos de la receta (fármaco, dosis, vía y frecuencia)")
+	}
+	if _, err := time.Parse(time.DateOnly, receta.Fecha_inicio); err != nil {
+		return errors.New("La fecha de inicio no es válida (use AAAA-MM-DD)")
+	}
+	if receta.Fecha_fin != "" {
+		if _, err := time.Parse(time.DateOnly, receta.Fecha_fin); err != nil {
+			return errors.New("La fecha de fin no es válida (use AAAA-MM-DD)")
+		}
+		if receta.Fecha_fin < receta.Fecha_inicio {
+			return errors.New("La fecha de fin es anterior a la de inicio")
+		}
+	}
+	return nil
+}
+
+// prescribir añade una receta a un expediente. Si el fármaco interacciona
+// con la medicación activa del paciente se devuelven los avisos; las
+// interacciones graves sólo se aceptan confirmando con 'Forzar'.
+func (s *server) prescribir(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos de la receta"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	expediente, res := s.expedienteAccesible(req.Username, req.ID)
+	if res != nil {
+		return *res
+	}
+
+	receta := Receta{
+		Expediente:   expediente.ID,
+		Paciente:     expediente.Paciente,
+		Farmaco:      strings.TrimSpace(req.Farmaco),
+		Dosis:        strings.TrimSpace(req.Dosis),
+		Via:          strings.TrimSpace(req.Via),
+		Frecuencia:   strings.TrimSpace(req.Frecuencia),
+		Fecha_inicio: req.FechaInicio,
+		Fecha_fin:    req.FechaFin,
+		Prescriptor:  req.Username,
+		Estado:       estadoRecetaActiva,
+	}
+	if receta.Fecha_inicio == "" {
+		receta.Fecha_inicio = time.Now().Format(time.DateOnly)
+	}
+	if err := validarPauta(receta); err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+
+	activas, err := s.recetasActivas(receta.Paciente, 0)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la medicación activa del paciente"}
+	}
+	avisos, grave := s.comprobarInteracciones(receta.Farmaco, activas)
+	if grave && !req.Forzar {
+		return api.Response{Success: -1, Message: "El fármaco tiene interacciones graves con la medicación activa; confirme para prescribirlo", Avisos: avisos}
+	}
+
+	id, err := s.siguienteSecuencia("Recetas")
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador de la receta"}
+	}
+	receta.ID = id
+	if err := s.guardarReceta(receta, 0); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la receta"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionPrescribir,
+		fmt.Sprintf("receta %d: %s %s %s %s en el expediente %d", id, receta.Farmaco, receta.Dosis, receta.Via, receta.Frecuencia, receta.Expediente))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Receta %d creada", id), Avisos: avisos}
+}
+
+// modificarReceta cambia la pauta de una receta activa. Sólo se modifican
+// los campos indicados en la petición.
+func (s *server) modificarReceta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Receta == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos de la receta"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	receta, version, err := s.obtenerReceta(strconv.Itoa(req.Receta))
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la receta %d", req.Receta)}
+	}
+	if _, res := s.expedienteAccesible(req.Username, receta.Expediente); res != nil {
+		return *res
+	}
+	if estadoReceta(receta, time.Now().Format(time.DateOnly)) != estadoRecetaActiva {
+		return api.Response{Success: -1, Message: fmt.Sprintf("La receta %d no está activa", req.Receta)}
+	}
+
+	anterior := receta
+	for campo, valor := range map[*string]string{
+		&receta.Farmaco:      req.Farmaco,
+		&receta.Dosis:        req.Dosis,
+		&receta.Via:          req.Via,
+		&receta.Frecuencia:   req.Frecuencia,
+		&receta.Fecha_inicio: req.FechaInicio,
+		&receta.Fecha_fin:    req.FechaFin,
+	} {
+		if valor = strings.TrimSpace(valor); valor != "" {
+			*campo = valor
+		}
+	}
+	if receta == anterior {
+		return api.Response{Success: -1, Message: "No se ha indicado ningún cambio"}
+	}
+	if err := validarPauta(receta); err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+
+	var avisos []string
+	if receta.Farmaco != anterior.Farmaco {
+		activas, err := s.recetasActivas(receta.Paciente, receta.ID)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener la medicación activa del paciente"}
+		}
+		var grave bool
+		avisos, grave = s.comprobarInteracciones(receta.Farmaco, activas)
+		if grave && !req.Forzar {
+			return api.Response{Success: -1, Message: "El fármaco tiene interacciones graves con la medicación activa; confirme para prescribirlo", Avisos: avisos}
+		}
+	}
+
+	receta.Modificada_por = req.Username
+	receta.Fecha_modificacion = time.Now().Format(time.RFC3339)
+	if err := s.guardarReceta(receta, version); errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La receta ha sido modificada por otro usuario; vuelva a consultarla"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la receta"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionModificarReceta,
+		fmt.Sprintf("receta %d: %s %s %s %s -> %s %s %s %s", receta.ID,
+			anterior.Farmaco, anterior.Dosis, anterior.Via, anterior.Frecuencia,
+			receta.Farmaco, receta.Dosis, receta.Via, receta.Frecuencia))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Receta %d modificada", receta.ID), Avisos: avisos}
+}
+
+// suspenderReceta interrumpe una receta activa indicando el motivo. La
+// receta se conserva como suspendida.
+func (s *server) suspenderReceta(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Receta == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos de la suspensión (receta y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	receta, version, err := s.obtenerReceta(strconv.Itoa(req.Receta))
+	if err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la receta %d", req.Receta)}
+	}
+	if _, res := s.expedienteAccesible(req.Username, receta.Expediente); res != nil {
+		return *res
+	}
+	if estadoReceta(receta, time.Now().Format(time.DateOnly)) != estadoRecetaActiva {
+		return api.Response{Success: -1, Message: fmt.Sprintf("La receta %d no está activa", req.Receta)}
+	}
+
+	receta.Estado = estadoRecetaSuspendida
+	receta.Suspendida_por = req.Username
+	receta.Fecha_suspension = time.Now().Format(time.RFC3339)
+	receta.Motivo_suspension = req.Motivo
+	if err := s.guardarReceta(receta, version); errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "La receta ha sido modificada por otro usuario; vuelva a consultarla"}
+	} else if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar la receta"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionSuspenderReceta,
+		fmt.Sprintf("receta %d (%s) suspendida: %s", receta.ID, receta.Farmaco, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Receta %d suspendida", receta.ID)}
+}
+
+// listarRecetas devuelve la medicación activa del paciente.
+func (s *server) listarRecetas(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	paciente, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, paciente); res != nil {
+		return *res
+	}
+
+	activas, err := s.recetasActivas(paciente, 0)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener la medicación activa del paciente"}
+	}
+	var registros [][]byte
+	for _, receta := range activas {
+		recetaJson, err := json.Marshal(receta)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la receta a json"}
+		}
+		registros = append(registros, recetaJson)
+	}
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("%d recetas activas", len(activas)), Registros: registros, Paciente: paciente}
+}
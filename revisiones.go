@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Acciones que originan una revisión de un expediente.
+const (
+	revisionCrear         = "crear"
+	revisionObservacion   = "observacion"
+	revisionReasignar     = "reasignar"
+	revisionEstadoInicial = "estado_inicial" // expedientes anteriores al registro de revisiones
+)
+
+// Revision es una entrada inmutable del historial de cambios de un
+// expediente. Guarda quién y cuándo lo modificó, los campos cambiados y el
+// contenido completo resultante, para poder reconstruirlo en cualquier fecha.
+type Revision struct {
+	Expediente int             `json:"expediente"`
+	Numero     uint64          `json:"numero"` //versión del expediente tras el cambio
+	Usuario    string          `json:"usuario"`
+	Fecha      string          `json:"fecha"` //RFC3339 en UTC
+	Accion     string          `json:"accion"`
+	Cambios    []Cambio        `json:"cambios,omitempty"`
+	Contenido  json.RawMessage `json:"contenido,omitempty"`
+}
+
+// Cambio describe la modificación de un campo del expediente. En las listas
+// a las que sólo se han añadido elementos, 'Nuevo' contiene los añadidos.
+type Cambio struct {
+	Campo    string          `json:"campo"`
+	Anterior json.RawMessage `json:"anterior,omitempty"`
+	Nuevo    json.RawMessage `json:"nuevo,omitempty"`
+}
+
+// claveRevision construye la clave de una revisión. Con los números
+// rellenos con ceros, las revisiones de un expediente quedan contiguas y
+// ordenadas.
+func claveRevision(expediente int, numero uint64) []byte {
+	return []byte(fmt.Sprintf("%010d|%010d", expediente, numero))
+}
+
+// prefijoRevisiones devuelve el prefijo de las revisiones de un expediente.
+func prefijoRevisiones(expediente int) []byte {
+	return []byte(fmt.Sprintf("%010d|", expediente))
+}
+
+// diferencias compara dos versiones de un registro JSON campo a campo.
+func diferencias(anterior, nuevo []byte) []Cambio {
+	var camposAnteriores, camposNuevos map[string]json.RawMessage
+	json.Unmarshal(anterior, &camposAnteriores)
+	json.Unmarshal(nuevo, &camposNuevos)
+
+	campos := make(map[string]bool)
+	for campo := range camposAnteriores {
+		campos[campo] = true
+	}
+	for campo := range camposNuevos {
+		campos[campo] = true
+	}
+	delete(campos, "version") // cambia siempre
+
+	var cambios []Cambio
+	for campo := range campos {
+		a, n := camposAnteriores[campo], camposNuevos[campo]
+		if bytes.Equal(a, n) {
+			continue
+		}
+		cambio := Cambio{Campo: campo, Anterior: a, Nuevo: n}
+
+		// En las listas que sólo crecen (observaciones) basta con lo añadido
+		var listaAnterior, listaNueva []json.RawMessage
+		if json.Unmarshal(a, &listaAnterior) == nil && json.Unmarshal(n, &listaNueva) == nil &&
+			len(listaNueva) > len(listaAnterior) && prefijoDeLista(listaAnterior, listaNueva) {
+			if anyadidos, err := json.Marshal(listaNueva[len(listaAnterior):]); err == nil {
+				cambio = Cambio{Campo: campo, Nuevo: anyadidos}
+			}
+		}
+		cambios = append(cambios, cambio)
+	}
+	sort.Slice(cambios, func(i, j int) bool { return cambios[i].Campo < cambios[j].Campo })
+	return cambios
+}
+
+// prefijoDeLista indica si 'corta' coincide con el comienzo de 'larga'.
+func prefijoDeLista(corta, larga []json.RawMessage) bool {
+	for i := range corta {
+		if !bytes.Equal(corta[i], larga[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// opRevision construye la escritura de la revisión que lleva el expediente
+// de 'anterior' (nil si se crea) a 'nuevo'.
+func opRevision(id int, numero uint64, usuario, accion string, anterior, nuevo []byte) (store.Op, error) {
+	revision := Revision{
+		Expediente: id,
+		Numero:     numero,
+		Usuario:    usuario,
+		Fecha:      time.Now().UTC().Format(time.RFC3339Nano),
+		Accion:     accion,
+		Contenido:  nuevo,
+	}
+	if anterior != nil {
+		revision.Cambios = diferencias(anterior, nuevo)
+	}
+	revisionJson, err := json.Marshal(revision)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Namespace: "RevisionesExpedientes", Key: claveRevision(id, numero), Value: revisionJson}, nil
+}
+
+// revisionEnFecha devuelve la última revisión del expediente anterior o
+// igual al instante indicado.
+func (s *server) revisionEnFecha(id int, instante time.Time) (Revision, error) {
+	var revision Revision
+	var inicio []byte
+	for {
+		pagina, siguiente, err := s.db.ScanReverse("RevisionesExpedientes", inicio, prefijoRevisiones(id), 50)
+		if err != nil && !noEncontrado(err) {
+			return revision, err
+		}
+		for _, kv := range pagina {
+			if err := json.Unmarshal(kv.Value, &revision); err != nil {
+				return revision, err
+			}
+			fecha, err := time.Parse(time.RFC3339Nano, revision.Fecha)
+			if err == nil && !fecha.After(instante) {
+				return revision, nil
+			}
+		}
+		if siguiente == nil {
+			return revision, fmt.Errorf("clave no encontrada: el expediente %d no existía en esa fecha", id)
+		}
+		inicio = siguiente
+	}
+}
+
+// parsearInstante interpreta la fecha de una consulta histórica: una fecha
+// (AAAA-MM-DD, hasta el final de ese día) o un instante RFC3339.
+func parsearInstante(fecha string) (time.Time, error) {
+	if instante, err := time.Parse(time.RFC3339, fecha); err == nil {
+		return instante, nil
+	}
+	dia, err := time.ParseInLocation(time.DateOnly, fecha, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return dia.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+// historialExpediente lista las revisiones de un expediente (quién, cuándo
+// y qué cambió), de la más antigua a la más reciente, paginadas con cursor.
+func (s *server) historialExpediente(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Faltan datos del expediente"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if _, res := s.expedienteAccesible(req.Username, req.ID); res != nil {
+		return *res
+	}
+
+	limite := req.Limite
+	if limite <= 0 {
+		limite = limiteExpedientes
+	}
+	limite = min(limite, limiteExpedientesMax)
+	inicio, err := descodificarCursor(req.Cursor)
+	if err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
+	pagina, siguiente, err := s.db.Scan("RevisionesExpedientes", inicio, prefijoRevisiones(req.ID), limite)
+	if err != nil && !noEncontrado(err) {
+		return api.Response{Success: -1, Message: "Error al obtener las revisiones del expediente"}
+	}
+
+	var revisiones [][]byte
+	for _, kv := range pagina {
+		// El contenido completo sólo se devuelve en las consultas por fecha
+		var revision Revision
+		if err := json.Unmarshal(kv.Value, &revision); err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la revisión a struct"}
+		}
+		revision.Contenido = nil
+		revisionJson, err := json.Marshal(revision)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir la revisión a json"}
+		}
+		revisiones = append(revisiones, revisionJson)
+	}
+
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("Revisiones del expediente %d", req.ID),
+		Registros: revisiones,
+		Cursor:    codificarCursor(siguiente),
+	}
+}
+
+// expedienteEnFecha devuelve el expediente tal y como estaba en la fecha
+// indicada, para revisiones médico-legales.
+func (s *server) expedienteEnFecha(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Fecha == "" {
+		return api.Response{Success: -1, Message: "Faltan datos del expediente o la fecha"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	instante, err := parsearInstante(req.Fecha)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Fecha no válida (use AAAA-MM-DD)"}
+	}
+	if _, res := s.expedienteAccesible(req.Username, req.ID); res != nil {
+		return *res
+	}
+
+	revision, err := s.revisionEnFecha(req.ID, instante)
+	if noEncontrado(err) {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El expediente %d no existía el %s", req.ID, req.Fecha)}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener las revisiones del expediente"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionExpedienteEnFecha,
+		fmt.Sprintf("consulta del expediente %d a fecha %s (revisión %d)", req.ID, req.Fecha, revision.Numero))
+
+	return api.Response{
+		Success:     1,
+		Message:     fmt.Sprintf("Expediente %d a fecha %s (revisión %d de %s, por %s)", req.ID, req.Fecha, revision.Numero, revision.Fecha, revision.Usuario),
+		Expedientes: [][]byte{revision.Contenido},
+	}
+}
+
+// migrarRevisiones guarda como primera revisión el estado actual de los
+// expedientes creados antes de que existiera el historial de revisiones.
+func (s *server) migrarRevisiones() error {
+	claves, err := s.db.ListKeys("Expedientes")
+	if noEncontrado(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		if existentes, err := s.db.KeysByPrefix("RevisionesExpedientes", prefijoRevisiones(id)); err == nil && len(existentes) > 0 {
+			continue
+		}
+		expedienteJson, version, err := s.db.GetWithVersion("Expedientes", clave)
+		if err != nil {
+			return err
+		}
+		op, err := opRevision(id, version, "migracion", revisionEstadoInicial, nil, expedienteJson)
+		if err != nil {
+			return err
+		}
+		if err := s.db.Batch([]store.Op{op}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
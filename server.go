@@ -3,48 +3,61 @@
 package server
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"prac/pkg/api"
 	"prac/pkg/store"
+	"prac/pkg/validation"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	"time"
 )
 
-var currentHospital int
-var currentSpecialty int
-
 // server encapsula el estado de nuestro servidor
 type server struct {
-	db                 store.Store // base de datos
-	log                *log.Logger // logger para mensajes de error e información
-	tokenCounter       int64       // contador para generar tokens
+	db                 store.Store         // base de datos
+	indices            *store.IndexedStore // la misma base de datos, para consultar sus índices
+	log                *log.Logger         // logger para mensajes de error e información
+	tokenCounter       int64               // contador para generar tokens
 	contadorIDPaciente int64
 	contadorIDMedico   int64
+	mu                 sync.Mutex    // protege los contadores del namespace 'Contadores'
+	interacciones      []Interaccion // reglas de interacciones entre fármacos
+	cifrado            cipher.AEAD   // cifrado de los adjuntos; nil si no hay clave
+	eventos            busEventos    // notificaciones para las conexiones abiertas en /events
 }
 
 type Usuario struct {
-	Constraseña  string `json:"contraseña"`
-	Apellido     string `json:"apellido"`
-	Especialidad int    `json:"especialidad"`
-	Hospital     int    `json:"hospital"`
+	Constraseña   string `json:"contraseña"`
+	Apellido      string `json:"apellido"`
+	Especialidad  int    `json:"especialidad"`
+	Hospital      int    `json:"hospital"`
+	Rol           string `json:"rol,omitempty"`
+	Deshabilitado bool   `json:"deshabilitado,omitempty"` //no puede iniciar sesión
 }
 
 type Paciente struct {
-	Nombre           string `json:"nombre"`
-	Apellido         string `json:"apellido"`
-	Fecha_nacimiento string `json:"fecha_nacimiento"`
-	Sexo             string `json:"sexo"`
-	Hospital         int    `json:"hospital"`
-	Historial        string `json:"historial"`
-	Medico           string `json:"medico"`
+	ID                    string             `json:"id"`
+	Identificadores       []Identificador    `json:"identificadores"`
+	Nombre                string             `json:"nombre"`
+	Apellido              string             `json:"apellido"`
+	Fecha_nacimiento      string             `json:"fecha_nacimiento"`
+	Sexo                  string             `json:"sexo"`
+	Hospital              int                `json:"hospital"`
+	Historial             string             `json:"historial"`
+	Medico                string             `json:"medico"`
+	Alertas               []Alerta           `json:"alertas,omitempty"`               //alergias, enfermedades crónicas y otros avisos
+	Hospitales_anteriores []EstanciaHospital `json:"hospitales_anteriores,omitempty"` //hospitales de los que se trasladó
 }
 
 type Hospital struct {
@@ -56,43 +69,108 @@ type Especialidad struct {
 }
 
 type Historial struct {
-	Fecha_creacion string `json:"fecha_creacion"`
-	Expedientes    []int  `json:"expedientes"` //tener en cuenta que para actualizarlos hay que coger la lista existente y añadirle uno nuevo
+	Fecha_creacion string     `json:"fecha_creacion"`
+	Expedientes    []int      `json:"expedientes"` //tener en cuenta que para actualizarlos hay que coger la lista existente y añadirle uno nuevo
+	Estado         string     `json:"estado"`
+	Episodios      []Episodio `json:"episodios"`
+}
+
+// Episodio representa un periodo de ingreso del paciente, desde que se le
+// da de alta (o reingresa) hasta que se le da de baja.
+type Episodio struct {
+	Fecha_ingreso  string `json:"fecha_ingreso"`
+	Medico_ingreso string `json:"medico_ingreso"`
+	Fecha_baja     string `json:"fecha_baja,omitempty"`
+	Medico_baja    string `json:"medico_baja,omitempty"`
+	Estado_final   string `json:"estado_final,omitempty"`
+	Motivo         string `json:"motivo,omitempty"`
 }
 
 type Observaciones struct {
-	Fecha_actualizacion string `json:"fecha_actualizacion"`
-	Diagnostico         string `json:"diagnostico"`
-	Medico              string `json:"medico"`
+	ID                  int           `json:"id"` //posición en el expediente, empezando en 1
+	Fecha_actualizacion string        `json:"fecha_actualizacion"`
+	Diagnostico         string        `json:"diagnostico"`
+	Medico              string        `json:"medico"`
+	Tipo                string        `json:"tipo,omitempty"`           //vacío, "correccion" o "anulacion"
+	Referencia          int           `json:"referencia,omitempty"`     //observación corregida o anulada por ésta
+	Motivo              string        `json:"motivo,omitempty"`         //motivo de la corrección o anulación
+	Estado              string        `json:"estado,omitempty"`         //vacío (vigente), "corregida" o "anulada"
+	Sustituida_por      int           `json:"sustituida_por,omitempty"` //entrada que corrige o anula ésta
+	Diagnosticos        []CodigoCIE10 `json:"diagnosticos,omitempty"`   //diagnósticos codificados con CIE-10
+	Firma               string        `json:"firma,omitempty"`          //vacío, "pendiente" o "refrendada" si la escribió un residente
+	Supervisor          string        `json:"supervisor,omitempty"`     //médico que debe refrendar la observación
+	Fecha_refrendo      string        `json:"fecha_refrendo,omitempty"`
 }
 
 type Expediente struct {
+	ID             int             `json:"id"`
+	Paciente       string          `json:"paciente,omitempty"`
 	Medico         string          `json:"medico"`
 	Observaciones  []Observaciones `json:"observaciones"`
 	Fecha_creacion string          `json:"fecha_creacion"`
 	Especialidad   int             `json:"especialidad"`
+	Ultimo_editor  string          `json:"ultimo_editor,omitempty"`
+	Version        uint64          `json:"version"` //versión del registro en el store; se rellena al leerlo
+	Adjuntos       []Adjunto       `json:"adjuntos,omitempty"`
 }
 
-// Run inicia la base de datos y arranca el servidor HTTP.
-func Run() error {
+// abrirServidor abre la base de datos y crea el servidor que trabaja sobre ella.
+func abrirServidor() (*server, error) {
 	// Abrimos la base de datos usando el motor bbolt
 	db, err := store.NewStore("bbolt", "data/server.db")
 	if err != nil {
-		return fmt.Errorf("error abriendo base de datos: %v", err)
+		return nil, fmt.Errorf("error abriendo base de datos: %v", err)
 	}
 
+	// Los índices secundarios se mantienen en las mismas escrituras que los registros
+	indexado := store.NewIndexedStore(db)
+	declararIndices(indexado)
+
 	// Creamos nuestro servidor con su logger con prefijo 'srv'
-	srv := &server{
-		db:  db,
-		log: log.New(os.Stdout, "[srv] ", log.LstdFlags),
+	return &server{
+		db:      indexado,
+		indices: indexado,
+		log:     log.New(os.Stdout, "[srv] ", log.LstdFlags),
+	}, nil
+}
+
+// Run inicia la base de datos y arranca el servidor HTTP.
+func Run() error {
+	srv, err := abrirServidor()
+	if err != nil {
+		return err
 	}
 
 	// Al terminar, cerramos la base de datos
 	defer srv.db.Close()
 
-	// Construimos un mux y asociamos /api a nuestro apiHandler,
+	// Adaptamos los datos existentes a los cambios de formato antes de atender peticiones
+	if err := srv.migrar(); err != nil {
+		return fmt.Errorf("error migrando la base de datos: %v", err)
+	}
+
+	// El catálogo CIE-10 es opcional: sin él no se pueden codificar diagnósticos
+	if err := srv.cargarCatalogoCIE10(rutaCatalogoCIE10); err != nil {
+		srv.log.Printf("No se ha podido cargar el catálogo CIE-10: %v", err)
+	}
+	if srv.interacciones, err = cargarInteracciones(rutaInteracciones); err != nil {
+		srv.log.Printf("No se han podido cargar las interacciones entre fármacos: %v", err)
+	}
+	if srv.cifrado, err = cargarClaveAdjuntos(rutaClaveAdjuntos); err != nil {
+		srv.log.Printf("No se ha podido cargar la clave de los adjuntos; no podrán subirse ni descargarse: %v", err)
+	}
+
+	// Los traslados aceptados con fecha futura se aplican al llegar su fecha
+	go srv.trasladosProgramados()
+
+	// Las subidas de adjuntos abandonadas se borran al cumplir su plazo
+	go srv.subidasProgramadas()
+
+	// Construimos un mux y asociamos /api a nuestro apiHandler y /events a
+	// las notificaciones,
 	mux := http.NewServeMux()
 	mux.Handle("/api", http.HandlerFunc(srv.apiHandler))
+	mux.Handle("/events", http.HandlerFunc(srv.eventsHandler))
 
 	// Iniciamos el servidor HTTP.
 	err = http.ListenAndServe(":8080", mux)
@@ -115,6 +193,12 @@ func (s *server) apiHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Los identificadores se usan como clave en el store: los normalizamos
+	// para que "12345678z" y "12345678-Z" correspondan al mismo paciente
+	req.DNI = validation.NormalizarDNI(req.DNI)
+	req.Duplicado = validation.NormalizarDNI(req.Duplicado)
+	req.Identificador = validation.NormalizarIdentificador(req.TipoIdentificador, req.Identificador)
+
 	// Despacho según la acción solicitada
 	var res api.Response
 	switch req.Action {
@@ -136,6 +220,128 @@ func (s *server) apiHandler(w http.ResponseWriter, r *http.Request) {
 		res = s.anyadirExpediente(req)
 	case api.ActionModificarExpediente:
 		res = s.anyadirObservaciones(req)
+	case api.ActionDarBaja:
+		res = s.darBaja(req)
+	case api.ActionReingresar:
+		res = s.reingresar(req)
+	case api.ActionSolicitarFusion:
+		res = s.solicitarFusion(req)
+	case api.ActionListarSolicitudesFusion:
+		res = s.listarSolicitudesFusion(req)
+	case api.ActionMergePacientes:
+		res = s.mergePacientes(req)
+	case api.ActionDeshacerFusion:
+		res = s.deshacerFusion(req)
+	case api.ActionAnyadirIdentificador:
+		res = s.anyadirIdentificador(req)
+	case api.ActionBuscarPacientes:
+		res = s.buscarPacientes(req)
+	case api.ActionReconstruirIndices:
+		res = s.reconstruirIndices(req)
+	case api.ActionHistorialExpediente:
+		res = s.historialExpediente(req)
+	case api.ActionExpedienteEnFecha:
+		res = s.expedienteEnFecha(req)
+	case api.ActionCorregirObservacion:
+		res = s.corregirObservacion(req)
+	case api.ActionAnularObservacion:
+		res = s.anularObservacion(req)
+	case api.ActionBuscarCIE10:
+		res = s.buscarCIE10(req)
+	case api.ActionPrescribir:
+		res = s.prescribir(req)
+	case api.ActionModificarReceta:
+		res = s.modificarReceta(req)
+	case api.ActionSuspenderReceta:
+		res = s.suspenderReceta(req)
+	case api.ActionListarRecetas:
+		res = s.listarRecetas(req)
+	case api.ActionAnyadirAlerta:
+		res = s.anyadirAlerta(req)
+	case api.ActionResolverAlerta:
+		res = s.resolverAlerta(req)
+	case api.ActionRegistrarMedicion:
+		res = s.registrarMedicion(req)
+	case api.ActionConsultarMediciones:
+		res = s.consultarMediciones(req)
+	case api.ActionIniciarAdjunto:
+		res = s.iniciarAdjunto(req)
+	case api.ActionSubirFragmento:
+		res = s.subirFragmento(req)
+	case api.ActionCompletarAdjunto:
+		res = s.completarAdjunto(req)
+	case api.ActionDescargarAdjunto:
+		res = s.descargarAdjunto(req)
+	case api.ActionPublicarHuecos:
+		res = s.publicarHuecos(req)
+	case api.ActionListarHuecos:
+		res = s.listarHuecos(req)
+	case api.ActionAgendaDia:
+		res = s.agendaDia(req)
+	case api.ActionReservarCita:
+		res = s.reservarCita(req)
+	case api.ActionCancelarCita:
+		res = s.cancelarCita(req)
+	case api.ActionReprogramarCita:
+		res = s.reprogramarCita(req)
+	case api.ActionSolicitarInterconsulta:
+		res = s.solicitarInterconsulta(req)
+	case api.ActionBandejaInterconsultas:
+		res = s.bandejaInterconsultas(req)
+	case api.ActionAceptarInterconsulta:
+		res = s.aceptarInterconsulta(req)
+	case api.ActionRechazarInterconsulta:
+		res = s.rechazarInterconsulta(req)
+	case api.ActionCompletarInterconsulta:
+		res = s.completarInterconsulta(req)
+	case api.ActionSolicitarTraslado:
+		res = s.solicitarTraslado(req)
+	case api.ActionListarTraslados:
+		res = s.listarTraslados(req)
+	case api.ActionAceptarTraslado:
+		res = s.aceptarTraslado(req)
+	case api.ActionRechazarTraslado:
+		res = s.rechazarTraslado(req)
+	case api.ActionListCatalogs:
+		res = s.listCatalogs(req)
+	case api.ActionCrearHospital:
+		res = s.crearEntrada(catalogoHospitales, req.Action, req)
+	case api.ActionRenombrarHospital:
+		res = s.renombrarEntrada(catalogoHospitales, req.Action, req)
+	case api.ActionBorrarHospital:
+		res = s.borrarEntrada(catalogoHospitales, req.Action, req)
+	case api.ActionCrearEspecialidad:
+		res = s.crearEntrada(catalogoEspecialidades, req.Action, req)
+	case api.ActionRenombrarEspecialidad:
+		res = s.renombrarEntrada(catalogoEspecialidades, req.Action, req)
+	case api.ActionBorrarEspecialidad:
+		res = s.borrarEntrada(catalogoEspecialidades, req.Action, req)
+	case api.ActionListarUsuarios:
+		res = s.listarUsuarios(req)
+	case api.ActionDeshabilitarUsuario:
+		res = s.deshabilitarUsuario(req)
+	case api.ActionHabilitarUsuario:
+		res = s.habilitarUsuario(req)
+	case api.ActionCambiarDestinoUsuario:
+		res = s.cambiarDestinoUsuario(req)
+	case api.ActionBorrarUsuario:
+		res = s.borrarUsuario(req)
+	case api.ActionGenerarCodigoReset:
+		res = s.generarCodigoReset(req)
+	case api.ActionResetPassword:
+		res = s.resetPassword(req)
+	case api.ActionCambiarRolUsuario:
+		res = s.cambiarRolUsuario(req)
+	case api.ActionDelegarResidente:
+		res = s.delegarResidente(req)
+	case api.ActionRevocarDelegacion:
+		res = s.revocarDelegacion(req)
+	case api.ActionListarDelegaciones:
+		res = s.listarDelegaciones(req)
+	case api.ActionPendientesRefrendo:
+		res = s.pendientesRefrendo(req)
+	case api.ActionRefrendarObservacion:
+		res = s.refrendarObservacion(req)
 
 	default:
 		res = api.Response{Success: -1, Message: "Acción desconocida"}
@@ -167,52 +373,28 @@ func (s *server) generateToken(expirationDuration time.Duration) (api.Token, err
 	}, nil
 }
 
-func (s *server) obtenerUltimoID(namespace string) string {
-	keys, err := s.db.ListKeys(namespace)
-	if err != nil {
-		return "Q"
-	}
-	if len(keys) == 0 {
-		return "1"
-	}
-
-	lastElement := string(keys[len(keys)-1])
-	fmt.Println("LastElemente: ", lastElement)
-	id_int, errAtoi := strconv.Atoi(lastElement)
-	if errAtoi != nil {
-		return "P"
-	}
-
-	id_int = id_int + 1
-
-	id_final := strconv.Itoa(id_int)
-	return id_final
-}
-
-func (s *server) obtenerIdHospital(nombre string) int {
-	listaKeys, err := s.db.ListKeys("Hospitales")
-	if err != nil {
-		return -1
-	}
-	var key int
-	for i := 0; i < len(listaKeys); i++ {
-		hospitalJson, errget := s.db.Get("Hospitales", []byte(listaKeys[i]))
-		if errget != nil {
-			return -1
+// siguienteSecuencia incrementa y devuelve el contador 'nombre' guardado
+// en el namespace 'Contadores'. Si no existe, empieza en 1.
+func (s *server) siguienteSecuencia(nombre string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	actual := 0
+	valor, err := s.db.Get("Contadores", []byte(nombre))
+	if err == nil {
+		actual, err = strconv.Atoi(string(valor))
+		if err != nil {
+			return 0, fmt.Errorf("contador '%s' corrupto: %v", nombre, err)
 		}
+	} else if !noEncontrado(err) {
+		return 0, err
+	}
 
-		var hospitalStruct Hospital
-
-		errStruct := json.Unmarshal(hospitalJson, &hospitalStruct)
-		if errStruct != nil {
-			return -1
-		}
-		if hospitalStruct.Nombre == nombre {
-			key = i + 1
-			break
-		}
+	actual++
+	if err := s.db.Put("Contadores", []byte(nombre), []byte(strconv.Itoa(actual))); err != nil {
+		return 0, err
 	}
-	return key
+	return actual, nil
 }
 
 // registerUser registra un nuevo usuario, si no existe.
@@ -223,6 +405,9 @@ func (s *server) registerUser(req api.Request) api.Response {
 	if req.Username == "" || req.Password == "" || req.Apellido == "" || req.Especialidad == 0 || req.Hospital == 0 {
 		return api.Response{Success: -1, Message: "Faltan credenciales"}
 	}
+	if err := validation.ValidarContrasenya(req.Username, req.Password); err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
 
 	// Verificamos si ya existe el usuario en 'auth'
 	exists, err := s.userExists(req.Username)
@@ -232,12 +417,25 @@ func (s *server) registerUser(req api.Request) api.Response {
 	if exists {
 		return api.Response{Success: -1, Message: "El usuario ya existe"}
 	}
+	if borrado, err := s.usuarioBorrado(req.Username); err != nil {
+		return api.Response{Success: -1, Message: "Error al verificar usuario"}
+	} else if borrado {
+		return api.Response{Success: -1, Message: "Ese nombre de usuario perteneció a un usuario borrado y no puede reutilizarse"}
+	}
+
+	// Nadie se registra como administrador: se nombran con el servidor parado
+	usuarios, err := s.db.ListKeys("Usuarios")
+	primero := noEncontrado(err) || (err == nil && len(usuarios) == 0)
+	if err := s.comprobarCatalogosUsuario(req.Hospital, req.Especialidad, primero); err != nil {
+		return api.Response{Success: -1, Message: err.Error()}
+	}
 
 	usuario := Usuario{
 		Constraseña:  req.Password,
 		Apellido:     req.Apellido,
 		Especialidad: req.Especialidad,
 		Hospital:     req.Hospital,
+		Rol:          api.RolMedico,
 	}
 
 	jsonUsuario, errJson := json.Marshal(usuario)
@@ -275,6 +473,9 @@ func (s *server) loginUser(req api.Request) api.Response {
 	if string(storedPass) != req.Password {
 		return api.Response{Success: -1, Message: "Credenciales inválidas"}
 	}
+	if datosUsuario.Deshabilitado {
+		return api.Response{Success: -1, Message: "El usuario está deshabilitado; contacte con un administrador"}
+	}
 
 	// Generamos un nuevo token, lo guardamos en 'sessions'
 	token, errGenerateToken := s.generateToken(30 * time.Minute)
@@ -295,61 +496,109 @@ func (s *server) loginUser(req api.Request) api.Response {
 		return api.Response{Success: -1, Message: "Erro al convertir hospital a struct"}
 	}
 
-	currentSpecialty = usuario.Especialidad
-	currentHospital = usuario.Hospital
 	fmt.Println("Token en el login ", token)
-	return api.Response{Success: 1, Message: "Login exitoso", Token: token}
+	return api.Response{Success: 1, Message: "Login exitoso", Token: token, Rol: usuario.Rol}
 }
 
 // Obtener expedientes de la especialidad del médico
 func (s *server) obtenerExpedientes(req api.Request) api.Response {
-	if req.DNI == "" || req.Token.Value == "" {
+	if (req.DNI == "" && req.Identificador == "" && req.Paciente == "") || req.Token.Value == "" {
 		return api.Response{Success: -1, Message: "Faltan datos"}
 	}
 	if !s.isTokenValid(req.Token, req.Username) {
 		return api.Response{Success: 0, Message: "Error en las credenciales: Token inválido o caducado"}
 	}
 
-	historial, err_hist := s.db.Get("Historiales", []byte(req.DNI))
+	// Se puede buscar al paciente por cualquiera de sus identificadores
+	paciente, errPaciente := s.pacienteDeRequest(req)
+	if errPaciente != nil {
+		return api.Response{Success: -1, Message: "No existe ningún paciente con el identificador introducido"}
+	}
+	if res := s.accesoPaciente(req.Username, paciente); res != nil {
+		return *res
+	}
 
+	historial, err_hist := s.obtenerHistorial(paciente)
 	if err_hist != nil {
 		return api.Response{Success: -1, Message: "El Dni introducido es incorrecto"}
 	}
 
-	var historial_json Historial
-	err := json.Unmarshal(historial, &historial_json)
-	lista_expedientes := historial_json.Expedientes
-
-	var info_expedientes [][]byte
-	for i := 0; i < len(lista_expedientes); i++ {
-		expedienteKey := strconv.Itoa(lista_expedientes[i]) // Convertir int a string
-		expediente, errExp := s.db.Get("Expedientes", []byte(expedienteKey))
-		if errExp != nil {
-			return api.Response{Success: -1, Message: "Los expedientes del paciente son incorrectos"}
-		}
-
-		// Convertimos el JSON a un mapa para modificarlo
-		var expedienteStruct Expediente
-		json.Unmarshal(expediente, &expedienteStruct)
-
-		info_expedientes = append(info_expedientes, expediente)
+	// Los expedientes se devuelven paginados: el cursor de la respuesta
+	// permite pedir la página siguiente
+	info_expedientes, cursor, err := s.paginaExpedientes(paciente, req.Cursor, req.Limite, req.Descendente)
+	if err != nil {
+		s.log.Printf("Error listando expedientes de %s: %v", paciente, err)
+		return api.Response{Success: -1, Message: "Los expedientes del paciente son incorrectos"}
 	}
-
+	// Las alertas acompañan siempre a los expedientes para que el médico
+	// las vea antes de cualquier otra cosa
+	alertas, err := s.alertasActivas(paciente)
 	if err != nil {
-		return api.Response{Success: -1, Message: "No existe dicha especialidad"}
+		return api.Response{Success: -1, Message: "Error al obtener las alertas del paciente"}
 	}
 
-	return api.Response{Success: 1, Message: "Expedientes obtenidos", Expedientes: info_expedientes}
+	return api.Response{
+		Success:     1,
+		Message:     "Expedientes obtenidos",
+		Expedientes: info_expedientes,
+		Estado:      estadoActual(historial),
+		Paciente:    paciente,
+		Cursor:      cursor,
+		Total:       len(historial.Expedientes),
+		Alertas:     alertas,
+	}
 }
 
 func (s *server) addPaciente(req api.Request) api.Response {
-	if req.DNI == "" || req.Nombre == "" || req.Apellido == "" || req.Fecha == "" || req.Username == "" || req.Sexo == "" || req.Token.Value == "" {
+	if req.Nombre == "" || req.Apellido == "" || req.Fecha == "" || req.Username == "" || req.Sexo == "" || req.Token.Value == "" {
 		return api.Response{Success: -1, Message: "Faltan datos del paciente"}
 	}
 
 	if !s.isTokenValid(req.Token, req.Username) {
 		return api.Response{Success: 0, Message: "Error en las credenciales: Token inválido o caducado"}
 	}
+	// El paciente queda en el hospital del médico que lo registra
+	medico, err := s.obtenerUsuario(req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el usuario"}
+	}
+
+	// Identificadores con los que se registra al paciente. El DNI/NIE ya no es
+	// obligatorio (extranjeros, recién nacidos): si no se indica ningún número
+	// de historia clínica se le asigna uno a partir del identificador interno.
+	var identificadores []Identificador
+	if req.DNI != "" {
+		identificadores = append(identificadores, Identificador{Tipo: tipoDocumento(req.DNI), Valor: req.DNI})
+	}
+	if req.TipoIdentificador != "" && req.Identificador != "" {
+		identificadores = append(identificadores, Identificador{Tipo: req.TipoIdentificador, Valor: req.Identificador})
+	}
+	for i, identificador := range identificadores {
+		for _, anterior := range identificadores[:i] {
+			if anterior.Tipo == identificador.Tipo {
+				return api.Response{Success: -1, Message: fmt.Sprintf("Se ha indicado dos veces un identificador de tipo %s", identificador.Tipo)}
+			}
+		}
+		// No se puede volver a registrar un identificador existente: se perderían sus expedientes
+		if err := s.comprobarIdentificadorLibre(identificador); err != nil {
+			return api.Response{Success: -1, Message: err.Error()}
+		}
+	}
+
+	if !req.Forzar {
+		duplicados, err := s.buscarDuplicados(req.Nombre, req.Apellido, req.Fecha)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al buscar pacientes duplicados"}
+		}
+		if len(duplicados) > 0 {
+			return api.Response{Success: -1, Message: "Existen pacientes con el mismo nombre, apellido y fecha de nacimiento", Duplicados: duplicados}
+		}
+	}
+
+	id, errID := s.nuevoIDPaciente()
+	if errID != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador del paciente"}
+	}
 
 	fecha := time.Now()
 	fechaStr := fecha.Format(time.DateOnly)
@@ -357,43 +606,49 @@ func (s *server) addPaciente(req api.Request) api.Response {
 	historial := Historial{
 		Fecha_creacion: fechaStr,
 		Expedientes:    lista_vacia_Expedientes,
-	}
-
-	historial_json, errJsonHist := json.Marshal(historial)
-
-	if errJsonHist != nil {
-		return api.Response{Success: -1, Message: "Error creando json de historial"}
-	}
-
-	errHist := s.db.Put("Historiales", []byte(req.DNI), []byte(historial_json))
-
-	if errHist != nil {
-		return api.Response{Success: -1, Message: "Error creando historial en la base de datos"}
+		Estado:         api.EstadoIngresado,
+		Episodios: []Episodio{{
+			Fecha_ingreso:  fechaStr,
+			Medico_ingreso: req.Username,
+		}},
 	}
 
 	paciente := Paciente{
+		ID:               id,
 		Nombre:           req.Nombre,
 		Apellido:         req.Apellido,
 		Fecha_nacimiento: req.Fecha,
-		Hospital:         currentHospital,
+		Hospital:         medico.Hospital,
 		Sexo:             req.Sexo,
 		Medico:           req.Username,
-		Historial:        req.DNI,
+		Historial:        id,
 	}
 
-	paciente_json, errJson := json.Marshal(paciente)
-
-	if errJson != nil {
-		return api.Response{Success: -1, Message: "No pueden convertirse los datos a json"}
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		paciente.Identificadores = identificadores
+		if req.TipoIdentificador != api.IdentificadorNHC {
+			nhc, err := s.nhcLibre(id)
+			if err != nil {
+				return api.Response{Success: -1, Message: "Error al asignar el número de historia clínica"}
+			}
+			paciente.Identificadores = append(slices.Clip(identificadores), nhc)
+		}
+		if err = s.crearPaciente(paciente, historial); !errors.Is(err, store.ErrVersionConflict) {
+			break
+		}
+		// Otro ha registrado a la vez uno de los identificadores: si es uno de
+		// los indicados se rechaza; si es el NHC asignado se elige otro
+		for _, identificador := range identificadores {
+			if err := s.comprobarIdentificadorLibre(identificador); err != nil {
+				return api.Response{Success: -1, Message: err.Error()}
+			}
+		}
 	}
-
-	err := s.db.Put("Pacientes", []byte(req.DNI), []byte(paciente_json))
-
 	if err != nil {
 		return api.Response{Success: -1, Message: "Error creando al paciente"}
 	}
 
-	return api.Response{Success: 1, Message: "Usuario creado"}
+	return api.Response{Success: 1, Message: fmt.Sprintf("Paciente creado con identificador %s", id), Paciente: id}
 }
 
 // fetchData verifica el token y retorna el contenido del namespace 'userdata'.
@@ -438,6 +693,9 @@ func (s *server) updateData(req api.Request) api.Response {
 	return api.Response{Success: 1, Message: "Datos de usuario actualizados"}
 }
 
+// anyadirObservaciones añade una observación a un expediente. Si la
+// petición indica la versión del expediente que vio el médico y otro la ha
+// modificado después, se responde con un conflicto y el expediente actual.
 func (s *server) anyadirObservaciones(req api.Request) api.Response {
 	if req.Username == "" || req.Token.Value == "" || req.Fecha == "" || req.Diagnostico == "" || req.ID == 0 {
 		return api.Response{Success: -1, Message: "Faltan credenciales"}
@@ -446,108 +704,95 @@ func (s *server) anyadirObservaciones(req api.Request) api.Response {
 		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
 	}
 
-	observacion := Observaciones{
-		Fecha_actualizacion: req.Fecha,
-		Diagnostico:         req.Diagnostico,
-	}
-	expediente, err := s.db.Get("Expedientes", []byte(string(req.ID)))
-
+	diagnosticos, err := s.diagnosticosCodificados(req.Diagnosticos)
 	if err != nil {
-		return api.Response{Success: -1, Message: "No existe un expediente con DNI: %"}
-	}
-	var expedienteStruct Expediente
-	errStruct := json.Unmarshal(expediente, &expedienteStruct)
-
-	if errStruct != nil {
-		return api.Response{Success: -1, Message: "Error al convertir a estructura el expediente"}
-	}
-
-	observaciones_originales := expedienteStruct.Observaciones
-
-	observaciones := append(observaciones_originales, observacion)
-	expedienteModificado := Expediente{
-		Medico:         req.Username,
-		Observaciones:  observaciones,
-		Fecha_creacion: expedienteStruct.Fecha_creacion,
-		Especialidad:   expedienteStruct.Especialidad,
+		return api.Response{Success: -1, Message: err.Error()}
 	}
 
-	expedienteModificadoJson, errJson := json.Marshal(expedienteModificado)
-
-	if errJson != nil {
-		return api.Response{Success: -1, Message: "Error al convertir expediente a Json"}
+	observacion := Observaciones{
+		Fecha_actualizacion: req.Fecha,
+		Diagnostico:         req.Diagnostico,
+		Medico:              req.Username,
+		Diagnosticos:        diagnosticos,
 	}
-	s.db.Put("Expedientes", []byte(string(req.ID)), []byte(expedienteModificadoJson))
 
-	return api.Response{Success: 1, Message: "Expediente modificado correctamente"}
+	var supervisor, paciente string
+	res := s.modificarExpediente(req, revisionObservacion, func(expediente *Expediente) error {
+		var err error
+		if supervisor, err = s.supervisorDe(req.Username, *expediente); err != nil {
+			return err
+		}
+		firmarObservacion(&observacion, supervisor)
+		anyadirObservacion(expediente, observacion)
+		paciente = expediente.Paciente
+		return nil
+	})
+	if res.Success != 1 {
+		return res
+	}
+	if paciente != "" {
+		s.publicarEvento(api.Evento{
+			Tipo:       api.EventoNuevaObservacion,
+			Autor:      req.Username,
+			Paciente:   paciente,
+			Expediente: req.ID,
+			Mensaje:    fmt.Sprintf("%s ha añadido una observación al expediente %d del paciente %s", req.Username, req.ID, paciente),
+		})
+	}
+	if supervisor != "" {
+		res.Message = fmt.Sprintf("Observación añadida, pendiente de refrendo por %s", supervisor)
+	}
+	return res
 }
 
 func (s *server) anyadirExpediente(req api.Request) api.Response {
-	if req.Username == "" || req.Diagnostico == "" || req.DNI == "" || req.Token.Value == "" {
+	if req.Username == "" || req.Diagnostico == "" || req.Token.Value == "" {
 		return api.Response{Success: -1, Message: "Faltan credenciales para añadir expedientes"}
 	}
 
 	if !s.isTokenValid(req.Token, req.Username) {
 		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
 	}
+	if s.esResidente(req.Username) {
+		return api.Response{Success: -1, Message: "Los residentes escriben en los expedientes de su supervisor; no pueden abrir expedientes"}
+	}
+	dni, errPaciente := s.pacienteDeRequest(req)
+	if errPaciente != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	if res := s.accesoPaciente(req.Username, dni); res != nil {
+		return *res
+	}
+	// El expediente se abre en la especialidad del médico
+	medico, errMedico := s.obtenerUsuario(req.Username)
+	if errMedico != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el usuario"}
+	}
 
 	fecha := time.Now()
 	fechaStr := fecha.Format(time.DateOnly)
 
+	diagnosticos, errDiag := s.diagnosticosCodificados(req.Diagnosticos)
+	if errDiag != nil {
+		return api.Response{Success: -1, Message: errDiag.Error()}
+	}
+
 	var observaciones []Observaciones
 
 	observacion := Observaciones{
+		ID:                  1,
 		Fecha_actualizacion: fechaStr,
 		Diagnostico:         req.Diagnostico,
 		Medico:              req.Username,
+		Diagnosticos:        diagnosticos,
 	}
-	ultimoId := s.obtenerUltimoID("Expedientes")
 	observaciones = append(observaciones, observacion)
 
-	expediente := Expediente{
-		Medico:         req.Username,
-		Observaciones:  observaciones,
-		Fecha_creacion: fechaStr,
-		Especialidad:   currentSpecialty,
-	}
-
-	expedieteJson, errJson := json.Marshal(expediente)
-	if errJson != nil {
-		return api.Response{Success: -1, Message: "Error convirtiendo a json el expediente"}
+	if _, err := s.crearExpediente(dni, req.Username, medico.Especialidad, observaciones); err != nil {
+		s.log.Printf("Error creando expediente de %s: %v", dni, err)
+		return api.Response{Success: -1, Message: "Error guardando el expediente"}
 	}
 
-	s.db.Put("Expedientes", []byte(ultimoId), []byte(expedieteJson))
-
-	historialPaciente, errget := s.db.Get("Historiales", []byte(string(req.DNI)))
-	if errget != nil {
-		return api.Response{Success: -1, Message: "Error al obtener el historial del paciente"}
-	}
-
-	var historialSruct Historial
-	errStructHistorial := json.Unmarshal(historialPaciente, &historialSruct)
-	if errStructHistorial != nil {
-		return api.Response{Success: -1, Message: "Error al convertir el historial a struct"}
-	}
-	expedientesOriginales := historialSruct.Expedientes
-
-	ultimoIdInt, erratoi := strconv.Atoi(ultimoId)
-	if erratoi != nil {
-		return api.Response{Success: -1, Message: "Error al convertir el id del expediente en int"}
-	}
-	expedientes := append(expedientesOriginales, ultimoIdInt)
-
-	nuevoHistorial := Historial{
-		Fecha_creacion: fechaStr,
-		Expedientes:    expedientes,
-	}
-
-	nuevoHistorialJson, erroerrJsonHistorial := json.Marshal(nuevoHistorial)
-	if erroerrJsonHistorial != nil {
-		return api.Response{Success: -1, Message: "Error al convertir el historial en json"}
-	}
-
-	s.db.Put("Historiales", []byte(req.DNI), []byte(nuevoHistorialJson))
-
 	return api.Response{Success: 1, Message: "Expediente creado y añadido al historial correctamente"}
 }
 
@@ -570,15 +815,12 @@ func (s *server) logoutUser(req api.Request) api.Response {
 }
 
 // userExists comprueba si existe un usuario con la clave 'username'
-// en 'auth'. Si no se encuentra, retorna false.
+// en 'Usuarios'. Si no se encuentra, retorna false.
 func (s *server) userExists(username string) (bool, error) {
-	_, err := s.db.Get("auth", []byte(username))
+	_, err := s.db.Get("Usuarios", []byte(username))
 	if err != nil {
 		// Si no existe namespace o la clave:
-		if strings.Contains(err.Error(), "bucket no encontrado: auth") {
-			return false, nil
-		}
-		if err.Error() == "clave no encontrada: "+username {
+		if noEncontrado(err) {
 			return false, nil
 		}
 		return false, err
@@ -586,6 +828,29 @@ func (s *server) userExists(username string) (bool, error) {
 	return true, nil
 }
 
+// noEncontrado indica si el error del store se debe a que no existe
+// el namespace o la clave solicitada.
+func noEncontrado(err error) bool {
+	return err != nil && (strings.HasPrefix(err.Error(), "bucket no encontrado") || strings.HasPrefix(err.Error(), "clave no encontrada"))
+}
+
+// obtenerUsuario recupera y decodifica los datos de un usuario.
+func (s *server) obtenerUsuario(username string) (Usuario, error) {
+	var usuario Usuario
+	usuarioJson, err := s.db.Get("Usuarios", []byte(username))
+	if err != nil {
+		return usuario, err
+	}
+	err = json.Unmarshal(usuarioJson, &usuario)
+	return usuario, err
+}
+
+// esAdmin comprueba si el usuario tiene el rol de administrador.
+func (s *server) esAdmin(username string) bool {
+	usuario, err := s.obtenerUsuario(username)
+	return err == nil && usuario.Rol == api.RolAdmin
+}
+
 func (s *server) isTokenValid(token api.Token, username string) bool {
 	tokenUser, err := s.db.Get("sessions", []byte(username))
 	if err != nil {
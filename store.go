@@ -3,7 +3,10 @@
 // que debe cumplir la interfaz Store.
 package store
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // Store define los métodos comunes que deben implementar
 // los diferentes motores de almacenamiento.
@@ -26,6 +29,52 @@ type Store interface {
 	// del namespace especificado.
 	KeysByPrefix(namespace string, prefix []byte) ([][]byte, error)
 
+	// Scan recorre en orden las claves del namespace que empiezan por
+	// 'prefix', a partir de 'start' (incluida; nil para empezar por el
+	// principio), y devuelve como mucho 'limit' pares clave/valor (sin límite
+	// si es 0). El segundo valor devuelto es la clave por la que continuar en
+	// la siguiente llamada, o nil si no quedan más.
+	Scan(namespace string, start, prefix []byte, limit int) ([]KV, []byte, error)
+
+	// ScanReverse es como Scan pero recorre las claves en orden inverso,
+	// empezando en 'start' (o en la última clave con el prefijo si es nil).
+	ScanReverse(namespace string, start, prefix []byte, limit int) ([]KV, []byte, error)
+
+	// GetWithVersion recupera el valor y su versión. Cada escritura de un
+	// registro incrementa su versión; un registro que no existe tiene la 0.
+	GetWithVersion(namespace string, key []byte) ([]byte, uint64, error)
+
+	// CompareAndSwap guarda 'value' sólo si la versión actual del registro es
+	// 'expected' (0 si todavía no existe). Si no coincide devuelve
+	// ErrVersionConflict sin modificar nada.
+	CompareAndSwap(namespace string, key []byte, expected uint64, value []byte) error
+
+	// Batch aplica todas las operaciones en una única transacción:
+	// o se aplican todas o no se aplica ninguna.
+	Batch(ops []Op) error
+
+	// Update ejecuta 'fn' dentro de una única transacción de escritura, para
+	// leer y escribir de forma atómica. Si 'fn' devuelve un error no se
+	// aplica nada de lo escrito.
+	Update(fn func(tx Tx) error) error
+
+	// Watch entrega por el canal, en orden de revisión, los cambios de los
+	// registros del namespace cuya clave empieza por 'prefix' con revisión
+	// mayor que 'desde'. Los cambios ya registrados se entregan primero y
+	// después los nuevos según se producen; como el registro se guarda en
+	// disco, tras un reinicio se puede continuar desde la última revisión
+	// procesada. Cada namespace conserva sólo sus últimos cambios; si los
+	// posteriores a 'desde' ya se han descartado devuelve
+	// ErrRevisionCompactada. Por eso 'desde' 0 sólo entrega el registro
+	// completo mientras no se haya descartado nada; después hay que partir
+	// de Revision() y leer el estado actual por otra vía. La función
+	// devuelta deja de vigilar y cierra el canal.
+	Watch(namespace string, prefix []byte, desde uint64) (<-chan Change, func(), error)
+
+	// Revision devuelve la revisión del último cambio registrado, para
+	// vigilar sólo los cambios posteriores.
+	Revision() (uint64, error)
+
 	// Close cierra cualquier recurso abierto (por ej. cerrar la base de datos).
 	Close() error
 
@@ -33,6 +82,57 @@ type Store interface {
 	Dump() error
 }
 
+// KV es un par clave/valor devuelto por Scan.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// Change es un cambio de un registro tal como lo entrega Watch. Cada
+// escritura o borrado de un registro (salvo los de los namespaces internos,
+// que empiezan por "__") recibe una revisión global creciente. El registro
+// de cambios no guarda los valores: quien los necesite debe leerlos con Get.
+type Change struct {
+	Revision  uint64 `json:"-"`
+	Namespace string `json:"-"`
+	Key       []byte `json:"key"`
+	Delete    bool   `json:"delete,omitempty"`
+}
+
+// Op es una escritura (o un borrado, si Delete es true) dentro de un Batch.
+// Si CheckVersion es true, el lote entero falla con ErrVersionConflict
+// cuando la versión actual del registro no es Version.
+type Op struct {
+	Namespace    string
+	Key          []byte
+	Value        []byte
+	Delete       bool
+	CheckVersion bool
+	Version      uint64
+}
+
+// Tx da acceso a una transacción de escritura abierta con Update. Las
+// lecturas ven lo escrito antes en la misma transacción.
+type Tx interface {
+	// Get recupera el valor de la clave, o nil si no existe.
+	Get(namespace string, key []byte) []byte
+
+	// ListKeys devuelve todas las claves del namespace (ninguna si no existe).
+	ListKeys(namespace string) [][]byte
+
+	// Apply aplica una operación como lo haría Batch; ErrVersionConflict
+	// hace fallar la transacción entera si se devuelve desde 'fn'.
+	Apply(op Op) error
+}
+
+// ErrVersionConflict indica que el registro cambió desde que se leyó.
+var ErrVersionConflict = errors.New("conflicto de versión: el registro ha sido modificado")
+
+// ErrRevisionCompactada indica que los cambios posteriores a la revisión
+// pedida ya se han descartado del registro; hay que volver a leer el
+// estado actual y vigilar desde Revision().
+var ErrRevisionCompactada = errors.New("la revisión pedida ya se ha descartado del registro de cambios")
+
 // NewStore permite instanciar diferentes tipos de Store
 // dependiendo del motor solicitado (sólo se soporta "bbolt").
 func NewStore(engine, path string) (Store, error) {
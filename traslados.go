@@ -0,0 +1,474 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// Índices de traslados por paciente y por hospital de destino.
+const (
+	indiceTrasladosPaciente = "paciente"
+	indiceTrasladosDestino  = "destino"
+)
+
+// Acción con la que se audita el cambio de hospital al llegar la fecha
+// efectiva de un traslado aceptado antes.
+const accionTrasladoEfectivo = "trasladoEfectivo"
+
+// Cada cuánto se aplican los traslados aceptados cuya fecha efectiva ha
+// llegado.
+const intervaloTraslados = time.Hour
+
+// Estados de un traslado. Los solicitados y los aceptados aún no efectivos
+// están abiertos: el paciente no puede tener otro traslado abierto.
+const (
+	estadoTrasladoSolicitado = "solicitado"
+	estadoTrasladoAceptado   = "aceptado"
+	estadoTrasladoEfectivo   = "efectivo"
+	estadoTrasladoRechazado  = "rechazado"
+)
+
+// Traslado es el paso de un paciente de un hospital a otro. Lo solicita un
+// médico del hospital de origen y lo acepta uno del de destino; el paciente
+// cambia de hospital en la fecha efectiva.
+type Traslado struct {
+	ID              int    `json:"id"`
+	Paciente        string `json:"paciente"`
+	Origen          int    `json:"origen"`
+	Destino         int    `json:"destino"`
+	Motivo          string `json:"motivo"`
+	Fecha_efectiva  string `json:"fecha_efectiva"` //AAAA-MM-DD
+	Estado          string `json:"estado"`
+	Solicitado_por  string `json:"solicitado_por"`
+	Fecha_solicitud string `json:"fecha_solicitud"`
+	Respondido_por  string `json:"respondido_por,omitempty"`
+	Fecha_respuesta string `json:"fecha_respuesta,omitempty"`
+	Motivo_rechazo  string `json:"motivo_rechazo,omitempty"`
+	Nombre_paciente string `json:"nombre_paciente,omitempty"` //sólo en las respuestas
+	Nombre_origen   string `json:"nombre_origen,omitempty"`   //sólo en las respuestas
+	Nombre_destino  string `json:"nombre_destino,omitempty"`  //sólo en las respuestas
+}
+
+// EstanciaHospital es un hospital en el que estuvo el paciente antes de un
+// traslado.
+type EstanciaHospital struct {
+	Hospital int    `json:"hospital"`
+	Hasta    string `json:"hasta"`    //fecha efectiva del traslado que lo sacó de él
+	Traslado int    `json:"traslado"` //traslado que lo sacó de él
+}
+
+// trasladoAbierto indica si el traslado aún puede cambiar el hospital del
+// paciente.
+func trasladoAbierto(traslado Traslado) bool {
+	return traslado.Estado == estadoTrasladoSolicitado || traslado.Estado == estadoTrasladoAceptado
+}
+
+// obtenerTraslado lee un traslado junto con su versión.
+func (s *server) obtenerTraslado(id int) (Traslado, uint64, error) {
+	var traslado Traslado
+	trasladoJson, version, err := s.db.GetWithVersion("Traslados", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return traslado, 0, err
+	}
+	err = json.Unmarshal(trasladoJson, &traslado)
+	return traslado, version, err
+}
+
+// guardarTraslado almacena el traslado sólo si no ha cambiado desde que se
+// leyó con 'version' (0 si es nuevo).
+func (s *server) guardarTraslado(traslado Traslado, version uint64) error {
+	trasladoJson, err := json.Marshal(traslado)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch([]store.Op{{
+		Namespace:    "Traslados",
+		Key:          []byte(strconv.Itoa(traslado.ID)),
+		Value:        trasladoJson,
+		CheckVersion: true,
+		Version:      version,
+	}})
+}
+
+// leerTraslados lee los traslados indexados bajo 'valor' en el índice
+// indicado.
+func (s *server) leerTraslados(indice, valor string) ([]Traslado, error) {
+	claves, err := s.indices.Query("Traslados", indice, []byte(valor))
+	if err != nil {
+		return nil, err
+	}
+	var traslados []Traslado
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			return nil, fmt.Errorf("clave de traslado incorrecta: %q", clave)
+		}
+		traslado, _, err := s.obtenerTraslado(id)
+		if err != nil {
+			return nil, err
+		}
+		traslados = append(traslados, traslado)
+	}
+	return traslados, nil
+}
+
+// trasladoAbiertoDe devuelve el traslado abierto del paciente, o nil si no
+// tiene ninguno.
+func (s *server) trasladoAbiertoDe(paciente string) (*Traslado, error) {
+	traslados, err := s.leerTraslados(indiceTrasladosPaciente, paciente)
+	if err != nil {
+		return nil, err
+	}
+	for _, traslado := range traslados {
+		if trasladoAbierto(traslado) {
+			return &traslado, nil
+		}
+	}
+	return nil, nil
+}
+
+// puedeVerPaciente indica si el médico puede acceder a los datos del
+// paciente: los administradores y los médicos de su hospital, y también los
+// del hospital de destino mientras haya un traslado abierto. Los pacientes
+// sin hospital (registros antiguos) son visibles para todos.
+func (s *server) puedeVerPaciente(username string, paciente Paciente) (bool, error) {
+	if paciente.Hospital == 0 {
+		return true, nil
+	}
+	usuario, err := s.obtenerUsuario(username)
+	if err != nil {
+		return false, err
+	}
+	if usuario.Rol == api.RolAdmin || usuario.Hospital == paciente.Hospital {
+		return true, nil
+	}
+	traslado, err := s.trasladoAbiertoDe(paciente.ID)
+	if err != nil {
+		return false, err
+	}
+	return traslado != nil && traslado.Destino == usuario.Hospital, nil
+}
+
+// accesoPaciente comprueba con puedeVerPaciente que el usuario pueda
+// acceder al paciente. Devuelve nil si puede o la respuesta para el
+// cliente si no.
+func (s *server) accesoPaciente(username, id string) *api.Response {
+	paciente, err := s.obtenerPaciente(id)
+	if err != nil {
+		return &api.Response{Success: -1, Message: "Error al obtener el paciente"}
+	}
+	if permitido, err := s.puedeVerPaciente(username, paciente); err != nil {
+		return &api.Response{Success: -1, Message: "Error al comprobar el acceso al paciente"}
+	} else if !permitido {
+		return &api.Response{Success: -1, Message: "El paciente pertenece a otro hospital"}
+	}
+	return nil
+}
+
+// accesoExpediente comprueba que el usuario pueda acceder al expediente:
+// su médico responsable siempre puede y el resto, si pueden acceder al
+// paciente. Los expedientes antiguos sin paciente son visibles para todos.
+func (s *server) accesoExpediente(username string, expediente Expediente) *api.Response {
+	if expediente.Medico == username || expediente.Paciente == "" {
+		return nil
+	}
+	return s.accesoPaciente(username, expediente.Paciente)
+}
+
+// nombreHospital devuelve el nombre del hospital, o su número si no existe.
+func (s *server) nombreHospital(id int) string {
+	hospitalJson, err := s.db.Get("Hospitales", []byte(strconv.Itoa(id)))
+	if err != nil {
+		return strconv.Itoa(id)
+	}
+	var hospital Hospital
+	if err := json.Unmarshal(hospitalJson, &hospital); err != nil || hospital.Nombre == "" {
+		return strconv.Itoa(id)
+	}
+	return hospital.Nombre
+}
+
+// hacerEfectivo cambia el hospital del paciente al de destino del traslado,
+// guardando el de origen entre sus hospitales anteriores, y marca el
+// traslado como efectivo. Si el paciente ya se había cambiado con este
+// traslado sólo se marca el traslado.
+func (s *server) hacerEfectivo(traslado Traslado, version uint64) error {
+	_, err := s.modificarPaciente(traslado.Paciente, func(paciente *Paciente) error {
+		if n := len(paciente.Hospitales_anteriores); n > 0 && paciente.Hospitales_anteriores[n-1].Traslado == traslado.ID {
+			return nil
+		}
+		if paciente.Hospital != traslado.Origen {
+			return fmt.Errorf("el paciente %s ya no está en el hospital %d", traslado.Paciente, traslado.Origen)
+		}
+		paciente.Hospitales_anteriores = append(paciente.Hospitales_anteriores, EstanciaHospital{
+			Hospital: traslado.Origen,
+			Hasta:    traslado.Fecha_efectiva,
+			Traslado: traslado.ID,
+		})
+		paciente.Hospital = traslado.Destino
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	traslado.Estado = estadoTrasladoEfectivo
+	return s.guardarTraslado(traslado, version)
+}
+
+// aplicarTrasladosVencidos hace efectivos los traslados aceptados cuya fecha
+// efectiva ya ha llegado.
+func (s *server) aplicarTrasladosVencidos() {
+	claves, err := s.db.ListKeys("Traslados")
+	if err != nil && !noEncontrado(err) {
+		s.log.Printf("Error listando los traslados: %v", err)
+		return
+	}
+	hoy := time.Now().Format(time.DateOnly)
+	for _, clave := range claves {
+		id, err := strconv.Atoi(string(clave))
+		if err != nil {
+			continue
+		}
+		traslado, version, err := s.obtenerTraslado(id)
+		if err != nil || traslado.Estado != estadoTrasladoAceptado || traslado.Fecha_efectiva > hoy {
+			continue
+		}
+		if err := s.hacerEfectivo(traslado, version); err != nil {
+			s.log.Printf("Error haciendo efectivo el traslado %d: %v", id, err)
+			continue
+		}
+		s.registrarAuditoria("sistema", accionTrasladoEfectivo,
+			fmt.Sprintf("traslado %d efectivo: paciente %s del hospital %d al %d", id, traslado.Paciente, traslado.Origen, traslado.Destino))
+	}
+}
+
+// trasladosProgramados aplica periódicamente los traslados vencidos.
+func (s *server) trasladosProgramados() {
+	s.aplicarTrasladosVencidos()
+	for range time.Tick(intervaloTraslados) {
+		s.aplicarTrasladosVencidos()
+	}
+}
+
+// solicitarTraslado pide trasladar al paciente al hospital req.Hospital a
+// partir de la fecha req.FechaInicio (hoy si se omite). Sólo puede pedirlo
+// un médico con acceso al paciente, y el paciente no puede tener otro
+// traslado abierto.
+func (s *server) solicitarTraslado(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Hospital == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos del traslado (hospital de destino y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	id, err := s.pacienteDeRequest(req)
+	if err != nil {
+		return api.Response{Success: -1, Message: "No existe el paciente indicado"}
+	}
+	paciente, err := s.obtenerPaciente(id)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener el paciente"}
+	}
+	if paciente.Hospital == 0 {
+		return api.Response{Success: -1, Message: "El paciente no tiene hospital asignado"}
+	}
+	usuario, err := s.obtenerUsuario(req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+	}
+	if usuario.Rol != api.RolAdmin && usuario.Hospital != paciente.Hospital {
+		return api.Response{Success: -1, Message: "Sólo los médicos del hospital del paciente pueden solicitar su traslado"}
+	}
+	if req.Hospital == paciente.Hospital {
+		return api.Response{Success: -1, Message: "El paciente ya está en ese hospital"}
+	}
+	if _, err := s.db.Get("Hospitales", []byte(strconv.Itoa(req.Hospital))); err != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el hospital %d", req.Hospital)}
+	}
+	hoy := time.Now().Format(time.DateOnly)
+	fecha := req.FechaInicio
+	if fecha == "" {
+		fecha = hoy
+	}
+	if _, err := time.Parse(time.DateOnly, fecha); err != nil {
+		return api.Response{Success: -1, Message: "Fecha efectiva no válida (use AAAA-MM-DD)"}
+	}
+	if fecha < hoy {
+		return api.Response{Success: -1, Message: "La fecha efectiva no puede ser anterior a hoy"}
+	}
+	abierto, err := s.trasladoAbiertoDe(id)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los traslados del paciente"}
+	}
+	if abierto != nil {
+		return api.Response{Success: -1, Message: fmt.Sprintf("El paciente ya tiene abierto el traslado %d al hospital %d", abierto.ID, abierto.Destino)}
+	}
+
+	traslado := Traslado{
+		Paciente:        id,
+		Origen:          paciente.Hospital,
+		Destino:         req.Hospital,
+		Motivo:          req.Motivo,
+		Fecha_efectiva:  fecha,
+		Estado:          estadoTrasladoSolicitado,
+		Solicitado_por:  req.Username,
+		Fecha_solicitud: time.Now().Format(time.RFC3339),
+	}
+	if traslado.ID, err = s.siguienteSecuencia("Traslados"); err != nil {
+		return api.Response{Success: -1, Message: "Error al generar el identificador del traslado"}
+	}
+	if err := s.guardarTraslado(traslado, 0); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el traslado"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionSolicitarTraslado,
+		fmt.Sprintf("traslado %d del paciente %s del hospital %d al %d a partir del %s: %s", traslado.ID, id, traslado.Origen, traslado.Destino, fecha, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Traslado %d solicitado al hospital %s", traslado.ID, s.nombreHospital(traslado.Destino)), Paciente: id}
+}
+
+// listarTraslados devuelve los traslados abiertos hacia el hospital del
+// médico, por fecha efectiva.
+func (s *server) listarTraslados(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	usuario, err := s.obtenerUsuario(req.Username)
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+	}
+	traslados, err := s.leerTraslados(indiceTrasladosDestino, strconv.Itoa(usuario.Hospital))
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al obtener los traslados"}
+	}
+	sort.SliceStable(traslados, func(i, j int) bool {
+		return traslados[i].Fecha_efectiva < traslados[j].Fecha_efectiva
+	})
+
+	var registros [][]byte
+	for _, traslado := range traslados {
+		if !trasladoAbierto(traslado) {
+			continue
+		}
+		if paciente, err := s.obtenerPaciente(traslado.Paciente); err == nil {
+			traslado.Nombre_paciente = paciente.Nombre + " " + paciente.Apellido
+		}
+		traslado.Nombre_origen = s.nombreHospital(traslado.Origen)
+		traslado.Nombre_destino = s.nombreHospital(traslado.Destino)
+		trasladoJson, err := json.Marshal(traslado)
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir el traslado a json"}
+		}
+		registros = append(registros, trasladoJson)
+	}
+	return api.Response{
+		Success:   1,
+		Message:   fmt.Sprintf("%d traslados hacia %s", len(registros), s.nombreHospital(usuario.Hospital)),
+		Registros: registros,
+	}
+}
+
+// trasladoPendiente lee el traslado req.ID y comprueba que esté solicitado
+// y que el médico pertenezca al hospital de destino. Si no, devuelve la
+// respuesta de error para el cliente.
+func (s *server) trasladoPendiente(req api.Request) (Traslado, uint64, *api.Response) {
+	traslado, version, err := s.obtenerTraslado(req.ID)
+	if noEncontrado(err) {
+		return traslado, 0, &api.Response{Success: -1, Message: fmt.Sprintf("No existe el traslado %d", req.ID)}
+	}
+	if err != nil {
+		return traslado, 0, &api.Response{Success: -1, Message: "Error al obtener el traslado"}
+	}
+	if traslado.Estado != estadoTrasladoSolicitado {
+		return traslado, 0, &api.Response{Success: -1, Message: fmt.Sprintf("El traslado %d ya está %s", req.ID, traslado.Estado)}
+	}
+	usuario, err := s.obtenerUsuario(req.Username)
+	if err != nil {
+		return traslado, 0, &api.Response{Success: -1, Message: "Error al obtener los datos del médico"}
+	}
+	if usuario.Hospital != traslado.Destino {
+		return traslado, 0, &api.Response{Success: -1, Message: "Sólo los médicos del hospital de destino pueden responder al traslado"}
+	}
+	return traslado, version, nil
+}
+
+// aceptarTraslado acepta el traslado solicitado req.ID. Si su fecha
+// efectiva ya ha llegado el paciente cambia de hospital en el acto; si no,
+// cambiará cuando llegue.
+func (s *server) aceptarTraslado(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 {
+		return api.Response{Success: -1, Message: "Falta el traslado a aceptar"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	traslado, version, res := s.trasladoPendiente(req)
+	if res != nil {
+		return *res
+	}
+
+	traslado.Estado = estadoTrasladoAceptado
+	traslado.Respondido_por = req.Username
+	traslado.Fecha_respuesta = time.Now().Format(time.RFC3339)
+	err := s.guardarTraslado(traslado, version)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "El traslado acaba de ser modificado por otro usuario"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el traslado"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionAceptarTraslado,
+		fmt.Sprintf("traslado %d del paciente %s del hospital %d al %d aceptado, efectivo el %s", traslado.ID, traslado.Paciente, traslado.Origen, traslado.Destino, traslado.Fecha_efectiva))
+
+	if traslado.Fecha_efectiva > time.Now().Format(time.DateOnly) {
+		return api.Response{Success: 1, Message: fmt.Sprintf("Traslado %d aceptado; será efectivo el %s", traslado.ID, traslado.Fecha_efectiva), Paciente: traslado.Paciente}
+	}
+	if _, version, err = s.obtenerTraslado(traslado.ID); err == nil {
+		err = s.hacerEfectivo(traslado, version)
+	}
+	if err != nil {
+		s.log.Printf("Error haciendo efectivo el traslado %d: %v", traslado.ID, err)
+		return api.Response{Success: -1, Message: "Traslado aceptado, pero no se pudo cambiar el hospital del paciente; se reintentará más tarde"}
+	}
+	return api.Response{Success: 1, Message: fmt.Sprintf("Traslado %d aceptado y efectivo: el paciente pasa a %s", traslado.ID, s.nombreHospital(traslado.Destino)), Paciente: traslado.Paciente}
+}
+
+// rechazarTraslado rechaza el traslado solicitado req.ID indicando el
+// motivo. El paciente sigue en su hospital.
+func (s *server) rechazarTraslado(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.ID == 0 || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos del rechazo (traslado y motivo)"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	traslado, version, res := s.trasladoPendiente(req)
+	if res != nil {
+		return *res
+	}
+
+	traslado.Estado = estadoTrasladoRechazado
+	traslado.Respondido_por = req.Username
+	traslado.Fecha_respuesta = time.Now().Format(time.RFC3339)
+	traslado.Motivo_rechazo = req.Motivo
+	err := s.guardarTraslado(traslado, version)
+	if errors.Is(err, store.ErrVersionConflict) {
+		return api.Response{Success: -1, Conflicto: true, Message: "El traslado acaba de ser modificado por otro usuario"}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el traslado"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionRechazarTraslado,
+		fmt.Sprintf("traslado %d del paciente %s del hospital %d al %d rechazado: %s", traslado.ID, traslado.Paciente, traslado.Origen, traslado.Destino, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Traslado %d rechazado", traslado.ID)}
+}
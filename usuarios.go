@@ -0,0 +1,383 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"prac/pkg/api"
+	"prac/pkg/store"
+)
+
+// rutaAdministradores lista los usuarios ya registrados que se nombran
+// administradores al migrar una base de datos anterior a los roles, uno por
+// línea ('#' para comentarios). Después se nombran con la opción -admin.
+const rutaAdministradores = "data/administradores.txt"
+
+// Acción con la que se audita la promoción de un administrador configurado.
+const accionPromoverAdministrador = "promoverAdministrador"
+
+// UsuarioListado son los datos de un usuario que ve un administrador; nunca
+// incluye la contraseña.
+type UsuarioListado struct {
+	Username      string `json:"username"`
+	Apellido      string `json:"apellido"`
+	Especialidad  int    `json:"especialidad"`
+	Hospital      int    `json:"hospital"`
+	Rol           string `json:"rol"`
+	Deshabilitado bool   `json:"deshabilitado,omitempty"`
+}
+
+// UsuarioBorrado queda en 'UsuariosBorrados' al borrar un usuario para que
+// nadie pueda registrarse con su nombre y aparecer como autor de sus
+// expedientes y revisiones.
+type UsuarioBorrado struct {
+	Fecha       string `json:"fecha"`
+	Borrado_por string `json:"borrado_por"`
+}
+
+// modificarUsuario aplica 'cambiar' sobre el usuario y lo guarda con una
+// escritura condicional, reintentando si otro lo ha modificado a la vez.
+func (s *server) modificarUsuario(username string, cambiar func(*Usuario) error) (Usuario, error) {
+	var usuario Usuario
+	for intento := 0; intento < maxReintentosCAS; intento++ {
+		usuarioJson, version, err := s.db.GetWithVersion("Usuarios", []byte(username))
+		if err != nil {
+			return usuario, err
+		}
+		usuario = Usuario{}
+		if err := json.Unmarshal(usuarioJson, &usuario); err != nil {
+			return usuario, err
+		}
+		if err := cambiar(&usuario); err != nil {
+			return usuario, err
+		}
+		if usuarioJson, err = json.Marshal(usuario); err != nil {
+			return usuario, err
+		}
+		err = s.db.CompareAndSwap("Usuarios", []byte(username), version, usuarioJson)
+		if !errors.Is(err, store.ErrVersionConflict) {
+			return usuario, err
+		}
+	}
+	return usuario, store.ErrVersionConflict
+}
+
+// cerrarSesiones invalida la sesión abierta del usuario, si la tiene.
+func (s *server) cerrarSesiones(username string) error {
+	if err := s.db.Delete("sessions", []byte(username)); err != nil && !noEncontrado(err) {
+		return err
+	}
+	return nil
+}
+
+// usuarioDestino valida la sesión del administrador y el usuario sobre el
+// que actúa (req.Medico), que no puede ser él mismo. Si no, devuelve la
+// respuesta de error para el cliente.
+func (s *server) usuarioDestino(req api.Request) *api.Response {
+	if !s.isTokenValid(req.Token, req.Username) {
+		return &api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return &api.Response{Success: -1, Message: "Solo un administrador puede gestionar usuarios"}
+	}
+	if req.Medico == req.Username {
+		return &api.Response{Success: -1, Message: "Un administrador no puede aplicarse esta acción a sí mismo"}
+	}
+	if existe, err := s.userExists(req.Medico); err != nil {
+		return &api.Response{Success: -1, Message: "Error al verificar usuario"}
+	} else if !existe {
+		return &api.Response{Success: -1, Message: fmt.Sprintf("No existe el usuario %s", req.Medico)}
+	}
+	return nil
+}
+
+// listarUsuarios devuelve los usuarios ordenados por nombre, opcionalmente
+// sólo los de un hospital.
+func (s *server) listarUsuarios(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" {
+		return api.Response{Success: -1, Message: "Faltan credenciales"}
+	}
+	if !s.isTokenValid(req.Token, req.Username) {
+		return api.Response{Success: 0, Message: "Token inválido o sesión expirada"}
+	}
+	if !s.esAdmin(req.Username) {
+		return api.Response{Success: -1, Message: "Solo un administrador puede gestionar usuarios"}
+	}
+
+	claves, err := s.db.ListKeys("Usuarios")
+	if err != nil && !noEncontrado(err) {
+		return api.Response{Success: -1, Message: "Error al obtener los usuarios"}
+	}
+	sort.Slice(claves, func(i, j int) bool { return string(claves[i]) < string(claves[j]) })
+	var registros [][]byte
+	for _, clave := range claves {
+		usuario, err := s.obtenerUsuario(string(clave))
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al obtener los usuarios"}
+		}
+		if req.Hospital != 0 && usuario.Hospital != req.Hospital {
+			continue
+		}
+		listadoJson, err := json.Marshal(UsuarioListado{
+			Username:      string(clave),
+			Apellido:      usuario.Apellido,
+			Especialidad:  usuario.Especialidad,
+			Hospital:      usuario.Hospital,
+			Rol:           usuario.Rol,
+			Deshabilitado: usuario.Deshabilitado,
+		})
+		if err != nil {
+			return api.Response{Success: -1, Message: "Error al convertir el usuario a json"}
+		}
+		registros = append(registros, listadoJson)
+	}
+	return api.Response{Success: 1, Message: fmt.Sprintf("%d usuarios", len(registros)), Registros: registros, Total: len(registros)}
+}
+
+// deshabilitarUsuario impide que el usuario req.Medico inicie sesión y
+// cierra la que tenga abierta. Sus datos se conservan.
+func (s *server) deshabilitarUsuario(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (usuario y motivo)"}
+	}
+	if res := s.usuarioDestino(req); res != nil {
+		return *res
+	}
+
+	if _, err := s.modificarUsuario(req.Medico, func(usuario *Usuario) error {
+		usuario.Deshabilitado = true
+		return nil
+	}); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el usuario"}
+	}
+	if err := s.cerrarSesiones(req.Medico); err != nil {
+		s.log.Printf("Error cerrando la sesión de %s: %v", req.Medico, err)
+		return api.Response{Success: -1, Message: "Usuario deshabilitado, pero no se pudo cerrar su sesión"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionDeshabilitarUsuario, fmt.Sprintf("usuario %s deshabilitado: %s", req.Medico, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Usuario %s deshabilitado y su sesión cerrada", req.Medico)}
+}
+
+// habilitarUsuario permite de nuevo iniciar sesión al usuario req.Medico.
+func (s *server) habilitarUsuario(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" {
+		return api.Response{Success: -1, Message: "Falta el usuario a habilitar"}
+	}
+	if res := s.usuarioDestino(req); res != nil {
+		return *res
+	}
+
+	if _, err := s.modificarUsuario(req.Medico, func(usuario *Usuario) error {
+		usuario.Deshabilitado = false
+		return nil
+	}); err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el usuario"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionHabilitarUsuario, fmt.Sprintf("usuario %s habilitado", req.Medico))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Usuario %s habilitado", req.Medico)}
+}
+
+// cambiarDestinoUsuario cambia el hospital y/o la especialidad del usuario
+// req.Medico (0 deja el actual). El acceso a los pacientes del nuevo
+// hospital es inmediato; la especialidad de los expedientes que cree cambia
+// desde su próximo inicio de sesión.
+func (s *server) cambiarDestinoUsuario(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" || (req.Hospital == 0 && req.Especialidad == 0) {
+		return api.Response{Success: -1, Message: "Faltan datos (usuario y nuevo hospital o especialidad)"}
+	}
+	if res := s.usuarioDestino(req); res != nil {
+		return *res
+	}
+
+	if req.Hospital != 0 && !s.existeEnCatalogo(catalogoHospitales.namespace, req.Hospital) {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe el hospital %d", req.Hospital)}
+	}
+	if req.Especialidad != 0 && !s.existeEnCatalogo(catalogoEspecialidades.namespace, req.Especialidad) {
+		return api.Response{Success: -1, Message: fmt.Sprintf("No existe la especialidad %d", req.Especialidad)}
+	}
+
+	var anterior Usuario
+	usuario, err := s.modificarUsuario(req.Medico, func(usuario *Usuario) error {
+		anterior = *usuario
+		if req.Hospital != 0 {
+			usuario.Hospital = req.Hospital
+		}
+		if req.Especialidad != 0 {
+			usuario.Especialidad = req.Especialidad
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el usuario"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionCambiarDestinoUsuario,
+		fmt.Sprintf("usuario %s: hospital %d -> %d, especialidad %d -> %d", req.Medico, anterior.Hospital, usuario.Hospital, anterior.Especialidad, usuario.Especialidad))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Usuario %s: hospital %d, especialidad %d", req.Medico, usuario.Hospital, usuario.Especialidad)}
+}
+
+// cambiarRolUsuario cambia el usuario req.Medico entre médico y residente.
+// Los residentes sólo escriben en los expedientes bajo una delegación, y lo
+// que escriben queda pendiente de refrendo.
+func (s *server) cambiarRolUsuario(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" || req.Rol == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (usuario y rol)"}
+	}
+	if res := s.usuarioDestino(req); res != nil {
+		return *res
+	}
+	if req.Rol != api.RolMedico && req.Rol != api.RolResidente {
+		return api.Response{Success: -1, Message: fmt.Sprintf("Rol no válido: %s", req.Rol)}
+	}
+
+	var anterior string
+	var rechazo error // motivo por el que no puede cambiarse, para el usuario
+	_, err := s.modificarUsuario(req.Medico, func(usuario *Usuario) error {
+		if usuario.Rol == api.RolAdmin {
+			rechazo = fmt.Errorf("%s es administrador y su rol no puede cambiarse", req.Medico)
+			return rechazo
+		}
+		anterior = usuario.Rol
+		usuario.Rol = req.Rol
+		return nil
+	})
+	if rechazo != nil {
+		return api.Response{Success: -1, Message: rechazo.Error()}
+	}
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al guardar el usuario"}
+	}
+	s.registrarAuditoria(req.Username, api.ActionCambiarRolUsuario, fmt.Sprintf("usuario %s: rol %s -> %s", req.Medico, anterior, req.Rol))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Usuario %s: rol %s", req.Medico, req.Rol)}
+}
+
+// borrarUsuario elimina la cuenta del usuario req.Medico y cierra su
+// sesión. Los expedientes, revisiones y auditoría que firmó se conservan, y
+// su nombre no puede volver a registrarse.
+func (s *server) borrarUsuario(req api.Request) api.Response {
+	if req.Username == "" || req.Token.Value == "" || req.Medico == "" || req.Motivo == "" {
+		return api.Response{Success: -1, Message: "Faltan datos (usuario y motivo)"}
+	}
+	if res := s.usuarioDestino(req); res != nil {
+		return *res
+	}
+
+	borradoJson, err := json.Marshal(UsuarioBorrado{Fecha: time.Now().Format(time.RFC3339), Borrado_por: req.Username})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al convertir el usuario a json"}
+	}
+	err = s.db.Batch([]store.Op{
+		{Namespace: "UsuariosBorrados", Key: []byte(req.Medico), Value: borradoJson},
+		{Namespace: "Usuarios", Key: []byte(req.Medico), Delete: true},
+		{Namespace: "CodigosReset", Key: []byte(req.Medico), Delete: true},
+	})
+	if err != nil {
+		return api.Response{Success: -1, Message: "Error al borrar el usuario"}
+	}
+	if err := s.cerrarSesiones(req.Medico); err != nil {
+		s.log.Printf("Error cerrando la sesión de %s: %v", req.Medico, err)
+	}
+	s.registrarAuditoria(req.Username, api.ActionBorrarUsuario, fmt.Sprintf("usuario %s borrado: %s", req.Medico, req.Motivo))
+
+	return api.Response{Success: 1, Message: fmt.Sprintf("Usuario %s borrado", req.Medico)}
+}
+
+// usuarioBorrado indica si el nombre de usuario perteneció a un usuario
+// borrado.
+func (s *server) usuarioBorrado(username string) (bool, error) {
+	_, err := s.db.Get("UsuariosBorrados", []byte(username))
+	if noEncontrado(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// cargarAdministradores lee el fichero de administradores configurados.
+func cargarAdministradores(ruta string) (map[string]bool, error) {
+	fichero, err := os.Open(ruta)
+	if err != nil {
+		return nil, err
+	}
+	defer fichero.Close()
+
+	administradores := make(map[string]bool)
+	lector := bufio.NewScanner(fichero)
+	for lector.Scan() {
+		linea := strings.TrimSpace(lector.Text())
+		if linea == "" || strings.HasPrefix(linea, "#") {
+			continue
+		}
+		administradores[linea] = true
+	}
+	if err := lector.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", ruta, err)
+	}
+	return administradores, nil
+}
+
+// PromoverAdministrador da el rol de administrador a un usuario ya
+// registrado. Se usa con el servidor parado (opción -admin), de modo que sólo
+// quien administra la máquina puede nombrar administradores.
+func PromoverAdministrador(username string) error {
+	srv, err := abrirServidor()
+	if err != nil {
+		return err
+	}
+	defer srv.db.Close()
+	return srv.promoverAdministrador(username)
+}
+
+// promoverAdministrador da el rol de administrador al usuario registrado.
+func (s *server) promoverAdministrador(username string) error {
+	var promovido bool
+	_, err := s.modificarUsuario(username, func(usuario *Usuario) error {
+		promovido = usuario.Rol != api.RolAdmin
+		usuario.Rol = api.RolAdmin
+		return nil
+	})
+	if noEncontrado(err) {
+		return fmt.Errorf("el usuario %s no está registrado", username)
+	}
+	if err != nil {
+		return err
+	}
+	if promovido {
+		s.registrarAuditoria("sistema", accionPromoverAdministrador, fmt.Sprintf("usuario %s promovido a administrador", username))
+	}
+	return nil
+}
+
+// migrarAdministradores nombra administradores a los usuarios de
+// rutaAdministradores que ya estaban registrados, para que las bases de datos
+// anteriores a los roles tengan quien gestione usuarios y catálogos. Los
+// nombres que no están registrados se ignoran: registrarse con ellos no da
+// ningún rol.
+func (s *server) migrarAdministradores() error {
+	administradores, err := cargarAdministradores(rutaAdministradores)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for username := range administradores {
+		if existe, err := s.userExists(username); err != nil {
+			return err
+		} else if !existe {
+			s.log.Printf("%s: el usuario %s no está registrado y no se nombra administrador", rutaAdministradores, username)
+			continue
+		}
+		if err := s.promoverAdministrador(username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
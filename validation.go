@@ -0,0 +1,209 @@
+// El paquete validation contiene las comprobaciones de formato de los datos
+// que introducen los usuarios, como los documentos de identidad españoles.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"prac/pkg/api"
+)
+
+// letrasControl es la tabla oficial de letras de control del DNI/NIE,
+// indexada por el resto de dividir el número entre 23.
+const letrasControl = "TRWAGMYFPDXBNJZSQVHLCKE"
+
+// NormalizarDNI pasa el documento a mayúsculas, elimina espacios, guiones
+// y puntos, y completa con ceros a la izquierda los DNIs de menos de 8 cifras.
+// No comprueba que el documento sea válido.
+func NormalizarDNI(documento string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(documento) {
+		if r == ' ' || r == '-' || r == '.' || r == '\t' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	normalizado := b.String()
+
+	// "1234567Z" es el mismo DNI que "01234567Z"
+	if n := len(normalizado); n >= 2 && n < 9 && esNumero(normalizado[:n-1]) && !esNumero(normalizado[n-1:]) {
+		normalizado = strings.Repeat("0", 9-n) + normalizado
+	}
+	return normalizado
+}
+
+// ValidarDNI comprueba que el DNI (ya normalizado) tenga 8 cifras y la
+// letra de control correcta.
+func ValidarDNI(dni string) error {
+	if len(dni) != 9 || !esNumero(dni[:8]) {
+		return errors.New("el DNI debe tener 8 cifras seguidas de una letra")
+	}
+	return comprobarLetra(dni[:8], dni[8])
+}
+
+// ValidarNIE comprueba que el NIE (ya normalizado) empiece por X, Y o Z,
+// tenga 7 cifras y la letra de control correcta.
+func ValidarNIE(nie string) error {
+	if len(nie) != 9 || !esNumero(nie[1:8]) {
+		return errors.New("el NIE debe tener una letra inicial (X, Y o Z), 7 cifras y una letra final")
+	}
+	// La letra inicial se sustituye por una cifra para calcular el control
+	prefijo := strings.IndexByte("XYZ", nie[0])
+	if prefijo < 0 {
+		return fmt.Errorf("el NIE debe empezar por X, Y o Z, no por %c", nie[0])
+	}
+	return comprobarLetra(fmt.Sprintf("%d%s", prefijo, nie[1:8]), nie[8])
+}
+
+// ValidarDocumento normaliza el documento y lo valida como NIE si empieza
+// por X, Y o Z, o como DNI en otro caso. Devuelve el documento normalizado.
+func ValidarDocumento(documento string) (string, error) {
+	normalizado := NormalizarDNI(documento)
+	if normalizado == "" {
+		return "", errors.New("el documento está vacío")
+	}
+	if strings.ContainsRune("XYZ", rune(normalizado[0])) {
+		return normalizado, ValidarNIE(normalizado)
+	}
+	return normalizado, ValidarDNI(normalizado)
+}
+
+// NormalizarIdentificador normaliza un identificador de paciente según su tipo.
+// Los pasaportes, NHC y tarjetas SIP se pasan a mayúsculas sin separadores.
+func NormalizarIdentificador(tipo, valor string) string {
+	switch tipo {
+	case api.IdentificadorDNI, api.IdentificadorNIE:
+		return NormalizarDNI(valor)
+	default:
+		var b strings.Builder
+		for _, r := range strings.ToUpper(valor) {
+			if r == ' ' || r == '-' || r == '.' || r == '/' || r == '\t' {
+				continue
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+}
+
+// ValidarIdentificador comprueba el formato de un identificador ya normalizado.
+func ValidarIdentificador(tipo, valor string) error {
+	switch tipo {
+	case api.IdentificadorDNI:
+		return ValidarDNI(valor)
+	case api.IdentificadorNIE:
+		return ValidarNIE(valor)
+	case api.IdentificadorPasaporte:
+		if len(valor) < 5 || len(valor) > 20 || !esAlfanumerico(valor) {
+			return errors.New("el pasaporte debe tener entre 5 y 20 letras o cifras")
+		}
+		return nil
+	case api.IdentificadorNHC:
+		if len(valor) > 12 || !esNumero(valor) {
+			return errors.New("el número de historia clínica debe tener entre 1 y 12 cifras")
+		}
+		return nil
+	case api.IdentificadorSIP:
+		if len(valor) > 12 || !esNumero(valor) {
+			return errors.New("el número de tarjeta SIP debe tener entre 1 y 12 cifras")
+		}
+		return nil
+	default:
+		return fmt.Errorf("tipo de identificador desconocido: %s", tipo)
+	}
+}
+
+// NormalizarCIE10 pasa un código CIE-10 a mayúsculas, quita los espacios y
+// añade el punto tras la categoría si falta ("j459" -> "J45.9").
+func NormalizarCIE10(codigo string) string {
+	codigo = strings.ToUpper(strings.Join(strings.Fields(codigo), ""))
+	if len(codigo) > 3 && !strings.Contains(codigo, ".") {
+		codigo = codigo[:3] + "." + codigo[3:]
+	}
+	return codigo
+}
+
+// ValidarCIE10 comprueba el formato de un código CIE-10 ya normalizado: una
+// letra y dos cifras (la categoría) y, opcionalmente, un punto seguido de
+// entre 1 y 4 letras o cifras (la subcategoría).
+func ValidarCIE10(codigo string) error {
+	if len(codigo) < 3 || codigo[0] < 'A' || codigo[0] > 'Z' || !esNumero(codigo[1:3]) {
+		return fmt.Errorf("el código CIE-10 %q debe empezar por una letra y dos cifras", codigo)
+	}
+	if len(codigo) == 3 {
+		return nil
+	}
+	if codigo[3] != '.' || len(codigo) < 5 || len(codigo) > 8 || !esAlfanumerico(codigo[4:]) {
+		return fmt.Errorf("el código CIE-10 %q tiene una subcategoría incorrecta", codigo)
+	}
+	return nil
+}
+
+// Longitud mínima de las contraseñas.
+const LongitudMinimaContrasenya = 10
+
+// ValidarContrasenya comprueba que la contraseña cumpla la política: al
+// menos LongitudMinimaContrasenya caracteres, con mayúsculas, minúsculas y
+// cifras, y que no contenga el nombre de usuario (si tiene 3 o más letras).
+func ValidarContrasenya(username, contrasenya string) error {
+	if len([]rune(contrasenya)) < LongitudMinimaContrasenya {
+		return fmt.Errorf("la contraseña debe tener al menos %d caracteres", LongitudMinimaContrasenya)
+	}
+	var mayuscula, minuscula, cifra bool
+	for _, r := range contrasenya {
+		switch {
+		case unicode.IsUpper(r):
+			mayuscula = true
+		case unicode.IsLower(r):
+			minuscula = true
+		case unicode.IsDigit(r):
+			cifra = true
+		}
+	}
+	if !mayuscula || !minuscula || !cifra {
+		return errors.New("la contraseña debe combinar mayúsculas, minúsculas y cifras")
+	}
+	if len([]rune(username)) >= 3 && strings.Contains(strings.ToLower(contrasenya), strings.ToLower(username)) {
+		return errors.New("la contraseña no puede contener el nombre de usuario")
+	}
+	return nil
+}
+
+// comprobarLetra verifica que 'letra' sea la letra de control de 'numero'.
+func comprobarLetra(numero string, letra byte) error {
+	n := 0
+	for _, c := range numero {
+		n = n*10 + int(c-'0')
+	}
+	esperada := letrasControl[n%23]
+	if letra != esperada {
+		return fmt.Errorf("la letra de control no es correcta: debería ser %c", esperada)
+	}
+	return nil
+}
+
+// esNumero indica si la cadena sólo contiene cifras.
+func esNumero(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// esAlfanumerico indica si la cadena sólo contiene letras y cifras.
+func esAlfanumerico(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
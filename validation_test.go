@@ -0,0 +1,89 @@
+package validation
+
+import "testing"
+
+func TestValidarDocumento(t *testing.T) {
+	tests := []struct {
+		name      string
+		documento string
+		want      string
+		wantErr   bool
+	}{
+		{"DNI válido", "12345678Z", "12345678Z", false},
+		{"DNI en minúsculas", "12345678z", "12345678Z", false},
+		{"DNI con guion", "12345678-Z", "12345678Z", false},
+		{"DNI con espacios", " 12.345.678 Z ", "12345678Z", false},
+		{"DNI de 7 cifras", "1234567L", "01234567L", false},
+		{"DNI con letra incorrecta", "12345678A", "12345678A", true},
+		{"DNI sin letra", "12345678", "12345678", true},
+		{"NIE X válido", "x-1234567-l", "X1234567L", false},
+		{"NIE Y válido", "Y1234567X", "Y1234567X", false},
+		{"NIE Z válido", "Z1234567R", "Z1234567R", false},
+		{"NIE con letra incorrecta", "X1234567A", "X1234567A", true},
+		{"Documento vacío", "  ", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidarDocumento(tt.documento)
+			if got != tt.want {
+				t.Errorf("ValidarDocumento(%q) = %q, want %q", tt.documento, got, tt.want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidarDocumento(%q) error = %v, wantErr %v", tt.documento, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidarCIE10(t *testing.T) {
+	tests := []struct {
+		name    string
+		codigo  string
+		want    string
+		wantErr bool
+	}{
+		{"Categoría", "I10", "I10", false},
+		{"Subcategoría", "J45.9", "J45.9", false},
+		{"Minúsculas sin punto", "j459", "J45.9", false},
+		{"Con espacios", " E11 .9 ", "E11.9", false},
+		{"Sin letra inicial", "110", "110", true},
+		{"Categoría incompleta", "J4", "J4", true},
+		{"Punto sin subcategoría", "J45.", "J45.", true},
+		{"Subcategoría demasiado larga", "J45.90001", "J45.90001", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizarCIE10(tt.codigo)
+			if got != tt.want {
+				t.Errorf("NormalizarCIE10(%q) = %q, want %q", tt.codigo, got, tt.want)
+			}
+			if err := ValidarCIE10(got); (err != nil) != tt.wantErr {
+				t.Errorf("ValidarCIE10(%q) error = %v, wantErr %v", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidarContrasenya(t *testing.T) {
+	tests := []struct {
+		name        string
+		username    string
+		contrasenya string
+		wantErr     bool
+	}{
+		{"Válida", "jgarcia", "Consulta2024", false},
+		{"Con símbolos y acentos", "jgarcia", "Año-Nuevo-2025!", false},
+		{"Demasiado corta", "jgarcia", "Abc12345", true},
+		{"Sin mayúsculas", "jgarcia", "consulta2024", true},
+		{"Sin minúsculas", "jgarcia", "CONSULTA2024", true},
+		{"Sin cifras", "jgarcia", "ConsultaMedica", true},
+		{"Contiene el usuario", "jgarcia", "JGarcia2024x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidarContrasenya(tt.username, tt.contrasenya); (err != nil) != tt.wantErr {
+				t.Errorf("ValidarContrasenya(%q, %q) error = %v, wantErr %v", tt.username, tt.contrasenya, err, tt.wantErr)
+			}
+		})
+	}
+}